@@ -0,0 +1,280 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackupID identifies a backup taken by BackupIncremental.
+type BackupID uint64
+
+// ErrBackupBase is returned when an incremental backup is requested or
+// applied on top of a backup which is not its base.
+var ErrBackupBase = errors.New("backup base mismatch")
+
+// backupMarkerName is the file recording the BackupID of a backup directory.
+const backupMarkerName = "billy.backup"
+
+// backupMarker is the content of the backup marker file.
+type backupMarker struct {
+	Magic   [5]byte // "billy"
+	Version uint16
+	ID      uint64
+}
+
+// incHeader is the header of the file holding the changed slots of a shelf
+// in an incremental backup. It is followed by Slots entries, each a uint64
+// slot number and the content of the slot.
+type incHeader struct {
+	Magic    [5]byte // "billy"
+	Version  uint16
+	Slotsize uint32
+	Since    uint64 // Since is the BackupID of the base
+	Tail     uint64 // Tail is the number of slots of the shelf
+	Slots    uint64
+}
+
+// incName returns the file name of the changed slots of a shelf.
+func incName(slotSize uint32) string {
+	return fmt.Sprintf("bkt_%08d.inc", slotSize)
+}
+
+// changeSet tracks the slots written or deleted since the last backup, once
+// started. It has its own lock, since UpdateRange does not hold the gapsMu.
+type changeSet struct {
+	mu    sync.Mutex
+	on    bool
+	slots gapSet
+}
+
+// mark records a change of the slot, if tracking.
+func (c *changeSet) mark(slot uint64) {
+	c.mu.Lock()
+	if c.on {
+		c.slots.add(slot)
+	}
+	c.mu.Unlock()
+}
+
+// restart starts tracking afresh, and returns the changes tracked so far.
+func (c *changeSet) restart() (gapSet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slots, on := c.slots, c.on
+	c.slots, c.on = gapSet{}, true
+	return slots, on
+}
+
+// BackupIncremental writes a backup of the database into dir, and returns its
+// ID. If since is zero, the backup is a full copy, as with SnapshotTo. Otherwise
+// it must be the ID of the last backup, and only the slots changed since then
+// are written, to be applied onto that backup with ApplyIncremental. Changes
+// are tracked in memory, so the first backup after opening must be full.
+func (db *database) BackupIncremental(since BackupID, dir string) (BackupID, error) {
+	db.backupMu.Lock()
+	defer db.backupMu.Unlock()
+	if since != db.lastBackup {
+		return 0, fmt.Errorf("%w: have %d, last backup %d", ErrBackupBase, since, db.lastBackup)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	// A failing backup leaves the changes partially consumed: require a new
+	// full backup
+	db.lastBackup = 0
+	for i, shelf := range db.shelves {
+		var err error
+		if since == 0 {
+			err = shelf.snapshotTo(dir, true)
+		} else {
+			err = shelf.writeIncremental(dir, since)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("shelf %d: %w", i, err)
+		}
+	}
+	if since == 0 {
+		if err := db.writeManifest(dir); err != nil {
+			return 0, err
+		}
+	}
+	id := BackupID(time.Now().UnixNano())
+	if id <= since {
+		id = since + 1
+	}
+	if err := writeBackupMarker(dir, id); err != nil {
+		return 0, err
+	}
+	db.lastBackup = id
+	return id, nil
+}
+
+// writeIncremental writes the slots changed since the last backup into dir,
+// along with the metadata and gap index of the shelf.
+func (s *shelf) writeIncremental(dir string, since BackupID) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	defer s.dropCache()
+
+	changed, on := s.changes.restart()
+	if !on {
+		return fmt.Errorf("%w: changes not tracked", ErrBackupBase)
+	}
+	gaps, tail := s.snapshotGaps()
+	f, err := os.Create(filepath.Join(dir, incName(s.slotSize)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var slots []uint64
+	changed.each(func(slot uint64) {
+		if slot < tail {
+			slots = append(slots, slot)
+		}
+	})
+	w := bufio.NewWriterSize(f, 1<<20)
+	h := &incHeader{Magic, curVersion, s.slotSize, uint64(since), tail, uint64(len(slots))}
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+	buf := make([]byte, 8+s.slotSize)
+	for _, slot := range slots {
+		binary.BigEndian.PutUint64(buf, slot)
+		if err := s.readSnapshotSlot(buf[8:], &gaps, slot); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := writeShelfMeta(filepath.Join(dir, metaName(s.slotSize)), s.created, atomic.LoadInt64(&s.modified), nil); err != nil {
+		return err
+	}
+	return writeGapIndex(filepath.Join(dir, gapIndexName(s.slotSize)), s.slotSize, tail, gaps.slice(), true)
+}
+
+// ApplyIncremental applies the incremental backup in dir onto the backup in
+// base, which must be the backup it was taken against, and is not in use. If
+// applying fails, base is left inconsistent, and must be restored from a
+// full backup.
+func ApplyIncremental(base, dir string) error {
+	baseID, err := readBackupMarker(base)
+	if err != nil {
+		return err
+	}
+	id, err := readBackupMarker(dir)
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "bkt_*.inc"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := applyIncremental(base, file, baseID); err != nil {
+			return fmt.Errorf("%v: %w", filepath.Base(file), err)
+		}
+	}
+	return writeBackupMarker(base, id)
+}
+
+// applyIncremental applies the changed slots of a shelf onto the shelf file in
+// base, and copies its metadata and gap index.
+func applyIncremental(base, file string, baseID BackupID) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReaderSize(in, 1<<20)
+	var h incHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	switch {
+	case h.Magic != Magic:
+		return fmt.Errorf("%w: missing magic", ErrBadHeader)
+	case h.Version != curVersion:
+		return &VersionError{File: file, Version: h.Version, Current: curVersion}
+	case BackupID(h.Since) != baseID:
+		return fmt.Errorf("%w: taken against %d, base is %d", ErrBackupBase, h.Since, baseID)
+	}
+	f, err := os.OpenFile(filepath.Join(base, fmt.Sprintf("bkt_%08d.bag", h.Slotsize)), os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 8+h.Slotsize)
+	for i := uint64(0); i < h.Slots; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("%w: slot entry %d: %v", ErrCorruptData, i, err)
+		}
+		slot := binary.BigEndian.Uint64(buf)
+		if slot >= h.Tail {
+			return fmt.Errorf("%w: slot %d beyond tail %d", ErrCorruptData, slot, h.Tail)
+		}
+		if _, err := f.WriteAt(buf[8:], int64(ShelfHeaderSize)+int64(slot)*int64(h.Slotsize)); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(int64(ShelfHeaderSize) + int64(h.Tail)*int64(h.Slotsize)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	for _, name := range []string{metaName(h.Slotsize), gapIndexName(h.Slotsize)} {
+		blob, err := os.ReadFile(filepath.Join(filepath.Dir(file), name))
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(base, name), blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBackupMarker(dir string, id BackupID) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, &backupMarker{Magic, curVersion, uint64(id)}); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, backupMarkerName), buf.Bytes())
+}
+
+func readBackupMarker(dir string) (BackupID, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, backupMarkerName))
+	if err != nil {
+		return 0, err
+	}
+	var m backupMarker
+	if err := binary.Read(bytes.NewReader(blob), binary.BigEndian, &m); err != nil || m.Magic != Magic {
+		return 0, fmt.Errorf("%w: backup marker in %v", ErrCorruptData, dir)
+	}
+	return BackupID(m.ID), nil
+}
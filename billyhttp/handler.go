@@ -0,0 +1,191 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package billyhttp exposes a billy database over HTTP, so that stored items
+// can be inspected with standard tools, or served behind a reverse proxy.
+//
+// The handler serves the following routes:
+//
+//	GET    /items/{key}  returns the item, honouring Range headers
+//	HEAD   /items/{key}  returns the headers of the item only
+//	PUT    /items/{key}  stores the body at the key, see billy.Database.PutAt
+//	POST   /items        stores the body, and returns its key
+//	DELETE /items/{key}  deletes the item
+//	GET    /stats        returns the infos of the database as JSON
+//
+// Keys are decimal, or hexadecimal with a 0x prefix.
+package billyhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethstorage/billy"
+)
+
+// itemsPath is the prefix of the routes of items.
+const itemsPath = "/items"
+
+// handler serves the routes of a database.
+type handler struct {
+	db      billy.Database
+	maxSize uint32 // maxSize is the largest slot size, to bound bodies
+}
+
+// NewHandler returns an http.Handler serving the given database. The routes
+// are relative to the root of the handler: use http.StripPrefix to mount it
+// elsewhere.
+func NewHandler(db billy.Database) http.Handler {
+	_, max := db.Limits()
+	return &handler{
+		db:      db,
+		maxSize: max,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case path == "/stats":
+		h.serveStats(w, r)
+	case path == itemsPath || path == itemsPath+"/":
+		if r.Method != http.MethodPost {
+			allow(w, http.MethodPost)
+			return
+		}
+		h.post(w, r)
+	case strings.HasPrefix(path, itemsPath+"/"):
+		key, err := h.parseKey(strings.TrimPrefix(path, itemsPath+"/"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.get(w, r, key)
+		case http.MethodPut:
+			h.put(w, r, key)
+		case http.MethodDelete:
+			writeError(w, h.db.Delete(key))
+		default:
+			allow(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// parseKey parses a key from the path. Keys outside of the shelves of the
+// database are rejected by the database itself.
+func (h *handler) parseKey(s string) (uint64, error) {
+	key, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: key %q", billy.ErrBadIndex, s)
+	}
+	return key, nil
+}
+
+// get serves the item at the given key. Range requests are handled by
+// http.ServeContent, which reads only the requested parts.
+func (h *handler) get(w http.ResponseWriter, r *http.Request, key uint64) {
+	item, err := h.db.GetReader(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, item)
+}
+
+// put stores the body of the request at the given key.
+func (h *handler) put(w http.ResponseWriter, r *http.Request, key uint64) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(h.maxSize)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.PutAt(key, data); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// post stores the body of the request, which must have a known length, and
+// responds with its key.
+func (h *handler) post(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength < 0 {
+		http.Error(w, "content length required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > int64(h.maxSize) {
+		writeError(w, &billy.OversizedError{Size: int(r.ContentLength), SlotSize: h.maxSize})
+		return
+	}
+	key, err := h.db.PutReader(r.Body, int(r.ContentLength))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", itemsPath, key))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%d\n", key)
+}
+
+// serveStats serves the infos of the database as JSON.
+func (h *handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		allow(w, http.MethodGet, http.MethodHead)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(h.db.Infos())
+}
+
+// allow responds that the method is not allowed, listing the allowed ones.
+func allow(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// writeError responds with the status matching the error, or with no content
+// if there is no error.
+func writeError(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("X-Billy-Error-Code", strconv.Itoa(int(billy.ErrorCode(err))))
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// errorStatus returns the http status for the given error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, billy.ErrOversized):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, billy.ErrBadIndex), errors.Is(err, billy.ErrDeleted), errors.Is(err, billy.ErrInvalidKey):
+		return http.StatusNotFound
+	case errors.Is(err, billy.ErrStaleKey):
+		return http.StatusGone
+	case errors.Is(err, billy.ErrEmptyData):
+		return http.StatusBadRequest
+	case errors.Is(err, billy.ErrSlotInUse):
+		return http.StatusConflict
+	case errors.Is(err, billy.ErrReadonly), errors.Is(err, billy.ErrStandby):
+		return http.StatusForbidden
+	case errors.Is(err, billy.ErrShelfFull), errors.Is(err, billy.ErrFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, billy.ErrClosed), errors.Is(err, billy.ErrPaused):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
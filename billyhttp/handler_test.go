@@ -0,0 +1,112 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billyhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethstorage/billy"
+)
+
+func TestHandler(t *testing.T) {
+	db, err := billy.Open(t.TempDir(), billy.SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+
+	do := func(method, path string, body []byte, header ...string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		blob, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, blob
+	}
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	// Post an item, and read it back whole and ranged
+	status, body := do("POST", "/items", data)
+	if status != http.StatusCreated {
+		t.Fatalf("have status %d want %d: %s", status, http.StatusCreated, body)
+	}
+	key, err := strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/items/" + strconv.FormatUint(key, 10)
+	if status, body := do("GET", path, nil); status != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("have %d %q want %d %q", status, body, http.StatusOK, data)
+	}
+	if status, body := do("GET", path, nil, "Range", "bytes=4-8"); status != http.StatusPartialContent || string(body) != "quick" {
+		t.Fatalf("have %d %q want %d %q", status, body, http.StatusPartialContent, "quick")
+	}
+	// Put an item at a key, addressed in hex
+	if status, body := do("PUT", "/items/0x5", []byte("hello")); status != http.StatusNoContent {
+		t.Fatalf("have status %d want %d: %s", status, http.StatusNoContent, body)
+	}
+	if have, err := db.Get(5); err != nil || string(have) != "hello" {
+		t.Fatalf("have %q want %q, err %v", have, "hello", err)
+	}
+	if status, _ := do("PUT", "/items/5", []byte("again")); status != http.StatusConflict {
+		t.Fatalf("have status %d want %d", status, http.StatusConflict)
+	}
+	// Delete the items
+	if status, body := do("DELETE", path, nil); status != http.StatusNoContent {
+		t.Fatalf("have status %d want %d: %s", status, http.StatusNoContent, body)
+	}
+	if status, _ := do("GET", path, nil); status != http.StatusNotFound {
+		t.Fatalf("have status %d want %d", status, http.StatusNotFound)
+	}
+	// Bad keys and oversized items are rejected
+	for _, p := range []string{"/items/foo", "/items/" + strconv.FormatUint(billy.Key(7, 0), 10)} {
+		if status, _ := do("GET", p, nil); status != http.StatusNotFound {
+			t.Fatalf("%s: have status %d want %d", p, status, http.StatusNotFound)
+		}
+	}
+	if status, _ := do("POST", "/items", make([]byte, 1000)); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("have status %d want %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if status, _ := do("PATCH", path, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("have status %d want %d", status, http.StatusMethodNotAllowed)
+	}
+	// Stats report the item left
+	status, body = do("GET", "/stats", nil)
+	if status != http.StatusOK {
+		t.Fatalf("have status %d want %d", status, http.StatusOK)
+	}
+	var infos billy.Infos
+	if err := json.Unmarshal(body, &infos); err != nil {
+		t.Fatal(err)
+	}
+	filled := uint64(0)
+	for _, shelf := range infos.Shelves {
+		filled += shelf.FilledSlots
+	}
+	if filled != 1 {
+		t.Fatalf("have %d items want 1", filled)
+	}
+}
@@ -0,0 +1,142 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// EvictionPolicy selects the items a Cache evicts to make room for new ones.
+type EvictionPolicy uint8
+
+const (
+	EvictFIFO EvictionPolicy = iota // EvictFIFO evicts the items stored first
+	EvictLRU                        // EvictLRU evicts the items read or stored least recently
+)
+
+// OnEvictFn is invoked by a Cache with the key of every item it evicts.
+type OnEvictFn func(key uint64)
+
+// Cache turns a size-limited database into a bounded disk cache: when a Put
+// fails because the database or shelf is full, it evicts items from the shelf
+// the data goes to, and retries into the freed slot. Items of other shelves
+// are not evicted, as their slots can't take the data. The order of the items
+// is held in memory. The items already stored when the Cache is created are
+// ordered by key, ahead of the new ones.
+//
+// Eviction relies on freed slots being reused right away, so it does not work
+// together with Options.ReuseDelay. Writes performed directly on the underlying
+// database, and items moved by compaction, are not tracked.
+type Cache struct {
+	db      *database
+	policy  EvictionPolicy
+	onEvict OnEvictFn
+
+	mu    sync.Mutex
+	order []*list.List             // order holds the keys per shelf, in eviction order
+	elems map[uint64]*list.Element // elems maps the keys to their place in the order
+}
+
+// NewCache creates a cache over the given database, which must be one returned
+// by Open. The optional onEvict callback is invoked for every evicted item,
+// with the lock of the cache held: it must not call into the cache.
+func NewCache(db Database, policy EvictionPolicy, onEvict OnEvictFn) (*Cache, error) {
+	c := &Cache{
+		db:      db.(*database),
+		policy:  policy,
+		onEvict: onEvict,
+		elems:   make(map[uint64]*list.Element),
+	}
+	for range c.db.shelves {
+		c.order = append(c.order, list.New())
+	}
+	err := db.Iterate(func(key uint64, size uint32, data []byte) {
+		c.add(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// add appends the key to the order of its shelf.
+func (c *Cache) add(key uint64) {
+	id, _ := SplitKey(key)
+	c.elems[key] = c.order[id].PushBack(key)
+}
+
+// Put stores the data, evicting items if needed, and returns its key.
+func (c *Cache) Put(data []byte) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		key, err := c.db.Put(data)
+		if err == nil {
+			c.add(key)
+			return key, nil
+		}
+		if !errors.Is(err, ErrFull) && !errors.Is(err, ErrShelfFull) {
+			return 0, err
+		}
+		// Evict the next item of the shelf the data goes to, if any
+		order := c.order[c.db.shelfFor(len(data))]
+		victim := order.Front()
+		if victim == nil {
+			return 0, err
+		}
+		key = victim.Value.(uint64)
+		if err := c.db.Delete(key); err != nil {
+			return 0, err
+		}
+		order.Remove(victim)
+		delete(c.elems, key)
+		if c.onEvict != nil {
+			if err := guard(func() error { c.onEvict(key); return nil }); err != nil {
+				return 0, c.db.repanic(err)
+			}
+		}
+	}
+}
+
+// Get retrieves the data stored at the given key. With EvictLRU, the item is
+// moved to the end of the eviction order.
+func (c *Cache) Get(key uint64) ([]byte, error) {
+	data, err := c.db.Get(key)
+	if err != nil || c.policy != EvictLRU {
+		return data, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[key]; ok {
+		id, _ := SplitKey(key)
+		c.order[id].MoveToBack(elem)
+	}
+	return data, nil
+}
+
+// Has returns whether the item at the given key is still cached.
+func (c *Cache) Has(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.elems[key]
+	return ok
+}
+
+// Delete deletes the item at the given key.
+func (c *Cache) Delete(key uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.db.Delete(key); err != nil {
+		return err
+	}
+	if elem, ok := c.elems[key]; ok {
+		id, _ := SplitKey(key)
+		c.order[id].Remove(elem)
+		delete(c.elems, key)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictFIFO, EvictLRU} {
+		db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithMaxSize(500))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, _ := db.Put(fill(0, 50))
+
+		var evicted []uint64
+		c, err := NewCache(db, policy, func(key uint64) { evicted = append(evicted, key) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []uint64
+		for i := 1; i <= 4; i++ {
+			key, err := c.Put(fill(byte(i), 50))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		// The database holds five items, the one stored before caching goes first
+		if _, err := c.Put(fill(5, 50)); err != nil {
+			t.Fatal(err)
+		}
+		want := []uint64{old}
+		if !reflect.DeepEqual(evicted, want) {
+			t.Fatalf("policy %d: have evicted %#x want %#x", policy, evicted, want)
+		}
+		// Reads reorder the items with LRU only
+		if have, err := c.Get(keys[0]); err != nil || !bytes.Equal(have, fill(1, 50)) {
+			t.Fatalf("have %x, err %v", have, err)
+		}
+		if _, err := c.Put(fill(6, 50)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, keys[0])
+		if policy == EvictLRU {
+			want[1] = keys[1]
+		}
+		if !reflect.DeepEqual(evicted, want) {
+			t.Fatalf("policy %d: have evicted %#x want %#x", policy, evicted, want)
+		}
+		// Items of the other shelves are not evicted
+		if _, err := c.Put(fill(7, 150)); !errors.Is(err, ErrFull) {
+			t.Fatalf("have %v want %v", err, ErrFull)
+		}
+		// The freed slot is reused by the new item
+		if key, _ := c.Put(fill(8, 50)); key != evicted[len(evicted)-1] {
+			t.Fatalf("have key %#x want %#x", key, evicted[len(evicted)-1])
+		}
+		if !c.Has(keys[3]) {
+			t.Fatalf("key %#x not cached", keys[3])
+		}
+		db.Close()
+	}
+}
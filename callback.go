@@ -0,0 +1,58 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+var ErrCallbackPanic = errors.New("callback panicked")
+
+// CallbackPanicError is returned when a callback passed to Open, Iterate,
+// IterateErr or Compact panics, and the database is configured to recover
+// from such panics. It matches ErrCallbackPanic when used with errors.Is.
+type CallbackPanicError struct {
+	Value any    // Value is the value passed to panic
+	Stack []byte // Stack is the stack trace of the panic
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrCallbackPanic, e.Value)
+}
+
+func (e *CallbackPanicError) Unwrap() error {
+	return ErrCallbackPanic
+}
+
+// guard invokes a user callback, converting a panic into a CallbackPanicError.
+// This lets the shelf abort the operation in a defined state, instead of
+// unwinding through it.
+func guard(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &CallbackPanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// repanic resumes a callback panic contained in the error, unless the database
+// is configured to return it as error. It is invoked after the shelf involved
+// has been brought into a defined state.
+func (db *database) repanic(err error) error {
+	return db.opts.repanic(err)
+}
+
+// repanic resumes a callback panic contained in the error, unless
+// RecoverPanics is set.
+func (o *Options) repanic(err error) error {
+	var cpe *CallbackPanicError
+	if !o.RecoverPanics && errors.As(err, &cpe) {
+		panic(cpe.Value)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ChunkedKeyFlag is set in the keys returned by Chunker for values stored in
+// chunks. It is never set in the keys of the database itself.
+const ChunkedKeyFlag = uint64(1) << 63
+
+// Chunker stores values larger than the largest slot of a database, by
+// splitting them into chunks of the largest slot size. A chunked value is
+// identified by the key of its manifest, an item holding its size and the
+// keys of its chunks, with ChunkedKeyFlag set. Values which fit into a slot
+// are stored as is.
+//
+// Chunks and manifests are ordinary items of the underlying database: they
+// show up as such when iterating it, and are moved by compaction like any
+// other item, which invalidates the manifests.
+type Chunker struct {
+	db        *database
+	chunkSize int // chunkSize is the size of the data in a chunk
+}
+
+// NewChunker creates a chunking layer over the given database, which must be
+// one returned by Open.
+func NewChunker(db Database) *Chunker {
+	d := db.(*database)
+	return &Chunker{
+		db:        d,
+		chunkSize: int(d.shelves[len(d.shelves)-1].slotSize) - itemHeaderSize - d.overhead(),
+	}
+}
+
+// Put stores the data, in chunks if it does not fit into a single slot, and
+// returns its key. If storing a chunk fails, the chunks already stored are
+// deleted again.
+func (c *Chunker) Put(data []byte) (uint64, error) {
+	if c.db.shelfFor(len(data)) < len(c.db.shelves) {
+		return c.db.Put(data)
+	}
+	var (
+		chunks   = (len(data) + c.chunkSize - 1) / c.chunkSize
+		manifest = make([]byte, 8+8*chunks)
+	)
+	if len(manifest) > c.chunkSize {
+		return 0, &OversizedError{Size: len(data), SlotSize: c.db.shelves[len(c.db.shelves)-1].slotSize}
+	}
+	binary.BigEndian.PutUint64(manifest, uint64(len(data)))
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * c.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		key, err := c.db.Put(data[i*c.chunkSize : end])
+		if err != nil {
+			c.deleteChunks(manifest[8 : 8+8*i])
+			return 0, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		binary.BigEndian.PutUint64(manifest[8+8*i:], key)
+	}
+	key, err := c.db.Put(manifest)
+	if err != nil {
+		c.deleteChunks(manifest[8:])
+		return 0, err
+	}
+	return key | ChunkedKeyFlag, nil
+}
+
+// Get retrieves the data stored at the given key, reassembling it from its
+// chunks if needed.
+func (c *Chunker) Get(key uint64) ([]byte, error) {
+	if key&ChunkedKeyFlag == 0 {
+		return c.db.Get(key)
+	}
+	size, keys, err := c.manifest(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, size)
+	for i, key := range keys {
+		chunk, err := c.db.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		data = append(data, chunk...)
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("%w: chunked size %d, manifest %d", ErrCorruptData, len(data), size)
+	}
+	return data, nil
+}
+
+// Delete deletes the data stored at the given key, along with its chunks.
+func (c *Chunker) Delete(key uint64) error {
+	if key&ChunkedKeyFlag == 0 {
+		return c.db.Delete(key)
+	}
+	_, keys, err := c.manifest(key)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := c.db.Delete(key); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+	return c.db.Delete(key &^ ChunkedKeyFlag)
+}
+
+// manifest reads the manifest of a chunked value, and returns the size of the
+// value and the keys of its chunks.
+func (c *Chunker) manifest(key uint64) (uint64, []uint64, error) {
+	manifest, err := c.db.Get(key &^ ChunkedKeyFlag)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(manifest) < 8 || len(manifest)%8 != 0 {
+		return 0, nil, fmt.Errorf("%w: manifest size %d", ErrCorruptData, len(manifest))
+	}
+	keys := make([]uint64, 0, len(manifest)/8-1)
+	for i := 8; i < len(manifest); i += 8 {
+		keys = append(keys, binary.BigEndian.Uint64(manifest[i:]))
+	}
+	return binary.BigEndian.Uint64(manifest), keys, nil
+}
+
+// deleteChunks deletes the chunks with the given keys, packed as in a
+// manifest, after a failed Put.
+func (c *Chunker) deleteChunks(keys []byte) {
+	for i := 0; i < len(keys); i += 8 {
+		_ = c.db.Delete(binary.BigEndian.Uint64(keys[i:]))
+	}
+}
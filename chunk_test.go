@@ -0,0 +1,61 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestChunker(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := NewChunker(db)
+
+	// Small values are stored as is
+	small, err := c.Put(fill(1, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small&ChunkedKeyFlag != 0 {
+		t.Fatalf("small value chunked: %#x", small)
+	}
+	// Large values are split over the largest shelf
+	large := make([]byte, 1000)
+	_, _ = rand.Read(large)
+	key, err := c.Put(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key&ChunkedKeyFlag == 0 {
+		t.Fatalf("large value not chunked: %#x", key)
+	}
+	if have, err := c.Get(key); err != nil || !bytes.Equal(have, large) {
+		t.Fatalf("have %d bytes, err %v", len(have), err)
+	}
+	count := func() (items int) {
+		_ = db.Iterate(func(uint64, uint32, []byte) { items++ })
+		return items
+	}
+	// The small value, four chunks and the manifest
+	if have, want := count(), 6; have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := count(), 1; have != want {
+		t.Fatalf("have %d items left, want %d", have, want)
+	}
+	// The manifest must fit into a slot too
+	if _, err := c.Put(make([]byte, 296*40)); !errors.Is(err, ErrOversized) {
+		t.Fatalf("have %v want %v", err, ErrOversized)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethstorage/billy"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	gapsFlag = &cli.BoolFlag{
+		Name:  "gaps",
+		Usage: "List the gap slots of each shelf",
+	}
+	shelfFlag = &cli.IntFlag{
+		Name:  "shelf",
+		Usage: "Interpret the argument as a slot in the shelf with this id, instead of a key",
+		Value: -1,
+	}
+	rawFlag = &cli.BoolFlag{
+		Name:  "raw",
+		Usage: "Write the raw payload instead of a hex dump",
+	}
+	inspectCommand = &cli.Command{
+		Action: inspect,
+		Name:   "inspect",
+		Usage:  "List the shelves with their slot sizes, tails and gaps",
+		Flags:  []cli.Flag{gapsFlag},
+		Description: `Opens the database read-only, and reports for every shelf the slot size,
+the tail (number of slots in the file), and the number of live items and gaps.`,
+	}
+	dataFlag = &cli.BoolFlag{
+		Name:  "data",
+		Usage: "Include the base64-encoded payload of every item",
+	}
+	jsonCommand = &cli.Command{
+		Action: dumpJSON,
+		Name:   "json",
+		Usage:  "Print every live item as a line of JSON",
+		Flags:  []cli.Flag{dataFlag},
+		Description: `Opens the database read-only, and prints one JSON object per live item,
+with its key, shelf, slot, size and sha256 hash, in ascending key order. The
+output of two databases can be compared with diff.`,
+	}
+	dumpCommand = &cli.Command{
+		Action:    dump,
+		Name:      "dump",
+		Usage:     "Print the payload stored at a key or slot",
+		ArgsUsage: "<key|slot>",
+		Flags:     []cli.Flag{shelfFlag, rawFlag},
+	}
+)
+
+// openReadonly opens the database in read-only mode, without printing the items.
+func openReadonly(ctx *cli.Context) (billy.Database, error) {
+	return billy.Open(ctx.String("path"),
+		billy.SlotSizePowerOfTwo(uint32(ctx.Int("min")), uint32(ctx.Int("max"))),
+		nil, billy.WithReadonly())
+}
+
+// parseKey parses a decimal or 0x-prefixed hex key.
+func parseKey(s string) (uint64, error) {
+	k, ok := big.NewInt(0).SetString(s, 0)
+	if !ok || !k.IsUint64() {
+		return 0, fmt.Errorf("failed to parse key from '%s'", s)
+	}
+	return k.Uint64(), nil
+}
+
+func inspect(ctx *cli.Context) error {
+	db, err := openReadonly(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// In read-only mode, the gaps are not tracked: find the live slots instead
+	live := make(map[int]map[uint64]bool)
+	err = db.Iterate(func(key uint64, size uint32, data []byte) {
+		id, slot := billy.SplitKey(key)
+		if live[id] == nil {
+			live[id] = make(map[uint64]bool)
+		}
+		live[id][slot] = true
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-6s %10s %10s %10s %10s\n", "shelf", "slotsize", "tail", "items", "gaps")
+	for id, shelf := range db.Infos().Shelves {
+		tail := shelf.FilledSlots + shelf.GappedSlots
+		items := uint64(len(live[id]))
+		fmt.Printf("%-6d %10d %10d %10d %10d\n", id, shelf.SlotSize, tail, items, tail-items)
+		if !ctx.Bool(gapsFlag.Name) || items == tail {
+			continue
+		}
+		var gaps []uint64
+		for slot := uint64(0); slot < tail; slot++ {
+			if !live[id][slot] {
+				gaps = append(gaps, slot)
+			}
+		}
+		fmt.Printf("       gaps: %v\n", gaps)
+	}
+	return nil
+}
+
+func dump(ctx *cli.Context) error {
+	arg, err := parseKey(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	key := arg
+	if id := ctx.Int(shelfFlag.Name); id >= 0 {
+		key = billy.Key(id, arg)
+		if shelf, slot := billy.SplitKey(key); shelf != id || slot != arg {
+			return fmt.Errorf("shelf %d, slot %d out of range", id, arg)
+		}
+	}
+	db, err := openReadonly(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if id, _ := billy.SplitKey(key); id >= len(db.Infos().Shelves) {
+		return fmt.Errorf("no shelf with id %d", id)
+	}
+	data, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool(rawFlag.Name) {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	fmt.Printf("key %#08x, size %d\n", key, len(data))
+	fmt.Print(hex.Dump(data))
+	return nil
+}
+
+func dumpJSON(ctx *cli.Context) error {
+	db, err := openReadonly(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.DumpJSON(os.Stdout, ctx.Bool(dataFlag.Name))
+}
@@ -84,6 +84,12 @@ func main() {
 		get64Command,
 		delCommand,
 		openCommand,
+		scanCommand,
+		watchCommand,
+		fsckCommand,
+		inspectCommand,
+		dumpCommand,
+		jsonCommand,
 	}
 	app.Flags = []cli.Flag{
 		pathFlag,
@@ -91,8 +97,9 @@ func main() {
 		maxFlag,
 	}
 	if err := app.Run(os.Args); err != nil {
+		// The exit status is the error code, for scripts to branch on
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(int(billy.ErrorCode(err)))
 	}
 }
 
@@ -113,7 +120,7 @@ func openDb(ctx *cli.Context) (billy.Database, *dbParams, error) {
 }
 
 func doOpenDb(opts *dbParams) (billy.Database, error) {
-	db, err := billy.Open(billy.Options{Path: opts.path}, billy.SlotSizePowerOfTwo(opts.min, opts.max), func(key uint64, size uint32, data []byte) {
+	db, err := billy.Open(opts.path, billy.SlotSizePowerOfTwo(opts.min, opts.max), func(key uint64, size uint32, data []byte) {
 		var d string
 		if len(data) > 100 {
 			d = fmt.Sprintf("%q...", data[:100])
@@ -242,6 +249,7 @@ func startIpc(endpoint string) (net.Listener, error) {
 // 2. GET string(id) -> string(base64 data)
 // 3. DEL string(id) -> -
 // 4. RST -> - (closes and reopens the database)
+// 5. SUB -> stream of mutations, see changefeed
 func serveCodec(conn net.Conn, db billy.Database, opts *dbParams) {
 	in := bufio.NewScanner(conn)
 	for in.Scan() {
@@ -259,8 +267,11 @@ func serveCodec(conn net.Conn, db billy.Database, opts *dbParams) {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				continue
 			}
-			id, _ := db.Put(data)
+			id, err := db.Put(data)
 			_, _ = conn.Write([]byte(fmt.Sprintf("%#08x\n", id)))
+			if err == nil {
+				feed.publish(fmt.Sprintf("PUT %#08x %d", id, len(data)))
+			}
 		case "GET ":
 			k, ok := big.NewInt(0).SetString(string(line[4:]), 0)
 			if !ok {
@@ -290,7 +301,9 @@ func serveCodec(conn net.Conn, db billy.Database, opts *dbParams) {
 				fmt.Fprintf(os.Stderr, "failed to parse key (oob)")
 				continue
 			}
-			_ = db.Delete(k.Uint64())
+			if err := db.Delete(k.Uint64()); err == nil {
+				feed.publish(fmt.Sprintf("DEL %#08x", k.Uint64()))
+			}
 		case "RST ":
 			// Restart it
 			db.Close()
@@ -300,6 +313,9 @@ func serveCodec(conn net.Conn, db billy.Database, opts *dbParams) {
 				fmt.Fprintf(os.Stderr, "error: %v\n", err)
 				continue
 			}
+		case "SUB ":
+			feed.subscribe(conn)
+			defer feed.unsubscribe(conn)
 		default:
 			fmt.Fprintf(os.Stderr, "bad verb\n")
 		}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethstorage/billy"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	fixFlag = &cli.BoolFlag{
+		Name:  "fix",
+		Usage: "Remove gap indexes and temporary files which diverge from the shelf files",
+	}
+	fsckCommand = &cli.Command{
+		Action: fsck,
+		Name:   "fsck",
+		Usage:  "Cross-check the gap indexes against the shelf files",
+		Flags:  []cli.Flag{fixFlag},
+		Description: `Compares the gap index of each shelf with the slot headers in the shelf
+file, and reports slots which the index considers gaps while the file holds
+data, slots which the index considers live while the file is blank, and tail
+mismatches. Also reports gap indexes without a shelf file, and leftover
+temporary files.
+
+With --fix, diverging and orphaned gap indexes are removed, so that the next
+open reconstructs the gaps from the shelf file. The database must not be open
+while being checked.`,
+	}
+)
+
+func fsck(ctx *cli.Context) error {
+	var (
+		path       = ctx.String("path")
+		fix        = ctx.Bool(fixFlag.Name)
+		slotSizeFn = billy.SlotSizePowerOfTwo(uint32(ctx.Int("min")), uint32(ctx.Int("max")))
+		known      = make(map[string]bool)
+		problems   int
+	)
+	remove := func(file string) {
+		if !fix {
+			return
+		}
+		if err := os.Remove(file); err != nil {
+			fmt.Fprintf(os.Stderr, "  failed to remove %v: %v\n", file, err)
+			return
+		}
+		fmt.Printf("  removed %v\n", file)
+	}
+	for done := false; !done; {
+		var slotSize uint32
+		slotSize, done = slotSizeFn()
+		report, err := billy.CheckGapIndex(path, slotSize)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("shelf %d: %w", slotSize, err)
+		}
+		known[report.Index] = true
+		switch {
+		case report.Missing:
+			fmt.Printf("shelf %d: no gap index\n", slotSize)
+			continue
+		case report.Consistent():
+			fmt.Printf("shelf %d: ok (clean: %t, slots: %d)\n", slotSize, report.Clean, report.FileTail)
+			continue
+		}
+		problems++
+		fmt.Printf("shelf %d: gap index diverges (clean: %t)\n", slotSize, report.Clean)
+		if report.Err != nil {
+			fmt.Printf("  unreadable: %v\n", report.Err)
+		}
+		if report.FileTail != report.IndexTail {
+			fmt.Printf("  tail: file %d, index %d\n", report.FileTail, report.IndexTail)
+		}
+		if len(report.LiveGaps) > 0 {
+			fmt.Printf("  %d gaps holding data, e.g. slot %d\n", len(report.LiveGaps), report.LiveGaps[0])
+		}
+		if len(report.DeadSlots) > 0 {
+			fmt.Printf("  %d live slots blank on disk, e.g. slot %d\n", len(report.DeadSlots), report.DeadSlots[0])
+		}
+		remove(report.Index)
+	}
+	// Gap indexes for shelves outside of the configured range, and temporary
+	// files from interrupted writes.
+	for _, pattern := range []string{"bkt_*.idx", "bkt_*.tmp"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return err
+		}
+		for _, file := range matches {
+			if known[file] {
+				continue
+			}
+			problems++
+			fmt.Printf("orphaned file %v\n", file)
+			remove(file)
+		}
+	}
+	if problems > 0 && !fix {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	return nil
+}
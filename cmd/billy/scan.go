@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethstorage/billy"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	hexFlag = &cli.StringFlag{
+		Name:  "hex",
+		Usage: "Report items containing this (hex-encoded) byte pattern",
+	}
+	sha256Flag = &cli.StringFlag{
+		Name:  "sha256",
+		Usage: "Report items whose sha256 hash matches this (hex-encoded) hash",
+	}
+	scanCommand = &cli.Command{
+		Action: scan,
+		Name:   "scan",
+		Usage:  "Search the live items for a byte pattern or a hash",
+		Flags:  []cli.Flag{hexFlag, sha256Flag},
+		Description: `Streams through all live items of the database (opened read-only), and
+reports the keys of the items which contain the given byte pattern, or whose
+sha256 hash matches the given hash.`,
+	}
+)
+
+// parseHex decodes a hex string, with or without 0x-prefix.
+func parseHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(s, "0x"))
+}
+
+func scan(ctx *cli.Context) error {
+	var (
+		pattern []byte
+		hash    []byte
+		err     error
+	)
+	if ctx.IsSet(hexFlag.Name) {
+		if pattern, err = parseHex(ctx.String(hexFlag.Name)); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+		if len(pattern) == 0 {
+			return fmt.Errorf("empty pattern")
+		}
+	}
+	if ctx.IsSet(sha256Flag.Name) {
+		if hash, err = parseHex(ctx.String(sha256Flag.Name)); err != nil {
+			return fmt.Errorf("invalid hash: %v", err)
+		}
+		if len(hash) != sha256.Size {
+			return fmt.Errorf("invalid hash length %d", len(hash))
+		}
+	}
+	if pattern == nil && hash == nil {
+		return fmt.Errorf("either --%v or --%v is required", hexFlag.Name, sha256Flag.Name)
+	}
+	db, err := billy.Open(ctx.String("path"),
+		billy.SlotSizePowerOfTwo(uint32(ctx.Int("min")), uint32(ctx.Int("max"))),
+		nil, billy.WithReadonly())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var scanned, matched int
+	err = db.Iterate(func(key uint64, size uint32, data []byte) {
+		scanned++
+		if pattern != nil {
+			if idx := bytes.Index(data, pattern); idx >= 0 {
+				matched++
+				fmt.Printf("%#08x size %d pattern at offset %d\n", key, len(data), idx)
+			}
+		}
+		if hash != nil {
+			if sum := sha256.Sum256(data); bytes.Equal(sum[:], hash) {
+				matched++
+				fmt.Printf("%#08x size %d hash match\n", key, len(data))
+			}
+		}
+	})
+	fmt.Fprintf(os.Stderr, "Scanned %d items, %d matches\n", scanned, matched)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	watchCommand = &cli.Command{
+		Action:    watch,
+		Name:      "watch",
+		Usage:     "Print the mutations performed by a running 'open' instance",
+		ArgsUsage: "<db dir or ipc socket>",
+		Description: `Subscribes to the changefeed of a database served by 'billy open', and
+prints the mutations as they happen, along with per-second rates.`,
+	}
+	// feed is the changefeed of the database served over ipc
+	feed = &changefeed{subs: make(map[net.Conn]struct{})}
+)
+
+// changefeed broadcasts mutation events to subscribed ipc connections.
+// Events are single lines of the form:
+//
+//	PUT <key> <size>
+//	DEL <key>
+type changefeed struct {
+	subs map[net.Conn]struct{}
+	mu   sync.Mutex
+}
+
+func (f *changefeed) subscribe(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[conn] = struct{}{}
+}
+
+func (f *changefeed) unsubscribe(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, conn)
+}
+
+// publish sends the event to all subscribers. Subscribers which fail to keep
+// up are dropped.
+func (f *changefeed) publish(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.subs {
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(event + "\n")); err != nil {
+			fmt.Fprintf(os.Stderr, "Dropping subscriber: %v\n", err)
+			delete(f.subs, conn)
+		}
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+func watch(ctx *cli.Context) error {
+	endpoint := ctx.Args().First()
+	if endpoint == "" {
+		endpoint = ctx.String("path")
+	}
+	if finfo, err := os.Stat(endpoint); err == nil && finfo.IsDir() {
+		endpoint = filepath.Join(endpoint, "billy.ipc")
+	}
+	conn, err := net.Dial("unix", endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("SUB \n")); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Watching %v\n", endpoint)
+
+	var (
+		events    = make(chan string)
+		failed    = make(chan error, 1)
+		abortChan = make(chan os.Signal, 1)
+		ticker    = time.NewTicker(time.Second)
+		puts      int
+		dels      int
+	)
+	defer ticker.Stop()
+	signal.Notify(abortChan, os.Interrupt)
+	go func() {
+		in := bufio.NewScanner(conn)
+		for in.Scan() {
+			events <- in.Text()
+		}
+		failed <- in.Err()
+	}()
+	for {
+		select {
+		case event := <-events:
+			switch {
+			case strings.HasPrefix(event, "PUT "):
+				puts++
+			case strings.HasPrefix(event, "DEL "):
+				dels++
+			}
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), event)
+		case <-ticker.C:
+			if puts+dels > 0 {
+				fmt.Fprintf(os.Stderr, "%d puts/s, %d dels/s\n", puts, dels)
+			}
+			puts, dels = 0, 0
+		case err := <-failed:
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "Connection closed\n")
+			}
+			return err
+		case <-abortChan:
+			return nil
+		}
+	}
+}
@@ -57,9 +57,9 @@ func main() {
 const verbose = false
 
 func doOpenDb(ctx *cli.Context, onData billy.OnDataFn) (billy.Database, error) {
-	db, err := billy.Open(billy.Options{Path: ctx.String("path")},
+	db, err := billy.Open(ctx.String("path"),
 		billy.SlotSizePowerOfTwo(uint32(ctx.Int("min")), uint32(ctx.Int("max"))),
-		onData)
+		onData, billy.WithInvariantChecks())
 	if err == nil {
 		fmt.Fprintf(os.Stderr, "Opened %v\n", ctx.String("path"))
 	}
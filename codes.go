@@ -0,0 +1,124 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Code is a stable numeric identifier of a class of errors, for callers which
+// cannot match errors with errors.Is, such as clients of a remote service or
+// scripts checking the exit status of the billy command. The values are part
+// of the API, and will not be reassigned. They are below 64, so they can be
+// used as process exit codes.
+type Code uint8
+
+const (
+	CodeOK            Code = 0  // No error
+	CodeUnknown       Code = 1  // An error without a code, e.g. from the OS
+	CodeClosed        Code = 10 // ErrClosed
+	CodeOversized     Code = 11 // ErrOversized
+	CodeBadIndex      Code = 12 // ErrBadIndex
+	CodeEmptyData     Code = 13 // ErrEmptyData
+	CodeReadonly      Code = 14 // ErrReadonly
+	CodeCorrupt       Code = 15 // ErrCorruptData
+	CodeLocked        Code = 16 // ErrLocked
+	CodeFull          Code = 17 // ErrShelfFull
+	CodeSlotInUse     Code = 18 // ErrSlotInUse
+	CodeDeleted       Code = 19 // ErrDeleted
+	CodeBadHeader     Code = 20 // ErrBadHeader
+	CodeVersion       Code = 21 // ErrVersion
+	CodeTimeout       Code = 22 // context.DeadlineExceeded or os.ErrDeadlineExceeded
+	CodePaused        Code = 23 // ErrPaused
+	CodeCallbackPanic Code = 24 // ErrCallbackPanic
+	CodeLeaseHeld     Code = 25 // ErrLeaseHeld
+	CodeLeaseExpired  Code = 26 // ErrLeaseExpired
+	CodeNotLeased     Code = 27 // ErrNotLeased
+	CodeBackupBase    Code = 28 // ErrBackupBase
+	CodeStandby       Code = 29 // ErrStandby
+	CodeDatabaseFull  Code = 30 // ErrFull
+	CodeStaleKey      Code = 31 // ErrStaleKey
+	CodeInvalidKey    Code = 32 // ErrInvalidKey
+	CodeSlotSizes     Code = 33 // ErrSlotSizes
+	CodeNoSpace       Code = 34 // ErrNoSpace
+)
+
+// errorCodes maps the errors to their codes. Errors wrapping several of them
+// get the code of the first one listed.
+var errorCodes = []struct {
+	err  error
+	code Code
+	name string
+}{
+	{ErrClosed, CodeClosed, "closed"},
+	{ErrOversized, CodeOversized, "oversized"},
+	{ErrBadIndex, CodeBadIndex, "bad index"},
+	{ErrEmptyData, CodeEmptyData, "empty data"},
+	{ErrReadonly, CodeReadonly, "read-only"},
+	{ErrBadHeader, CodeBadHeader, "bad header"},
+	{ErrVersion, CodeVersion, "version"},
+	{ErrSlotSizes, CodeSlotSizes, "slot sizes"},
+	{ErrCorruptData, CodeCorrupt, "corrupt"},
+	{ErrLocked, CodeLocked, "locked"},
+	{ErrShelfFull, CodeFull, "full"},
+	{ErrFull, CodeDatabaseFull, "database full"},
+	{ErrNoSpace, CodeNoSpace, "no space"},
+	{ErrSlotInUse, CodeSlotInUse, "slot in use"},
+	{ErrDeleted, CodeDeleted, "deleted"},
+	{ErrStaleKey, CodeStaleKey, "stale key"},
+	{ErrInvalidKey, CodeInvalidKey, "invalid key"},
+	{context.DeadlineExceeded, CodeTimeout, "timeout"},
+	{os.ErrDeadlineExceeded, CodeTimeout, "timeout"},
+	{ErrPaused, CodePaused, "paused"},
+	{ErrCallbackPanic, CodeCallbackPanic, "callback panic"},
+	{ErrLeaseHeld, CodeLeaseHeld, "lease held"},
+	{ErrLeaseExpired, CodeLeaseExpired, "lease expired"},
+	{ErrNotLeased, CodeNotLeased, "not leased"},
+	{ErrBackupBase, CodeBackupBase, "backup base"},
+	{ErrStandby, CodeStandby, "standby"},
+}
+
+// ErrorCode returns the code of the given error: CodeOK if it is nil, and
+// CodeUnknown if it does not wrap any of the errors of this package.
+func ErrorCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return CodeUnknown
+}
+
+func (c Code) String() string {
+	switch c {
+	case CodeOK:
+		return "ok"
+	case CodeUnknown:
+		return "unknown"
+	}
+	for _, e := range errorCodes {
+		if e.code == c {
+			return e.name
+		}
+	}
+	return fmt.Sprintf("code(%d)", uint8(c))
+}
+
+// Err returns the error of the package identified by the code, for decoding
+// codes received from remote. It returns nil for CodeOK and CodeUnknown.
+func (c Code) Err() error {
+	for _, e := range errorCodes {
+		if e.code == c {
+			return e.err
+		}
+	}
+	return nil
+}
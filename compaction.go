@@ -0,0 +1,85 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// CompactionMode tells how a shelf is compacted.
+type CompactionMode int
+
+const (
+	CompactMove CompactionMode = iota // CompactMove moves items into the gaps and truncates the file
+	CompactTrim                       // CompactTrim only truncates the gaps at the end of the file
+	CompactSkip                       // CompactSkip leaves the shelf as is
+)
+
+// ShelfState describes a shelf to a CompactionPolicy.
+type ShelfState struct {
+	SlotSize uint32 // SlotSize is the slot size of the shelf
+	Tail     uint64 // Tail is the number of slots in the file
+	Gaps     uint64 // Gaps is the number of free slots below the tail, zero when opening
+	Opening  bool   // Opening is set for the compaction while opening
+}
+
+// CompactionPolicy decides how the shelves of a database are compacted, both
+// while opening and in Compact.
+//
+// When opening, the gaps are not known yet: they are collected by scanning
+// the shelf, so CompactSkip is treated like CompactTrim. For Compact, maxMoves
+// limits the number of items moved, if positive, so that a compaction can be
+// spread over several calls.
+type CompactionPolicy interface {
+	Compaction(shelf ShelfState) (mode CompactionMode, maxMoves int)
+}
+
+// CompactionPolicyFunc adapts a function to a CompactionPolicy.
+type CompactionPolicyFunc func(shelf ShelfState) (CompactionMode, int)
+
+// Compaction implements CompactionPolicy.
+func (f CompactionPolicyFunc) Compaction(shelf ShelfState) (CompactionMode, int) {
+	return f(shelf)
+}
+
+// TrimOnlyPolicy never moves items, and only truncates the free slots at the
+// end of the shelves. It suits append-mostly archives, whose items keep their
+// keys, and whose gaps are filled by new items anyway.
+func TrimOnlyPolicy() CompactionPolicy {
+	return CompactionPolicyFunc(func(ShelfState) (CompactionMode, int) {
+		return CompactTrim, 0
+	})
+}
+
+// GapRatioPolicy moves items in Compact once at least the given ratio of the
+// slots of a shelf are gaps, and at most maxMoves items per call if positive.
+// Shelves with fewer gaps are only trimmed, and so are all shelves while
+// opening, leaving the moves to Compact. It suits high-churn pools.
+func GapRatioPolicy(ratio float64, maxMoves int) CompactionPolicy {
+	return CompactionPolicyFunc(func(shelf ShelfState) (CompactionMode, int) {
+		if shelf.Opening || shelf.Tail == 0 || float64(shelf.Gaps) < ratio*float64(shelf.Tail) {
+			return CompactTrim, 0
+		}
+		return CompactMove, maxMoves
+	})
+}
+
+// compaction consults the compaction policy of the shelf, which is to move
+// everything if there is none. This method assumes that the gapsMu is held,
+// unless the shelf is being opened.
+func (s *shelf) compaction(opening bool) (CompactionMode, int, error) {
+	if s.policy == nil {
+		return CompactMove, 0, nil
+	}
+	var (
+		state = ShelfState{SlotSize: s.slotSize, Tail: s.count, Opening: opening}
+		mode  CompactionMode
+		moves int
+	)
+	if !opening {
+		state.Gaps = uint64(s.gaps.len())
+	}
+	err := guard(func() error {
+		mode, moves = s.policy.Compaction(state)
+		return nil
+	})
+	return mode, moves, err
+}
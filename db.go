@@ -5,9 +5,14 @@
 package billy
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Database represents a `billy` storage.
@@ -19,18 +24,52 @@ type Database interface {
 	// The data is copied by the database, and is safe to modify after the method returns
 	Put(data []byte) (uint64, error)
 
+	// PutReader stores length bytes read from r, like Put, without holding
+	// them all in memory, unless the database is encrypted: the data is then
+	// read entirely to be sealed. If reading fails, or r holds fewer than
+	// length bytes, nothing is stored. Writes failing on a full disk are
+	// retried as decided by OnNoSpace, in place rather than with a new slot.
+	PutReader(r io.Reader, length int) (uint64, error)
+
 	// Get retrieves the data stored at the given key.
 	Get(key uint64) ([]byte, error)
 
+	// GetReader returns a reader over the data stored at the given key, which
+	// reads from disk on demand instead of loading the data at once.
+	GetReader(key uint64) (*io.SectionReader, error)
+
+	// PutAt stores the data at the given key, which must not be in use. This
+	// allows restoring items under keys which are stored externally, e.g.
+	// from a backup or a peer.
+	PutAt(key uint64, data []byte) error
+
+	// UpdateRange overwrites part of the data stored at the given key,
+	// starting at offset off. The range must be within the stored data.
+	UpdateRange(key, off uint64, data []byte) error
+
+	// Has returns whether the given key holds live data. It consults the
+	// in-memory state only, and does not read from disk.
+	Has(key uint64) (bool, error)
+
+	// GetInto retrieves the data stored at the given key into buf, and
+	// returns its size. If buf is too small, the needed size is returned
+	// along with io.ErrShortBuffer. Reusing buf avoids allocating per read.
+	GetInto(key uint64, buf []byte) (int, error)
+
 	// GetSample retrieves a portion of the data stored at the given key.
 	// The offset and length are in bytes, and the data returned is a sub-slice
-	// of the original data.
+	// of the original data. Only the item header and the requested range are
+	// read from disk, in a single read if the range is close to the start of
+	// the item, so small samples of large items are cheap. Encrypted items
+	// are read as a whole.
 	GetSample(key, off, length uint64) ([]byte, error)
 
 	// Delete marks the data for deletion, which means it will (eventually) be
-	// overwritten by other data. After calling Delete with a given key, the results
-	// from doing Get(key) is undefined -- it may return the same data, or some other
-	// data, or fail with an error.
+	// overwritten by other data. After calling Delete with a given key, Get(key)
+	// fails with ErrDeleted for as long as the key is among the recently deleted
+	// ones and has not been reused. Otherwise the results from doing Get(key) are
+	// undefined -- it may return the same data, or some other data, or fail with
+	// an error.
 	Delete(key uint64) error
 
 	// Size returns the storage size of the value belonging to the given key.
@@ -39,12 +78,128 @@ type Database interface {
 	// Limits returns the smallest and largest slot size.
 	Limits() (uint32, uint32)
 
+	// SlotSizeFor returns the slot size of the shelf which Put would store
+	// data of the given size in, without storing anything. The padding of
+	// such an item is the slot size minus the data size, the item header and
+	// the encryption overhead, if any. Data too large for every shelf fails
+	// with an OversizedError.
+	SlotSizeFor(size int) (uint32, error)
+
 	// Infos retrieves various internal statistics about the database.
 	Infos() *Infos
 
 	// Iterate iterates through all the data in the database, and invokes the
 	// given onData method for every element
-	Iterate(onData OnDataFn) error
+	Iterate(onData OnDataFn, opts ...IterateOption) error
+
+	// IterateErr iterates through all the data in the database, and invokes
+	// the given onData method for every element. If onData returns an error,
+	// the iteration is aborted. Returning ErrStopIteration stops the iteration
+	// without error.
+	IterateErr(onData OnDataErrFn, opts ...IterateOption) error
+
+	// IterateParallel is like IterateErr, but reads every shelf with n
+	// goroutines, each visiting a contiguous range of its slots. onData is
+	// invoked concurrently, and items are not visited in key order.
+	IterateParallel(n int, onData OnDataErrFn, opts ...IterateOption) error
+
+	// IterateItems is like IterateErr, but describes every item with an
+	// ItemInfo, which holds its shelf, slot and stored size along with the key.
+	IterateItems(onItem OnItemFn, opts ...IterateOption) error
+
+	// All returns an iterator over the items in the database, which can be
+	// ranged over with Go 1.23 or later.
+	All(opts ...IterateOption) func(yield func(uint64, []byte) bool)
+
+	// Compact moves items into the gaps of their shelves and truncates the
+	// files, while the database is live. The optional onMove method is invoked
+	// for every item which changes key, without locks held, so it may access
+	// the database.
+	Compact(onMove OnMoveFn) error
+
+	// Checkpoint syncs the data to disk and persists the gap lists, so that a
+	// subsequent Open without onData callback (e.g. after a crash) does not
+	// need to scan the shelves, as long as no gaps are created or filled in
+	// the meantime.
+	Checkpoint() error
+
+	// Sync fsyncs the shelf files which have been written to since they were
+	// last synced. Calling it periodically (or after a batch of writes)
+	// bounds the data lost on a crash, with one pass over all shelves instead
+	// of an fsync per write as with WithSync.
+	Sync() error
+
+	// Flush is a write barrier: it returns once the writes made before it
+	// are synced to disk. With periodic syncing (see WithGroupCommit), it
+	// triggers a sync right away and shares it with the concurrent Flush
+	// calls and writes. Otherwise, it is the same as Sync.
+	Flush() error
+
+	// SnapshotTo writes a copy of the database into the given directory while
+	// it stays in use, latching one shelf at a time. The copy can be opened as
+	// a database with the same slot sizes.
+	SnapshotTo(dir string) error
+
+	// Export writes the live items to w as a tar archive, with one file per
+	// item named by its key, which can be imported into a database with
+	// different slot sizes.
+	Export(w io.Writer) error
+
+	// Import stores the items of an archive written by Export, in the
+	// shelves matching their sizes. The optional onImport callback is
+	// invoked with the old and new key of every item.
+	Import(r io.Reader, onImport OnImportFn) error
+
+	// BackupIncremental writes a backup into the given directory and returns
+	// its ID: a full copy if since is zero, otherwise the slots changed since
+	// the backup with that ID, which must be the last one. Incremental backups
+	// are applied with ApplyIncremental.
+	BackupIncremental(since BackupID, dir string) (BackupID, error)
+
+	// PutWithTTL stores the data like Put, along with an expiry time ttl from
+	// now. Expired items are removed by Expire.
+	PutWithTTL(data []byte, ttl time.Duration) (uint64, error)
+
+	// Expire deletes all items whose expiry time is at or before now, and
+	// invokes the optional onExpire callback with their keys.
+	Expire(now time.Time, onExpire OnExpireFn) error
+
+	// Verify cross-checks the bookkeeping of the shelves against their files:
+	// the gap lists, the tails and file sizes, and the headers of the last
+	// slots. It returns an error wrapping ErrCorruptData for the first shelf
+	// found inconsistent.
+	Verify() error
+
+	// PauseBackground waits for the maintenance operations in flight (Compact,
+	// Expire and Checkpoint) to finish, and makes further ones fail with
+	// ErrPaused until ResumeBackground is called.
+	PauseBackground()
+
+	// ResumeBackground allows maintenance operations again.
+	ResumeBackground()
+
+	// Reconcile compares the database against an external list of the keys
+	// and hashes of the items expected in it, in a single pass over both, and
+	// reports the missing, extra and mismatching items.
+	Reconcile(commitments CommitmentIterator, hash HashFn, report func(Mismatch)) error
+
+	// ApplyChange stores data at key, replacing any item there, or deletes
+	// the item at key if data is nil. It is used to apply the changes of a
+	// primary database onto a standby, and works while in standby.
+	ApplyChange(key uint64, data []byte) error
+
+	// Promote makes a database opened WithStandby accept writes.
+	Promote()
+
+	// DumpJSON writes the live items as newline-delimited JSON, one object
+	// per item with its key, shelf, slot, size and hash, and optionally its
+	// data.
+	DumpJSON(w io.Writer, withData bool) error
+
+	// DebugState writes a JSON dump of the internal state of the database,
+	// such as the options, tails and gap lists of the shelves, for inclusion
+	// in bug reports.
+	DebugState(w io.Writer) error
 }
 
 // OnDataFn is used to iterate the entire dataset in the database.
@@ -52,6 +207,34 @@ type Database interface {
 // the iterator, so it needs to be copied if it is to be used later.
 type OnDataFn func(key uint64, size uint32, data []byte)
 
+// OnDataErrFn is used to iterate the dataset in the database, with the
+// possibility to abort the iteration by returning an error. The content of
+// 'data' is only valid until the method returns.
+type OnDataErrFn func(key uint64, size uint32, data []byte) error
+
+// ItemInfo describes an item visited by IterateItems.
+type ItemInfo struct {
+	Key      uint64 // Key is the key of the item
+	Shelf    int    // Shelf is the id of the shelf holding the item
+	Slot     uint64 // Slot is the index of the slot within the shelf
+	SlotSize uint32 // SlotSize is the slot size of the shelf
+	Stored   uint32 // Stored is the size of the data in the slot, encryption included
+}
+
+// OnItemFn is used to iterate the dataset in the database like OnDataErrFn,
+// along with information about the items. The content of 'data' is only valid
+// until the method returns.
+type OnItemFn func(item ItemInfo, data []byte) error
+
+// ErrStopIteration can be returned by an OnDataErrFn to stop the iteration
+// early, without IterateErr returning an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// OnMoveFn is used to notify about an item being relocated by compaction, from
+// oldKey to newKey. After the method returns, the content of 'data' will be
+// modified, so it needs to be copied if it is to be used later.
+type OnMoveFn func(oldKey, newKey uint64, data []byte)
+
 // SlotSizeFn is a method that acts as a "generator": a closure which, at each
 // invocation, should spit out the next slot-size. In order to create a database with three
 // shelves invocation of the method should return e.g.
@@ -64,6 +247,29 @@ type OnDataFn func(key uint64, size uint32, data []byte)
 // plan to store 120 bytes, then the slot needs to be at least 124 bytes large.
 type SlotSizeFn func() (size uint32, done bool)
 
+// SlotSizes collects the slot sizes produced by the given SlotSizeFn, and
+// checks that they are increasing and few enough to be addressed by keys. The
+// SlotSizeFn is used up, and must not be passed on afterwards.
+func SlotSizes(slotSizeFn SlotSizeFn) ([]uint32, error) {
+	var (
+		slotSizes []uint32
+		prev      uint32
+	)
+	for done := false; !done; {
+		var slotSize uint32
+		slotSize, done = slotSizeFn()
+		if slotSize <= prev {
+			return nil, fmt.Errorf("slot sizes must be in increasing order")
+		}
+		prev = slotSize
+		slotSizes = append(slotSizes, slotSize)
+		if len(slotSizes) > 0xfff {
+			return nil, fmt.Errorf("too many shelves (%d)", len(slotSizes))
+		}
+	}
+	return slotSizes, nil
+}
+
 // SlotSizePowerOfTwo is a SlotSizeFn which arranges the slots in shelves which
 // double in size for each level.
 func SlotSizePowerOfTwo(min, max uint32) SlotSizeFn {
@@ -87,84 +293,590 @@ func SlotSizeLinear(size, count int) SlotSizeFn {
 }
 
 type database struct {
+	// oversized is the number of rejected oversized puts, accessed atomically.
+	// It is the first field to be 64-bit aligned on 32-bit platforms.
+	oversized uint64
+	standby   uint32 // standby is set (atomically) while writes are rejected
+
 	shelves []*shelf
+	metrics Metrics
+	opts    *Options
+	sealer  *sealer     // sealer encrypts the items, nil if not encrypted
+	quota   *quota      // quota limits the size of the shelves, nil if unlimited
+	lock    *dirLock    // lock is the lock file of the directory, nil if read-only or in-memory
+	remap   *remapTable // remap maps the keys of moved items, nil unless Options.Remap is set
+	syncer  *syncer     // syncer syncs the shelves in the background, nil unless configured
+
+	maintMu sync.RWMutex // maintMu is read-locked by maintenance operations in flight
+	paused  bool         // paused is set while maintenance is paused, guarded by maintMu
+
+	backupMu   sync.Mutex // backupMu serializes the backups
+	lastBackup BackupID   // lastBackup is the ID of the last backup, guarded by backupMu
 }
 
-type Options struct {
-	Path     string
-	Readonly bool
-	Repair   bool
-	Snappy   bool // unused for now
+// OversizedError is returned by Put when the data does not fit into any of the
+// shelves of the database. It matches ErrOversized when used with errors.Is.
+type OversizedError struct {
+	Size     int    // Size of the rejected data
+	SlotSize uint32 // Slot size of the largest shelf
+}
+
+func (e *OversizedError) Error() string {
+	return fmt.Sprintf("%v: size %d exceeds max item size %d (largest slot %d); "+
+		"configure a larger slot size or split the data into chunks",
+		ErrOversized, e.Size, e.SlotSize-itemHeaderSize, e.SlotSize)
+}
+
+func (e *OversizedError) Unwrap() error {
+	return ErrOversized
 }
 
 // Open opens a (new or existing) database, with configurable limits. The given
 // slotSizeFn will be used to determine both the shelf sizes and the number of
-// shelves. The function must yield values in increasing order.
+// shelves. The function must yield values in increasing order. The slot sizes
+// are recorded in a manifest when the database is created, and later opens
+// with other slot sizes fail with ErrSlotSizes.
+//
+// A database opened for writing is locked by a LOCK file in its directory,
+// recording the id of the process, and further writable opens fail with
+// ErrLocked. A lock file left behind by a process which has died is taken
+// over.
 //
 // If shelf already exists, they are opened and read, in order to populate the
 // internal gap-list. While doing so, it's a good opportunity for the caller to
 // read the data out, (which is probably desirable), which can be done using the
 // optional onData callback.
-func Open(opts Options, slotSizeFn SlotSizeFn, onData OnDataFn) (Database, error) {
-	var (
-		db           = &database{}
-		prevSlotSize uint32
-		prevId       int
-		slotSize     uint32
-		slotSizes    []uint32
-		done         bool
-	)
-	for !done {
-		slotSize, done = slotSizeFn()
-		if slotSize <= prevSlotSize {
-			return nil, fmt.Errorf("slot sizes must be in increasing order")
+//
+// The path denotes the directory where the shelf files are stored. An empty
+// path opens an ephemeral in-memory database. Further configuration is passed
+// as options.
+func Open(path string, slotSizeFn SlotSizeFn, onData OnDataFn, options ...Option) (Database, error) {
+	opts := &Options{Path: path}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.DirectIO && opts.IOUring {
+		return nil, errors.New("direct I/O and io_uring can't be combined")
+	}
+	if opts.KeySecret != nil && len(opts.KeySecret) == 0 {
+		return nil, errors.New("empty key secret")
+	}
+	if opts.KeySecret != nil && opts.Generations && path != "" {
+		return nil, errors.New("authenticated keys with generations would not resolve after a crash")
+	}
+	opts.limiter = newIOLimiter(opts.MaintenanceBytesPerSec, opts.MaintenanceIOPS)
+	db := &database{metrics: opts.metrics(), opts: opts}
+	if opts.Standby {
+		db.standby = 1
+	}
+	if opts.OnWatermark != nil && opts.MaxSize == 0 {
+		return nil, errors.New("watermarks require a size limit")
+	}
+	if opts.MaxSize > 0 {
+		quota, err := newQuota(opts.MaxSize, opts.HighWatermark, opts.LowWatermark, opts.OnWatermark)
+		if err != nil {
+			return nil, err
+		}
+		db.quota = quota
+	}
+	if opts.EncryptionKey != nil {
+		sealer, err := newSealer(opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		db.sealer = sealer
+	}
+	slotSizes, err := SlotSizes(slotSizeFn)
+	if err != nil {
+		return nil, err
+	}
+	var newManifest bool
+	if path != "" {
+		if err := checkMigration(path); err != nil {
+			return nil, err
+		}
+		if newManifest, err = checkManifest(path, slotSizes); err != nil {
+			return nil, err
+		}
+		if !opts.Readonly {
+			if db.lock, err = lockDir(path, opts.logger()); err != nil {
+				return nil, err
+			}
+			// Callback panics resumed while opening must not leave the
+			// directory locked
+			defer func() {
+				if r := recover(); r != nil {
+					db.lock.release()
+					panic(r)
+				}
+			}()
+		}
+	}
+	if opts.Remap {
+		// Moves are recorded while the shelves are opened
+		if db.remap, err = openRemap(path, opts.Readonly); err != nil {
+			if db.lock != nil {
+				db.lock.release()
+			}
+			return nil, err
+		}
+	}
+	if opts.OpenWorkers > 1 {
+		err = db.openParallel(slotSizes, onData)
+	} else {
+		err = db.openSequential(slotSizes, onData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.remap.failed(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if newManifest && !opts.Readonly {
+		if err := writeManifest(path, slotSizes); err != nil {
+			db.Close()
+			return nil, err
 		}
-		prevSlotSize = slotSize
+	}
+	if !opts.Readonly {
+		db.syncer = newSyncer(opts.SyncInterval, opts.SyncWrites, db.Sync)
+	}
+	return db, nil
+}
 
-		slotSizes = append(slotSizes, slotSize)
-		if id := len(slotSizes) & 0xfff; id < prevId {
-			return nil, fmt.Errorf("too many shelves (%d)", len(slotSizes))
-		} else {
-			prevId = id
+// openSequential opens the shelves with the given slot sizes one by one.
+func (db *database) openSequential(slotSizes []uint32, onData OnDataFn) error {
+	for id, slotSize := range slotSizes {
+		shelf, err := db.openShelf(id, slotSize, onData)
+		if err != nil {
+			db.Close() // Close shelves
+			return err
 		}
+		db.shelves = append(db.shelves, shelf)
+	}
+	return nil
+}
+
+// openParallel opens the shelves with the given slot sizes using up to
+// Options.OpenWorkers goroutines.
+func (db *database) openParallel(slotSizes []uint32, onData OnDataFn) error {
+	var (
+		shelves = make([]*shelf, len(slotSizes))
+		errs    = make([]error, len(slotSizes))
+		workers = make(chan struct{}, db.opts.OpenWorkers)
+		wg      sync.WaitGroup
+	)
+	for id, slotSize := range slotSizes {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(id int, slotSize uint32) {
+			defer func() { <-workers; wg.Done() }()
+			shelves[id], errs[id] = db.openShelf(id, slotSize, onData)
+		}(id, slotSize)
 	}
-	for _, slotSize = range slotSizes {
-		shelf, err := openShelf(opts.Path, slotSize, wrapShelfDataFn(len(db.shelves), slotSize, onData), opts.Readonly, opts.Repair)
+	wg.Wait()
+	for _, shelf := range shelves {
+		if shelf != nil {
+			db.shelves = append(db.shelves, shelf)
+		}
+	}
+	// Report the error of the first failing shelf, like a sequential open
+	for _, err := range errs {
 		if err != nil {
 			db.Close() // Close shelves
+			return err
+		}
+	}
+	return nil
+}
+
+// openShelf opens the shelf with the given id and slot size, upgrading the file
+// first if configured to.
+func (db *database) openShelf(id int, slotSize uint32, onData OnDataFn) (*shelf, error) {
+	opts := db.opts
+	if opts.Upgrade && !opts.Readonly && opts.Path != "" {
+		if err := upgradeShelf(opts.Path, slotSize, opts); err != nil {
 			return nil, err
 		}
-		db.shelves = append(db.shelves, shelf)
 	}
-	return db, nil
+	if fn, ok := opts.ShelfOnData[slotSize]; ok {
+		onData = fn
+	}
+	var openErr error
+	shelf, err := openShelfMoving(opts.Path, slotSize, db.wrapShelfDataFn(id, slotSize, onData, &openErr), db.wrapShelfMoveFn(id, slotSize, opts.OnMove, true), opts)
+	if err != nil {
+		return nil, db.repanic(err)
+	}
+	if opts.CheckInvariants {
+		shelf.checkInvariants("open")
+	}
+	if openErr != nil {
+		shelf.Close()
+		return nil, fmt.Errorf("shelf %d: %w", id, openErr)
+	}
+	if opts.ShareGaps {
+		if err := shelf.shareGaps(); err != nil {
+			shelf.Close()
+			return nil, err
+		}
+	}
+	if db.quota != nil {
+		shelf.setQuota(db.quota)
+	}
+	return shelf, nil
+}
+
+// OpenMemory opens an ephemeral database backed by memory, with the same
+// behaviour as one stored on disk. It is meant for tests of consumers and for
+// caches which need not survive the process. Any path set through the options
+// is ignored.
+func OpenMemory(slotSizeFn SlotSizeFn, options ...Option) (Database, error) {
+	options = append(options, func(o *Options) { o.Path = "" })
+	return Open("", slotSizeFn, nil, options...)
 }
 
 // Put stores the data to the underlying database, and returns the key needed
 // for later accessing the data.
 // The data is copied by the database, and is safe to modify after the method returns
 func (db *database) Put(data []byte) (uint64, error) {
-	// Search uses binary search to find and return the smallest index i
-	// in [0, n) at which f(i) is true,
-	index := sort.Search(len(db.shelves), func(i int) bool {
-		return len(data)+itemHeaderSize <= int(db.shelves[i].slotSize)
-	})
+	return db.put(data, 0)
+}
+
+// PutReader stores length bytes read from r, and returns their key. The data
+// is streamed into the slot in chunks, except for encrypted databases, where
+// it is read entirely to be sealed. If reading fails, or r holds fewer than
+// length bytes, nothing is stored.
+func (db *database) PutReader(r io.Reader, length int) (uint64, error) {
+	if err := db.writable(); err != nil {
+		return 0, err
+	}
+	if length <= 0 {
+		return 0, ErrEmptyData
+	}
+	index := db.shelfFor(length)
 	if index == len(db.shelves) {
-		return 0, fmt.Errorf("no shelf found for size %d", len(data))
+		atomic.AddUint64(&db.oversized, 1)
+		db.metrics.Oversized(length)
+		return 0, &OversizedError{
+			Size:     length,
+			SlotSize: db.shelves[len(db.shelves)-1].slotSize,
+		}
+	}
+	if db.sealer != nil {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, err
+		}
+		return db.put(data, 0)
 	}
-	if slot, err := db.shelves[index].Put(data); err != nil {
+	slot, err := db.shelves[index].putReader(r, length, db.retryNoSpace)
+	if err != nil {
 		return 0, err
-	} else {
-		return slot | uint64(index)<<28, nil
 	}
+	return db.putDone(index, slot), nil
+}
+
+// put stores the data, with an expiry time in unix nanoseconds unless it is
+// zero.
+func (db *database) put(data []byte, expiry int64) (uint64, error) {
+	if err := db.writable(); err != nil {
+		return 0, err
+	}
+	size := len(data)
+	if expiry != 0 {
+		size += itemExpirySize
+	}
+	index := db.shelfFor(size)
+	if index == len(db.shelves) {
+		atomic.AddUint64(&db.oversized, 1)
+		db.metrics.Oversized(len(data))
+		return 0, &OversizedError{
+			Size:     len(data),
+			SlotSize: db.shelves[len(db.shelves)-1].slotSize,
+		}
+	}
+	if db.sealer != nil {
+		data = db.sealer.seal(db.shelves[index].slotSize, data)
+	}
+	slot, err := db.shelves[index].put(data, expiry)
+	for attempt := 1; err != nil; attempt++ {
+		var retry bool
+		if retry, err = db.retryNoSpace(attempt, err); !retry {
+			return 0, err
+		}
+		slot, err = db.shelves[index].put(data, expiry)
+	}
+	return db.putDone(index, slot), nil
+}
+
+// putDone does the bookkeeping shared by put and PutReader for the item just
+// stored in the given slot, and returns its key.
+func (db *database) putDone(index int, slot uint64) uint64 {
+	db.remap.forget(Key(index, slot))
+	db.syncer.wrote()
+	if db.opts.CheckInvariants {
+		db.shelves[index].checkInvariants("put", slot)
+	}
+	return db.key(index, slot)
+}
+
+// PutAt stores the data at the given key. The key must be one which could have
+// been returned by Put for the data: its shelf must be large enough to hold the
+// data, and the slot must not be in use. Slots between the tail of the shelf
+// and the given slot become gaps.
+func (db *database) PutAt(key uint64, data []byte) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if db.opts.KeySecret != nil && db.validKey(key) {
+		if err := db.checkMAC(key, 0); err != nil {
+			return err
+		}
+	}
+	return db.putAt(key, data)
+}
+
+// putAt stores the data at the given key, see PutAt.
+func (db *database) putAt(key uint64, data []byte) error {
+	if !db.validKey(key) {
+		return fmt.Errorf("%w: key %#x", ErrBadIndex, key)
+	}
+	id, slot := SplitKey(key)
+	shelf := db.shelves[id]
+	if len(data)+db.overhead()+itemHeaderSize > int(shelf.slotSize) {
+		return &OversizedError{Size: len(data), SlotSize: shelf.slotSize}
+	}
+	if db.sealer != nil {
+		data = db.sealer.seal(shelf.slotSize, data)
+	}
+	err := shelf.PutAt(slot, data)
+	for attempt := 1; err != nil; attempt++ {
+		var retry bool
+		if retry, err = db.retryNoSpace(attempt, err); !retry {
+			return err
+		}
+		err = shelf.PutAt(slot, data)
+	}
+	db.remap.forget(Key(id, slot))
+	db.syncer.wrote()
+	if db.opts.KeySecret != nil {
+		err = shelf.setGeneration(slot, 0) // The key is authenticated without generation
+	} else if gen := KeyGeneration(key); gen != 0 {
+		err = shelf.setGeneration(slot, gen)
+	}
+	if err != nil {
+		return err
+	}
+	if db.opts.CheckInvariants {
+		shelf.checkInvariants("putat", slot)
+	}
+	return nil
+}
+
+// resolve returns the current key of the item stored at the given key, which
+// differs if the item has been moved and the moves are remapped.
+func (db *database) resolve(key uint64) uint64 {
+	if db.remap == nil {
+		return key
+	}
+	to, ok := db.remap.resolve(key & keyIndexMask)
+	if !ok {
+		return key
+	}
+	id, slot := SplitKey(to)
+	return db.key(id, slot)
+}
+
+// key returns the key of the item at the given slot of the shelf with the
+// given id, carrying the generation of the slot if tracked, or the code
+// authenticating both if keys are authenticated.
+func (db *database) key(id int, slot uint64) uint64 {
+	key, gen := Key(id, slot), db.shelves[id].gens.get(slot)
+	if db.opts.KeySecret != nil {
+		return key | uint64(db.keyMAC(key, gen))<<keyGenBits
+	}
+	return withGeneration(key, gen)
+}
+
+// validKey returns whether the key lies within the shelves of the database.
+// The bits above the shelf id must be zero, unless they hold the generation
+// of the slot or the authentication code of the key.
+func (db *database) validKey(key uint64) bool {
+	id, slot := SplitKey(key)
+	if db.opts.Generations || db.opts.KeySecret != nil {
+		key &= keyIndexMask
+	}
+	return id < len(db.shelves) && key == Key(id, slot)
+}
+
+// checkKey returns ErrStaleKey if the slot of the key has been reused since
+// the key was issued, or ErrInvalidKey if the key was not issued by the
+// database. Reads check after reading, as a reused slot gets its new
+// generation before it is written.
+func (db *database) checkKey(key uint64) error {
+	id, slot := SplitKey(key)
+	if db.opts.KeySecret != nil {
+		return db.checkMAC(key, db.shelves[id].gens.get(slot))
+	}
+	return db.shelves[id].gens.check(slot, KeyGeneration(key))
+}
+
+// lookup returns the shelf and slot of the key. Keys outside of the shelves of
+// the database fail with ErrBadIndex, or with ErrInvalidKey if keys are
+// authenticated, as do keys with a wrong authentication code, before anything
+// is read. Reads check the key again afterwards, see checkKey.
+func (db *database) lookup(key uint64) (*shelf, uint64, error) {
+	if !db.validKey(key) {
+		if db.opts.KeySecret != nil {
+			return nil, 0, fmt.Errorf("%w: key %#x", ErrInvalidKey, key)
+		}
+		return nil, 0, fmt.Errorf("%w: key %#x", ErrBadIndex, key)
+	}
+	id, slot := SplitKey(key)
+	if db.opts.KeySecret != nil {
+		if err := db.checkMAC(key, db.shelves[id].gens.get(slot)); err != nil {
+			return nil, 0, err
+		}
+	}
+	return db.shelves[id], slot, nil
+}
+
+// UpdateRange overwrites part of the data stored at the given key, starting at
+// offset off, in place. The range must be within the stored data. Encrypted
+// items can't be patched in place, and are rewritten as a whole instead.
+//
+// The key is assumed to be one returned by Put or Iterate (potentially on Open).
+func (db *database) UpdateRange(key, off uint64, data []byte) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	key = db.resolve(key)
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return err
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	defer db.syncer.wrote()
+	if db.sealer == nil {
+		return shelf.UpdateRange(slot, off, data)
+	}
+	return shelf.rewrite(slot, func(sealed []byte) ([]byte, error) {
+		item, err := db.sealer.open(shelf.slotSize, sealed)
+		if err != nil {
+			return nil, err
+		}
+		if off > uint64(len(item)) || uint64(len(data)) > uint64(len(item))-off {
+			return nil, fmt.Errorf("%w: update %d+%d, item size %d", ErrBadIndex, off, len(data), len(item))
+		}
+		copy(item[off:], data)
+		return db.sealer.seal(shelf.slotSize, item), nil
+	})
+}
+
+// shelfFor returns the index of the smallest shelf which can hold an item of
+// the given size, or len(db.shelves) if no shelf is large enough.
+func (db *database) shelfFor(size int) int {
+	// Search uses binary search to find and return the smallest index i
+	// in [0, n) at which f(i) is true,
+	return sort.Search(len(db.shelves), func(i int) bool {
+		return size+db.overhead()+itemHeaderSize <= int(db.shelves[i].slotSize)
+	})
+}
+
+// overhead returns the number of bytes by which the stored items are larger
+// than the data passed to Put.
+func (db *database) overhead() int {
+	if db.sealer == nil {
+		return 0
+	}
+	return db.sealer.overhead()
 }
 
 // Get retrieves the data stored at the given key.
 //
 // The key is assumed to be one returned by Put or Iterate (potentially on Open).
-// Attempting to access a different key is undefined behavior and may panic.
+// Other keys fail with ErrBadIndex, or ErrInvalidKey if keys are authenticated.
 func (db *database) Get(key uint64) ([]byte, error) {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].Get(key & 0x0FFFFFFF)
+	key = db.resolve(key)
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := shelf.Get(slot)
+	if err == nil {
+		err = db.checkKey(key)
+	}
+	if err != nil || db.sealer == nil {
+		return data, err
+	}
+	return db.sealer.open(shelf.slotSize, data)
+}
+
+// GetReader returns a reader over the data stored at the given key. The data
+// is read from the shelf file on demand, so large items can be streamed
+// without loading them at once. Encrypted items are read and opened upfront.
+// Reading fails with ErrClosed once the database is closed.
+//
+// The key is assumed to be one returned by Put or Iterate (potentially on Open).
+// Other keys fail with ErrBadIndex, or ErrInvalidKey if keys are authenticated.
+func (db *database) GetReader(key uint64) (*io.SectionReader, error) {
+	key = db.resolve(key)
+	if db.sealer != nil {
+		data, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	}
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := shelf.GetReader(slot)
+	if err == nil {
+		err = db.checkKey(key)
+	}
+	return r, err
+}
+
+// Has returns whether the given key holds live data, without reading from
+// disk. Keys outside of the range of the database are reported as not live.
+func (db *database) Has(key uint64) (bool, error) {
+	key = db.resolve(key)
+	if !db.validKey(key) {
+		return false, nil
+	}
+	id, slot := SplitKey(key)
+	live, err := db.shelves[id].Has(slot)
+	if live && db.checkKey(key) != nil {
+		return false, nil
+	}
+	return live, err
+}
+
+// GetInto retrieves the data stored at the given key into buf, and returns its
+// size. If buf is too small, the needed size is returned along with
+// io.ErrShortBuffer. A buf of the slot size (see Size) never falls short, and
+// is filled with a single read.
+//
+// The key is assumed to be one returned by Put or Iterate (potentially on Open).
+func (db *database) GetInto(key uint64, buf []byte) (int, error) {
+	key = db.resolve(key)
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := shelf.GetInto(slot, buf)
+	if err == nil {
+		err = db.checkKey(key)
+	}
+	if err != nil || db.sealer == nil {
+		return n, err
+	}
+	return db.sealer.openInPlace(shelf.slotSize, buf[:n])
 }
 
 // GetSample retrieves a portion of the data stored at the given key.
@@ -175,69 +887,374 @@ func (db *database) Get(key uint64) ([]byte, error) {
 //
 // The key is assumed to be one returned by Put or Iterate (potentially on Open).
 func (db *database) GetSample(key, off, length uint64) ([]byte, error) {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].GetSample(key&0x0FFFFFFF, off, length)
+	key = db.resolve(key)
+	if db.sealer != nil {
+		// The whole item is needed to decrypt any part of it
+		data, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if off > uint64(len(data)) || length > uint64(len(data))-off {
+			return nil, fmt.Errorf("%w: sample %d+%d, size %d", ErrBadIndex, off, length, len(data))
+		}
+		return data[off : off+length], nil
+	}
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	sample, err := shelf.GetSample(slot, off, length)
+	if err == nil {
+		err = db.checkKey(key)
+	}
+	return sample, err
 }
 
 // Infos retrieves various internal statistics about the database.
 
 // Delete marks the data for deletion, which means it will (eventually) be
-// overwritten by other data. After calling Delete with a given key, the results
-// from doing Get(key) is undefined -- it may return the same data, or some other
-// data, or fail with an error.
+// overwritten by other data. After calling Delete with a given key, Get(key)
+// fails with ErrDeleted while the key is among the recently deleted ones, see
+// Database.Delete.
 //
 // The key is assumed to be one returned by Put or Iterate (potentially on Open).
-// Attempting to access a different key is undefined behavior and may panic.
+// Other keys fail with ErrBadIndex, or ErrInvalidKey if keys are authenticated.
 func (db *database) Delete(key uint64) error {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].Delete(key & 0x0FFFFFFF)
+	if err := db.writable(); err != nil {
+		return err
+	}
+	return db.delete(key)
+}
+
+// delete deletes the item at the given key, see Delete.
+func (db *database) delete(key uint64) error {
+	key = db.resolve(key)
+	shelf, slot, err := db.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = shelf.deleteChecked(slot, func() error { return db.checkKey(key) })
+	if err == nil {
+		db.syncer.wrote()
+	}
+	if db.opts.CheckInvariants {
+		shelf.checkInvariants("delete")
+	}
+	return err
 }
 
 // Size returns the storage size (padding included) of a database entry belonging
 // to a key.
 //
 // The key is assumed to be one returned by Put or Iterate (potentially on Open).
-// Attempting to access a different key is undefined behavior and may panic.
+// Other keys have size zero.
 func (db *database) Size(key uint64) uint32 {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].slotSize
+	shelf, _, err := db.lookup(db.resolve(key))
+	if err != nil {
+		return 0
+	}
+	return shelf.slotSize
+}
+
+// wrapShelfMoveFn wraps an onMove callback for a shelf, converting slots to
+// keys and decrypting the data. While opening, the keys are plain, like those
+// passed to the onData callback, and the moves are recorded in the remap table
+// too; live compactions record them with recordMoveFn instead. It returns nil
+// if there is nothing to do.
+func (db *database) wrapShelfMoveFn(shelfId int, shelfSlotSize uint32, onMove OnMoveFn, opening bool) onShelfMoveFn {
+	if onMove == nil && (db.remap == nil || !opening) {
+		return nil
+	}
+	key := db.key
+	if opening {
+		key = func(id int, slot uint64) uint64 { return Key(id, slot) }
+	}
+	return func(oldSlot, newSlot uint64, data []byte) {
+		if opening {
+			db.remap.move(Key(shelfId, oldSlot), Key(shelfId, newSlot))
+		}
+		if onMove == nil {
+			return
+		}
+		if db.sealer != nil {
+			// The items were decrypted when written, so this can only fail
+			// on disk corruption
+			if plain, err := db.sealer.open(shelfSlotSize, data); err == nil {
+				data = plain
+			}
+		}
+		onMove(key(shelfId, oldSlot), key(shelfId, newSlot), data)
+	}
 }
 
-func wrapShelfDataFn(shelfId int, shelfSlotSize uint32, onData OnDataFn) onShelfDataFn {
+// recordMoveFn returns a callback recording the moves of a live compaction of
+// a shelf in the remap table, or nil if moves are not remapped. It is invoked
+// with the locks of the shelf held, before the old slot can be reused.
+func (db *database) recordMoveFn(shelfId int) func(oldSlot, newSlot uint64) {
+	if db.remap == nil {
+		return nil
+	}
+	return func(oldSlot, newSlot uint64) {
+		db.remap.move(Key(shelfId, oldSlot), Key(shelfId, newSlot))
+	}
+}
+
+// wrapShelfDataFn wraps the onData callback passed to Open for a shelf. If the
+// items can't be decrypted, they are not passed on, and the first error is
+// stored in errp.
+func (db *database) wrapShelfDataFn(shelfId int, shelfSlotSize uint32, onData OnDataFn, errp *error) onShelfDataFn {
 	if onData == nil {
 		return nil
 	}
 	return func(slot uint64, data []byte) {
-		key := slot | uint64(shelfId)<<28
+		key := Key(shelfId, slot)
+		if db.sealer != nil {
+			var err error
+			if data, err = db.sealer.open(shelfSlotSize, data); err != nil {
+				if *errp == nil {
+					*errp = fmt.Errorf("slot %d: %w", slot, err)
+				}
+				return
+			}
+		}
 		onData(key, shelfSlotSize, data)
 	}
 }
 
 // Iterate iterates through all the data in the database, and invokes the
 // given onData method for every element
-func (db *database) Iterate(onData OnDataFn) error {
+func (db *database) Iterate(onData OnDataFn, opts ...IterateOption) error {
+	if onData == nil {
+		return db.IterateErr(nil, opts...)
+	}
+	return db.IterateErr(func(key uint64, size uint32, data []byte) error {
+		onData(key, size, data)
+		return nil
+	}, opts...)
+}
+
+// IterateErr iterates through all the data in the database, and invokes the
+// given onData method for every element. If onData returns ErrStopIteration,
+// the iteration is stopped and nil is returned. Any other error aborts the
+// iteration and is returned to the caller. Items which can't be read abort the
+// iteration too, unless WithSkipCorrupt is passed.
+func (db *database) IterateErr(onData OnDataErrFn, opts ...IterateOption) error {
+	return db.iterate(1, onDataItem(onData), opts)
+}
+
+// IterateItems iterates through all the data in the database like IterateErr,
+// and invokes the given onItem method for every element, along with the shelf,
+// slot and stored size of the item.
+func (db *database) IterateItems(onItem OnItemFn, opts ...IterateOption) error {
+	return db.iterate(1, onItem, opts)
+}
+
+// onDataItem adapts an OnDataErrFn to the OnItemFn used internally.
+func onDataItem(onData OnDataErrFn) OnItemFn {
+	if onData == nil {
+		return nil
+	}
+	return func(item ItemInfo, data []byte) error {
+		return onData(item.Key, item.SlotSize, data)
+	}
+}
+
+// iterate implements IterateErr, IterateItems and IterateParallel, reading
+// every shelf with the given number of workers.
+func (db *database) iterate(workers int, onItem OnItemFn, opts []IterateOption) error {
+	cfg := newIterateConfig(opts)
+	if db.sealer != nil {
+		cfg = cfg.withOverhead(uint32(db.sealer.overhead()))
+	}
+	if cfg.slotSize != 0 && !db.hasSlotSize(cfg.slotSize) {
+		return fmt.Errorf("%w: no shelf with slot size %d", ErrBadIndex, cfg.slotSize)
+	}
+	for i, shelf := range db.shelves {
+		var (
+			onShelfData onShelfDataErrFn
+			shelfCfg    = cfg.forShelf(i)
+		)
+		if shelfCfg.skipShelf || (cfg.slotSize != 0 && cfg.slotSize != shelf.slotSize) {
+			continue
+		}
+		if onItem != nil {
+			var (
+				id   = i
+				size = shelf.slotSize
+			)
+			onShelfData = func(slot uint64, data []byte) error {
+				stored := uint32(len(data))
+				if db.sealer != nil {
+					var err error
+					if data, err = db.sealer.open(size, data); err != nil {
+						return shelfCfg.corrupt(slot, err)
+					}
+				}
+				return onItem(ItemInfo{db.key(id, slot), id, slot, size, stored}, data)
+			}
+		}
+		var err error
+		if workers > 1 {
+			err = shelf.iterateParallel(workers, onShelfData, shelfCfg)
+		} else {
+			err = shelf.IterateErr(onShelfData, shelfCfg)
+		}
+		if err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return db.repanic(fmt.Errorf("shelf %d: %w", i, err))
+		}
+	}
+	return nil
+}
+
+// hasSlotSize returns whether the database has a shelf with the given slot
+// size.
+func (db *database) hasSlotSize(slotSize uint32) bool {
+	for _, shelf := range db.shelves {
+		if shelf.slotSize == slotSize {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns an iterator over the keys and data of the items in the database,
+// in ascending key order. Its type matches iter.Seq2[uint64, []byte], so with
+// Go 1.23 or later it can be ranged over, and breaking out of the loop stops
+// the iteration:
+//
+//	for key, data := range db.All() { ... }
+//
+// The data is only valid until the next iteration. The iteration stops at the
+// first item which can't be read: use IterateErr to see the error.
+func (db *database) All(opts ...IterateOption) func(yield func(uint64, []byte) bool) {
+	return func(yield func(uint64, []byte) bool) {
+		_ = db.IterateErr(func(key uint64, size uint32, data []byte) error {
+			if !yield(key, data) {
+				return ErrStopIteration
+			}
+			return nil
+		}, opts...)
+	}
+}
+
+// Compact moves items into the gaps of their shelves and truncates the files,
+// while the database is live. The optional onMove method is invoked for every
+// item which changes key, once the item has moved: the old key is no longer
+// valid by then. The items are moved in batches, and onMove is invoked between
+// them, without locks held, so it may access the database.
+func (db *database) Compact(onMove OnMoveFn) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	done, err := db.startMaintenance()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if onMove == nil {
+		onMove = db.opts.OnMove
+	}
+	for i, shelf := range db.shelves {
+		if err := shelf.compactLive(db.wrapShelfMoveFn(i, shelf.slotSize, onMove, false), db.recordMoveFn(i)); err != nil {
+			return db.repanic(fmt.Errorf("shelf %d: %w", i, err))
+		}
+		if db.opts.CheckInvariants {
+			shelf.checkInvariants("compact")
+		}
+	}
+	return db.remap.failed()
+}
+
+// Checkpoint syncs the data to disk and persists the gap lists, so that a
+// subsequent Open without onData callback does not need to scan the shelves.
+func (db *database) Checkpoint() error {
+	done, err := db.startMaintenance()
+	if err != nil {
+		return err
+	}
+	defer done()
+	for i, shelf := range db.shelves {
+		if err := shelf.Checkpoint(); err != nil {
+			return fmt.Errorf("shelf %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Sync fsyncs the shelf files which have been written to since they were last
+// synced. All shelves are synced even if some fail, and the first error is
+// returned.
+func (db *database) Sync() error {
 	var err error
 	for i, shelf := range db.shelves {
-		if e := shelf.Iterate(wrapShelfDataFn(i, shelf.slotSize, onData)); e != nil {
+		if e := shelf.Sync(); e != nil && err == nil {
 			err = fmt.Errorf("shelf %d: %w", i, e)
 		}
 	}
+	if e := db.remap.sync(); e != nil && err == nil {
+		err = e
+	}
 	return err
 }
 
+// Flush syncs the writes made so far to disk, through the background syncer
+// if there is one, so that concurrent calls share the fsyncs.
+func (db *database) Flush() error {
+	if db.syncer != nil {
+		if ok, err := db.syncer.flush(); ok {
+			return err
+		}
+	}
+	return db.Sync()
+}
+
+// Verify cross-checks the bookkeeping of the shelves against their files, and
+// returns an error for the first shelf found inconsistent.
+func (db *database) Verify() error {
+	for i, shelf := range db.shelves {
+		if err := shelf.verifyInvariants(); err != nil {
+			return fmt.Errorf("shelf %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
 func (db *database) Limits() (uint32, uint32) {
 	smallest := db.shelves[0].slotSize
 	largest := db.shelves[len(db.shelves)-1].slotSize
 	return smallest, largest
 }
 
+func (db *database) SlotSizeFor(size int) (uint32, error) {
+	index := db.shelfFor(size)
+	if index == len(db.shelves) {
+		return 0, &OversizedError{
+			Size:     size,
+			SlotSize: db.shelves[len(db.shelves)-1].slotSize,
+		}
+	}
+	return db.shelves[index].slotSize, nil
+}
+
 // Close implements io.Closer
 func (db *database) Close() error {
+	db.syncer.stop()
 	var err error
 	for _, shelf := range db.shelves {
 		if e := shelf.Close(); e != nil {
 			err = e
 		}
 	}
+	if e := db.remap.close(); e != nil {
+		err = e
+	}
+	if db.lock != nil {
+		if e := db.lock.release(); e != nil {
+			err = e
+		}
+	}
 	return err
 }
@@ -5,12 +5,23 @@
 package billy
 
 import (
+	"archive/tar"
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestGrowFile(t *testing.T) {
@@ -66,7 +77,7 @@ func fill(data byte, size int) []byte {
 }
 
 func TestDBBasics(t *testing.T) {
-	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,7 +123,7 @@ func TestDBBasics(t *testing.T) {
 func TestDbErrors(t *testing.T) {
 	// Create a db
 	p := t.TempDir()
-	db, err := Open(Options{Path: p}, SlotSizePowerOfTwo(128, 500), nil)
+	db, err := Open(p, SlotSizePowerOfTwo(128, 500), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,14 +135,14 @@ func TestDbErrors(t *testing.T) {
 		t.Fatalf("want %v,  have %v", ErrClosed, err)
 	}
 	// Open readonly
-	if db, err = Open(Options{Path: p, Readonly: true}, SlotSizePowerOfTwo(128, 500), nil); err != nil {
+	if db, err = Open(p, SlotSizePowerOfTwo(128, 500), nil, WithReadonly()); err != nil {
 		t.Fatal(err)
 	}
 	if _, err := db.Put([]byte{}); !errors.Is(err, ErrReadonly) {
 		t.Fatalf("want %v,  have %v", ErrReadonly, err)
 	}
 	// Open regular again
-	db, err = Open(Options{Path: p}, SlotSizePowerOfTwo(128, 500), nil)
+	db, err = Open(p, SlotSizePowerOfTwo(128, 500), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -163,7 +174,7 @@ func TestCustomSlotSizesFailures(t *testing.T) {
 			return c, c > 5
 		},
 	} {
-		_, err := Open(Options{Path: t.TempDir()}, tt, nil)
+		_, err := Open(t.TempDir(), tt, nil)
 		if err == nil {
 			t.Errorf("test %d: expected error but got none", i)
 		}
@@ -173,7 +184,7 @@ func TestCustomSlotSizesFailures(t *testing.T) {
 
 func TestCustomSlotSizesOk(t *testing.T) {
 	a := 0
-	db, err := Open(Options{Path: t.TempDir()}, func() (uint32, bool) {
+	db, err := Open(t.TempDir(), func() (uint32, bool) {
 		ret := 10 * (1 + a)
 		a++
 		return uint32(ret), ret >= 30
@@ -230,7 +241,7 @@ func TestSlotSizePowerOfTwo(t *testing.T) {
 
 func TestSizes(t *testing.T) {
 	a := 0
-	db, err := Open(Options{Path: t.TempDir()}, func() (uint32, bool) {
+	db, err := Open(t.TempDir(), func() (uint32, bool) {
 		// Return 10, 20, 30
 		ret := 10 * (1 + a)
 		a++
@@ -298,3 +309,3228 @@ func TestSizes(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestShareGaps(t *testing.T) {
+	p := t.TempDir()
+	writer, err := Open(p, SlotSizePowerOfTwo(128, 500), nil, WithShareGaps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	k0, _ := writer.Put(fill(0, 140))
+	k1, _ := writer.Put(fill(1, 140))
+	k2, _ := writer.Put(fill(2, 140))
+	if err := writer.Delete(k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := Open(p, SlotSizePowerOfTwo(128, 500), nil, WithReadonly(), WithShareGaps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	iterate := func() map[uint64]byte {
+		t.Helper()
+		items := make(map[uint64]byte)
+		if err := reader.Iterate(func(key uint64, size uint32, data []byte) {
+			items[key] = data[0]
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	if have := iterate(); len(have) != 2 || have[k0] != 0 || have[k2] != 2 {
+		t.Fatalf("wrong items: %v", have)
+	}
+	// Writes by the writer should become visible to the reader, right away
+	// on Sync
+	k3, _ := writer.Put(fill(3, 140))
+	k4, _ := writer.Put(fill(4, 140))
+	if err := writer.Delete(k0); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if have := iterate(); len(have) != 3 || have[k2] != 2 || have[k3] != 3 || have[k4] != 4 {
+		t.Fatalf("wrong items: %v", have)
+	}
+	// Otherwise once the publication interval has passed
+	if err := writer.Delete(k2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * gapPublishInterval)
+	if have := iterate(); len(have) != 2 || have[k3] != 3 || have[k4] != 4 {
+		t.Fatalf("wrong items: %v", have)
+	}
+}
+
+func TestDBCompact(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	k0, _ := db.Put(fill(0, 140))
+	k1, _ := db.Put(fill(1, 140))
+	k2, _ := db.Put(fill(2, 140))
+	if err := db.Delete(k0); err != nil {
+		t.Fatal(err)
+	}
+	moved := make(map[uint64]uint64)
+	if err := db.Compact(func(oldKey, newKey uint64, data []byte) {
+		moved[oldKey] = newKey
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[k2] != k0 {
+		t.Fatalf("wrong moves: %v", moved)
+	}
+	if have, err := db.Get(k0); err != nil || !bytes.Equal(have, fill(2, 140)) {
+		t.Fatalf("wrong data: %x %v", have, err)
+	}
+	if have, err := db.Get(k1); err != nil || !bytes.Equal(have, fill(1, 140)) {
+		t.Fatalf("wrong data: %x %v", have, err)
+	}
+}
+
+func TestDBCompactReentrant(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 200; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	for i := 0; i < 100; i++ {
+		_ = db.Delete(keys[i])
+	}
+	// Writers queue up for the locks while the callbacks read and delete
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				key, _ := db.Put(fill(0xff, 50))
+				_ = db.Delete(key)
+			}
+		}
+	}()
+	var moves int
+	err = db.Compact(func(oldKey, newKey uint64, data []byte) {
+		moves++
+		if live, _ := db.Has(newKey); !live {
+			t.Errorf("moved item %#x not live", newKey)
+		}
+		if have, err := db.Get(newKey); err != nil || !bytes.Equal(have, data) {
+			t.Errorf("moved item %#x: have %x, %v", newKey, have, err)
+		}
+		if moves%10 == 0 {
+			if err := db.Delete(newKey); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moves == 0 {
+		t.Fatal("no items moved")
+	}
+}
+
+func TestIterateErr(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		_, _ = db.Put(fill(byte(i), 140))
+		_, _ = db.Put(fill(byte(i), 280))
+	}
+	// Nil callback should not panic
+	if err := db.Iterate(nil); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.IterateErr(func(key uint64, size uint32, data []byte) error {
+		if count++; count == 3 {
+			return ErrStopIteration
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("have %d iterations, want %d", count, 3)
+	}
+	fail := errors.New("fail")
+	count = 0
+	if err := db.IterateErr(func(key uint64, size uint32, data []byte) error {
+		if count++; count == 15 {
+			return fail
+		}
+		return nil
+	}); !errors.Is(err, fail) {
+		t.Fatalf("want %v, have %v", fail, err)
+	}
+	if count != 15 {
+		t.Fatalf("have %d iterations, want %d", count, 15)
+	}
+}
+
+func TestOversizedPut(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Put(fill(0, 600))
+	if !errors.Is(err, ErrOversized) {
+		t.Fatalf("want %v, have %v", ErrOversized, err)
+	}
+	var oversized *OversizedError
+	if !errors.As(err, &oversized) {
+		t.Fatalf("want OversizedError, have %T", err)
+	}
+	if oversized.Size != 600 || oversized.SlotSize != 512 {
+		t.Fatalf("wrong error fields: %+v", oversized)
+	}
+	_, _ = db.Put(fill(0, 509))
+	if have, want := db.Infos().OversizedPuts, uint64(2); have != want {
+		t.Fatalf("have %d oversized puts, want %d", have, want)
+	}
+}
+
+func TestIterateSizeRange(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for size := 100; size < 500; size += 50 {
+		_, _ = db.Put(fill(1, size))
+	}
+	for i, tc := range []struct {
+		min, max uint32
+		want     []int
+	}{
+		{0, 1000, []int{100, 150, 200, 250, 300, 350, 400, 450}},
+		{150, 300, []int{150, 200, 250, 300}},
+		{0, 149, []int{100}},
+		{451, 1000, nil},
+	} {
+		var have []int
+		if err := db.Iterate(func(key uint64, size uint32, data []byte) {
+			have = append(have, len(data))
+		}, WithSizeRange(tc.min, tc.max)); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tc.want) {
+			t.Errorf("test %d: have %v want %v", i, have, tc.want)
+		}
+	}
+}
+
+func TestIterateSlotSize(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for size := 100; size < 500; size += 50 {
+		_, _ = db.Put(fill(1, size))
+	}
+	for i, tc := range []struct {
+		slotSize uint32
+		want     []int
+	}{
+		{128, []int{100}},
+		{256, []int{150, 200, 250}},
+		{512, []int{300, 350, 400, 450}},
+	} {
+		var have []int
+		if err := db.Iterate(func(key uint64, size uint32, data []byte) {
+			have = append(have, len(data))
+		}, WithSlotSize(tc.slotSize)); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tc.want) {
+			t.Errorf("test %d: have %v want %v", i, have, tc.want)
+		}
+	}
+	if err := db.Iterate(nil, WithSlotSize(100)); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("have %v want %v", err, ErrBadIndex)
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, _ := db.Put(fill(1, 10))
+	b, _ := db.Put(fill(2, 150))
+
+	var buf bytes.Buffer
+	if err := db.DumpJSON(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	for _, key := range []uint64{a, b} {
+		var item dumpItem
+		if err := dec.Decode(&item); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := db.Get(key)
+		hash := sha256.Sum256(data)
+		shelf, slot := SplitKey(key)
+		want := dumpItem{fmt.Sprintf("%#x", key), shelf, db.Size(key), slot, len(data), fmt.Sprintf("%x", hash), data}
+		if !reflect.DeepEqual(item, want) {
+			t.Fatalf("have %+v want %+v", item, want)
+		}
+	}
+	if dec.More() {
+		t.Fatal("unexpected items")
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	db, err := Open("", SlotSizeLinear(10, 2), nil, WithoutCompaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = db.Put(fill(byte(i), 4))
+	}
+	_ = db.Delete(1)
+	_, _ = db.Put(fill(0, 50))
+
+	var buf bytes.Buffer
+	if err := db.DebugState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var state debugState
+	if err := json.Unmarshal(buf.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Options.NoCompaction || state.OversizedPuts != 1 {
+		t.Fatalf("wrong state: %v", buf.String())
+	}
+	if have, want := fmt.Sprint(state.Shelves[0].Tail, state.Shelves[0].Gaps), "3 [1]"; have != want {
+		t.Fatalf("have %v want %v", have, want)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	var (
+		p     = t.TempDir()
+		key   = bytes.Repeat([]byte{1}, 32)
+		data  = []byte("secret message which must not be stored in the clear, not even on disks")
+		sizes = SlotSizeLinear(100, 2)
+	)
+	db, err := Open(p, sizes, nil, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := db.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The plaintext fits into shelf 0, but with the sealing overhead it doesn't
+	if have, want := k>>28, uint64(1); have != want {
+		t.Fatalf("have shelf %d want %d", have, want)
+	}
+	if have, err := db.Get(k); err != nil || !bytes.Equal(have, data) {
+		t.Fatalf("have %q want %q (err %v)", have, data, err)
+	}
+	if have, err := db.GetSample(k, 7, 7); err != nil || string(have) != "message" {
+		t.Fatalf("have %q want %q (err %v)", have, "message", err)
+	}
+	if _, err := db.GetSample(k, 70, 10); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+	var seen []byte
+	if err := db.Iterate(func(key uint64, size uint32, d []byte) { seen = d },
+		WithSizeRange(uint32(len(data)), uint32(len(data)))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seen, data) {
+		t.Fatalf("have %q want %q", seen, data)
+	}
+	db.Close()
+
+	raw, err := os.ReadFile(filepath.Join(p, "bkt_00000200.bag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("plaintext found on disk")
+	}
+	// Reopening with the wrong key fails when reading the items
+	_, err = Open(p, SlotSizeLinear(100, 2), func(uint64, uint32, []byte) {},
+		WithEncryptionKey(bytes.Repeat([]byte{2}, 32)))
+	if !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("want %v, have %v", ErrCorruptData, err)
+	}
+	if _, err := Open(p, SlotSizeLinear(100, 2), nil, WithEncryptionKey([]byte{1})); err == nil {
+		t.Fatal("expected error for invalid key")
+	}
+}
+
+func TestOpenMemory(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(10, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 1; i < 25; i++ {
+		key, err := db.Put(fill(byte(i), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i, key := range keys {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, fill(byte(i+1), i+1)) {
+			t.Fatalf("key %x: have %x (err %v)", key, have, err)
+		}
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, shelf := range db.Infos().Shelves {
+		if shelf.FilledSlots != 0 {
+			t.Fatalf("shelf %d: have %d items, want 0", shelf.SlotSize, shelf.FilledSlots)
+		}
+	}
+}
+
+func TestInvariantChecks(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(10, 3), nil, WithInvariantChecks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 1000; i++ {
+		if len(keys) > 0 && i%3 == 0 {
+			j := (i * 7) % len(keys)
+			if err := db.Delete(keys[j]); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys[:j], keys[j+1:]...)
+			continue
+		}
+		key, err := db.Put(fill(byte(i), 1+i%25))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if i%100 == 0 {
+			if err := db.Compact(nil); err != nil {
+				t.Fatal(err)
+			}
+			keys = keys[:0]
+			_ = db.Iterate(func(key uint64, size uint32, data []byte) {
+				keys = append(keys, key)
+			})
+		}
+	}
+	// Corrupt the bookkeeping, and expect the next mutation to notice
+	shelf := db.(*database).shelves[0]
+	shelf.gapsMu.Lock()
+	shelf.gaps.add(shelf.count + 5)
+	shelf.gapsMu.Unlock()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected invariant violation")
+		}
+		shelf.gapsMu.Lock()
+		shelf.gaps.reset()
+		shelf.gapsMu.Unlock()
+	}()
+	_, _ = db.Put(fill(0, 3))
+}
+
+func TestCallbackPanic(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(10, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _ = db.Put(fill(byte(i), 5))
+	}
+	_ = db.Delete(2)
+	_ = db.Delete(4)
+	db.Close()
+
+	panicky := func(uint64, uint32, []byte) { panic("boom") }
+	// Recovered panics are returned as errors
+	if _, err := Open(p, SlotSizeLinear(10, 1), panicky, WithRecoverPanics()); !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("want %v, have %v", ErrCallbackPanic, err)
+	}
+	// Other panics are resumed, after closing the files
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("want panic, have %v", r)
+			}
+		}()
+		_, _ = Open(p, SlotSizeLinear(10, 1), panicky)
+	}()
+	db, err = Open(p, SlotSizeLinear(10, 1), nil, WithRecoverPanics(), WithoutCompaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var items int
+	_ = db.Iterate(func(uint64, uint32, []byte) { items++ })
+	if items != 8 {
+		t.Fatalf("have %d items, want 8", items)
+	}
+	if err := db.Iterate(panicky); !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("want %v, have %v", ErrCallbackPanic, err)
+	}
+	// An aborted compaction leaves the shelf consistent
+	if err := db.Compact(func(uint64, uint64, []byte) { panic("boom") }); !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("want %v, have %v", ErrCallbackPanic, err)
+	}
+	if err := db.(*database).shelves[0].verifyInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemainingSlots(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = db.Put(fill(byte(i), 4))
+	}
+	_ = db.Delete(1)
+	if have, want := db.Infos().Shelves[0].RemainingSlots, maxSlots-2; have != want {
+		t.Fatalf("have %d want %d", have, want)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(20, 2), nil, WithInvariantChecks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		keep     = make(map[uint64][]byte)
+		expiring = make(map[uint64]bool)
+	)
+	for i := 0; i < 10; i++ {
+		data := fill(byte(i), 10)
+		if i%2 == 0 {
+			key, err := db.Put(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keep[key] = data
+			continue
+		}
+		key, err := db.PutWithTTL(data, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The expiry header doesn't fit into the first shelf
+		if key>>28 != 1 {
+			t.Fatalf("key %x: expected second shelf", key)
+		}
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("have %x want %x (err %v)", have, data, err)
+		}
+		if have, err := db.GetSample(key, 2, 3); err != nil || !bytes.Equal(have, data[2:5]) {
+			t.Fatalf("have %x want %x (err %v)", have, data[2:5], err)
+		}
+		expiring[key] = true
+	}
+	// Nothing expired yet
+	if err := db.Expire(time.Now(), func(key uint64) { t.Fatalf("unexpected expiry of %x", key) }); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Reopen, reading all items
+	var items int
+	db, err = Open(p, SlotSizeLinear(20, 2), func(key uint64, size uint32, data []byte) {
+		if len(data) != 10 {
+			t.Fatalf("key %x: have size %d want 10", key, len(data))
+		}
+		items++
+	}, WithInvariantChecks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if items != 10 {
+		t.Fatalf("have %d items want 10", items)
+	}
+	if err := db.Expire(time.Now().Add(2*time.Hour), func(key uint64) {
+		if !expiring[key] {
+			t.Fatalf("unexpected expiry of %x", key)
+		}
+		delete(expiring, key)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 0 {
+		t.Fatalf("not expired: %v", expiring)
+	}
+	for key, data := range keep {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("have %x want %x (err %v)", have, data, err)
+		}
+	}
+	if have := db.Infos().Shelves[1].FilledSlots; have != 0 {
+		t.Fatalf("have %d items in shelf 1, want 0", have)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(make([]byte, 16))}} {
+		db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := fill(7, 50)
+		key, _ := db.Put(data)
+		buf := make([]byte, db.Size(key))
+		if n, err := db.GetInto(key, buf); err != nil || !bytes.Equal(buf[:n], data) {
+			t.Fatalf("have %x want %x (err %v)", buf[:n], data, err)
+		}
+		if allocs := testing.AllocsPerRun(10, func() { _, _ = db.GetInto(key, buf) }); allocs > 0 && len(opts) == 0 && !lockOrderChecks {
+			t.Errorf("have %v allocs, want 0", allocs)
+		}
+		// Too small a buffer reports the needed size
+		n, err := db.GetInto(key, make([]byte, 10))
+		if !errors.Is(err, io.ErrShortBuffer) || n < len(data) {
+			t.Fatalf("have %d, %v", n, err)
+		}
+		buf = make([]byte, n)
+		if n, err := db.GetInto(key, buf); err != nil || !bytes.Equal(buf[:n], data) {
+			t.Fatalf("have %x want %x (err %v)", buf[:n], data, err)
+		}
+		db.Close()
+	}
+}
+
+func TestPutAt(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(10, 2), nil, WithInvariantChecks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restore items out of order, leaving gaps
+	items := map[uint64][]byte{
+		5:         fill(1, 5),
+		2:         fill(2, 5),
+		1<<28 | 3: fill(3, 15),
+	}
+	for key, data := range items {
+		if err := db.PutAt(key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutAt(2, fill(4, 5)); !errors.Is(err, ErrSlotInUse) {
+		t.Fatalf("want %v, have %v", ErrSlotInUse, err)
+	}
+	if err := db.PutAt(4, fill(4, 15)); !errors.Is(err, ErrOversized) {
+		t.Fatalf("want %v, have %v", ErrOversized, err)
+	}
+	if err := db.PutAt(2<<28, fill(4, 5)); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+	// New items fill the gaps
+	if key, _ := db.Put(fill(4, 5)); key != 0 {
+		t.Fatalf("have key %d want 0", key)
+	}
+	db.Close()
+
+	items[0] = fill(4, 5)
+	db, err = Open(p, SlotSizeLinear(10, 2), func(key uint64, size uint32, data []byte) {
+		if !bytes.Equal(items[key], data) {
+			t.Fatalf("key %x: have %x want %x", key, data, items[key])
+		}
+		delete(items, key)
+	}, WithoutCompaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(items) != 0 {
+		t.Fatalf("missing items: %v", items)
+	}
+	if have, want := db.Infos().Shelves[0].GappedSlots, uint64(3); have != want {
+		t.Fatalf("have %d gaps want %d", have, want)
+	}
+}
+
+func TestUpdateRange(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(make([]byte, 16))}} {
+		db, err := OpenMemory(SlotSizeLinear(100, 2), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			data   = []byte("hello world, this is billy")
+			key, _ = db.Put(data)
+			ttl, _ = db.PutWithTTL(data, time.Hour)
+		)
+		for _, k := range []uint64{key, ttl} {
+			if err := db.UpdateRange(k, 6, []byte("there")); err != nil {
+				t.Fatal(err)
+			}
+			if have, _ := db.Get(k); string(have) != "hello there, this is billy" {
+				t.Fatalf("have %q", have)
+			}
+			if err := db.UpdateRange(k, 22, []byte("billy!")); !errors.Is(err, ErrBadIndex) {
+				t.Fatalf("want %v, have %v", ErrBadIndex, err)
+			}
+		}
+		// The expiry time is retained
+		var expired []uint64
+		_ = db.Expire(time.Now().Add(2*time.Hour), func(k uint64) { expired = append(expired, k) })
+		if len(expired) != 1 || expired[0] != ttl {
+			t.Fatalf("have expired %v, want [%d]", expired, ttl)
+		}
+		db.Close()
+	}
+}
+
+func TestHas(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := db.Put(fill(1, 10))
+	b, _ := db.Put(fill(2, 10))
+	if err := db.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		key  uint64
+		want bool
+	}{
+		{a, false},       // deleted
+		{b, true},        // live
+		{b + 1, false},   // beyond the tail
+		{1 << 28, false}, // empty shelf
+		{5 << 28, false}, // no such shelf
+		{1 << 40, false}, // reserved bits set
+	} {
+		have, err := db.Has(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tt.want {
+			t.Errorf("test %d: have %v want %v", i, have, tt.want)
+		}
+	}
+	db.Close()
+	if _, err := db.Has(b); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want %v, have %v", ErrClosed, err)
+	}
+}
+
+func TestCoalescedReads(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2), WithCoalescedReads())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, _ := db.Put(fill(1, 50))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				data, err := db.Get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(data) != 50 {
+					t.Errorf("have %d bytes, want 50", len(data))
+					return
+				}
+				data[0] = byte(i) // the data must not be shared
+			}
+		}(i)
+	}
+	wg.Wait()
+	// A Get after an update sees the update
+	if err := db.UpdateRange(key, 0, []byte{9}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := db.Get(key); data[0] != 9 {
+		t.Fatalf("have %d, want 9", data[0])
+	}
+}
+
+func TestGetDeleted(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, _ := db.Put(fill(1, 10))
+	b, _ := db.Put(fill(2, 10))
+	if err := db.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(a); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("want %v, have %v", ErrDeleted, err)
+	}
+	if _, err := db.GetSample(a, 0, 1); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("want %v, have %v", ErrDeleted, err)
+	}
+	if _, err := db.GetInto(a, make([]byte, 100)); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("want %v, have %v", ErrDeleted, err)
+	}
+	if _, err := db.Get(b); err != nil {
+		t.Fatal(err)
+	}
+	// Once the slot is reused, it can be read again
+	c, _ := db.Put(fill(3, 10))
+	if c != a {
+		t.Fatalf("have key %d, want reused key %d", c, a)
+	}
+	if data, err := db.Get(c); err != nil || !bytes.Equal(data, fill(3, 10)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+}
+
+func TestInfosSizes(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 4; i++ {
+		key, _ := db.Put(fill(byte(i), 10))
+		keys = append(keys, key)
+	}
+	_, _ = db.Put(fill(9, 150))
+	_ = db.Delete(keys[1])
+	_ = db.Delete(keys[2])
+
+	infos := db.Infos()
+	for i, want := range []struct{ file, wasted uint64 }{
+		{uint64(ShelfHeaderSize) + 4*100, 2 * 100},
+		{uint64(ShelfHeaderSize) + 200, 0},
+	} {
+		shelf := infos.Shelves[i]
+		if shelf.FileSize != want.file || shelf.WastedBytes != want.wasted {
+			t.Errorf("shelf %d: have size %d wasted %d, want %d %d", i, shelf.FileSize, shelf.WastedBytes, want.file, want.wasted)
+		}
+	}
+	if have, want := infos.FileSize, uint64(2*ShelfHeaderSize)+600; have != want {
+		t.Errorf("have total size %d, want %d", have, want)
+	}
+	if have, want := infos.WastedBytes, uint64(200); have != want {
+		t.Errorf("have total waste %d, want %d", have, want)
+	}
+}
+
+func TestShelfTimes(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := db.Infos().Shelves
+	for _, shelf := range before {
+		if shelf.Created.IsZero() || !shelf.Modified.Equal(shelf.Created) {
+			t.Fatalf("new shelf: have created %v modified %v", shelf.Created, shelf.Modified)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := db.Put(fill(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+
+	db, err = Open(p, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	after := db.Infos().Shelves
+	for i, shelf := range after {
+		if !shelf.Created.Equal(before[i].Created) {
+			t.Errorf("shelf %d: have created %v want %v", i, shelf.Created, before[i].Created)
+		}
+	}
+	if !after[0].Modified.After(before[0].Modified) {
+		t.Errorf("written shelf: have modified %v, want after %v", after[0].Modified, before[0].Modified)
+	}
+	if !after[1].Modified.Equal(before[1].Modified) {
+		t.Errorf("untouched shelf: have modified %v want %v", after[1].Modified, before[1].Modified)
+	}
+}
+
+func TestSnapshotTo(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 30; i++ {
+		key, err := db.Put(fill(byte(i), 10+i*8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < len(keys); i += 3 {
+		_ = db.Delete(keys[i])
+	}
+	// Keep writing while the snapshot is taken
+	var (
+		stop = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				key, _ := db.Put(fill(0xff, 50))
+				_ = db.Delete(key)
+			}
+		}
+	}()
+	dir := t.TempDir()
+	err = db.SnapshotTo(dir)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SnapshotTo(dir); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("have %v want %v", err, os.ErrExist)
+	}
+	snap, err := Open(dir, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	for i, key := range keys {
+		has, _ := snap.Has(key)
+		if deleted := i%3 == 0; deleted {
+			if has {
+				t.Errorf("item %d: deleted item in snapshot", i)
+			}
+			continue
+		}
+		data, err := snap.Get(key)
+		if err != nil {
+			t.Fatalf("item %d: %v", i, err)
+		}
+		if !bytes.Equal(data, fill(byte(i), 10+i*8)) {
+			t.Errorf("item %d: have %x", i, data)
+		}
+	}
+}
+
+func TestIterateSkipCorrupt(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		key, _ := db.Put(fill(byte(i), 150))
+		keys = append(keys, key)
+	}
+	// Corrupt the header of the middle item
+	f, err := os.OpenFile(filepath.Join(p, "bkt_00000200.bag"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0, 0, 0}, int64(ShelfHeaderSize)+200); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := db.Iterate(func(uint64, uint32, []byte) {}); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("want %v, have %v", ErrCorruptData, err)
+	}
+	var (
+		seen    []uint64
+		corrupt []uint64
+	)
+	err = db.Iterate(func(key uint64, size uint32, data []byte) {
+		seen = append(seen, key)
+	}, WithSkipCorrupt(func(key uint64, err error) {
+		if !errors.Is(err, ErrCorruptData) {
+			t.Errorf("want %v, have %v", ErrCorruptData, err)
+		}
+		corrupt = append(corrupt, key)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != keys[0] || seen[1] != keys[2] {
+		t.Fatalf("have keys %v, want %v", seen, []uint64{keys[0], keys[2]})
+	}
+	if len(corrupt) != 1 || corrupt[0] != keys[1] {
+		t.Fatalf("have corrupt keys %v, want [%d]", corrupt, keys[1])
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var (
+		p     = t.TempDir()
+		fname = filepath.Join(p, "bkt_00000100.bag")
+	)
+	db, err := Open(p, SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = db.Put(fill(byte(i), 50))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func() {
+		f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0xff, 0, 0, 0}, int64(ShelfHeaderSize)+200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt()
+	if err := db.Verify(); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("want %v, have %v", ErrCorruptData, err)
+	}
+	db.Close() // writes a clean gap index
+
+	// The gap index can't be trusted with a corrupt last slot: the shelf
+	// is scanned, and the corruption found.
+	corrupt()
+	if _, err := Open(p, SlotSizeLinear(100, 1), nil); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("want %v, have %v", ErrCorruptData, err)
+	}
+	db, err = Open(p, SlotSizeLinear(100, 1), nil, WithRepair())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if have := db.Infos().Shelves[0].FilledSlots; have != 2 {
+		t.Fatalf("have %d items, want 2", have)
+	}
+}
+
+func TestOpenWorkers(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64]bool)
+	for i := 1; i < 8*100-itemHeaderSize; i += 37 {
+		key, err := db.Put(fill(byte(i), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = true
+	}
+	db.Close()
+
+	var (
+		mu   sync.Mutex
+		have = make(map[uint64]bool)
+	)
+	db, err = Open(p, SlotSizeLinear(100, 8), func(key uint64, size uint32, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		have[key] = true
+	}, WithOpenWorkers(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %d items, want %d", len(have), len(want))
+	}
+	for key := range want {
+		if !have[key] {
+			t.Fatalf("missing key %#x", key)
+		}
+	}
+	db.Close()
+
+	// A failing shelf fails the open, and leaves no shelf locked
+	if err := os.WriteFile(filepath.Join(p, "bkt_00000500.bag"), []byte("bolly"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(p, SlotSizeLinear(100, 8), nil, WithOpenWorkers(3)); !errors.Is(err, ErrBadHeader) {
+		t.Fatalf("want %v, have %v", ErrBadHeader, err)
+	}
+	os.Remove(filepath.Join(p, "bkt_00000500.bag"))
+	db, err = Open(p, SlotSizeLinear(100, 8), nil, WithOpenWorkers(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestPauseBackground(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, _ := db.Put(fill(1, 10))
+	_, _ = db.Put(fill(2, 10))
+	_ = db.Delete(a)
+
+	// Pausing waits for the compaction in flight
+	var (
+		moving  = make(chan struct{})
+		release = make(chan struct{})
+		paused  = make(chan struct{})
+	)
+	go func() {
+		_ = db.Compact(func(oldKey, newKey uint64, data []byte) {
+			close(moving)
+			<-release
+		})
+	}()
+	<-moving
+	go func() {
+		db.PauseBackground()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatal("pause did not wait for compaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-paused
+
+	if err := db.Compact(nil); !errors.Is(err, ErrPaused) {
+		t.Fatalf("want %v, have %v", ErrPaused, err)
+	}
+	if err := db.Expire(time.Now(), nil); !errors.Is(err, ErrPaused) {
+		t.Fatalf("want %v, have %v", ErrPaused, err)
+	}
+	if err := db.Checkpoint(); !errors.Is(err, ErrPaused) {
+		t.Fatalf("want %v, have %v", ErrPaused, err)
+	}
+	// Regular operations carry on
+	if _, err := db.Put(fill(3, 10)); err != nil {
+		t.Fatal(err)
+	}
+	db.ResumeBackground()
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShelfOnData(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, _ := db.Put(fill(1, 50))
+	large, _ := db.Put(fill(3, 250))
+	middle, _ := db.Put(fill(2, 150))
+	db.Close()
+
+	var generic, special []uint64
+	db, err = Open(p, SlotSizeLinear(100, 3), func(key uint64, size uint32, data []byte) {
+		generic = append(generic, key)
+	}, WithShelfOnData(300, func(key uint64, size uint32, data []byte) {
+		if size != 300 {
+			t.Errorf("have slot size %d, want 300", size)
+		}
+		special = append(special, key)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(generic) != 2 || generic[0] != small || generic[1] != middle {
+		t.Fatalf("have generic keys %v, want %v", generic, []uint64{small, middle})
+	}
+	if len(special) != 1 || special[0] != large {
+		t.Fatalf("have special keys %v, want [%d]", special, large)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = db.Put(fill(byte(i), 250))
+	}
+	_ = db.Iterate(func(key uint64, size uint32, data []byte) {
+		shelf, slot := SplitKey(key)
+		if shelf != 2 || size != 300 || slot != uint64(data[0]) {
+			t.Errorf("key %#x: have shelf %d slot %d, want shelf 2 slot %d", key, shelf, slot, data[0])
+		}
+		if have := Key(shelf, slot); have != key {
+			t.Errorf("have key %#x want %#x", have, key)
+		}
+	})
+	if have, want := Key(0xfff, maxSlots-1), uint64(1)<<40-1; have != want {
+		t.Fatalf("have %#x want %#x", have, want)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want Code
+	}{
+		{nil, CodeOK},
+		{io.EOF, CodeUnknown},
+		{ErrClosed, CodeClosed},
+		{fmt.Errorf("shelf 3: %w", ErrOversized), CodeOversized},
+		{fmt.Errorf("%w: missing magic", ErrBadHeader), CodeBadHeader},
+		{&VersionError{File: "bkt", Version: 9}, CodeVersion},
+		{fmt.Errorf("open: %w", ErrLocked), CodeLocked},
+	} {
+		if have := ErrorCode(tt.err); have != tt.want {
+			t.Errorf("%v: have %v want %v", tt.err, have, tt.want)
+		}
+	}
+	// The codes are unique per error, and named
+	seen := make(map[Code]error)
+	for _, e := range errorCodes {
+		if prev, ok := seen[e.code]; ok && e.code != CodeTimeout {
+			t.Errorf("code %d used by %v and %v", e.code, prev, e.err)
+		}
+		seen[e.code] = e.err
+		if have := ErrorCode(e.err); have != e.code {
+			t.Errorf("%v: have %v want %v", e.err, have, e.code)
+		}
+		if e.code.String() != e.name {
+			t.Errorf("code %d: have name %q want %q", e.code, e.code.String(), e.name)
+		}
+	}
+}
+
+func TestBackupIncremental(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items := make(map[uint64][]byte)
+	put := func(data []byte) {
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items[key] = data
+	}
+	for i := 0; i < 20; i++ {
+		put(fill(byte(i), 10+i*10))
+	}
+	if _, err := db.BackupIncremental(1, t.TempDir()); !errors.Is(err, ErrBackupBase) {
+		t.Fatalf("have %v want %v", err, ErrBackupBase)
+	}
+	full := t.TempDir()
+	id, err := db.BackupIncremental(0, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change some items, and grow and shrink the shelves
+	for key := range items {
+		if key%2 == 0 {
+			_ = db.Delete(key)
+			delete(items, key)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		put(fill(byte(100+i), 50))
+	}
+	for key, data := range items {
+		if err := db.UpdateRange(key, 0, []byte{0xee}); err != nil {
+			t.Fatal(err)
+		}
+		data[0] = 0xee
+		break
+	}
+	inc := t.TempDir()
+	next, err := db.BackupIncremental(id, inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= id {
+		t.Fatalf("have id %d after %d", next, id)
+	}
+	if err := ApplyIncremental(full, inc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyIncremental(full, inc); !errors.Is(err, ErrBackupBase) {
+		t.Fatalf("reapplied: have %v want %v", err, ErrBackupBase)
+	}
+	restored, err := Open(full, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	count := 0
+	_ = restored.Iterate(func(key uint64, size uint32, data []byte) {
+		if want, ok := items[key]; !ok || !bytes.Equal(data, want) {
+			t.Errorf("key %x: have %x want %x", key, data, want)
+		}
+		count++
+	})
+	if count != len(items) {
+		t.Fatalf("have %d items want %d", count, len(items))
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(bytes.Repeat([]byte{1}, 32))}} {
+		db, err := Open(t.TempDir(), SlotSizeLinear(100*1024, 3), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Spanning several chunks, into the second shelf
+		data := make([]byte, 150*1024)
+		_, _ = rand.Read(data)
+		key, err := db.PutReader(bytes.NewReader(data), len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("have %d bytes, err %v", len(have), err)
+		}
+		// A short reader stores nothing
+		if _, err := db.PutReader(bytes.NewReader(data[:1000]), len(data)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("have %v want %v", err, io.ErrUnexpectedEOF)
+		}
+		if have, want := db.Infos().Shelves[1].FilledSlots, uint64(1); have != want {
+			t.Fatalf("have %d items want %d", have, want)
+		}
+		if _, err := db.PutReader(bytes.NewReader(data), 300*1024); !errors.Is(err, ErrOversized) {
+			t.Fatalf("have %v want %v", err, ErrOversized)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestStandby(t *testing.T) {
+	primary, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	standby, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithStandby())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	if _, err := standby.Put(fill(1, 10)); !errors.Is(err, ErrStandby) {
+		t.Fatalf("have %v want %v", err, ErrStandby)
+	}
+	// Ship the changes of the primary, twice to check replaying
+	type change struct {
+		key  uint64
+		data []byte
+	}
+	var feed []change
+	for i := 0; i < 4; i++ {
+		key, _ := primary.Put(fill(byte(i), 10+i*40))
+		feed = append(feed, change{key, fill(byte(i), 10+i*40)})
+	}
+	_ = primary.Delete(feed[1].key)
+	feed = append(feed, change{feed[1].key, nil})
+	key, _ := primary.Put(fill(9, 20))
+	feed = append(feed, change{key, fill(9, 20)})
+
+	for i := 0; i < 2; i++ {
+		for _, c := range feed {
+			if err := standby.ApplyChange(c.key, c.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	items := make(map[uint64][]byte)
+	_ = primary.Iterate(func(key uint64, size uint32, data []byte) {
+		items[key] = append([]byte{}, data...)
+	})
+	for key, data := range items {
+		if have, err := standby.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Errorf("key %#x: have %x (%v) want %x", key, have, err, data)
+		}
+	}
+	if have, want := standby.Infos().Shelves[0].FilledSlots, primary.Infos().Shelves[0].FilledSlots; have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	standby.Promote()
+	if _, err := standby.Put(fill(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithEncryptionKey(bytes.Repeat([]byte{1}, 32))}} {
+		db, err := Open(t.TempDir(), SlotSizeLinear(2000, 2), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 1500)
+		_, _ = rand.Read(data)
+		key, _ := db.Put(data)
+		r, err := db.GetReader(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, err := io.ReadAll(r); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("have %d bytes, err %v", len(have), err)
+		}
+		if _, err := r.Seek(1000, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		have := make([]byte, 10)
+		if _, err := io.ReadFull(r, have); err != nil || !bytes.Equal(have, data[1000:1010]) {
+			t.Fatalf("have %x want %x, err %v", have, data[1000:1010], err)
+		}
+		_ = db.Close()
+		if _, err := r.ReadAt(have, 0); db.(*database).sealer == nil && !errors.Is(err, ErrClosed) {
+			t.Fatalf("have %v want %v", err, ErrClosed)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var (
+		keys   []uint64
+		hashes [][]byte
+	)
+	for i := 0; i < 6; i++ {
+		data := fill(byte(i), 10+i*30)
+		key, _ := db.Put(data)
+		sum := sha256.Sum256(data)
+		keys, hashes = append(keys, key), append(hashes, sum[:])
+	}
+	_ = db.Delete(keys[4])
+	commitments := CommitmentSlice{
+		{keys[0], hashes[0]},
+		{keys[1], hashes[2]}, // Wrong hash
+		// keys[2] not committed
+		{keys[3], hashes[3]},
+		{keys[4], hashes[4]}, // Deleted
+		{keys[5], hashes[5]},
+		{keys[5] + 1, hashes[0]}, // Never stored
+	}
+	var have []string
+	err = db.Reconcile(&commitments, nil, func(m Mismatch) {
+		have = append(have, fmt.Sprintf("%v %#x", m.Kind, m.Key))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		fmt.Sprintf("hash mismatch %#x", keys[1]),
+		fmt.Sprintf("extra %#x", keys[2]),
+		fmt.Sprintf("missing %#x", keys[4]),
+		fmt.Sprintf("missing %#x", keys[5]+1),
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("have %v want %v", have, want)
+	}
+	unsorted := CommitmentSlice{{keys[1], nil}, {keys[0], nil}}
+	if err := db.Reconcile(&unsorted, nil, func(Mismatch) {}); err == nil {
+		t.Fatal("expected error for unsorted commitments")
+	}
+}
+
+func TestAll(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 6; i++ {
+		key, _ := db.Put(fill(byte(i), 10+i*30))
+		keys = append(keys, key)
+	}
+	// The same loop as `for key, data := range db.All()` with a break
+	var have []uint64
+	db.All()(func(key uint64, data []byte) bool {
+		if want := fill(byte(len(have)), 10+len(have)*30); !bytes.Equal(data, want) {
+			t.Fatalf("key %#x: have %x want %x", key, data, want)
+		}
+		have = append(have, key)
+		return len(have) < 4
+	})
+	if !reflect.DeepEqual(have, keys[:4]) {
+		t.Fatalf("have %#x want %#x", have, keys[:4])
+	}
+	// Options apply as with IterateErr
+	have = have[:0]
+	db.All(WithStartKey(keys[3]))(func(key uint64, data []byte) bool {
+		have = append(have, key)
+		return true
+	})
+	if !reflect.DeepEqual(have, keys[3:]) {
+		t.Fatalf("have %#x want %#x", have, keys[3:])
+	}
+}
+
+func TestIterateParallel(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[uint64]string)
+	for i := 0; i < 50; i++ {
+		data := fill(byte(i), 10+i*3)
+		key, _ := db.Put(data)
+		want[key] = string(data)
+	}
+	for i := uint64(0); i < 10; i++ {
+		_ = db.Delete(i)
+		delete(want, i)
+	}
+	for _, n := range []int{0, 1, 3, 8, 100} {
+		var (
+			mu   sync.Mutex
+			have = make(map[uint64]string)
+		)
+		err := db.IterateParallel(n, func(key uint64, size uint32, data []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := have[key]; ok {
+				t.Errorf("key %#x visited twice", key)
+			}
+			have[key] = string(data)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("workers %d: have %d items want %d", n, len(have), len(want))
+		}
+	}
+	// Errors abort all workers, and are returned
+	fail := errors.New("fail")
+	err = db.IterateParallel(4, func(key uint64, size uint32, data []byte) error {
+		return fail
+	})
+	if !errors.Is(err, fail) {
+		t.Fatalf("have %v want %v", err, fail)
+	}
+	var visited uint32
+	err = db.IterateParallel(4, func(key uint64, size uint32, data []byte) error {
+		atomic.AddUint32(&visited, 1)
+		return ErrStopIteration
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visited > 4 {
+		t.Fatalf("have %d items visited after stopping, want at most 4", visited)
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	db, err := Open(b.TempDir(), SlotSizeLinear(4096, 4), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	data := fill(1, 3000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Put(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIterate(b *testing.B) {
+	db, err := Open(b.TempDir(), SlotSizeLinear(4096, 4), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Put(fill(byte(i), 100+i*10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Iterate(func(uint64, uint32, []byte) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDirectIO(t *testing.T) { testIOBackend(t, WithDirectIO()) }
+func TestIOUring(t *testing.T)  { testIOBackend(t, WithIOUring()) }
+
+// testIOBackend exercises a database whose files are accessed in a different
+// way than with plain reads and writes, which is configured by the option.
+func testIOBackend(t *testing.T, option Option) {
+	dir := t.TempDir()
+	db, err := Open(dir, SlotSizeLinear(1000, 10), nil, option)
+	if err != nil {
+		t.Skipf("backend not available: %v", err)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		want = make(map[uint64][]byte)
+	)
+	// Slots of unaligned sizes share blocks, write them concurrently
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				data := fill(byte(i*20+j), 10+(i*20+j)*37%9000)
+				key, err := db.Put(data)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				want[key] = data
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for key, data := range want {
+		if key%3 == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+			continue
+		}
+		if err := db.UpdateRange(key, 1, []byte{0xff}); err != nil {
+			t.Fatal(err)
+		}
+		data[1] = 0xff
+	}
+	check := func(db Database) {
+		t.Helper()
+		for key, data := range want {
+			if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("key %#x: have %d bytes want %d, err %v", key, len(have), len(data), err)
+			}
+		}
+		for _, shelf := range db.Infos().Shelves {
+			if slots := shelf.FilledSlots + shelf.GappedSlots; shelf.FileSize != uint64(ShelfHeaderSize)+slots*uint64(shelf.SlotSize) {
+				t.Fatalf("shelf %d: file size %d for %d slots", shelf.SlotSize, shelf.FileSize, slots)
+			}
+		}
+	}
+	check(db)
+	db.Close()
+
+	// The files are readable with plain I/O
+	db, err = Open(dir, SlotSizeLinear(1000, 10), nil, WithoutCompaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, SlotSizeLinear(100, 2), nil, WithMaxSize(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for _, size := range []int{50, 50, 50, 150} {
+		key, err := db.Put(fill(1, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// The database is full, growing any shelf fails
+	if _, err := db.Put(fill(2, 50)); !errors.Is(err, ErrFull) {
+		t.Fatalf("have %v want %v", err, ErrFull)
+	}
+	err = db.PutAt(Key(0, 5), fill(2, 50))
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("have %v want %v", err, ErrFull)
+	}
+	if code := ErrorCode(err); code != CodeDatabaseFull {
+		t.Fatalf("have code %v want %v", code, CodeDatabaseFull)
+	}
+	// Gaps can be reused, and truncation frees space
+	_ = db.Delete(keys[1])
+	if _, err := db.Put(fill(3, 50)); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Delete(keys[3])
+	if _, err := db.Put(fill(4, 50)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Existing data is kept when reopening with a lower limit
+	db, err = Open(dir, SlotSizeLinear(100, 2), nil, WithMaxSize(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put(fill(5, 50)); !errors.Is(err, ErrFull) {
+		t.Fatalf("have %v want %v", err, ErrFull)
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	marks := make(chan bool, 10)
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithMaxSize(1000),
+		WithWatermarks(0.8, 0.5, func(high bool) { marks <- high }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case high := <-marks:
+			if high != want {
+				t.Fatalf("have high %v want %v", high, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watermark %v not reported", want)
+		}
+	}
+	var keys []uint64
+	for i := 0; i < 8; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	expect(true)
+	// Deleting from the end truncates the file, down to the low watermark
+	for i := len(keys) - 1; i >= 4; i-- {
+		if err := db.Delete(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(false)
+	select {
+	case high := <-marks:
+		t.Fatalf("unexpected report %v", high)
+	default:
+	}
+	// Invalid watermarks are rejected
+	_, err = Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithMaxSize(1000),
+		WithWatermarks(0.5, 0.8, func(bool) {}))
+	if err == nil {
+		t.Fatal("inverted watermarks accepted")
+	}
+	if _, err = Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithWatermarks(0.8, 0.5, func(bool) {})); err == nil {
+		t.Fatal("watermarks accepted without size limit")
+	}
+}
+
+func TestGenerations(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2), WithGenerations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a, _ := db.Put(fill(1, 10))
+	if KeyGeneration(a) == 0 {
+		t.Fatalf("key %#x has no generation", a)
+	}
+	_ = db.Delete(a)
+	b, _ := db.Put(fill(2, 10))
+	if _, slotA := SplitKey(a); b&keyIndexMask != Key(0, slotA) || b == a {
+		t.Fatalf("have key %#x, want reuse of %#x with new generation", b, a)
+	}
+	// The stale key is rejected, the current one and keys without generation
+	// are accepted
+	if _, err := db.Get(a); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	if _, err := db.GetSample(a, 0, 1); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	if err := db.UpdateRange(a, 0, []byte{9}); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	if err := db.Delete(a); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	if has, _ := db.Has(a); has {
+		t.Fatal("stale key reported live")
+	}
+	for _, key := range []uint64{b, b & keyIndexMask} {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, fill(2, 10)) {
+			t.Fatalf("key %#x: have %x, err %v", key, have, err)
+		}
+	}
+	if code := ErrorCode(fmt.Errorf("%w", ErrStaleKey)); code != CodeStaleKey {
+		t.Fatalf("have code %v want %v", code, CodeStaleKey)
+	}
+	// Iteration and compaction report keys with generations
+	c, _ := db.Put(fill(3, 10))
+	d, _ := db.Put(fill(4, 10))
+	_ = db.Delete(c)
+	var iterated []uint64
+	_ = db.Iterate(func(key uint64, _ uint32, _ []byte) { iterated = append(iterated, key) })
+	if want := []uint64{b, d}; !reflect.DeepEqual(iterated, want) {
+		t.Fatalf("have keys %#x want %#x", iterated, want)
+	}
+	var moved uint64
+	err = db.Compact(func(from, to uint64, _ []byte) {
+		if from != d {
+			t.Errorf("have moved key %#x want %#x", from, d)
+		}
+		moved = to
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyGeneration(moved) != KeyGeneration(d) {
+		t.Fatalf("have generation %d want %d", KeyGeneration(moved), KeyGeneration(d))
+	}
+	if have, err := db.Get(moved); err != nil || !bytes.Equal(have, fill(4, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	if _, err := db.Get(c); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	// PutAt adopts the generation of the key
+	_ = db.Delete(moved)
+	if err := db.PutAt(moved, fill(5, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := db.Get(moved); err != nil || !bytes.Equal(have, fill(5, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+}
+
+func TestGenerationsReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, SlotSizeLinear(100, 2), nil, WithGenerations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := db.Put(fill(1, 10))
+	_ = db.Delete(a)
+	b, _ := db.Put(fill(2, 10))
+	if b&keyIndexMask != a&keyIndexMask {
+		t.Fatalf("have key %#x, want reuse of %#x", b, a)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The generations are loaded again, so the stale key is still rejected
+	db, err = Open(dir, SlotSizeLinear(100, 2), nil, WithGenerations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(a); !errors.Is(err, ErrStaleKey) {
+		t.Fatalf("have %v want %v", err, ErrStaleKey)
+	}
+	if have, err := db.Get(b); err != nil || !bytes.Equal(have, fill(2, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	// Once the generations change, they are dropped from the metadata file,
+	// so that they aren't loaded after a crash
+	_ = db.Delete(b)
+	c, _ := db.Put(fill(3, 10))
+	if c == a || c == b {
+		t.Fatalf("key %#x reissued", c)
+	}
+	if _, _, gens, err := readShelfMeta(filepath.Join(dir, metaName(100))); err != nil || gens != nil {
+		t.Fatalf("have generations %x, err %v", gens, err)
+	}
+}
+
+func TestKeySecret(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 2), WithKeySecret([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a, _ := db.Put(fill(1, 10))
+	if have, err := db.Get(a); err != nil || !bytes.Equal(have, fill(1, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	// Keys not issued by the database are rejected
+	for _, key := range []uint64{a & keyIndexMask, a ^ 1<<40} {
+		if _, err := db.Get(key); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("key %#x: have %v want %v", key, err, ErrInvalidKey)
+		}
+		if has, _ := db.Has(key); has {
+			t.Fatalf("key %#x reported live", key)
+		}
+		if err := db.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("key %#x: have %v want %v", key, err, ErrInvalidKey)
+		}
+	}
+	other, err := OpenMemory(SlotSizeLinear(100, 2), WithKeySecret([]byte("other")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if b, _ := other.Put(fill(1, 10)); b == a {
+		t.Fatalf("databases with different secrets issued key %#x", a)
+	}
+	if _, err := other.Get(a); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("have %v want %v", err, ErrInvalidKey)
+	}
+	// Iteration reports the authenticated keys, and PutAt takes them
+	var iterated []uint64
+	_ = db.Iterate(func(key uint64, _ uint32, _ []byte) { iterated = append(iterated, key) })
+	if want := []uint64{a}; !reflect.DeepEqual(iterated, want) {
+		t.Fatalf("have keys %#x want %#x", iterated, want)
+	}
+	_ = db.Delete(a)
+	if err := db.PutAt(a&keyIndexMask, fill(2, 10)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("have %v want %v", err, ErrInvalidKey)
+	}
+	if err := db.PutAt(a, fill(2, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := db.Get(a); err != nil || !bytes.Equal(have, fill(2, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	// With generations, stale keys are rejected too
+	gens, err := OpenMemory(SlotSizeLinear(100, 2), WithKeySecret([]byte("secret")), WithGenerations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gens.Close()
+	b, _ := gens.Put(fill(3, 10))
+	_ = gens.Delete(b)
+	c, _ := gens.Put(fill(4, 10))
+	if _, err := gens.Get(b); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("have %v want %v", err, ErrInvalidKey)
+	}
+	if have, err := gens.Get(c); err != nil || !bytes.Equal(have, fill(4, 10)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	if _, err := OpenMemory(SlotSizeLinear(100, 2), WithKeySecret([]byte{})); err == nil {
+		t.Fatal("empty secret accepted")
+	}
+	// Generations are lost in a crash, so they can't authenticate on disk
+	if _, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil, WithKeySecret([]byte("secret")), WithGenerations()); err == nil {
+		t.Fatal("persistent authenticated generations accepted")
+	}
+}
+
+func TestForgedKeys(t *testing.T) {
+	for _, secret := range [][]byte{nil, []byte("secret")} {
+		db, err := OpenMemory(SlotSizeLinear(100, 2), WithKeySecret(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ErrBadIndex
+		if secret != nil {
+			want = ErrInvalidKey
+		}
+		// Keys beyond the shelves are rejected rather than panicking
+		for _, key := range []uint64{Key(2, 0), Key(1000, 0) | 0x123<<keyGenBits, ^uint64(0)} {
+			if _, err := db.Get(key); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if _, err := db.GetReader(key); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if _, err := db.GetInto(key, make([]byte, 100)); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if _, err := db.GetSample(key, 0, 1); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if err := db.UpdateRange(key, 0, []byte{1}); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if err := db.Delete(key); !errors.Is(err, want) {
+				t.Fatalf("key %#x: have %v want %v", key, err, want)
+			}
+			if size := db.Size(key); size != 0 {
+				t.Fatalf("key %#x: have size %d", key, size)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestIterateItems(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 3), WithEncryptionKey(make([]byte, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[uint64]int)
+	for _, size := range []int{10, 20, 150, 250} {
+		key, err := db.Put(fill(byte(size), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = size
+	}
+	err = db.IterateItems(func(item ItemInfo, data []byte) error {
+		size, ok := want[item.Key]
+		if !ok {
+			return fmt.Errorf("unexpected key %#x", item.Key)
+		}
+		delete(want, item.Key)
+		if shelf, slot := SplitKey(item.Key); item.Shelf != shelf || item.Slot != slot {
+			return fmt.Errorf("have shelf %d slot %d, want %d %d", item.Shelf, item.Slot, shelf, slot)
+		}
+		if item.SlotSize != db.Size(item.Key) {
+			return fmt.Errorf("have slot size %d want %d", item.SlotSize, db.Size(item.Key))
+		}
+		if int(item.Stored) != size+28 || !bytes.Equal(data, fill(byte(size), size)) {
+			return fmt.Errorf("have stored %d, data %x for size %d", item.Stored, data, size)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 0 {
+		t.Fatalf("items not visited: %v", want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := OpenMemory(SlotSizeLinear(100, 3), WithEncryptionKey(make([]byte, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[string][]byte)
+	for _, size := range []int{10, 20, 150, 250} {
+		key, _ := db.Put(fill(byte(size), size))
+		want[fmt.Sprintf("%016x", key)] = fill(byte(size), size)
+	}
+	deleted, _ := db.Put(fill(1, 30))
+	_ = db.Delete(deleted)
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want[hdr.Name]) {
+			t.Fatalf("entry %v: have %x want %x", hdr.Name, data, want[hdr.Name])
+		}
+		delete(want, hdr.Name)
+	}
+	if len(want) != 0 {
+		t.Fatalf("items not exported: %v", want)
+	}
+}
+
+func TestImport(t *testing.T) {
+	src, err := OpenMemory(SlotSizeLinear(100, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, size := range []int{10, 20, 150, 250} {
+		_, _ = src.Put(fill(byte(size), size))
+	}
+	var archive bytes.Buffer
+	if err := src.Export(&archive); err != nil {
+		t.Fatal(err)
+	}
+	// Import into a database with other slot sizes
+	dst, err := OpenMemory(SlotSizePowerOfTwo(64, 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	imported := 0
+	err = dst.Import(&archive, func(oldKey, newKey uint64) {
+		imported++
+		want, _ := src.Get(oldKey)
+		if have, err := dst.Get(newKey); err != nil || !bytes.Equal(have, want) {
+			t.Errorf("key %#x: have %x, err %v, want %x", newKey, have, err, want)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 4 {
+		t.Fatalf("have %d items imported want 4", imported)
+	}
+	// Archives not written by Export are rejected
+	var bad bytes.Buffer
+	tw := tar.NewWriter(&bad)
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "item", Size: 1, Mode: 0644})
+	_, _ = tw.Write([]byte{1})
+	_ = tw.Close()
+	if err := dst.Import(&bad, nil); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("have %v want %v", err, ErrCorruptData)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64][]byte)
+	for _, size := range []int{10, 20, 150, 250} {
+		key, _ := db.Put(fill(byte(size), size))
+		want[key] = fill(byte(size), size)
+	}
+	db.Close()
+
+	rekeyed := make(map[uint64][]byte)
+	err = Migrate(dir, SlotSizeLinear(100, 3), SlotSizePowerOfTwo(64, 512), func(oldKey, newKey uint64) {
+		rekeyed[newKey] = want[oldKey]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rekeyed) != len(want) {
+		t.Fatalf("have %d items rekeyed want %d", len(rekeyed), len(want))
+	}
+	// The old shelves and the temporary directory are gone
+	for _, name := range []string{"bkt_00000100.bag", "bkt_00000200.bag", migrateDir} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%v: have %v want %v", name, err, os.ErrNotExist)
+		}
+	}
+	db, err = Open(dir, SlotSizePowerOfTwo(64, 512), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, data := range rekeyed {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("key %#x: have %x, err %v, want %x", key, have, err, data)
+		}
+	}
+}
+
+func TestMigrateSafety(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64][]byte)
+	for _, size := range []int{10, 150, 250} {
+		key, _ := db.Put(fill(byte(size), size))
+		want[key] = fill(byte(size), size)
+	}
+	// A database open for writing is not migrated
+	if err := Migrate(dir, SlotSizeLinear(100, 3), SlotSizeLinear(300, 1), nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("have %v want %v", err, ErrLocked)
+	}
+	db.Close()
+
+	// Interrupt a migration in the middle of the swap
+	if err := MigrateTo(dir, filepath.Join(dir, migrateDir), SlotSizeLinear(100, 3), SlotSizeLinear(300, 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMigrateMarker(filepath.Join(dir, migrateMarker), []uint32{100, 200, 300}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "bkt_00000100.bag")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, SlotSizeLinear(100, 3), nil); err == nil {
+		t.Fatal("opened half swapped database")
+	}
+	// Migrating again completes the swap, the old layout is not read again
+	if err := Migrate(dir, SlotSizeLinear(100, 3), SlotSizeLinear(300, 1), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{migrateMarker, migrateDir, "bkt_00000200.bag"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%v: have %v want %v", name, err, os.ErrNotExist)
+		}
+	}
+	db, err = Open(dir, SlotSizeLinear(300, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var have [][]byte
+	_ = db.Iterate(func(_ uint64, _ uint32, data []byte) { have = append(have, data) })
+	if len(have) != len(want) {
+		t.Fatalf("have %d items want %d", len(have), len(want))
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src, err := OpenMemory(SlotSizeLinear(100, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	var keys []uint64
+	for _, size := range []int{10, 20, 150, 250} {
+		key, _ := src.Put(fill(byte(size), size))
+		keys = append(keys, key)
+	}
+	_ = src.Delete(keys[0])
+	small := func(key uint64, data []byte) bool { return len(data) < 200 }
+
+	// Keys are kept with the same slot sizes
+	same, err := OpenMemory(SlotSizeLinear(100, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer same.Close()
+	if err := Copy(same, src, small, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		has, _ := same.Has(key)
+		if want := i == 1 || i == 2; has != want {
+			t.Fatalf("key %#x: have %v want %v", key, has, want)
+		}
+	}
+	// Or remapped into other slot sizes
+	other, err := OpenMemory(SlotSizePowerOfTwo(64, 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	copied := 0
+	err = Copy(other, src, nil, false, func(oldKey, newKey uint64) {
+		copied++
+		want, _ := src.Get(oldKey)
+		if have, err := other.Get(newKey); err != nil || !bytes.Equal(have, want) {
+			t.Errorf("key %#x: have %x, err %v, want %x", newKey, have, err, want)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 3 {
+		t.Fatalf("have %d items copied want 3", copied)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var sources []string
+	for _, fills := range [][]byte{{1, 2}, {3, 4, 5}} {
+		dir := t.TempDir()
+		db, err := Open(dir, SlotSizeLinear(100, 2), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range fills {
+			_, _ = db.Put(fill(b, 10))
+		}
+		db.Close()
+		sources = append(sources, dir)
+	}
+	// The second source collides with the first on slots 0 and 1
+	dir := t.TempDir()
+	relocated := make(map[uint64]uint64)
+	err := Merge(dir, sources, SlotSizeLinear(100, 2), func(key uint64, stored, incoming []byte) MergeAction {
+		if key == 0 {
+			return MergeReplace
+		}
+		return MergeRelocate
+	}, func(oldKey, newKey uint64) {
+		relocated[oldKey] = newKey
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint64]uint64{1: 3}; !reflect.DeepEqual(relocated, want) {
+		t.Fatalf("have relocated %v want %v", relocated, want)
+	}
+	db, err := Open(dir, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, b := range []byte{3, 2, 5, 4} {
+		if have, err := db.Get(uint64(key)); err != nil || !bytes.Equal(have, fill(b, 10)) {
+			t.Fatalf("key %d: have %x, err %v, want %x", key, have, err, fill(b, 10))
+		}
+	}
+	db.Close()
+
+	// Without resolver, collisions fail
+	err = Merge(t.TempDir(), sources, SlotSizeLinear(100, 2), nil, nil)
+	if !errors.Is(err, ErrSlotInUse) {
+		t.Fatalf("have %v want %v", err, ErrSlotInUse)
+	}
+}
+
+func TestSlotSizeFor(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tt := range []struct {
+		size int
+		want uint32
+	}{
+		{1, 100}, {96, 100}, {97, 200}, {196, 200}, {296, 300},
+	} {
+		have, err := db.SlotSizeFor(tt.size)
+		if err != nil {
+			t.Fatalf("size %d: %v", tt.size, err)
+		}
+		if have != tt.want {
+			t.Fatalf("size %d: have %d want %d", tt.size, have, tt.want)
+		}
+		key, err := db.Put(fill(1, tt.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := db.Size(key); stored != have {
+			t.Fatalf("size %d: stored in %d, predicted %d", tt.size, stored, have)
+		}
+	}
+	var oversized *OversizedError
+	if _, err := db.SlotSizeFor(297); !errors.As(err, &oversized) {
+		t.Fatalf("want OversizedError, have %v", err)
+	}
+	if infos := db.Infos(); infos.OversizedPuts != 0 {
+		t.Fatalf("have %d oversized puts, want none", infos.OversizedPuts)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(fill(1, 150)); err != nil {
+		t.Fatal(err)
+	}
+	snap := filepath.Join(t.TempDir(), "snap")
+	if err := db.SnapshotTo(snap); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	for _, dir := range []string{p, snap} {
+		if have, err := SlotSizesOf(dir); err != nil || !reflect.DeepEqual(have, []uint32{100, 200, 300}) {
+			t.Fatalf("%v: have %v, %v", dir, have, err)
+		}
+	}
+	// Other slot sizes are rejected, without creating shelves
+	if _, err := Open(p, SlotSizeLinear(100, 4), nil); !errors.Is(err, ErrSlotSizes) {
+		t.Fatalf("want %v, have %v", ErrSlotSizes, err)
+	}
+	if _, err := os.Stat(filepath.Join(p, "bkt_00000400.bag")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("shelf created: %v", err)
+	}
+	// Databases without manifest are checked against their shelf files
+	if err := os.Remove(filepath.Join(p, manifestName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(p, SlotSizeLinear(200, 2), nil); !errors.Is(err, ErrSlotSizes) {
+		t.Fatalf("want %v, have %v", ErrSlotSizes, err)
+	}
+	db, err = Open(p, SlotSizeLinear(100, 3), nil, WithReadonly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := SlotSizesOf(p); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("read-only open wrote manifest: %v", err)
+	}
+	db, err = Open(p, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if have, err := SlotSizesOf(p); err != nil || !reflect.DeepEqual(have, []uint32{100, 200, 300}) {
+		t.Fatalf("have %v, %v", have, err)
+	}
+	// The manifest follows the slot sizes through migrations
+	if err := Migrate(p, SlotSizeList(100, 200, 300), SlotSizeList(160, 320), nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := SlotSizesOf(p); err != nil || !reflect.DeepEqual(have, []uint32{160, 320}) {
+		t.Fatalf("have %v, %v", have, err)
+	}
+}
+
+func TestReadonlyAlongsideWriter(t *testing.T) {
+	p := t.TempDir()
+	writer, err := Open(p, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	var keys []uint64
+	for i := 0; i < 5; i++ {
+		key, err := writer.Put(fill(byte(i), 140))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// A second writer is locked out, a reader is not
+	if _, err := Open(p, SlotSizePowerOfTwo(128, 500), nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("want %v, have %v", ErrLocked, err)
+	}
+	reader, err := Open(p, SlotSizePowerOfTwo(128, 500), nil, WithReadonly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// Truncating the shelf under the reader must not fail its iterations
+	for _, key := range keys[3:] {
+		if err := writer.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, iterate := range []func(OnDataErrFn) error{
+		func(fn OnDataErrFn) error { return reader.IterateErr(fn) },
+		func(fn OnDataErrFn) error { return reader.IterateParallel(2, fn) },
+	} {
+		var (
+			mu   sync.Mutex
+			seen = make(map[uint64]byte)
+		)
+		if err := iterate(func(key uint64, size uint32, data []byte) error {
+			mu.Lock()
+			seen[key] = data[0]
+			mu.Unlock()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != 3 || seen[keys[0]] != 0 || seen[keys[1]] != 1 || seen[keys[2]] != 2 {
+			t.Fatalf("wrong items: %v", seen)
+		}
+	}
+	// Items stored since the open can be read by key
+	key, err := writer.Put(fill(9, 140))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := reader.Get(key); err != nil || !bytes.Equal(have, fill(9, 140)) {
+		t.Fatalf("wrong data: %x %v", have, err)
+	}
+}
+
+func TestDirLock(t *testing.T) {
+	p := t.TempDir()
+	lockPath := filepath.Join(p, dirLockName)
+	db, err := Open(p, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := readDirLock(lockPath); err != nil || owner != currentOwner() {
+		t.Fatalf("have owner %+v, %v, want %+v", owner, err, currentOwner())
+	}
+	if _, err := Open(p, SlotSizeLinear(100, 2), nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("want %v, have %v", ErrLocked, err)
+	}
+	reader, err := Open(p, SlotSizeLinear(100, 2), nil, WithReadonly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	db.Close()
+	if _, err := os.Stat(lockPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lock file left behind: %v", err)
+	}
+	// Lock files of live processes are respected, those of dead ones and
+	// unreadable ones are taken over
+	for i, tt := range []struct {
+		content string
+		taken   bool
+	}{
+		{fmt.Sprintf("%d %d\n", os.Getpid(), processStart(os.Getpid())), false},
+		{fmt.Sprintf("%d %d\n", math.MaxInt32, 0), true},
+		{"garbage", true},
+	} {
+		if err := os.WriteFile(lockPath, []byte(tt.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(p, SlotSizeLinear(100, 2), nil)
+		if !tt.taken {
+			if !errors.Is(err, ErrLocked) {
+				t.Fatalf("test %d: want %v, have %v", i, ErrLocked, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		db.Close()
+	}
+}
+
+// readMetrics counts the bytes read from the shelf files.
+type readMetrics struct {
+	NopMetrics
+	read int64
+}
+
+func (m *readMetrics) Read(_ uint32, n int) { atomic.AddInt64(&m.read, int64(n)) }
+
+func TestOpenHeadersOnly(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(headerScanSlotSize, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, err := db.Put(fill(byte(i), 1000*(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for _, i := range []int{2, 5} {
+		if err := db.Delete(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Without compaction nor callback, only the headers are read
+	os.Remove(filepath.Join(p, gapIndexName(headerScanSlotSize)))
+	metrics := new(readMetrics)
+	db, err = Open(p, SlotSizeLinear(headerScanSlotSize, 1), nil, WithoutCompaction(), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if have, want := atomic.LoadInt64(&metrics.read), int64(10*itemHeaderSize); have != want {
+		t.Fatalf("have %d bytes read, want %d", have, want)
+	}
+	// The gaps are known, and get filled first
+	for _, i := range []int{2, 5} {
+		if key, err := db.Put(fill(9, 100)); err != nil || key != keys[i] {
+			t.Fatalf("have key %#x, %v, want %#x", key, err, keys[i])
+		}
+	}
+	for _, i := range []int{0, 9} {
+		if have, err := db.Get(keys[i]); err != nil || !bytes.Equal(have, fill(byte(i), 1000*(i+1))) {
+			t.Fatalf("item %d: wrong data, %v", i, err)
+		}
+	}
+}
+
+func TestCompactionProgress(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	_ = db.Delete(keys[2])
+	_ = db.Delete(keys[5])
+	db.Close()
+
+	var (
+		reports []CompactionProgress
+		boom    bool
+	)
+	onProgress := func(progress CompactionProgress) {
+		if boom {
+			panic("boom")
+		}
+		reports = append(reports, progress)
+	}
+	last := func() CompactionProgress {
+		t.Helper()
+		if len(reports) == 0 || !reports[len(reports)-1].Finished {
+			t.Fatalf("no final report: %+v", reports)
+		}
+		final := reports[len(reports)-1]
+		final.Elapsed, reports = 0, nil
+		return final
+	}
+	// Compaction when opening, scanning the slots
+	db, err = Open(p, SlotSizeLinear(100, 1), func(uint64, uint32, []byte) {}, WithCompactionProgress(onProgress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CompactionProgress{SlotSize: 100, Done: 10, Total: 10, Moved: 2, Reclaimed: 200, Finished: true}
+	if have := last(); have != want {
+		t.Fatalf("have %+v want %+v", have, want)
+	}
+	db.Close()
+
+	// Compaction on demand, filling the gaps
+	db, err = Open(p, SlotSizeLinear(100, 1), nil, WithCompactionProgress(onProgress), WithRecoverPanics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reports = nil
+	for _, key := range keys[:3] {
+		_ = db.Delete(key)
+	}
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	want = CompactionProgress{SlotSize: 100, Done: 3, Total: 3, Moved: 3, Reclaimed: 300, Finished: true}
+	if have := last(); have != want {
+		t.Fatalf("have %+v want %+v", have, want)
+	}
+	// Panics in the callback abort the compaction
+	_ = db.Delete(keys[3])
+	boom = true
+	if err := db.Compact(nil); !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("want %v, have %v", ErrCallbackPanic, err)
+	}
+}
+
+func TestMaintenanceRate(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(1000, 1), nil, WithMaintenanceRate(1000000, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := db.Put(fill(byte(i), 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := func(fn func() error) time.Duration {
+		t.Helper()
+		start := time.Now()
+		if err := fn(); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	// Snapshots read slot by slot, at 1000 reads per second
+	if have := elapsed(func() error { return db.SnapshotTo(t.TempDir()) }); have < 90*time.Millisecond {
+		t.Fatalf("snapshot took %v, want at least 100ms", have)
+	}
+	// Iterations read in batches, 100KB at 1MB per second, if throttled
+	time.Sleep(100 * time.Millisecond)
+	if have := elapsed(func() error {
+		if err := db.Iterate(nil, WithThrottle()); err != nil {
+			return err
+		}
+		return db.Iterate(nil, WithThrottle())
+	}); have < 90*time.Millisecond {
+		t.Fatalf("throttled iterations took %v, want at least 100ms", have)
+	}
+}
+
+func TestCompactionPolicy(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	for _, i := range []int{1, 2, 9} {
+		_ = db.Delete(keys[i])
+	}
+	db.Close()
+
+	tail := func(db Database) uint64 {
+		t.Helper()
+		shelf := db.Infos().Shelves[0]
+		return shelf.FilledSlots + shelf.GappedSlots
+	}
+	// Trimming only keeps the keys while opening
+	var states []ShelfState
+	record := CompactionPolicyFunc(func(state ShelfState) (CompactionMode, int) {
+		states = append(states, state)
+		return TrimOnlyPolicy().Compaction(state)
+	})
+	db, err = Open(p, SlotSizeLinear(100, 1), func(uint64, uint32, []byte) {}, WithCompactionPolicy(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := tail(db); have != 9 {
+		t.Fatalf("have tail %d want 9", have)
+	}
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []ShelfState{
+		{SlotSize: 100, Tail: 9, Opening: true},
+		{SlotSize: 100, Tail: 9, Gaps: 2},
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("have states %+v want %+v", states, want)
+	}
+	if have, err := db.Get(keys[8]); err != nil || !bytes.Equal(have, fill(8, 50)) {
+		t.Fatalf("item moved: %x %v", have, err)
+	}
+	db.Close()
+
+	// Moves happen above the gap ratio, as many as allowed per call
+	db, err = Open(p, SlotSizeLinear(100, 1), nil, WithCompactionPolicy(GapRatioPolicy(0.25, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if have := tail(db); have != 9 {
+		t.Fatalf("have tail %d want 9", have)
+	}
+	_ = db.Delete(keys[3])
+	for _, want := range []uint64{8, 7, 7} {
+		if err := db.Compact(nil); err != nil {
+			t.Fatal(err)
+		}
+		if have := tail(db); have != want {
+			t.Fatalf("have tail %d want %d", have, want)
+		}
+	}
+}
+
+func TestOnMove(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	_ = db.Delete(keys[2])
+	_ = db.Delete(keys[5])
+	db.Close()
+
+	var (
+		moved = make(map[uint64]uint64)
+		seen  = make(map[uint64]byte)
+	)
+	onMove := func(oldKey, newKey uint64, data []byte) {
+		if _, ok := seen[newKey]; ok {
+			t.Fatalf("key %#x reported before its move", newKey)
+		}
+		if !bytes.Equal(data, fill(data[0], 50)) {
+			t.Fatalf("wrong data moved: %x", data)
+		}
+		moved[oldKey] = newKey
+	}
+	db, err = Open(p, SlotSizeLinear(100, 1), func(key uint64, size uint32, data []byte) {
+		seen[key] = data[0]
+	}, WithOnMove(onMove))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if want := map[uint64]uint64{keys[9]: keys[2], keys[8]: keys[5]}; !reflect.DeepEqual(moved, want) {
+		t.Fatalf("have moves %v want %v", moved, want)
+	}
+	if len(seen) != 8 || seen[keys[2]] != 9 || seen[keys[5]] != 8 {
+		t.Fatalf("wrong items: %v", seen)
+	}
+	// Compact falls back to the callback of the options
+	moved, seen = make(map[uint64]uint64), nil
+	_ = db.Delete(keys[0])
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint64]uint64{keys[7]: keys[0]}; !reflect.DeepEqual(moved, want) {
+		t.Fatalf("have moves %v want %v", moved, want)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil, WithRemap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	_ = db.Delete(keys[2])
+	_ = db.Delete(keys[5])
+	db.Close()
+
+	// The compaction while opening moves the last items into the gaps
+	db, err = Open(p, SlotSizeLinear(100, 1), func(uint64, uint32, []byte) {}, WithRemap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 3, 8, 9} {
+		if have, err := db.Get(keys[i]); err != nil || !bytes.Equal(have, fill(byte(i), 50)) {
+			t.Fatalf("item %d: have %x, %v", i, have, err)
+		}
+	}
+	// Reusing the old slot of a moved item drops its entry
+	key, _ := db.Put(fill(10, 50))
+	if key != keys[8] {
+		t.Fatalf("have key %#x want %#x", key, keys[8])
+	}
+	if have, _ := db.Get(keys[8]); !bytes.Equal(have, fill(10, 50)) {
+		t.Fatalf("have %x want new item", have)
+	}
+	_ = db.Delete(keys[0])
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(p, SlotSizeLinear(100, 1), nil, WithRemap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, want := range map[int]byte{8: 10, 9: 9, 2: 9, 5: 8} {
+		if have, err := db.Get(keys[i]); err != nil || !bytes.Equal(have, fill(want, 50)) {
+			t.Fatalf("key %d: have %x, %v, want item %d", i, have, err, want)
+		}
+	}
+	if err := db.Delete(keys[9]); err != nil {
+		t.Fatal(err)
+	}
+	if live, _ := db.Has(keys[2]); live {
+		t.Fatal("item deleted through its old key still live")
+	}
+}
+
+func TestRemapPutReader(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil, WithRemap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 4; i++ {
+		key, _ := db.Put(fill(byte(i), 50))
+		keys = append(keys, key)
+	}
+	// Move the last item into the gap of the first one
+	_ = db.Delete(keys[0])
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := db.Get(keys[3]); !bytes.Equal(have, fill(3, 50)) {
+		t.Fatalf("have %x want moved item", have)
+	}
+	// Reusing the old slot through PutReader drops its entry
+	key, err := db.PutReader(bytes.NewReader(fill(10, 50)), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != keys[3] {
+		t.Fatalf("have key %#x want %#x", key, keys[3])
+	}
+	if have, _ := db.Get(key); !bytes.Equal(have, fill(10, 50)) {
+		t.Fatalf("have %x want new item", have)
+	}
+	if have, _ := db.Get(keys[0]); !bytes.Equal(have, fill(3, 50)) {
+		t.Fatalf("have %x want moved item", have)
+	}
+}
+
+// recordLogger is a Logger which keeps the messages.
+type recordLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func TestCrashSafeWrites(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 1), nil, WithCrashSafeWrites())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 4; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	key, err := db.PutReader(bytes.NewReader(fill(4, 60)), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, key)
+	for i, key := range keys[:4] {
+		if have, _ := db.Get(key); !bytes.Equal(have, fill(byte(i), 50)) {
+			t.Fatalf("item %d: have %x", i, have)
+		}
+	}
+	if have, _ := db.Get(keys[4]); !bytes.Equal(have, fill(4, 60)) {
+		t.Fatalf("streamed item: have %x", have)
+	}
+	db.Close()
+
+	// Simulate a crash before the header of slot 1 was written
+	f, err := os.OpenFile(filepath.Join(p, "bkt_00000100.bag"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(ShelfHeaderSize)+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var (
+		logger = new(recordLogger)
+		seen   = make(map[byte]bool)
+	)
+	db, err = Open(p, SlotSizeLinear(100, 1), func(key uint64, size uint32, data []byte) {
+		seen[data[0]] = true
+	}, WithLogger(logger), WithoutCompaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if want := map[byte]bool{0: true, 2: true, 3: true, 4: true}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("have items %v want %v", seen, want)
+	}
+	if len(logger.msgs) != 1 {
+		t.Fatalf("have log %q, want one torn item", logger.msgs)
+	}
+	if live, _ := db.Has(keys[1]); live {
+		t.Fatal("torn item live")
+	}
+	// The torn slot is reused like a gap
+	if key, _ := db.Put(fill(5, 50)); key != keys[1] {
+		t.Fatalf("have key %#x want %#x", key, keys[1])
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dirty := func(db Database) bool {
+		return atomic.LoadUint32(&db.(*database).shelves[0].dirty) != 0
+	}
+	// waitClean waits for the background syncer to sync the shelf
+	waitClean := func(db Database) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); dirty(db); {
+			if time.Now().After(deadline) {
+				t.Fatal("shelf not synced")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Synced after a number of writes
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 1), nil, WithGroupCommit(0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _ = db.Put(fill(byte(i), 50))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !dirty(db) {
+		t.Fatal("shelf synced before the threshold")
+	}
+	_, _ = db.Put(fill(2, 50))
+	waitClean(db)
+	db.Close()
+
+	// Synced periodically, or on Flush
+	db, err = Open(t.TempDir(), SlotSizeLinear(100, 1), nil, WithGroupCommit(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = db.Put(fill(0, 50))
+	waitClean(db)
+
+	_, _ = db.Put(fill(1, 50))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Flush(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dirty(db) {
+		t.Fatal("shelf dirty after flush")
+	}
+	db.Close()
+	if err := db.Flush(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("have %v want %v", err, ErrClosed)
+	}
+}
+
+// fullStore is a store whose writes fail with ENOSPC while full is set.
+type fullStore struct {
+	store
+	full int32
+}
+
+func (f *fullStore) WriteAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&f.full) != 0 {
+		return 0, syscall.ENOSPC
+	}
+	return f.store.WriteAt(p, off)
+}
+
+func TestNoSpace(t *testing.T) {
+	if !isNoSpace(syscall.ENOSPC) {
+		t.Skip("ENOSPC not detected on this platform")
+	}
+	var (
+		fs       *fullStore
+		giveUp   = true
+		attempts []int
+	)
+	onNoSpace := func(attempt int, err error) bool {
+		attempts = append(attempts, attempt)
+		if giveUp {
+			return false
+		}
+		if attempt == 2 {
+			atomic.StoreInt32(&fs.full, 0) // Space freed
+		}
+		return true
+	}
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 1), nil, WithNoSpaceHandler(onNoSpace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		_, _ = db.Put(fill(byte(i), 50))
+	}
+	shelf := db.(*database).shelves[0]
+	fs = &fullStore{store: shelf.f, full: 1}
+	shelf.f = fs
+
+	_, err = db.Put(fill(2, 50))
+	if !errors.Is(err, ErrNoSpace) || ErrorCode(err) != CodeNoSpace {
+		t.Fatalf("have %v want %v", err, ErrNoSpace)
+	}
+	if err := db.PutAt(Key(0, 5), fill(2, 50)); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("have %v want %v", err, ErrNoSpace)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 1}) {
+		t.Fatalf("have attempts %v", attempts)
+	}
+	// The slots of the failed writes are released
+	if info := db.Infos().Shelves[0]; info.FilledSlots != 2 || info.GappedSlots != 0 {
+		t.Fatalf("have %d filled and %d gapped slots, want 2 and 0", info.FilledSlots, info.GappedSlots)
+	}
+	// The write is retried while the callback asks for it
+	giveUp, attempts = false, nil
+	key, err := db.Put(fill(2, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2}) {
+		t.Fatalf("have attempts %v", attempts)
+	}
+	if have, _ := db.Get(key); !bytes.Equal(have, fill(2, 50)) {
+		t.Fatalf("have %x", have)
+	}
+	// PutReader retries in place, and releases the slot if it gives up
+	atomic.StoreInt32(&fs.full, 1)
+	attempts = nil
+	if key, err = db.PutReader(bytes.NewReader(fill(3, 50)), 50); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2}) {
+		t.Fatalf("have attempts %v", attempts)
+	}
+	if have, _ := db.Get(key); !bytes.Equal(have, fill(3, 50)) {
+		t.Fatalf("have %x", have)
+	}
+	atomic.StoreInt32(&fs.full, 1)
+	giveUp = true
+	if _, err := db.PutReader(bytes.NewReader(fill(4, 50)), 50); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("have %v want %v", err, ErrNoSpace)
+	}
+	if info := db.Infos().Shelves[0]; info.FilledSlots != 4 || info.GappedSlots != 0 {
+		t.Fatalf("have %d filled and %d gapped slots, want 4 and 0", info.FilledSlots, info.GappedSlots)
+	}
+}
+
+func TestOpenShelf(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 4; i++ {
+		key, err := db.Put(fill(byte(i+1), 200))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The shelf of the database opens on its own, and is compacted
+	var loaded []uint64
+	shelf, err := OpenShelf(p, 256, func(slot uint64, data []byte) {
+		loaded = append(loaded, slot)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shelf.Close()
+	if have, want := fmt.Sprint(loaded), "[0 1 2]"; have != want {
+		t.Fatalf("have slots %v want %v", have, want)
+	}
+	if have := shelf.SlotSize(); have != 256 {
+		t.Fatalf("have slot size %d want 256", have)
+	}
+	if data, err := shelf.Get(1); err != nil || !bytes.Equal(data, fill(4, 200)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+	slot, err := shelf.Put(fill(5, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shelf.Update(slot, fill(6, 120)); err != nil {
+		t.Fatal(err)
+	}
+	if err := shelf.PutAt(10, fill(7, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := shelf.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	var visited []uint64
+	err = shelf.IterateErr(func(slot uint64, data []byte) error {
+		visited = append(visited, slot)
+		if len(visited) == 2 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(visited), "[1 2]"; have != want {
+		t.Fatalf("have slots %v want %v", have, want)
+	}
+	moves := make(map[uint64]uint64)
+	if err := shelf.Compact(func(from, to uint64, data []byte) { moves[from] = to }); err != nil {
+		t.Fatal(err)
+	}
+	if to, ok := moves[10]; !ok || to != 0 {
+		t.Fatalf("have moves %v", moves)
+	}
+	if data, err := shelf.Get(moves[10]); err != nil || !bytes.Equal(data, fill(7, 50)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+	if info := shelf.Infos(); info.SlotSize != 256 || info.FilledSlots != 4 || info.GappedSlots != 0 {
+		t.Fatalf("have infos %+v", info)
+	}
+	// Callback panics are resumed, or returned if recovering
+	mem, err := OpenShelf("", 200, nil, WithRecoverPanics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	mem.Put(fill(1, 10))
+	if err := mem.Iterate(func(uint64, []byte) { panic("boom") }); !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("have %v want %v", err, ErrCallbackPanic)
+	}
+}
@@ -0,0 +1,131 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// debugState is the JSON representation of the database written by DebugState.
+type debugState struct {
+	Options       debugOptions  `json:"options"`
+	OversizedPuts uint64        `json:"oversizedPuts"`
+	Shelves       []*debugShelf `json:"shelves"`
+}
+
+type debugOptions struct {
+	Path         string `json:"path"`
+	Readonly     bool   `json:"readonly"`
+	Repair       bool   `json:"repair"`
+	ShareGaps    bool   `json:"shareGaps"`
+	Sync         bool   `json:"sync"`
+	NoCompaction bool   `json:"noCompaction"`
+	Encrypted    bool   `json:"encrypted"`
+	CoalesceRead bool   `json:"coalesceReads"`
+	Logger       bool   `json:"logger"`  // Logger is set if a logger is configured
+	Metrics      bool   `json:"metrics"` // Metrics is set if metrics are configured
+}
+
+type debugShelf struct {
+	SlotSize uint32   `json:"slotSize"`
+	Tail     uint64   `json:"tail"`
+	Gaps     []uint64 `json:"gaps"`
+	Closed   bool     `json:"closed"`
+	Readonly bool     `json:"readonly"`
+	IdxPath  string   `json:"idxPath,omitempty"`
+	IdxClean bool     `json:"idxClean"`
+	Shared   bool     `json:"shared"`
+
+	// LockWait is how long it took to acquire the locks of the shelf while
+	// taking the dump, as an indication of lock contention.
+	LockWait time.Duration `json:"lockWaitNs"`
+}
+
+// DebugState writes a JSON dump of the internal state of the database. Each
+// shelf is captured consistently, but not the database as a whole.
+func (db *database) DebugState(w io.Writer) error {
+	state := &debugState{
+		Options: debugOptions{
+			Path:         db.opts.Path,
+			Readonly:     db.opts.Readonly,
+			Repair:       db.opts.Repair,
+			ShareGaps:    db.opts.ShareGaps,
+			Sync:         db.opts.Sync,
+			NoCompaction: db.opts.NoCompaction,
+			Encrypted:    db.sealer != nil,
+			CoalesceRead: db.opts.CoalesceReads,
+			Logger:       db.opts.Logger != nil,
+			Metrics:      db.opts.Metrics != nil,
+		},
+		OversizedPuts: atomic.LoadUint64(&db.oversized),
+	}
+	for _, shelf := range db.shelves {
+		state.Shelves = append(state.Shelves, shelf.debugState())
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+func (s *shelf) debugState() *debugShelf {
+	start := time.Now()
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+
+	return &debugShelf{
+		SlotSize: s.slotSize,
+		Tail:     s.count,
+		Gaps:     s.gaps.slice(),
+		Closed:   s.closed,
+		Readonly: s.readonly,
+		IdxPath:  s.idxPath,
+		IdxClean: s.idxClean,
+		Shared:   s.shared,
+		LockWait: time.Since(start),
+	}
+}
+
+// dumpItem is the JSON representation of an item written by DumpJSON.
+type dumpItem struct {
+	Key      string `json:"key"` // Key is hex-encoded, as JSON numbers lose precision
+	Shelf    int    `json:"shelf"`
+	SlotSize uint32 `json:"slotSize"`
+	Slot     uint64 `json:"slot"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+	Data     []byte `json:"data,omitempty"` // Data is base64-encoded by encoding/json
+}
+
+// DumpJSON writes the live items of the database to w as newline-delimited
+// JSON, one object per item in ascending key order, with its key, shelf, slot,
+// size and the sha256 hash of its data. If withData is set, the data itself is
+// included too, base64-encoded. Dumps of two databases can be diffed with
+// standard tools.
+func (db *database) DumpJSON(w io.Writer, withData bool) error {
+	enc := json.NewEncoder(w)
+	return db.IterateItems(func(item ItemInfo, data []byte) error {
+		hash := sha256.Sum256(data)
+		out := &dumpItem{
+			Key:      fmt.Sprintf("%#x", item.Key),
+			Shelf:    item.Shelf,
+			SlotSize: item.SlotSize,
+			Slot:     item.Slot,
+			Size:     len(data),
+			SHA256:   hex.EncodeToString(hash[:]),
+		}
+		if withData {
+			out.Data = data
+		}
+		return enc.Encode(out)
+	})
+}
@@ -0,0 +1,148 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// Dedup stores every distinct value once, addressing values by their SHA-256
+// hash: a Put of a value which is already stored returns the key of the stored
+// copy. The hashes of all items are held in memory, indexed when the Dedup is
+// created.
+//
+// Since values are shared, each one carries a reference count: Put and AddRef
+// take a reference, and Release drops one, deleting the value once none are
+// left. The counts are held in memory too, and the items indexed on creation
+// start out with one reference each.
+//
+// Writes performed directly on the underlying database, and items moved by
+// compaction, are not tracked.
+type Dedup struct {
+	db     *database
+	mu     sync.Mutex
+	keys   map[[32]byte]uint64 // keys maps the hashes of the values to their keys
+	hashes map[uint64][32]byte // hashes maps the keys to the hashes of their values
+	refs   map[uint64]uint32   // refs maps the keys to their reference counts
+}
+
+// NewDedup creates a deduplicating layer over the given database, which must
+// be one returned by Open, and indexes the items stored in it. If the database
+// already holds duplicates, the first one found is used for further Puts.
+func NewDedup(db Database) (*Dedup, error) {
+	d := &Dedup{
+		db:     db.(*database),
+		keys:   make(map[[32]byte]uint64),
+		hashes: make(map[uint64][32]byte),
+		refs:   make(map[uint64]uint32),
+	}
+	err := db.Iterate(func(key uint64, size uint32, data []byte) {
+		d.add(key, sha256.Sum256(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// add records the hash of the value stored at the given key.
+func (d *Dedup) add(key uint64, hash [32]byte) {
+	if _, ok := d.keys[hash]; !ok {
+		d.keys[hash] = key
+	}
+	d.hashes[key] = hash
+	d.refs[key] = 1
+}
+
+// Put stores the data, unless it is stored already, and returns its key along
+// with a reference to it.
+func (d *Dedup) Put(data []byte) (uint64, error) {
+	hash := sha256.Sum256(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key, ok := d.keys[hash]; ok {
+		d.refs[key]++
+		return key, nil
+	}
+	key, err := d.db.Put(data)
+	if err != nil {
+		return 0, err
+	}
+	d.add(key, hash)
+	return key, nil
+}
+
+// Get retrieves the data stored at the given key.
+func (d *Dedup) Get(key uint64) ([]byte, error) {
+	return d.db.Get(key)
+}
+
+// Lookup returns the key of the value with the given SHA-256 hash, if stored.
+func (d *Dedup) Lookup(hash [32]byte) (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key, ok := d.keys[hash]
+	return key, ok
+}
+
+// AddRef takes another reference to the value stored at the given key.
+func (d *Dedup) AddRef(key uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.refs[key]; !ok {
+		return fmt.Errorf("%w: key %#x not tracked", ErrBadIndex, key)
+	}
+	d.refs[key]++
+	return nil
+}
+
+// Release drops a reference to the value stored at the given key, and deletes
+// it if that was the last one, which is reported by the returned flag.
+func (d *Dedup) Release(key uint64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	refs, ok := d.refs[key]
+	if !ok {
+		return false, fmt.Errorf("%w: key %#x not tracked", ErrBadIndex, key)
+	}
+	if refs > 1 {
+		d.refs[key] = refs - 1
+		return false, nil
+	}
+	if err := d.db.Delete(key); err != nil {
+		return false, err
+	}
+	d.remove(key)
+	return true, nil
+}
+
+// Delete deletes the data stored at the given key, regardless of the
+// references to it. Since values are shared, this affects every user of the
+// key.
+func (d *Dedup) Delete(key uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.db.Delete(key); err != nil {
+		return err
+	}
+	d.remove(key)
+	return nil
+}
+
+// remove forgets the value stored at the given key.
+func (d *Dedup) remove(key uint64) {
+	hash, ok := d.hashes[key]
+	if !ok {
+		return
+	}
+	delete(d.hashes, key)
+	delete(d.refs, key)
+	if d.keys[hash] == key {
+		delete(d.keys, hash)
+	}
+}
@@ -0,0 +1,91 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(p, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate stored before deduplication
+	first, _ := db.Put(fill(1, 50))
+	_, _ = db.Put(fill(1, 50))
+
+	d, err := NewDedup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := d.Put(fill(1, 50)); key != first {
+		t.Fatalf("have key %#x want %#x", key, first)
+	}
+	a, _ := d.Put(fill(2, 150))
+	b, _ := d.Put(fill(2, 150))
+	if a != b {
+		t.Fatalf("duplicate stored twice: %#x %#x", a, b)
+	}
+	if key, ok := d.Lookup(sha256.Sum256(fill(2, 150))); !ok || key != a {
+		t.Fatalf("have lookup %#x %v want %#x", key, ok, a)
+	}
+	if have, want := db.Infos().Shelves[1].FilledSlots, uint64(1); have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	// Once deleted, the value is stored afresh
+	if err := d.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Lookup(sha256.Sum256(fill(2, 150))); ok {
+		t.Fatal("deleted value found")
+	}
+	if _, err := d.Put(fill(2, 150)); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := db.Infos().Shelves[1].FilledSlots, uint64(1); have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	_ = db.Close()
+}
+
+func TestDedupRefs(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d, _ := NewDedup(db)
+
+	// Two puts and an explicit reference
+	key, _ := d.Put(fill(1, 50))
+	_, _ = d.Put(fill(1, 50))
+	if err := d.AddRef(key); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if freed, err := d.Release(key); freed || err != nil {
+			t.Fatalf("release %d: have freed %v, err %v", i, freed, err)
+		}
+		if has, _ := db.Has(key); !has {
+			t.Fatalf("release %d: value deleted", i)
+		}
+	}
+	if freed, err := d.Release(key); !freed || err != nil {
+		t.Fatalf("last release: have freed %v, err %v", freed, err)
+	}
+	if has, _ := db.Has(key); has {
+		t.Fatal("value not deleted")
+	}
+	if _, err := d.Release(key); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("have %v want %v", err, ErrBadIndex)
+	}
+	if err := d.AddRef(key); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("have %v want %v", err, ErrBadIndex)
+	}
+}
@@ -0,0 +1,71 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// deletedCacheSize is the number of recently deleted slots remembered per
+// shelf.
+const deletedCacheSize = 1024
+
+// deletedCache remembers the most recently deleted slots of a shelf, so that
+// reads of them can fail fast with ErrDeleted instead of hitting the disk. A
+// slot is forgotten once it is handed out for new data.
+type deletedCache struct {
+	count int32 // count is the number of slots remembered, read without the lock
+
+	mu    sync.RWMutex
+	slots map[uint64]*list.Element // slots maps the slots to their place in the order
+	order *list.List               // order holds the slots in order of deletion, for eviction
+}
+
+// add remembers the slot as deleted, evicting the oldest one if the cache is
+// full.
+func (c *deletedCache) add(slot uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots == nil {
+		c.slots = make(map[uint64]*list.Element)
+		c.order = list.New()
+	}
+	if _, ok := c.slots[slot]; ok {
+		return
+	}
+	if c.order.Len() == deletedCacheSize {
+		delete(c.slots, c.order.Remove(c.order.Front()).(uint64))
+	}
+	c.slots[slot] = c.order.PushBack(slot)
+	atomic.StoreInt32(&c.count, int32(c.order.Len()))
+}
+
+// remove forgets the slot, as it is being reused.
+func (c *deletedCache) remove(slot uint64) {
+	if atomic.LoadInt32(&c.count) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.slots[slot]; ok {
+		c.order.Remove(elem)
+		delete(c.slots, slot)
+		atomic.StoreInt32(&c.count, int32(c.order.Len()))
+	}
+}
+
+// has returns whether the slot was deleted recently. Shelves without deleted
+// slots are checked without taking the lock.
+func (c *deletedCache) has(slot uint64) bool {
+	if atomic.LoadInt32(&c.count) == 0 {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.slots[slot]
+	return ok
+}
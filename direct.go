@@ -0,0 +1,131 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// directAlign is the alignment of the offsets, sizes and memory buffers of
+// direct I/O.
+const directAlign = 4096
+
+// directStore is a store over a file opened for direct I/O. As such files can
+// only be accessed in aligned blocks, reads and writes are widened to the
+// blocks they touch, and writes read-modify-write their partial blocks. The
+// file is truncated back to its logical size after writes extending it.
+type directStore struct {
+	f    *os.File
+	mu   sync.Mutex // mu serializes writes, as neighbouring slots share blocks
+	size int64      // size is the logical size of the file, guarded by mu
+}
+
+// newDirectStore switches the file to direct I/O and wraps it.
+func newDirectStore(f *os.File) (*directStore, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := setDirectIO(f); err != nil {
+		return nil, err
+	}
+	return &directStore{f: f, size: stat.Size()}, nil
+}
+
+// alignedBuf returns a zeroed buffer of the given size, aligned to directAlign
+// in memory.
+func alignedBuf(size int64) []byte {
+	buf := make([]byte, size+directAlign)
+	skip := int64(0)
+	if rem := int64(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1)); rem != 0 {
+		skip = directAlign - rem
+	}
+	return buf[skip : skip+size]
+}
+
+// blocks returns the range of whole blocks covering [off, off+size).
+func blocks(off, size int64) (int64, int64) {
+	return off &^ (directAlign - 1), (off + size + directAlign - 1) &^ (directAlign - 1)
+}
+
+// ReadAt implements io.ReaderAt of the store interface.
+func (d *directStore) ReadAt(p []byte, off int64) (int, error) {
+	lo, hi := blocks(off, int64(len(p)))
+	buf := alignedBuf(hi - lo)
+	n, err := d.f.ReadAt(buf, lo)
+	if avail := int64(n) - (off - lo); avail < int64(len(p)) {
+		if avail < 0 {
+			avail = 0
+		}
+		copy(p, buf[off-lo:off-lo+avail])
+		if err == nil {
+			err = io.EOF
+		}
+		return int(avail), err
+	}
+	return copy(p, buf[off-lo:]), nil
+}
+
+// WriteAt implements io.WriterAt of the store interface.
+func (d *directStore) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lo, hi := blocks(off, int64(len(p)))
+	buf := alignedBuf(hi - lo)
+
+	// Fill in the existing content of the partially written blocks. If the
+	// write is within a single block, it is read only once.
+	first := off != lo
+	if first {
+		if _, err := d.f.ReadAt(buf[:directAlign], lo); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	if end := off + int64(len(p)); end != hi && !(first && hi-lo == directAlign) {
+		if _, err := d.f.ReadAt(buf[hi-lo-directAlign:], hi-directAlign); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	copy(buf[off-lo:], p)
+	if _, err := d.f.WriteAt(buf, lo); err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > d.size {
+		d.size = end
+	}
+	if hi > d.size {
+		if err := d.f.Truncate(d.size); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Truncate implements the store interface.
+func (d *directStore) Truncate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.f.Truncate(size); err != nil {
+		return err
+	}
+	d.size = size
+	return nil
+}
+
+// Stat implements the store interface.
+func (d *directStore) Stat() (os.FileInfo, error) { return d.f.Stat() }
+
+// Sync implements the store interface.
+func (d *directStore) Sync() error { return d.f.Sync() }
+
+// Close implements io.Closer of the store interface.
+func (d *directStore) Close() error { return d.f.Close() }
+
+// file implements wrappedFile.
+func (d *directStore) file() *os.File { return d.f }
@@ -0,0 +1,23 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package billy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDirectIO switches the file to direct I/O, bypassing the page cache.
+func setDirectIO(f *os.File) error {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.FcntlInt(f.Fd(), unix.F_SETFL, flags|unix.O_DIRECT)
+	return err
+}
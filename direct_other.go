@@ -0,0 +1,17 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package billy
+
+import (
+	"errors"
+	"os"
+)
+
+// setDirectIO is not supported on this platform.
+func setDirectIO(f *os.File) error {
+	return errors.New("direct I/O not supported")
+}
@@ -0,0 +1,114 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dirLockName is the lock file of a database directory, naming the process
+// which has the database open for writing.
+const dirLockName = "LOCK"
+
+// lockOwner identifies a process by its id and start time. The start time
+// tells apart a process which reuses the id of a dead owner. It is zero on
+// platforms which do not report it, where only the id is checked.
+type lockOwner struct {
+	pid   int
+	start int64
+}
+
+// currentOwner returns the identity of the current process.
+func currentOwner() lockOwner {
+	pid := os.Getpid()
+	return lockOwner{pid, processStart(pid)}
+}
+
+// alive reports whether the owner is still running.
+func (o lockOwner) alive() bool {
+	if !processAlive(o.pid) {
+		return false
+	}
+	if o.start == 0 {
+		return true
+	}
+	start := processStart(o.pid)
+	return start == 0 || start == o.start
+}
+
+// dirLock is the lock file of a database directory opened for writing. It
+// complements the locks on the shelf files: it survives the crash of its owner,
+// but is taken over once the owner is found dead, and it also works where file
+// locks are not supported.
+type dirLock struct {
+	path  string
+	owner lockOwner
+}
+
+// lockDir creates the lock file in dir, taking it over if its owner is dead.
+// It fails with ErrLocked if the lock is held by a live process, including
+// the current one.
+func lockDir(dir string, log Logger) (*dirLock, error) {
+	var (
+		path = filepath.Join(dir, dirLockName)
+		self = currentOwner()
+	)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d %d\n", self.pid, self.start)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &dirLock{path, self}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		owner, err := readDirLock(path)
+		if err == nil && owner.alive() {
+			return nil, fmt.Errorf("%w: held by process %d, file %v", ErrLocked, owner.pid, path)
+		}
+		if err != nil {
+			log.Printf("billy: taking over unreadable lock file %v: %v", path, err)
+		} else {
+			log.Printf("billy: taking over lock file %v of dead process %d", path, owner.pid)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	// Another process took the lock over first
+	return nil, fmt.Errorf("%w, file %v", ErrLocked, path)
+}
+
+// readDirLock reads the owner recorded in the lock file at path.
+func readDirLock(path string) (lockOwner, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return lockOwner{}, err
+	}
+	var owner lockOwner
+	if _, err := fmt.Sscanf(string(blob), "%d %d\n", &owner.pid, &owner.start); err != nil {
+		return lockOwner{}, fmt.Errorf("%w: lock file: %v", ErrCorruptData, err)
+	}
+	return owner, nil
+}
+
+// release removes the lock file, unless it has been taken over meanwhile.
+func (l *dirLock) release() error {
+	owner, err := readDirLock(l.path)
+	if err != nil || owner != l.owner {
+		return nil
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,18 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package billy
+
+// processAlive assumes that the process is running, on platforms where this
+// can't be checked, so that lock files are never taken over.
+func processAlive(pid int) bool {
+	return true
+}
+
+// processStart is not supported on this platform.
+func processStart(pid int) int64 {
+	return 0
+}
@@ -0,0 +1,93 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// sealer encrypts the items of a database with AES-GCM.
+//
+// Every item is sealed with a fresh random nonce, which is stored in front of
+// the ciphertext. The nonce is deliberately not derived from the location of
+// the item: slots are reused after deletion, and reusing a nonce with the same
+// key breaks GCM. Instead, the slot size of the shelf is authenticated as
+// additional data, so that an item cannot be transplanted into another shelf.
+// Items are not bound to their slot, since compaction moves them around.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer creates a sealer from an AES key, which must be 16, 24 or 32 bytes
+// long.
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead}, nil
+}
+
+// overhead returns the number of bytes a sealed item is larger than the
+// plaintext.
+func (s *sealer) overhead() int {
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+// seal encrypts the data for storage in a shelf with the given slot size.
+func (s *sealer) seal(slotSize uint32, data []byte) []byte {
+	var (
+		ad    [4]byte
+		nonce = make([]byte, s.aead.NonceSize(), s.overhead()+len(data))
+	)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // The system random source is broken
+	}
+	binary.BigEndian.PutUint32(ad[:], slotSize)
+	return s.aead.Seal(nonce, nonce, data, ad[:])
+}
+
+// open decrypts and authenticates an item read from a shelf with the given
+// slot size.
+func (s *sealer) open(slotSize uint32, data []byte) ([]byte, error) {
+	if len(data) < s.overhead() {
+		return nil, fmt.Errorf("%w: sealed item too short (%d bytes)", ErrCorruptData, len(data))
+	}
+	var ad [4]byte
+	binary.BigEndian.PutUint32(ad[:], slotSize)
+
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, ad[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptData, err)
+	}
+	return plain, nil
+}
+
+// openInPlace decrypts and authenticates an item read from a shelf with the
+// given slot size, and moves the plaintext to the start of data. It returns the
+// size of the plaintext.
+func (s *sealer) openInPlace(slotSize uint32, data []byte) (int, error) {
+	if len(data) < s.overhead() {
+		return 0, fmt.Errorf("%w: sealed item too short (%d bytes)", ErrCorruptData, len(data))
+	}
+	var ad [4]byte
+	binary.BigEndian.PutUint32(ad[:], slotSize)
+
+	ns := s.aead.NonceSize()
+	plain, err := s.aead.Open(data[ns:ns], data[:ns], data[ns:], ad[:])
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCorruptData, err)
+	}
+	return copy(data, plain), nil
+}
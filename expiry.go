@@ -0,0 +1,111 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"time"
+)
+
+// OnExpireFn is invoked by Expire with the key of every item which has been
+// removed.
+type OnExpireFn func(key uint64)
+
+// PutWithTTL stores the data like Put, along with an expiry time ttl from now.
+// Items are not removed automatically once expired: this is done by Expire.
+// The expiry time takes 8 bytes of the slot.
+func (db *database) PutWithTTL(data []byte, ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %v", ttl)
+	}
+	return db.put(data, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire deletes all items whose expiry time is at or before now, and invokes
+// the optional onExpire callback with their keys. Items stored without TTL
+// never expire.
+func (db *database) Expire(now time.Time, onExpire OnExpireFn) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	done, err := db.startMaintenance()
+	if err != nil {
+		return err
+	}
+	defer done()
+	for i, shelf := range db.shelves {
+		expired, err := shelf.Expire(now.UnixNano())
+		if db.opts.CheckInvariants {
+			shelf.checkInvariants("expire")
+		}
+		if err != nil {
+			return fmt.Errorf("shelf %d: %w", i, err)
+		}
+		if onExpire == nil {
+			continue
+		}
+		for _, slot := range expired {
+			key := db.key(i, slot)
+			if err := guard(func() error { onExpire(key); return nil }); err != nil {
+				return db.repanic(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Expire deletes the items whose expiry time, in unix nanoseconds, is at or
+// before now, and returns their slots.
+func (s *shelf) Expire(now int64) ([]uint64, error) {
+	if s.readonly {
+		return nil, ErrReadonly
+	}
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+
+	expired, err := s.findExpired(now)
+	if err != nil {
+		return nil, err
+	}
+	for i, slot := range expired {
+		if err := s.delete(slot); err != nil {
+			return expired[:i], err
+		}
+	}
+	return expired, nil
+}
+
+// findExpired returns the live slots whose expiry time is at or before now.
+// This method assumes that the gapsMu is held.
+func (s *shelf) findExpired(now int64) ([]uint64, error) {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	var (
+		buf     = make([]byte, itemHeaderSize+itemExpirySize)
+		expired []uint64
+	)
+	for slot := uint64(0); slot < s.count; slot++ {
+		if s.gaps.contains(slot) {
+			continue
+		}
+		if _, ok := s.pending[slot]; ok {
+			continue
+		}
+		if _, ok := s.busy[slot]; ok {
+			continue // Expires on the next run
+		}
+		expiry, err := s.readExpiry(buf, slot)
+		if err != nil {
+			return nil, fmt.Errorf("slot %d: %w", slot, err)
+		}
+		if expiry != 0 && expiry <= now {
+			expired = append(expired, slot)
+		}
+	}
+	return expired, nil
+}
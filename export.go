@@ -0,0 +1,87 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// OnImportFn is invoked by Import for every imported item, with the key it had
+// in the exported database and its new key.
+type OnImportFn func(oldKey, newKey uint64)
+
+// Export writes the live items of the database to w as a tar archive, with
+// one regular file per item, named by its key as 16 hex digits and holding its
+// data, in ascending key order. Encrypted items are exported decrypted. The
+// archive does not depend on the slot sizes, so it can be imported into a
+// database with a different configuration. Expiry times are not exported.
+func (db *database) Export(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := db.IterateErr(func(key uint64, size uint32, data []byte) error {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     exportName(key),
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Import stores the items of an archive written by Export, placing them into
+// the shelves of this database by their size. The optional onImport callback
+// is invoked with the old and new key of every item, for consumers to update
+// the keys they hold. Items are streamed into their slots, and an error aborts
+// the import, leaving the items imported so far in place.
+func (db *database) Import(r io.Reader, onImport OnImportFn) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%w: entry %q is not a file", ErrCorruptData, hdr.Name)
+		}
+		oldKey, err := strconv.ParseUint(hdr.Name, 16, 64)
+		if err != nil || len(hdr.Name) != 16 {
+			return fmt.Errorf("%w: entry %q is not a key", ErrCorruptData, hdr.Name)
+		}
+		size := int(hdr.Size)
+		if int64(size) != hdr.Size {
+			return fmt.Errorf("entry %q: %w", hdr.Name, ErrOversized)
+		}
+		newKey, err := db.PutReader(tr, size)
+		if err != nil {
+			return fmt.Errorf("entry %q: %w", hdr.Name, err)
+		}
+		if onImport != nil {
+			if err := guard(func() error { onImport(oldKey, newKey); return nil }); err != nil {
+				return db.repanic(err)
+			}
+		}
+	}
+}
+
+// exportName returns the name of the archive entry of the item with the given
+// key.
+func exportName(key uint64) string {
+	return fmt.Sprintf("%016x", key)
+}
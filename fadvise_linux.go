@@ -0,0 +1,19 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package billy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropFileCache advises the kernel to drop the clean pages of the file from
+// the page cache.
+func dropFileCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
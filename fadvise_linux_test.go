@@ -0,0 +1,68 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDropScanCache(t *testing.T) {
+	// resident returns the number of pages of the file in the page cache
+	resident := func(path string) int {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stat, _ := f.Stat()
+		mem, err := unix.Mmap(int(f.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Munmap(mem)
+		pages := make([]byte, (len(mem)+os.Getpagesize()-1)/os.Getpagesize())
+		_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), uintptr(unsafe.Pointer(&pages[0])))
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		n := 0
+		for _, p := range pages {
+			n += int(p & 1)
+		}
+		return n
+	}
+	for _, drop := range []bool{false, true} {
+		p := t.TempDir()
+		a, err := openShelf(p, 1<<12, nil, &Options{DropScanCache: drop})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 64; i++ {
+			if _, err := a.Put(getBlob(byte(i), 1000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Written pages are only dropped once clean
+		if err := a.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Iterate(func(uint64, []byte) {}); err != nil {
+			t.Fatal(err)
+		}
+		pages := resident(filepath.Join(p, "bkt_00004096.bag"))
+		a.Close()
+		if drop && pages != 0 {
+			t.Fatalf("have %d pages cached after the scan, want 0", pages)
+		}
+		if !drop && pages == 0 {
+			t.Skip("file system does not cache the shelf file")
+		}
+	}
+}
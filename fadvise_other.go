@@ -0,0 +1,15 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package billy
+
+import "os"
+
+// dropFileCache does nothing on this platform, where the page cache can't be
+// advised.
+func dropFileCache(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	var (
+		p        = t.TempDir()
+		slotSize = uint32(1 << 12)
+		extent   = int64(1 << 20)
+	)
+	a, err := openShelf(p, slotSize, nil, &Options{Preallocate: extent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	stat := func() (int64, int64) {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(p, "bkt_00004096.bag"), &stat); err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size, stat.Blocks * 512
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i+1), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.prealloc == 0 {
+		t.Skip("preallocation not supported by the file system")
+	}
+	// The file size covers the slots only, but the extent is allocated
+	size, allocated := stat()
+	if want := int64(ShelfHeaderSize) + 3*int64(slotSize); size != want {
+		t.Fatalf("have size %d want %d", size, want)
+	}
+	if allocated < extent {
+		t.Fatalf("have %d bytes allocated, want at least %d", allocated, extent)
+	}
+	if have, want := a.reserved, int64(ShelfHeaderSize)+extent; have != want {
+		t.Fatalf("have %d bytes reserved, want %d", have, want)
+	}
+	// Truncation releases the reservation, which is renewed by the next Put
+	if err := a.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if a.reserved != 0 {
+		t.Fatalf("have %d bytes reserved after truncation", a.reserved)
+	}
+	if _, err := a.Put(getBlob(4, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := a.reserved, int64(ShelfHeaderSize)+2*int64(slotSize)+extent; have != want {
+		t.Fatalf("have %d bytes reserved, want %d", have, want)
+	}
+}
@@ -0,0 +1,17 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package billy
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocate is not supported on this platform.
+func preallocate(f *os.File, off, size int64) error {
+	return errors.New("preallocation not supported")
+}
@@ -0,0 +1,14 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package billy
+
+import "os"
+
+// lockFile is a no-op on platforms without file locking support.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,386 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// gapPublishInterval is the minimum time between two publications of the gaps
+// of a shelf which shares them. The changes in between are published at once,
+// when the interval has passed.
+const gapPublishInterval = 50 * time.Millisecond
+
+// gapIndexClean is set in the gap index flags if the gap index was written
+// while no mutations were in flight (on Close or Checkpoint), and can thus be
+// trusted when opening the shelf.
+const gapIndexClean = uint8(1)
+
+// gapIndexHeader is the file-header for a gap index file. The gap index holds
+// the tail and the gap list of a shelf. It serves two purposes:
+//   - A clean gap index allows opening the shelf without scanning all slot
+//     headers to reconstruct the gaps.
+//   - When sharing gaps, it lets processes opening the shelf read-only know
+//     which slots are live in the writer.
+type gapIndexHeader struct {
+	Magic    [5]byte // "billy"
+	Version  uint16
+	Slotsize uint32
+	Flags    uint8
+	Tail     uint64
+	Gaps     uint64 // number of gaps following the header
+}
+
+// gapIndexName returns the file name of the gap index of a shelf.
+func gapIndexName(slotSize uint32) string {
+	return fmt.Sprintf("bkt_%08d.idx", slotSize)
+}
+
+// writeGapIndex atomically replaces the gap index file at the given path,
+// by writing to a temporary file first and then moving it into place.
+func writeGapIndex(path string, slotSize uint32, tail uint64, gaps []uint64, clean bool) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	var (
+		w = bufio.NewWriter(f)
+		h = gapIndexHeader{Magic, curVersion, slotSize, 0, tail, uint64(len(gaps))}
+	)
+	if clean {
+		h.Flags |= gapIndexClean
+	}
+	if err = binary.Write(w, binary.BigEndian, &h); err == nil {
+		err = binary.Write(w, binary.BigEndian, gaps)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && clean {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readGapIndex reads the tail and gap list from the gap index file at the
+// given path, and whether the index was marked as clean.
+func readGapIndex(path string, slotSize uint32) (uint64, []uint64, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer f.Close()
+
+	var (
+		r = bufio.NewReader(f)
+		h gapIndexHeader
+	)
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return 0, nil, false, err
+	}
+	switch {
+	case h.Magic != Magic:
+		return 0, nil, false, errors.New("missing magic")
+	case h.Version != curVersion:
+		return 0, nil, false, fmt.Errorf("wrong version: %d", h.Version)
+	case h.Slotsize != slotSize:
+		return 0, nil, false, fmt.Errorf("wrong slotsize, file:%d, need:%d", h.Slotsize, slotSize)
+	case h.Gaps > h.Tail:
+		return 0, nil, false, fmt.Errorf("%w: %d gaps, tail %d", ErrCorruptData, h.Gaps, h.Tail)
+	}
+	gaps := make([]uint64, h.Gaps)
+	if err := binary.Read(r, binary.BigEndian, gaps); err != nil {
+		return 0, nil, false, err
+	}
+	for i, gap := range gaps {
+		if gap >= h.Tail || (i > 0 && gap <= gaps[i-1]) {
+			return 0, nil, false, fmt.Errorf("%w: gap %d, tail %d", ErrCorruptData, gap, h.Tail)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return 0, nil, false, fmt.Errorf("%w: trailing data", ErrCorruptData)
+	}
+	return h.Tail, gaps, h.Flags&gapIndexClean != 0, nil
+}
+
+// loadGapIndex attempts to populate the gaps from a clean gap index, instead of
+// scanning the slot headers. It returns false if the gap index is missing, not
+// clean or does not match the shelf file, in which case a full scan is needed.
+func (s *shelf) loadGapIndex() bool {
+	if s.idxPath == "" {
+		return false
+	}
+	tail, gaps, clean, err := readGapIndex(s.idxPath, s.slotSize)
+	if err != nil || !clean || tail != s.count {
+		return false
+	}
+	s.gaps = newGapSet(gaps)
+	return true
+}
+
+// shareGaps makes the shelf share its gap list through the gap index. In
+// read-write mode, the gap index is published when the gaps or the tail
+// change, at most every gapPublishInterval. In read-only mode, the gap index
+// (if present) is reloaded before iterating, so that slots deleted by a
+// concurrent writer are skipped.
+func (s *shelf) shareGaps() error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+
+	if s.idxPath == "" {
+		return nil
+	}
+	s.shared = true
+	if s.readonly {
+		return nil
+	}
+	return s.writeSharedGaps()
+}
+
+// publishGaps schedules the publication of the current tail and gaps to the
+// gap index, if the shelf is sharing them. The gap index is written right away
+// if the last publication is at least gapPublishInterval ago, otherwise once
+// it is. A failure to publish does not fail the mutation, which is done
+// already: it is logged, and the gap index is removed, so that it is not
+// trusted. This method assumes that the gapsMu is held.
+func (s *shelf) publishGaps() {
+	if !s.shared || s.readonly || s.closed || s.publishTimer != nil {
+		return
+	}
+	s.idxClean = false
+	if wait := gapPublishInterval - time.Since(s.published); wait > 0 {
+		s.publishTimer = time.AfterFunc(wait, func() {
+			s.gapsMu.Lock()
+			defer s.gapsMu.Unlock()
+			s.publishPending()
+		})
+		return
+	}
+	s.publishNow()
+}
+
+// publishPending publishes the gaps if a publication is scheduled. This method
+// assumes that the gapsMu is held.
+func (s *shelf) publishPending() {
+	if s.publishTimer == nil {
+		return
+	}
+	s.cancelPublish()
+	if !s.closed {
+		s.publishNow()
+	}
+}
+
+// cancelPublish drops the scheduled publication, as a clean gap index is about
+// to be written. This method assumes that the gapsMu is held.
+func (s *shelf) cancelPublish() {
+	if s.publishTimer != nil {
+		s.publishTimer.Stop()
+		s.publishTimer = nil
+	}
+}
+
+// publishNow writes the gap index, logging and removing it on failure. This
+// method assumes that the gapsMu is held.
+func (s *shelf) publishNow() {
+	if err := s.writeSharedGaps(); err != nil {
+		s.log.Printf("billy: publishing gaps failed, shelf %d: %v", s.slotSize, err)
+		if err := os.Remove(s.idxPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.log.Printf("billy: removing gap index failed, shelf %d: %v", s.slotSize, err)
+		}
+	}
+}
+
+// writeSharedGaps writes the current tail and gaps to the gap index, marked as
+// not clean. This method assumes that the gapsMu is held.
+func (s *shelf) writeSharedGaps() error {
+	s.idxClean = false
+	s.published = time.Now()
+	return writeGapIndex(s.idxPath, s.slotSize, s.count, s.gaps.slice(), false)
+}
+
+// invalidateGaps ensures that a clean gap index is no longer trusted, before
+// the gaps or the tail are modified. If the gaps are shared, the gap index is
+// rewritten as not clean, otherwise it is removed.
+// This method assumes that the gapsMu is held.
+func (s *shelf) invalidateGaps() error {
+	if !s.idxClean || s.readonly || s.closed {
+		return nil
+	}
+	if s.shared {
+		// Synchronously, as the gap index on disk must be marked as not
+		// clean before the gaps change
+		return s.writeSharedGaps()
+	}
+	s.idxClean = false
+	if err := os.Remove(s.idxPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkpointGaps writes a clean gap index. This method assumes that the gapsMu
+// is held, and that the shelf file has been synced.
+func (s *shelf) checkpointGaps() error {
+	if s.idxPath == "" || s.readonly {
+		return nil
+	}
+	s.cancelPublish()
+	if err := writeGapIndex(s.idxPath, s.slotSize, s.count, s.gaps.slice(), true); err != nil {
+		return err
+	}
+	s.idxClean = true
+	return nil
+}
+
+// reloadGaps loads the tail and gaps published by a writer, if the shelf is
+// opened read-only and sharing gaps. If no gap index has been published, the
+// current state is retained. This method assumes that the gapsMu is held.
+func (s *shelf) reloadGaps() error {
+	if !s.shared || !s.readonly {
+		return nil
+	}
+	tail, gaps, _, err := readGapIndex(s.idxPath, s.slotSize)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gap index %v: %w", s.idxPath, err)
+	}
+	s.count, s.gaps = tail, newGapSet(gaps)
+	return nil
+}
+
+// Checkpoint syncs the shelf file and writes a clean gap index, so that a
+// subsequent open does not need to scan the slot headers, provided that no
+// gaps are created or filled in the meantime.
+func (s *shelf) Checkpoint() error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readonly || s.idxPath == "" {
+		return nil
+	}
+	// Blank the gaps on disk, like Close does, so that the file agrees with
+	// the gap index.
+	var (
+		hdr = make([]byte, itemHeaderSize)
+		err error
+	)
+	s.gaps.each(func(gap uint64) {
+		if err == nil {
+			err = s.writeSlot(hdr, gap)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&s.dirty, 0)
+	if err := s.f.Sync(); err != nil {
+		atomic.StoreUint32(&s.dirty, 1)
+		return err
+	}
+	if err := s.saveMeta(); err != nil {
+		return err
+	}
+	return s.checkpointGaps()
+}
+
+// GapIndexReport describes how the gap index of a shelf relates to the actual
+// contents of the shelf file.
+type GapIndexReport struct {
+	SlotSize  uint32
+	Index     string // Path of the gap index file
+	Missing   bool   // Missing is set if there is no gap index
+	Clean     bool   // Clean is set if the gap index is marked as clean
+	Err       error  // Err is set if the gap index could not be read
+	FileTail  uint64 // FileTail is the number of slots in the shelf file
+	IndexTail uint64 // IndexTail is the number of slots according to the gap index
+
+	// LiveGaps are slots which the gap index considers gaps, but which hold
+	// data in the file.
+	LiveGaps []uint64
+	// DeadSlots are slots which the gap index considers live, but which are
+	// blank in the file.
+	DeadSlots []uint64
+}
+
+// Consistent returns whether the gap index agrees with the shelf file. A
+// missing gap index is consistent, since it is simply not used.
+func (r *GapIndexReport) Consistent() bool {
+	if r.Missing {
+		return true
+	}
+	return r.Err == nil && r.FileTail == r.IndexTail && len(r.LiveGaps) == 0 && len(r.DeadSlots) == 0
+}
+
+// CheckGapIndex cross-checks the gap index of the shelf with the given slot
+// size in the given directory against the slot headers in the shelf file. The
+// shelf must not be open for writing while being checked.
+func CheckGapIndex(path string, slotSize uint32) (*GapIndexReport, error) {
+	f, err := os.Open(filepath.Join(path, fmt.Sprintf("bkt_%08d.bag", slotSize)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report := &GapIndexReport{
+		SlotSize: slotSize,
+		Index:    filepath.Join(path, gapIndexName(slotSize)),
+		FileTail: uint64(stat.Size()-int64(ShelfHeaderSize)) / uint64(slotSize),
+	}
+	var gaps []uint64
+	report.IndexTail, gaps, report.Clean, report.Err = readGapIndex(report.Index, slotSize)
+	if errors.Is(report.Err, os.ErrNotExist) {
+		report.Missing, report.Err = true, nil
+		return report, nil
+	}
+	if report.Err != nil {
+		return report, nil
+	}
+	hdr := make([]byte, itemHeaderSize)
+	for slot := uint64(0); slot < report.FileTail && slot < report.IndexTail; slot++ {
+		if _, err := f.ReadAt(hdr, int64(ShelfHeaderSize)+int64(slot)*int64(slotSize)); err != nil {
+			return nil, err
+		}
+		var (
+			blank = binary.BigEndian.Uint32(hdr) == 0
+			isGap = len(gaps) > 0 && gaps[0] == slot
+		)
+		if isGap {
+			gaps = gaps[1:]
+		}
+		switch {
+		case isGap && !blank:
+			report.LiveGaps = append(report.LiveGaps, slot)
+		case !isGap && blank:
+			report.DeadSlots = append(report.DeadSlots, slot)
+		}
+	}
+	return report, nil
+}
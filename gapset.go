@@ -0,0 +1,203 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// gapPageBits is the log2 of the number of slots covered by a gap page.
+const gapPageBits = 12
+
+// gapPage is a bitmap of the gaps among 4096 consecutive slots.
+type gapPage struct {
+	bits [1 << gapPageBits / 64]uint64
+	n    int // n is the number of gaps in the page
+}
+
+// gapSet holds the gaps of a shelf as a two-level bitmap: pages of 4096 slots
+// which are only allocated while they hold gaps. Adding, removing and looking
+// up gaps takes constant time, and finding the first or last gap is cheap, so
+// heavily churned shelves with millions of gaps stay fast. The zero value is
+// an empty set.
+type gapSet struct {
+	pages []*gapPage // pages[i] covers the slots from i<<gapPageBits, nil if it has no gaps
+	n     int        // n is the number of gaps
+	lo    int        // lo is the index of the first page which may be non-nil
+}
+
+// newGapSet creates a set holding the given gaps.
+func newGapSet(gaps []uint64) gapSet {
+	var g gapSet
+	for _, gap := range gaps {
+		g.add(gap)
+	}
+	return g
+}
+
+// len returns the number of gaps.
+func (g *gapSet) len() int {
+	return g.n
+}
+
+// add adds the slot to the gaps, if not present already.
+func (g *gapSet) add(slot uint64) {
+	idx := int(slot >> gapPageBits)
+	for len(g.pages) <= idx {
+		g.pages = append(g.pages, nil)
+	}
+	page := g.pages[idx]
+	if page == nil {
+		page = new(gapPage)
+		g.pages[idx] = page
+	}
+	word, mask := (slot&(1<<gapPageBits-1))/64, uint64(1)<<(slot%64)
+	if page.bits[word]&mask != 0 {
+		return
+	}
+	page.bits[word] |= mask
+	page.n++
+	g.n++
+	if idx < g.lo {
+		g.lo = idx
+	}
+}
+
+// remove removes the slot from the gaps, if present.
+func (g *gapSet) remove(slot uint64) {
+	idx := int(slot >> gapPageBits)
+	if idx >= len(g.pages) || g.pages[idx] == nil {
+		return
+	}
+	page := g.pages[idx]
+	word, mask := (slot&(1<<gapPageBits-1))/64, uint64(1)<<(slot%64)
+	if page.bits[word]&mask == 0 {
+		return
+	}
+	page.bits[word] &^= mask
+	page.n--
+	g.n--
+	if page.n > 0 {
+		return
+	}
+	g.pages[idx] = nil
+	// Keep the last page non-nil, for last to be cheap
+	for len(g.pages) > 0 && g.pages[len(g.pages)-1] == nil {
+		g.pages = g.pages[:len(g.pages)-1]
+	}
+}
+
+// contains returns whether the slot is a gap.
+func (g *gapSet) contains(slot uint64) bool {
+	idx := int(slot >> gapPageBits)
+	if idx >= len(g.pages) || g.pages[idx] == nil {
+		return false
+	}
+	word, mask := (slot&(1<<gapPageBits-1))/64, uint64(1)<<(slot%64)
+	return g.pages[idx].bits[word]&mask != 0
+}
+
+// first returns the lowest gap, if there are any.
+func (g *gapSet) first() (uint64, bool) {
+	if g.n == 0 {
+		return 0, false
+	}
+	for g.pages[g.lo] == nil {
+		g.lo++
+	}
+	page := g.pages[g.lo]
+	for i, word := range page.bits {
+		if word != 0 {
+			return uint64(g.lo)<<gapPageBits + uint64(i*64+bits.TrailingZeros64(word)), true
+		}
+	}
+	panic("empty gap page")
+}
+
+// last returns the highest gap, if there are any.
+func (g *gapSet) last() (uint64, bool) {
+	if g.n == 0 {
+		return 0, false
+	}
+	idx := len(g.pages) - 1
+	page := g.pages[idx]
+	for i := len(page.bits) - 1; i >= 0; i-- {
+		if word := page.bits[i]; word != 0 {
+			return uint64(idx)<<gapPageBits + uint64(i*64+63-bits.LeadingZeros64(word)), true
+		}
+	}
+	panic("empty gap page")
+}
+
+// next returns the lowest gap at or above the given slot, if there is any.
+func (g *gapSet) next(slot uint64) (uint64, bool) {
+	for idx := int(slot >> gapPageBits); idx < len(g.pages); idx++ {
+		page := g.pages[idx]
+		if page == nil {
+			continue
+		}
+		var offset uint64 // Offset of slot within its page, zero for later pages
+		if uint64(idx) == slot>>gapPageBits {
+			offset = slot & (1<<gapPageBits - 1)
+		}
+		for i := int(offset / 64); i < len(page.bits); i++ {
+			word := page.bits[i]
+			if i == int(offset/64) {
+				word &^= 1<<(offset%64) - 1
+			}
+			if word != 0 {
+				return uint64(idx)<<gapPageBits + uint64(i*64+bits.TrailingZeros64(word)), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// trimTail removes the gaps directly below the given tail, and returns the
+// tail which remains.
+func (g *gapSet) trimTail(tail uint64) uint64 {
+	for {
+		last, ok := g.last()
+		if !ok || last+1 != tail {
+			return tail
+		}
+		g.remove(last)
+		tail--
+	}
+}
+
+// each invokes fn for every gap, in ascending order.
+func (g *gapSet) each(fn func(slot uint64)) {
+	for idx := g.lo; idx < len(g.pages); idx++ {
+		page := g.pages[idx]
+		if page == nil {
+			continue
+		}
+		for i, word := range page.bits {
+			for word != 0 {
+				bit := bits.TrailingZeros64(word)
+				fn(uint64(idx)<<gapPageBits + uint64(i*64+bit))
+				word &^= 1 << bit
+			}
+		}
+	}
+}
+
+// slice returns the gaps in ascending order.
+func (g *gapSet) slice() []uint64 {
+	gaps := make([]uint64, 0, g.n)
+	g.each(func(slot uint64) { gaps = append(gaps, slot) })
+	return gaps
+}
+
+// reset removes all gaps.
+func (g *gapSet) reset() {
+	*g = gapSet{}
+}
+
+func (g gapSet) String() string {
+	return fmt.Sprint(g.slice())
+}
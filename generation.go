@@ -0,0 +1,163 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrStaleKey is returned for keys whose slot has been reused for other data
+// since they were issued, see Options.Generations.
+var ErrStaleKey = errors.New("stale key")
+
+// generations holds the generations of the slots of a shelf. They are saved
+// to the metadata file of the shelf when it is closed or checkpointed, and
+// dropped from it before they change, so that they are only loaded if they
+// match the shelf. Otherwise, e.g. after a crash, only the generations of the
+// slots handed out since opening are known. All slots share one counter, which
+// starts at a random value in that case, so that keys issued before the crash
+// are unlikely to match the generation of a slot reused after it.
+type generations struct {
+	mu    sync.Mutex
+	next  uint32            // next is the generation to hand out next
+	slots map[uint64]uint32 // slots maps the slots to their generations
+}
+
+// newGenerations creates the generation tracker of a shelf.
+func newGenerations() *generations {
+	var seed [4]byte
+	_, _ = rand.Read(seed[:]) // A zero seed only weakens restarts
+	return &generations{
+		next:  binary.BigEndian.Uint32(seed[:]),
+		slots: make(map[uint64]uint32),
+	}
+}
+
+// bump assigns a new generation to the slot, as it is handed out for new data.
+// This method assumes that the gapsMu of the shelf is held.
+func (g *generations) bump(slot uint64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Generation zero marks keys which are not checked, skip it
+	if g.next++; g.next&keyGenMask == 0 {
+		g.next++
+	}
+	g.slots[slot] = g.next & keyGenMask
+}
+
+// get returns the generation of the slot, zero if it is not known.
+func (g *generations) get(slot uint64) uint32 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.slots[slot]
+}
+
+// set sets the generation of the slot, e.g. to the one of a key passed to
+// PutAt, or of an item moved into the slot. Zero makes the slot unchecked.
+func (g *generations) set(slot uint64, gen uint32) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if gen == 0 {
+		delete(g.slots, slot)
+	} else {
+		g.slots[slot] = gen
+	}
+}
+
+// check returns ErrStaleKey if the slot has a known generation other than
+// gen. Keys without generation always pass.
+func (g *generations) check(slot uint64, gen uint32) error {
+	if gen == 0 {
+		return nil
+	}
+	if have := g.get(slot); have != 0 && have != gen {
+		return fmt.Errorf("%w: slot %d, generation %d, current %d", ErrStaleKey, slot, gen, have)
+	}
+	return nil
+}
+
+// encode returns the counter and the generations of the slots, in the format
+// stored in the metadata file: the counter, the number of slots, and then the
+// slot and generation of each, ordered by slot.
+func (g *generations) encode() []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	slots := make([]uint64, 0, len(g.slots))
+	for slot := range g.slots {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	blob := make([]byte, 12+12*len(slots))
+	binary.BigEndian.PutUint32(blob, g.next)
+	binary.BigEndian.PutUint64(blob[4:], uint64(len(slots)))
+	for i, slot := range slots {
+		binary.BigEndian.PutUint64(blob[12+12*i:], slot)
+		binary.BigEndian.PutUint32(blob[20+12*i:], g.slots[slot])
+	}
+	return blob
+}
+
+// decode replaces the counter and the generations with those encoded in the
+// blob.
+func (g *generations) decode(blob []byte) error {
+	if len(blob) < 12 {
+		return fmt.Errorf("%w: generations size %d", ErrCorruptData, len(blob))
+	}
+	next, count := binary.BigEndian.Uint32(blob), binary.BigEndian.Uint64(blob[4:])
+	if blob = blob[12:]; uint64(len(blob)) != 12*count {
+		return fmt.Errorf("%w: %d generations in %d bytes", ErrCorruptData, count, len(blob))
+	}
+	slots := make(map[uint64]uint32, count)
+	for ; len(blob) > 0; blob = blob[12:] {
+		slots[binary.BigEndian.Uint64(blob)] = binary.BigEndian.Uint32(blob[8:]) & keyGenMask
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next, g.slots = next, slots
+	return nil
+}
+
+// invalidateGens ensures that the generations saved in the metadata file are
+// no longer loaded, before the generation of a slot changes. This method
+// assumes that the gapsMu is held.
+func (s *shelf) invalidateGens() error {
+	if !s.gensSaved {
+		return nil
+	}
+	if err := writeShelfMeta(s.metaPath, s.created, atomic.LoadInt64(&s.modified), nil); err != nil {
+		return err
+	}
+	s.gensSaved = false
+	return nil
+}
+
+// setGeneration sets the generation of the slot, see generations.set.
+func (s *shelf) setGeneration(slot uint64, gen uint32) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	if err := s.invalidateGens(); err != nil {
+		return err
+	}
+	s.gens.set(slot, gen)
+	return nil
+}
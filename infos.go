@@ -4,9 +4,22 @@
 
 package billy
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 // Infos contains a set of statistics about the underlying datastore.
 type Infos struct {
 	Shelves []*ShelfInfos
+
+	// OversizedPuts is the number of Put calls rejected because the data did
+	// not fit into any shelf.
+	OversizedPuts uint64
+
+	// FileSize and WastedBytes are the totals of all shelves.
+	FileSize    uint64
+	WastedBytes uint64
 }
 
 // ShelfInfos contains some statistics about the data stored in a single shelf.
@@ -14,19 +27,53 @@ type ShelfInfos struct {
 	SlotSize    uint32
 	FilledSlots uint64
 	GappedSlots uint64
+
+	// RemainingSlots is the number of items which can still be added to the
+	// shelf: the gaps, plus the slots up to the maximum tail.
+	RemainingSlots uint64
+
+	// FileSize is the size of the shelf file in bytes, header included.
+	FileSize uint64
+
+	// WastedBytes is an estimate of the space in the shelf file not holding
+	// live data: the gapped slots, which compaction can reclaim. The padding
+	// of live items within their slots is not included.
+	WastedBytes uint64
+
+	// Created and Modified are the times the shelf was created and last
+	// written to. They are persisted across restarts, and zero if unknown,
+	// which is the case for shelves created by older versions of billy.
+	Created  time.Time
+	Modified time.Time
 }
 
 // Infos gathers and returns some stats about the database.
 func (db *database) Infos() *Infos {
-	infos := new(Infos)
+	infos := &Infos{
+		OversizedPuts: atomic.LoadUint64(&db.oversized),
+	}
 	for _, shelf := range db.shelves {
-		slots, gaps := shelf.stats()
-
-		infos.Shelves = append(infos.Shelves, &ShelfInfos{
-			SlotSize:    shelf.slotSize,
-			FilledSlots: slots - gaps,
-			GappedSlots: gaps,
-		})
+		info := shelf.infos()
+		infos.FileSize += info.FileSize
+		infos.WastedBytes += info.WastedBytes
+		infos.Shelves = append(infos.Shelves, info)
 	}
 	return infos
 }
+
+// infos gathers the stats of the shelf.
+func (s *shelf) infos() *ShelfInfos {
+	slots, gaps := s.stats()
+	created, modified := s.times()
+
+	return &ShelfInfos{
+		SlotSize:       s.slotSize,
+		FilledSlots:    slots - gaps,
+		GappedSlots:    gaps,
+		RemainingSlots: s.maxSlots - slots + gaps,
+		FileSize:       s.fileSize(slots),
+		WastedBytes:    gaps * uint64(s.slotSize),
+		Created:        created,
+		Modified:       modified,
+	}
+}
@@ -0,0 +1,73 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "fmt"
+
+// checkInvariants verifies the bookkeeping of the shelf, and panics if it is
+// inconsistent. The given slots, if any, are expected to be live. It is invoked
+// after every mutation if Options.CheckInvariants is set.
+func (s *shelf) checkInvariants(op string, live ...uint64) {
+	if err := s.verifyInvariants(live...); err != nil {
+		panic(fmt.Sprintf("billy: invariant violated after %v, shelf %d: %v", op, s.slotSize, err))
+	}
+}
+
+// verifyInvariants checks that
+//   - the gaps are below the tail,
+//   - the given live slots are below the tail, and not gaps,
+//   - the file and the tail agree, see checkTail.
+func (s *shelf) verifyInvariants(live ...uint64) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	if gap, ok := s.gaps.last(); ok && gap >= s.count {
+		return fmt.Errorf("%w: gap %d beyond tail %d", ErrCorruptData, gap, s.count)
+	}
+	for _, slot := range live {
+		if slot >= s.count {
+			return fmt.Errorf("%w: live slot %d beyond tail %d", ErrCorruptData, slot, s.count)
+		}
+		if s.gaps.contains(slot) {
+			return fmt.Errorf("%w: live slot %d is a gap", ErrCorruptData, slot)
+		}
+	}
+	return s.checkTail()
+}
+
+// checkTail checks that the file holds whole slots up to the tail, and that
+// the header of the last slot is parseable, if it holds data. The file may be
+// shorter than the tail while a Put is in flight, since the tail is extended
+// before the data is written. This method assumes that the gapsMu and fileMu
+// are held (or that the shelf is being opened).
+func (s *shelf) checkTail() error {
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(stat.Size()) - uint64(ShelfHeaderSize)
+	if size%uint64(s.slotSize) != 0 {
+		return fmt.Errorf("%w: file size %d not a multiple of the slot size", ErrCorruptData, size)
+	}
+	slots := size / uint64(s.slotSize)
+	if slots > s.count || (slots < s.count && len(s.pending) == 0) {
+		return fmt.Errorf("%w: file holds %d slots, tail %d", ErrCorruptData, slots, s.count)
+	}
+	if slots == 0 {
+		return nil
+	}
+	last := slots - 1
+	if _, ok := s.pending[last]; ok || s.gaps.contains(last) {
+		return nil
+	}
+	if _, err := s.readSize(make([]byte, itemHeaderSize), last); err != nil {
+		return fmt.Errorf("last slot %d: %w", last, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ioRetries is the number of times in a row a read or write of a shelf file is
+// retried when it is interrupted, or transfers nothing, before it fails.
+const ioRetries = 8
+
+// SlotIOError is returned when reading or writing a shelf file fails, telling
+// where. It wraps the error of the file, so errors.Is and errors.As see
+// through it.
+type SlotIOError struct {
+	Op       string // Op is "read" or "write"
+	SlotSize uint32 // SlotSize is the slot size of the shelf
+	Slot     uint64 // Slot is the slot at Offset, unless it is in the file header
+	Offset   int64  // Offset is the position in the file where the transfer stopped
+	Err      error
+}
+
+func (e *SlotIOError) Error() string {
+	if e.Offset < int64(ShelfHeaderSize) {
+		return fmt.Sprintf("%s shelf %d, file header, offset %d: %v", e.Op, e.SlotSize, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s shelf %d, slot %d, offset %d: %v", e.Op, e.SlotSize, e.Slot, e.Offset, e.Err)
+}
+
+func (e *SlotIOError) Unwrap() error {
+	return e.Err
+}
+
+// retryStore wraps the store of a shelf. It completes the reads and writes
+// which are cut short or interrupted, as stores other than os.File may do,
+// and reports where the ones which ultimately fail stopped.
+type retryStore struct {
+	store
+	slotSize uint32
+}
+
+// ReadAt implements io.ReaderAt of the store interface. Reading past the end
+// of the file fails with a bare io.EOF, like with os.File.
+func (r *retryStore) ReadAt(p []byte, off int64) (int, error) {
+	return r.transfer("read", r.store.ReadAt, p, off)
+}
+
+// WriteAt implements io.WriterAt of the store interface.
+func (r *retryStore) WriteAt(p []byte, off int64) (int, error) {
+	return r.transfer("write", r.store.WriteAt, p, off)
+}
+
+// transfer invokes fn until p is transferred, resuming after the bytes done.
+func (r *retryStore) transfer(op string, fn func([]byte, int64) (int, error), p []byte, off int64) (int, error) {
+	var total, stuck int
+	for total < len(p) {
+		n, err := fn(p[total:], off+int64(total))
+		total += n
+		if errors.Is(err, io.EOF) {
+			return total, err
+		}
+		if err != nil && !isInterrupted(err) {
+			return total, r.fail(op, off+int64(total), err)
+		}
+		if n > 0 {
+			stuck = 0
+			continue
+		}
+		if stuck++; stuck == ioRetries {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+			return total, r.fail(op, off+int64(total), err)
+		}
+	}
+	return total, nil
+}
+
+// fail wraps err with the location in the file.
+func (r *retryStore) fail(op string, off int64, err error) error {
+	e := &SlotIOError{Op: op, SlotSize: r.slotSize, Offset: off, Err: err}
+	if off >= int64(ShelfHeaderSize) {
+		e.Slot = uint64(off-int64(ShelfHeaderSize)) / uint64(r.slotSize)
+	}
+	return e
+}
@@ -0,0 +1,13 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package billy
+
+// isInterrupted reports no error as transient, on platforms without
+// interrupted system calls.
+func isInterrupted(err error) bool {
+	return false
+}
@@ -0,0 +1,19 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package billy
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// isInterrupted reports whether the error is a transient failure of a system
+// call, which is to be retried.
+func isInterrupted(err error) bool {
+	return errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN)
+}
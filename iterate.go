@@ -0,0 +1,138 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "fmt"
+
+// IterateOption configures an iteration performed by Iterate or IterateErr.
+type IterateOption func(*iterateConfig)
+
+// iterateConfig contains the configuration of an iteration.
+type iterateConfig struct {
+	filterSize bool   // filterSize enables filtering by payload size
+	minSize    uint32 // minSize is the smallest payload size to visit
+	maxSize    uint32 // maxSize is the largest payload size to visit
+
+	// onCorrupt is invoked for slots which can't be read, which are then
+	// skipped instead of aborting the iteration. At the shelf level, it is
+	// invoked with slots rather than keys.
+	onCorrupt OnCorruptFn
+
+	startKey  uint64 // startKey is the key to start the iteration at
+	startSlot uint64 // startSlot is the slot to start at, at the shelf level
+	skipShelf bool   // skipShelf is set for shelves before the start key
+
+	slotSize uint32 // slotSize restricts the iteration to one shelf, if set
+	throttle bool   // throttle subjects the reads to the maintenance rates
+}
+
+// OnCorruptFn is invoked for items skipped by an iteration because they could
+// not be read or decoded, see WithSkipCorrupt.
+type OnCorruptFn func(key uint64, err error)
+
+// WithSizeRange makes the iteration skip items whose payload size is outside
+// of [min, max] (inclusive). Skipped items are not read from disk beyond their
+// header, and the callback is not invoked for them.
+func WithSizeRange(min, max uint32) IterateOption {
+	return func(c *iterateConfig) {
+		c.filterSize = true
+		c.minSize, c.maxSize = min, max
+	}
+}
+
+// WithSkipCorrupt makes the iteration skip items which can't be read, e.g.
+// because of corrupt headers or failing sectors, instead of aborting with an
+// error. The optional onCorrupt callback is invoked for every skipped item.
+func WithSkipCorrupt(onCorrupt OnCorruptFn) IterateOption {
+	return func(c *iterateConfig) {
+		if onCorrupt == nil {
+			onCorrupt = func(uint64, error) {}
+		}
+		c.onCorrupt = onCorrupt
+	}
+}
+
+// WithStartKey makes the iteration start at the given key, skipping the items
+// with lower keys without reading them. Since items are visited in ascending
+// key order, this resumes an iteration after the last key seen, plus one.
+func WithStartKey(key uint64) IterateOption {
+	return func(c *iterateConfig) {
+		c.startKey = key
+	}
+}
+
+// WithSlotSize restricts the iteration to the shelf with the given slot size,
+// so that only its file is read. The iteration fails with ErrBadIndex if the
+// database has no such shelf.
+func WithSlotSize(slotSize uint32) IterateOption {
+	return func(c *iterateConfig) {
+		c.slotSize = slotSize
+	}
+}
+
+// WithThrottle subjects the reads of the iteration to the maintenance rates of
+// the database, see WithMaintenanceRate, for background scans which must not
+// slow down other users of the disk.
+func WithThrottle() IterateOption {
+	return func(c *iterateConfig) {
+		c.throttle = true
+	}
+}
+
+// newIterateConfig assembles the configuration from the given options.
+func newIterateConfig(opts []IterateOption) *iterateConfig {
+	cfg := new(iterateConfig)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// skipSize returns whether an item with the given payload size should be
+// skipped by the iteration.
+func (c *iterateConfig) skipSize(size uint32) bool {
+	return c != nil && c.filterSize && (size < c.minSize || size > c.maxSize)
+}
+
+// corrupt reports an unreadable slot, if corrupt slots are to be skipped. It
+// returns the error to abort the iteration with, which is nil if the slot is
+// to be skipped.
+func (c *iterateConfig) corrupt(slot uint64, err error) error {
+	if c == nil || c.onCorrupt == nil {
+		return fmt.Errorf("slot %d: %w", slot, err)
+	}
+	return guard(func() error { c.onCorrupt(slot, err); return nil })
+}
+
+// forShelf returns a copy of the configuration which reports corrupt slots of
+// the shelf with the given id by their keys, and starts at the slot of the
+// start key, if in the shelf.
+func (c *iterateConfig) forShelf(id int) *iterateConfig {
+	cfg := *c
+	switch shelf, slot := SplitKey(c.startKey); {
+	case id < shelf:
+		cfg.skipShelf = true
+	case id == shelf:
+		cfg.startSlot = slot
+	}
+	if onCorrupt := c.onCorrupt; onCorrupt != nil {
+		cfg.onCorrupt = func(slot uint64, err error) { onCorrupt(Key(id, slot), err) }
+	}
+	return &cfg
+}
+
+// withOverhead returns a copy of the configuration with the size range shifted
+// by the given overhead, so that it applies to the stored size of items rather
+// than their payload size.
+func (c *iterateConfig) withOverhead(overhead uint32) *iterateConfig {
+	cfg := *c
+	if cfg.minSize += overhead; cfg.minSize < overhead {
+		cfg.minSize = ^uint32(0)
+	}
+	if cfg.maxSize += overhead; cfg.maxSize < overhead {
+		cfg.maxSize = ^uint32(0)
+	}
+	return &cfg
+}
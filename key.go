@@ -0,0 +1,41 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// A key identifies an item in the database. It packs the id of the shelf (its
+// index among the slot sizes) in bits 28-39, and the slot within the shelf in
+// bits 0-27. If enabled, bits 40-63 hold the generation of the slot.
+const (
+	keySlotBits  = 28
+	keySlotMask  = 1<<keySlotBits - 1
+	keyShelfMask = 0xfff
+	keyGenBits   = 40
+	keyGenMask   = 1<<24 - 1
+	keyIndexMask = 1<<keyGenBits - 1
+)
+
+// Key returns the key of the item at the given slot of the shelf with the given
+// id, the index of its slot size.
+func Key(shelf int, slot uint64) uint64 {
+	return slot | uint64(shelf)<<keySlotBits
+}
+
+// SplitKey returns the shelf id and slot of the item with the given key. It is
+// the inverse of Key, for keys returned by the database. The generation of the
+// slot, if any, is ignored.
+func SplitKey(key uint64) (shelf int, slot uint64) {
+	return int(key>>keySlotBits) & keyShelfMask, key & keySlotMask
+}
+
+// KeyGeneration returns the generation of the slot carried by the key, which
+// is zero for keys without one. See Options.Generations.
+func KeyGeneration(key uint64) uint32 {
+	return uint32(key >> keyGenBits)
+}
+
+// withGeneration returns the key with the given slot generation.
+func withGeneration(key uint64, gen uint32) uint64 {
+	return key | uint64(gen)<<keyGenBits
+}
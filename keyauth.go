@@ -0,0 +1,48 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidKey is returned for keys which were not issued by a database with
+// authenticated keys, see Options.KeySecret.
+var ErrInvalidKey = errors.New("invalid key")
+
+// keyMAC returns the authentication code of the key with the given shelf id
+// and slot, for the given generation of the slot: the first 24 bits of the
+// HMAC-SHA256 of the three.
+func (db *database) keyMAC(index uint64, gen uint32) uint32 {
+	var msg [12]byte
+	binary.BigEndian.PutUint64(msg[:], index)
+	binary.BigEndian.PutUint32(msg[8:], gen)
+
+	mac := hmac.New(sha256.New, db.opts.KeySecret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	return uint32(sum[0])<<16 | uint32(sum[1])<<8 | uint32(sum[2])
+}
+
+// checkMAC returns ErrInvalidKey if the authentication code of the key does
+// not match the given generation of its slot.
+func (db *database) checkMAC(key uint64, gen uint32) error {
+	want := db.keyMAC(key&keyIndexMask, gen)
+	if !hmac.Equal(macBytes(uint32(key>>keyGenBits)), macBytes(want)) {
+		return fmt.Errorf("%w: key %#x", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// macBytes encodes an authentication code, for constant time comparison.
+func macBytes(mac uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], mac)
+	return b[:]
+}
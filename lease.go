@@ -0,0 +1,218 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLeaseHeld    = errors.New("lease held by other writer")
+	ErrLeaseExpired = errors.New("lease expired")
+	ErrNotLeased    = errors.New("key outside of lease")
+)
+
+// Leases hands out expirable write ownership over ranges of shelves. It is
+// meant to be used when a database is fronted by a server accepting writes
+// from several nodes, see remote.NewLeasedServer: a writer must hold a lease
+// covering a shelf in order to put, update or delete items on it, so two
+// misconfigured writers cannot interleave writes on the same shelf.
+//
+// Leases cover ranges of shelf ids rather than ranges of keys. As the shelf
+// id makes up the upper bits of a key, the shelves first to last are the keys
+// from Key(first, 0) up to the last key of shelf last. A Put lands in the
+// shelf picked by the size of the data, so a writer needs a lease over the
+// shelves of the sizes it writes.
+//
+// Reads are not subject to leases, and writes performed directly on the
+// underlying database bypass them.
+type Leases struct {
+	db     *database
+	mu     sync.Mutex
+	owners map[int]*Lease // owners maps shelf id to the lease covering it
+	now    func() time.Time
+}
+
+// Lease represents write ownership of the shelves [First, Last] (inclusive)
+// by a single holder, until it expires or is released.
+type Lease struct {
+	Holder string
+	First  int
+	Last   int
+
+	leases  *Leases
+	expires time.Time
+	writes  int // writes is the number of writes in progress under the lease
+}
+
+// NewLeases creates a lease manager for the given database, which must be one
+// returned by Open.
+func NewLeases(db Database) (*Leases, error) {
+	d, ok := db.(*database)
+	if !ok {
+		return nil, fmt.Errorf("leases unsupported for database type %T", db)
+	}
+	return &Leases{
+		db:     d,
+		owners: make(map[int]*Lease),
+		now:    time.Now,
+	}, nil
+}
+
+// Acquire grants the holder a lease over the shelves with id first to last
+// (inclusive), valid for the given duration. If any of the shelves is covered
+// by a lease of a different holder which is unexpired, or still has writes in
+// progress, ErrLeaseHeld is returned.
+func (l *Leases) Acquire(holder string, first, last int, ttl time.Duration) (*Lease, error) {
+	if first < 0 || last < first || last >= len(l.db.shelves) {
+		return nil, fmt.Errorf("%w: shelves %d-%d", ErrBadIndex, first, last)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for id := first; id <= last; id++ {
+		if owner, ok := l.owners[id]; ok && owner.Holder != holder && (now.Before(owner.expires) || owner.writes > 0) {
+			return nil, fmt.Errorf("%w: shelf %d, holder %q", ErrLeaseHeld, id, owner.Holder)
+		}
+	}
+	lease := &Lease{
+		Holder:  holder,
+		First:   first,
+		Last:    last,
+		leases:  l,
+		expires: now.Add(ttl),
+	}
+	for id := first; id <= last; id++ {
+		l.owners[id] = lease
+	}
+	return lease, nil
+}
+
+// Renew extends the lease to expire ttl from now. A lease which has already
+// expired or been superseded cannot be renewed.
+func (ls *Lease) Renew(ttl time.Duration) error {
+	l := ls.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := ls.check(ls.First); err != nil {
+		return err
+	}
+	ls.expires = l.now().Add(ttl)
+	return nil
+}
+
+// Release gives up the lease, making the shelves available to other holders
+// once the writes in progress under it are done.
+func (ls *Lease) Release() {
+	l := ls.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id := ls.First; id <= ls.Last; id++ {
+		if l.owners[id] == ls && ls.writes == 0 {
+			delete(l.owners, id)
+		}
+	}
+	ls.expires = time.Time{}
+}
+
+// Expires returns the time when the lease expires.
+func (ls *Lease) Expires() time.Time {
+	ls.leases.mu.Lock()
+	defer ls.leases.mu.Unlock()
+
+	return ls.expires
+}
+
+// check verifies that the lease is valid, and covers the given shelf. This
+// method assumes that the lease manager is locked.
+func (ls *Lease) check(id int) error {
+	if id < ls.First || id > ls.Last {
+		return fmt.Errorf("%w: shelf %d, lease %d-%d", ErrNotLeased, id, ls.First, ls.Last)
+	}
+	if ls.leases.owners[id] != ls || !ls.leases.now().Before(ls.expires) {
+		return fmt.Errorf("%w: holder %q", ErrLeaseExpired, ls.Holder)
+	}
+	return nil
+}
+
+// begin checks that the lease is valid and covers the given shelf, and
+// registers a write under it. The write must be ended with end, and is done
+// in between without the lock of the lease manager held. Until then the
+// shelves are not handed to other holders, even if the lease expires.
+func (ls *Lease) begin(id int) error {
+	l := ls.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := ls.check(id); err != nil {
+		return err
+	}
+	ls.writes++
+	return nil
+}
+
+// end ends a write registered by begin.
+func (ls *Lease) end() {
+	ls.leases.mu.Lock()
+	ls.writes--
+	ls.leases.mu.Unlock()
+}
+
+// Put stores the data in the database, provided that the shelf it belongs
+// to is covered by the lease.
+func (ls *Lease) Put(data []byte) (uint64, error) {
+	db := ls.leases.db
+
+	// Oversized data is rejected by the database itself
+	if id := db.shelfFor(len(data)); id < len(db.shelves) {
+		if err := ls.begin(id); err != nil {
+			return 0, err
+		}
+		defer ls.end()
+	}
+	return db.Put(data)
+}
+
+// PutAt stores the data in the database at the given key, provided that the
+// shelf of the key is covered by the lease.
+func (ls *Lease) PutAt(key uint64, data []byte) error {
+	id, _ := SplitKey(key)
+	if err := ls.begin(id); err != nil {
+		return err
+	}
+	defer ls.end()
+
+	return ls.leases.db.PutAt(key, data)
+}
+
+// UpdateRange overwrites part of the data at the given key, provided that the
+// shelf of the key is covered by the lease.
+func (ls *Lease) UpdateRange(key, off uint64, data []byte) error {
+	id, _ := SplitKey(key)
+	if err := ls.begin(id); err != nil {
+		return err
+	}
+	defer ls.end()
+
+	return ls.leases.db.UpdateRange(key, off, data)
+}
+
+// Delete removes the data at the given key from the database, provided that
+// the shelf it belongs to is covered by the lease.
+func (ls *Lease) Delete(key uint64) error {
+	id, _ := SplitKey(key)
+	if err := ls.begin(id); err != nil {
+		return err
+	}
+	defer ls.end()
+
+	return ls.leases.db.Delete(key)
+}
@@ -0,0 +1,129 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	leases, err := NewLeases(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	leases.now = func() time.Time { return now }
+
+	a, err := leases.Acquire("a", 0, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overlapping lease by other holder must fail
+	if _, err := leases.Acquire("b", 1, 2, time.Minute); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("want %v, have %v", ErrLeaseHeld, err)
+	}
+	b, err := leases.Acquire("b", 2, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Put(fill(0, 140)); err != nil {
+		t.Fatal(err)
+	}
+	// 300 bytes goes to shelf 2, owned by b
+	if _, err := a.Put(fill(0, 300)); !errors.Is(err, ErrNotLeased) {
+		t.Fatalf("want %v, have %v", ErrNotLeased, err)
+	}
+	key, err := b.Put(fill(0, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete(key); !errors.Is(err, ErrNotLeased) {
+		t.Fatalf("want %v, have %v", ErrNotLeased, err)
+	}
+	// Let b expire, a can then take over
+	now = now.Add(2 * time.Minute)
+	if err := b.Delete(key); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("want %v, have %v", ErrLeaseExpired, err)
+	}
+	if err := b.Renew(time.Minute); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("want %v, have %v", ErrLeaseExpired, err)
+	}
+	c, err := leases.Acquire("a", 0, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	c.Release()
+	if _, err := leases.Acquire("b", 0, 2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leases.Acquire("b", 0, 3, time.Minute); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+}
+
+func TestLeaseWrites(t *testing.T) {
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := NewLeases(struct{ Database }{db}); err == nil {
+		t.Fatal("leases over foreign database created")
+	}
+	leases, err := NewLeases(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	leases.now = func() time.Time { return now }
+
+	a, err := leases.Acquire("a", 0, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := a.Put(fill(1, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UpdateRange(key, 1, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.PutAt(Key(1, 0), fill(3, 200)); !errors.Is(err, ErrNotLeased) {
+		t.Fatalf("want %v, have %v", ErrNotLeased, err)
+	}
+	if err := a.UpdateRange(Key(1, 0), 0, []byte{2}); !errors.Is(err, ErrNotLeased) {
+		t.Fatalf("want %v, have %v", ErrNotLeased, err)
+	}
+	// A write in progress keeps the shelf from other holders, even once the
+	// lease has expired or been released
+	if err := a.begin(0); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	a.Release()
+	if _, err := leases.Acquire("b", 0, 0, time.Minute); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("want %v, have %v", ErrLeaseHeld, err)
+	}
+	a.end()
+	b, err := leases.Acquire("b", 0, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,19 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !billydebug
+
+package billy
+
+import "sync"
+
+// The shelf mutexes are plain mutexes, unless built with the billydebug tag,
+// in which case the lock order is verified at runtime (see lockorder_debug.go).
+type (
+	gapsMutex = sync.Mutex
+	fileMutex = sync.RWMutex
+)
+
+// lockOrderChecks is set if the lock order is verified at runtime.
+const lockOrderChecks = false
@@ -0,0 +1,140 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build billydebug
+
+package billy
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Lock ranks of the shelf mutexes. A goroutine may only acquire a lock with a
+// higher rank than all the locks it already holds, on any shelf. This rules
+// out both lock order inversions and re-entrant locking.
+const (
+	gapsRank = 1
+	fileRank = 2
+)
+
+// lockOrderChecks is set if the lock order is verified at runtime.
+const lockOrderChecks = true
+
+// heldLock is a lock held by a goroutine, with the stack where it was acquired.
+type heldLock struct {
+	lock  any
+	rank  int
+	name  string
+	stack string
+}
+
+var (
+	lockOrderMu sync.Mutex
+	heldLocks   = make(map[uint64][]heldLock) // heldLocks maps goroutine id to its held locks
+)
+
+// goid returns the id of the current goroutine, parsed from its stack trace.
+func goid() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	id, _ := strconv.ParseUint(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+	return id
+}
+
+// acquiring verifies that the current goroutine is allowed to acquire the
+// given lock, and panics with a report of the held locks otherwise. It must be
+// called before blocking on the lock, so that violations are reported rather
+// than deadlocking.
+func acquiring(lock any, rank int, name string) {
+	var (
+		id    = goid()
+		stack = make([]byte, 4096)
+	)
+	stack = stack[:runtime.Stack(stack, false)]
+
+	lockOrderMu.Lock()
+	defer lockOrderMu.Unlock()
+
+	held := heldLocks[id]
+	for _, h := range held {
+		if h.rank < rank {
+			continue
+		}
+		var report strings.Builder
+		fmt.Fprintf(&report, "billy: lock order violation: acquiring %v while holding %v\n", name, h.name)
+		fmt.Fprintf(&report, "\nacquiring %v at:\n%s\n", name, stack)
+		for _, h := range held {
+			fmt.Fprintf(&report, "\nholding %v, acquired at:\n%s\n", h.name, h.stack)
+		}
+		panic(report.String())
+	}
+	heldLocks[id] = append(held, heldLock{lock, rank, name, string(stack)})
+}
+
+// released removes the lock from the locks held by the current goroutine.
+func released(lock any) {
+	id := goid()
+
+	lockOrderMu.Lock()
+	defer lockOrderMu.Unlock()
+
+	held := heldLocks[id]
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i].lock == lock {
+			held = append(held[:i], held[i+1:]...)
+			break
+		}
+	}
+	if len(held) == 0 {
+		delete(heldLocks, id)
+	} else {
+		heldLocks[id] = held
+	}
+}
+
+// gapsMutex is the mutex guarding the gaps of a shelf, with lock order checks.
+type gapsMutex struct {
+	mu sync.Mutex
+}
+
+func (m *gapsMutex) Lock() {
+	acquiring(m, gapsRank, "gapsMu")
+	m.mu.Lock()
+}
+
+func (m *gapsMutex) Unlock() {
+	released(m)
+	m.mu.Unlock()
+}
+
+// fileMutex is the mutex guarding the file of a shelf, with lock order checks.
+type fileMutex struct {
+	mu sync.RWMutex
+}
+
+func (m *fileMutex) Lock() {
+	acquiring(m, fileRank, "fileMu")
+	m.mu.Lock()
+}
+
+func (m *fileMutex) Unlock() {
+	released(m)
+	m.mu.Unlock()
+}
+
+func (m *fileMutex) RLock() {
+	acquiring(m, fileRank, "fileMu (read)")
+	m.mu.RLock()
+}
+
+func (m *fileMutex) RUnlock() {
+	released(m)
+	m.mu.RUnlock()
+}
@@ -0,0 +1,37 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build billydebug
+
+package billy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLockOrderViolation(t *testing.T) {
+	a, err := openShelf("", 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// Correct order
+	a.gapsMu.Lock()
+	a.fileMu.RLock()
+	a.fileMu.RUnlock()
+	a.gapsMu.Unlock()
+
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(r.(string), "acquiring gapsMu while holding fileMu") {
+			t.Fatalf("expected lock order violation, have %v", r)
+		}
+		// Leave the locks in a sane state for Close
+		released(&a.fileMu)
+		a.fileMu.mu.Unlock()
+	}()
+	a.fileMu.Lock()
+	a.gapsMu.Lock()
+}
@@ -0,0 +1,43 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "errors"
+
+// ErrPaused is returned by maintenance operations invoked while maintenance is
+// paused, see PauseBackground.
+var ErrPaused = errors.New("maintenance paused")
+
+// PauseBackground pauses the maintenance operations (Compact, Expire and
+// Checkpoint): it waits for the ones in flight to finish, after which they
+// fail with ErrPaused until ResumeBackground is called. Billy runs nothing in
+// the background by itself, but this allows a caller to guarantee that no
+// maintenance I/O happens during a latency-critical window, without
+// coordinating the goroutines which drive it.
+//
+// It must not be called from the callbacks of maintenance operations.
+func (db *database) PauseBackground() {
+	db.maintMu.Lock()
+	db.paused = true
+	db.maintMu.Unlock()
+}
+
+// ResumeBackground allows maintenance operations again.
+func (db *database) ResumeBackground() {
+	db.maintMu.Lock()
+	db.paused = false
+	db.maintMu.Unlock()
+}
+
+// startMaintenance registers a maintenance operation, unless maintenance is
+// paused. The returned function must be called once the operation is done.
+func (db *database) startMaintenance() (func(), error) {
+	db.maintMu.RLock()
+	if db.paused {
+		db.maintMu.RUnlock()
+		return nil, ErrPaused
+	}
+	return db.maintMu.RUnlock, nil
+}
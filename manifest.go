@@ -0,0 +1,141 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrSlotSizes is returned by Open when the slot sizes passed differ from the
+// ones the database was created with.
+var ErrSlotSizes = errors.New("slot sizes mismatch")
+
+// manifestName is the file recording the slot sizes of a database.
+const manifestName = "MANIFEST"
+
+// manifestHeader is the header of the manifest file. It is followed by Count
+// slot sizes, each a uint32.
+type manifestHeader struct {
+	Magic   [5]byte // "billy"
+	Version uint16
+	Count   uint32
+}
+
+// readManifest reads the slot sizes recorded in the manifest in dir.
+func readManifest(dir string) ([]uint32, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		r = bytes.NewReader(blob)
+		h manifestHeader
+	)
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil || h.Magic != Magic {
+		return nil, fmt.Errorf("%w: manifest in %v", ErrCorruptData, dir)
+	}
+	if h.Version != curVersion {
+		return nil, fmt.Errorf("%w: manifest version %d", ErrVersion, h.Version)
+	}
+	if uint64(r.Len()) != 4*uint64(h.Count) {
+		return nil, fmt.Errorf("%w: manifest of %d slot sizes has %d bytes", ErrCorruptData, h.Count, len(blob))
+	}
+	sizes := make([]uint32, h.Count)
+	if err := binary.Read(r, binary.BigEndian, sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// writeManifest atomically replaces the manifest in dir with the given slot
+// sizes.
+func writeManifest(dir string, sizes []uint32) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, &manifestHeader{Magic, curVersion, uint32(len(sizes))}); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, sizes); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestName), buf.Bytes())
+}
+
+// checkManifest verifies that the database in dir has the given slot sizes,
+// and reports whether the manifest has to be written. Databases created before
+// manifests were introduced have none: their shelf files are checked instead,
+// since opening them with other slot sizes would leave shelves behind.
+func checkManifest(dir string, sizes []uint32) (bool, error) {
+	have, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		have, err = shelfSizes(dir)
+		if err != nil {
+			return false, err
+		}
+		for _, size := range have {
+			if i := sort.Search(len(sizes), func(i int) bool { return sizes[i] >= size }); i == len(sizes) || sizes[i] != size {
+				return false, fmt.Errorf("%w: found shelf of slot size %d, want slot sizes %v", ErrSlotSizes, size, sizes)
+			}
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !equalSizes(have, sizes) {
+		return false, fmt.Errorf("%w: have %v, want %v", ErrSlotSizes, have, sizes)
+	}
+	return false, nil
+}
+
+// shelfSizes returns the slot sizes of the shelf files in dir.
+func shelfSizes(dir string) ([]uint32, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "bkt_*.bag"))
+	if err != nil {
+		return nil, err
+	}
+	var sizes []uint32
+	for _, file := range files {
+		var size uint32
+		if _, err := fmt.Sscanf(filepath.Base(file), "bkt_%08d.bag", &size); err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes, nil
+}
+
+// equalSizes reports whether the slot size lists are the same.
+func equalSizes(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeManifest writes the manifest of the database into dir, for copies of
+// the database.
+func (db *database) writeManifest(dir string) error {
+	sizes := make([]uint32, len(db.shelves))
+	for i, shelf := range db.shelves {
+		sizes[i] = shelf.slotSize
+	}
+	return writeManifest(dir, sizes)
+}
+
+// SlotSizesOf returns the slot sizes recorded in the manifest of the database
+// in dir, for opening it with SlotSizeList without knowing its slot sizes.
+func SlotSizesOf(dir string) ([]uint32, error) {
+	return readManifest(dir)
+}
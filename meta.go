@@ -0,0 +1,147 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// shelfMeta is the header of the metadata file of a shelf, which records
+// when the shelf was created and last modified, in unix nanoseconds. It is
+// followed by the encoded slot generations, if they are tracked and match the
+// shelf, see generations.encode.
+type shelfMeta struct {
+	Magic    [5]byte // "billy"
+	Version  uint16
+	Created  int64
+	Modified int64
+}
+
+// metaName returns the file name of the metadata file of a shelf.
+func metaName(slotSize uint32) string {
+	return fmt.Sprintf("bkt_%08d.meta", slotSize)
+}
+
+// readShelfMeta reads the creation and modification times from the metadata
+// file at the given path, and the encoded generations, nil if there are none.
+func readShelfMeta(path string) (int64, int64, []byte, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var m shelfMeta
+	if len(blob) < binary.Size(m) {
+		return 0, 0, nil, fmt.Errorf("%w: metadata size %d", ErrCorruptData, len(blob))
+	}
+	if err := binary.Read(bytes.NewReader(blob), binary.BigEndian, &m); err != nil {
+		return 0, 0, nil, err
+	}
+	switch {
+	case m.Magic != Magic:
+		return 0, 0, nil, errors.New("missing magic")
+	case m.Version != curVersion:
+		return 0, 0, nil, fmt.Errorf("wrong version: %d", m.Version)
+	}
+	var gens []byte
+	if len(blob) > binary.Size(m) {
+		gens = blob[binary.Size(m):]
+	}
+	return m.Created, m.Modified, gens, nil
+}
+
+// writeShelfMeta atomically replaces the metadata file at the given path,
+// followed by the encoded generations, if any.
+func writeShelfMeta(path string, created, modified int64, gens []byte) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, &shelfMeta{Magic, curVersion, created, modified}); err != nil {
+		return err
+	}
+	buf.Write(gens)
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// writeFileAtomic replaces the file at path with the given content, through a
+// temporary file, so that it is never left partially written.
+func writeFileAtomic(path string, blob []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, blob, 0666); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadMeta initializes the creation and modification times of the shelf. For
+// new shelves, these are the current time, otherwise they are read from the
+// metadata file, along with the generations of the slots if saved. Shelves
+// created before metadata files were introduced have unknown (zero) times,
+// until they are modified.
+func (s *shelf) loadMeta(isNew bool) error {
+	now := time.Now().UnixNano()
+	if isNew || s.metaPath == "" {
+		s.created, s.modified = now, now
+		return s.saveMeta()
+	}
+	created, modified, gens, err := readShelfMeta(s.metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		s.log.Printf("billy: ignoring unreadable metadata file %v: %v", s.metaPath, err)
+		return nil
+	}
+	s.created, s.modified = created, modified
+	if s.gens != nil && gens != nil {
+		if err := s.gens.decode(gens); err != nil {
+			s.log.Printf("billy: ignoring unreadable generations in %v: %v", s.metaPath, err)
+			return nil
+		}
+		s.gensSaved = true
+	}
+	return nil
+}
+
+// saveMeta writes the creation and modification times to the metadata file,
+// along with the generations of the slots if tracked, unless the shelf is
+// in-memory or read-only. The generations must match the data on disk, e.g.
+// after syncing the shelf file.
+func (s *shelf) saveMeta() error {
+	if s.metaPath == "" || s.readonly {
+		return nil
+	}
+	var gens []byte
+	if s.gens != nil {
+		gens = s.gens.encode()
+	}
+	if err := writeShelfMeta(s.metaPath, s.created, atomic.LoadInt64(&s.modified), gens); err != nil {
+		return err
+	}
+	s.gensSaved = s.gens != nil
+	return nil
+}
+
+// touch records that the shelf has been modified.
+func (s *shelf) touch() {
+	atomic.StoreInt64(&s.modified, time.Now().UnixNano())
+}
+
+// times returns the creation and last modification time of the shelf, which
+// are zero if unknown.
+func (s *shelf) times() (time.Time, time.Time) {
+	var created, modified time.Time
+	if s.created != 0 {
+		created = time.Unix(0, s.created)
+	}
+	if m := atomic.LoadInt64(&s.modified); m != 0 {
+		modified = time.Unix(0, m)
+	}
+	return created, modified
+}
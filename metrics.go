@@ -0,0 +1,51 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// Metrics receives events about the operations performed by a database, so
+// that they can be wired into external telemetry. The shelf an event belongs
+// to is identified by its slot size.
+//
+// The methods are invoked synchronously, sometimes while internal locks are
+// held: implementations must be fast, safe for concurrent use, and must not
+// call back into the database.
+type Metrics interface {
+	// Put is invoked when an item of the given size has been stored.
+	Put(slotSize uint32, size int)
+	// Get is invoked when an item of the given size has been retrieved.
+	Get(slotSize uint32, size int)
+	// Delete is invoked when an item has been deleted.
+	Delete(slotSize uint32)
+	// Read is invoked when bytes have been read from the shelf file.
+	Read(slotSize uint32, bytes int)
+	// Write is invoked when bytes have been written to the shelf file.
+	Write(slotSize uint32, bytes int)
+	// Gaps is invoked when the tail or number of gaps of a shelf has changed.
+	Gaps(slotSize uint32, tail uint64, gaps int)
+	// Move is invoked when an item has been moved by compaction.
+	Move(slotSize uint32)
+	// Oversized is invoked when a Put has been rejected because the item of
+	// the given size does not fit into any shelf.
+	Oversized(size int)
+}
+
+// NopMetrics is a Metrics implementation which discards all events. It can be
+// embedded by implementations which are only interested in some of them.
+type NopMetrics struct{}
+
+func (NopMetrics) Put(uint32, int)          {}
+func (NopMetrics) Get(uint32, int)          {}
+func (NopMetrics) Delete(uint32)            {}
+func (NopMetrics) Read(uint32, int)         {}
+func (NopMetrics) Write(uint32, int)        {}
+func (NopMetrics) Gaps(uint32, uint64, int) {}
+func (NopMetrics) Move(uint32)              {}
+func (NopMetrics) Oversized(int)            {}
+
+// reportGaps reports the tail and number of gaps to the metrics. This method
+// assumes that the gapsMu is held.
+func (s *shelf) reportGaps() {
+	s.metrics.Gaps(s.slotSize, s.count, s.gaps.len())
+}
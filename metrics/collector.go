@@ -0,0 +1,141 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package metrics exposes the statistics of a billy database to Prometheus.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ethstorage/billy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector over a billy database. It exposes
+// per-shelf statistics, which are gathered from the database on every scrape,
+// and the latencies of the operations performed through Database.
+type Collector struct {
+	db billy.Database
+
+	slots         *prometheus.Desc
+	items         *prometheus.Desc
+	gaps          *prometheus.Desc
+	fragmentation *prometheus.Desc
+	fileSize      *prometheus.Desc
+	wasted        *prometheus.Desc
+	remaining     *prometheus.Desc
+	oversized     *prometheus.Desc
+	latency       *prometheus.HistogramVec
+}
+
+// NewCollector creates a collector for the given database. The namespace is
+// prepended to all metric names, and may be empty.
+func NewCollector(db billy.Database, namespace string) *Collector {
+	shelfLabels := []string{"slotsize"}
+	return &Collector{
+		db: db,
+		slots: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "slots"),
+			"Total number of slots in the shelf, live or gapped", shelfLabels, nil),
+		items: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "items"),
+			"Number of live items in the shelf", shelfLabels, nil),
+		gaps: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "gaps"),
+			"Number of gaps in the shelf", shelfLabels, nil),
+		fragmentation: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "fragmentation_ratio"),
+			"Ratio of gapped slots to total slots in the shelf", shelfLabels, nil),
+		fileSize: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "file_bytes"),
+			"Size of the shelf file in bytes", shelfLabels, nil),
+		wasted: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "wasted_bytes"),
+			"Estimated bytes of the shelf file taken up by gaps", shelfLabels, nil),
+		remaining: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "remaining_slots"),
+			"Number of items which can still be added to the shelf", shelfLabels, nil),
+		oversized: prometheus.NewDesc(prometheus.BuildFQName(namespace, "billy", "oversized_puts_total"),
+			"Number of puts rejected for not fitting into any shelf", nil, nil),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "billy",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of database operations",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, []string{"op"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.slots
+	ch <- c.items
+	ch <- c.gaps
+	ch <- c.fragmentation
+	ch <- c.fileSize
+	ch <- c.wasted
+	ch <- c.remaining
+	ch <- c.oversized
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	infos := c.db.Infos()
+	for _, shelf := range infos.Shelves {
+		var (
+			label = strconv.FormatUint(uint64(shelf.SlotSize), 10)
+			slots = shelf.FilledSlots + shelf.GappedSlots
+			frag  float64
+		)
+		if slots > 0 {
+			frag = float64(shelf.GappedSlots) / float64(slots)
+		}
+		ch <- prometheus.MustNewConstMetric(c.slots, prometheus.GaugeValue, float64(slots), label)
+		ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(shelf.FilledSlots), label)
+		ch <- prometheus.MustNewConstMetric(c.gaps, prometheus.GaugeValue, float64(shelf.GappedSlots), label)
+		ch <- prometheus.MustNewConstMetric(c.fragmentation, prometheus.GaugeValue, frag, label)
+		ch <- prometheus.MustNewConstMetric(c.fileSize, prometheus.GaugeValue, float64(shelf.FileSize), label)
+		ch <- prometheus.MustNewConstMetric(c.wasted, prometheus.GaugeValue, float64(shelf.WastedBytes), label)
+		ch <- prometheus.MustNewConstMetric(c.remaining, prometheus.GaugeValue, float64(shelf.RemainingSlots), label)
+	}
+	ch <- prometheus.MustNewConstMetric(c.oversized, prometheus.CounterValue, float64(infos.OversizedPuts))
+	c.latency.Collect(ch)
+}
+
+// Database returns the database, wrapped so that the latencies of the
+// operations performed through it are measured by the collector.
+func (c *Collector) Database() billy.Database {
+	return &timedDatabase{Database: c.db, latency: c.latency}
+}
+
+// timedDatabase measures the latencies of the operations of a database.
+type timedDatabase struct {
+	billy.Database
+	latency *prometheus.HistogramVec
+}
+
+func (db *timedDatabase) observe(op string, start time.Time) {
+	db.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (db *timedDatabase) Put(data []byte) (uint64, error) {
+	defer db.observe("put", time.Now())
+	return db.Database.Put(data)
+}
+
+func (db *timedDatabase) Get(key uint64) ([]byte, error) {
+	defer db.observe("get", time.Now())
+	return db.Database.Get(key)
+}
+
+func (db *timedDatabase) GetSample(key, off, length uint64) ([]byte, error) {
+	defer db.observe("getsample", time.Now())
+	return db.Database.GetSample(key, off, length)
+}
+
+func (db *timedDatabase) Delete(key uint64) error {
+	defer db.observe("delete", time.Now())
+	return db.Database.Delete(key)
+}
+
+func (db *timedDatabase) Compact(onMove billy.OnMoveFn) error {
+	defer db.observe("compact", time.Now())
+	return db.Database.Compact(onMove)
+}
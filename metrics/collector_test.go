@@ -0,0 +1,56 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethstorage/billy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	db, err := billy.Open("", billy.SlotSizePowerOfTwo(128, 256), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := NewCollector(db, "test")
+	tdb := c.Database()
+	for i := 0; i < 4; i++ {
+		_, _ = tdb.Put(make([]byte, 100))
+	}
+	_ = tdb.Delete(1)
+	_, _ = tdb.Get(0)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+# HELP test_billy_fragmentation_ratio Ratio of gapped slots to total slots in the shelf
+# TYPE test_billy_fragmentation_ratio gauge
+test_billy_fragmentation_ratio{slotsize="128"} 0.25
+test_billy_fragmentation_ratio{slotsize="256"} 0
+# HELP test_billy_items Number of live items in the shelf
+# TYPE test_billy_items gauge
+test_billy_items{slotsize="128"} 3
+test_billy_items{slotsize="256"} 0
+# HELP test_billy_wasted_bytes Estimated bytes of the shelf file taken up by gaps
+# TYPE test_billy_wasted_bytes gauge
+test_billy_wasted_bytes{slotsize="128"} 128
+test_billy_wasted_bytes{slotsize="256"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"test_billy_items", "test_billy_fragmentation_ratio", "test_billy_wasted_bytes"); err != nil {
+		t.Fatal(err)
+	}
+	if have := testutil.CollectAndCount(c, "test_billy_operation_duration_seconds"); have != 3 {
+		t.Fatalf("have %d latency series, want 3", have)
+	}
+}
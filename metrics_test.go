@@ -0,0 +1,150 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingMetrics counts the events received, per kind.
+type countingMetrics struct {
+	NopMetrics
+	mu     sync.Mutex
+	counts map[string]int
+	gaps   map[uint32]int
+}
+
+func (m *countingMetrics) inc(kind string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[kind] += n
+}
+
+func (m *countingMetrics) Put(uint32, int)       { m.inc("put", 1) }
+func (m *countingMetrics) Get(uint32, int)       { m.inc("get", 1) }
+func (m *countingMetrics) Delete(uint32)         { m.inc("delete", 1) }
+func (m *countingMetrics) Write(_ uint32, n int) { m.inc("written", n) }
+func (m *countingMetrics) Read(uint32, int)      { m.inc("read", 1) }
+func (m *countingMetrics) Move(uint32)           { m.inc("move", 1) }
+func (m *countingMetrics) Oversized(int)         { m.inc("oversized", 1) }
+func (m *countingMetrics) Gaps(slotSize uint32, tail uint64, gaps int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gaps[slotSize] = gaps
+}
+
+func TestMetrics(t *testing.T) {
+	m := &countingMetrics{counts: make(map[string]int), gaps: make(map[uint32]int)}
+	db, err := Open(t.TempDir(), SlotSizePowerOfTwo(128, 500), nil, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	k0, _ := db.Put(fill(0, 140))
+	_, _ = db.Put(fill(1, 140))
+	_, _ = db.Put(fill(2, 140))
+	_, _ = db.Put(fill(3, 1000))
+	_, _ = db.Get(k0)
+	_ = db.Delete(k0)
+	if have, want := m.gaps[256], 1; have != want {
+		t.Fatalf("have %d gaps, want %d", have, want)
+	}
+	if err := db.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := m.gaps[256], 0; have != want {
+		t.Fatalf("have %d gaps, want %d", have, want)
+	}
+	for kind, want := range map[string]int{
+		"put":       3,
+		"get":       1,
+		"delete":    1,
+		"move":      1,
+		"oversized": 1,
+		"written":   4 * 256,
+	} {
+		if have := m.counts[kind]; have != want {
+			t.Errorf("%v: have %d, want %d", kind, have, want)
+		}
+	}
+}
+
+func TestBatchedReads(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		m   = &countingMetrics{counts: make(map[string]int), gaps: make(map[uint32]int)}
+	)
+	db, err := Open(dir, SlotSizeLinear(128, 1), nil, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if _, err := db.Put(fill(byte(i), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i += 3 {
+		_ = db.Delete(uint64(i))
+	}
+	// 2000 slots of 128 bytes take one read per megabyte
+	m.counts = make(map[string]int)
+	items := 0
+	if err := db.Iterate(func(uint64, uint32, []byte) { items++ }); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := m.counts["read"], 1; have != want {
+		t.Fatalf("have %d reads want %d", have, want)
+	}
+	if have, want := items, 1333; have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	db.Close()
+
+	// Compaction on open reads forwards and backwards, in batches too
+	m.counts = make(map[string]int)
+	items = 0
+	db, err = Open(dir, SlotSizeLinear(128, 1), func(uint64, uint32, []byte) { items++ }, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if have, want := items, 1333; have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+	if have := m.counts["read"]; have > 4 {
+		t.Fatalf("have %d reads want at most 4", have)
+	}
+}
+
+// writeCounter counts the writes to shelf files.
+type writeCounter struct {
+	NopMetrics
+	writes uint32
+}
+
+func (m *writeCounter) Write(uint32, int) { atomic.AddUint32(&m.writes, 1) }
+
+func TestSingleWritePerPut(t *testing.T) {
+	m := new(writeCounter)
+	db, err := Open(t.TempDir(), SlotSizeLinear(128, 2), nil, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := db.Put(fill(byte(i), 10+i*20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.PutWithTTL(fill(10, 10), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := atomic.LoadUint32(&m.writes), uint32(11); have != want {
+		t.Fatalf("have %d writes want %d", have, want)
+	}
+}
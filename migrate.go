@@ -0,0 +1,343 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// migrateDir is the directory within the database directory into which Migrate
+// writes the migrated database, before moving it in place.
+const migrateDir = "migrate.tmp"
+
+// migrateMarker is the file recording that the migrated database is complete,
+// and that its files are being swapped for the old ones. It lists the old slot
+// sizes, so that an interrupted swap can be completed.
+const migrateMarker = "MIGRATE"
+
+// Migrate rewrites the database in dir from the slot sizes given by oldSlots to
+// those given by newSlots, in place. The items are copied into a new database
+// in a subdirectory first, which then replaces the shelf files of the old slot
+// sizes. The optional onRekey callback is invoked with the old and new key of
+// every item, as items change keys; the new keys are valid once Migrate has
+// returned without error. The options, e.g. the encryption key, apply to both
+// layouts.
+//
+// The directory is locked for the whole migration, which fails with ErrLocked
+// if the database is open for writing. If Migrate is interrupted while copying,
+// the database is unchanged. Once the copy is complete, a marker file records
+// that the files are being swapped: until the swap is done, Open fails, and
+// calling Migrate again completes it.
+func Migrate(dir string, oldSlots, newSlots SlotSizeFn, onRekey OnImportFn, options ...Option) error {
+	opts := new(Options)
+	for _, option := range options {
+		option(opts)
+	}
+	lock, err := lockDir(dir, opts.logger())
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	marker := filepath.Join(dir, migrateMarker)
+	oldSizes, err := readMigrateMarker(marker)
+	if errors.Is(err, os.ErrNotExist) {
+		if oldSizes, err = SlotSizes(oldSlots); err != nil {
+			return err
+		}
+		tmp := filepath.Join(dir, migrateDir)
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+		// The source is opened read-only, without taking the lock file
+		if err := MigrateTo(dir, tmp, SlotSizeList(oldSizes...), newSlots, onRekey, options...); err != nil {
+			return err
+		}
+		err = writeMigrateMarker(marker, oldSizes)
+	}
+	if err != nil {
+		return err
+	}
+	return swapMigrated(dir, oldSizes)
+}
+
+// swapMigrated replaces the shelf files of the old slot sizes in dir by the
+// migrated database, and removes the marker file once done. It can be repeated
+// if interrupted.
+func swapMigrated(dir string, oldSizes []uint32) error {
+	tmp := filepath.Join(dir, migrateDir)
+	for _, size := range oldSizes {
+		for _, name := range shelfFileNames(size) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == dirLockName {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmp, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, migrateMarker))
+}
+
+// writeMigrateMarker records the old slot sizes of a migration in the marker
+// file.
+func writeMigrateMarker(path string, sizes []uint32) error {
+	var buf bytes.Buffer
+	for _, size := range sizes {
+		fmt.Fprintf(&buf, "%d\n", size)
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// readMigrateMarker reads the old slot sizes from the marker file of an
+// interrupted migration.
+func readMigrateMarker(path string) ([]uint32, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sizes []uint32
+	for _, field := range strings.Fields(string(blob)) {
+		size, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: migration marker: %v", ErrCorruptData, err)
+		}
+		sizes = append(sizes, uint32(size))
+	}
+	return sizes, nil
+}
+
+// checkMigration fails if a migration of the database in dir has been
+// interrupted while swapping the files, as the directory then holds neither
+// layout completely.
+func checkMigration(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, migrateMarker)); err == nil {
+		return fmt.Errorf("migration of %v interrupted, run Migrate again to complete it", dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// MigrateTo copies the database in dir, with the slot sizes given by oldSlots,
+// into a new database in target with the slot sizes given by newSlots. The
+// source is opened read-only and left as is. The optional onRekey callback is
+// invoked with the old and new key of every item. The options apply to both
+// databases.
+func MigrateTo(dir, target string, oldSlots, newSlots SlotSizeFn, onRekey OnImportFn, options ...Option) error {
+	src, err := Open(dir, oldSlots, nil, append(options[:len(options):len(options)], WithReadonly())...)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	dst, err := Open(target, newSlots, nil, options...)
+	if err != nil {
+		return err
+	}
+	if err := Copy(dst, src, nil, false, onRekey); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// CopyFilterFn selects the items copied by Copy.
+type CopyFilterFn func(key uint64, data []byte) bool
+
+// Copy stores the live items of src which pass the optional filter in dst,
+// streaming through src once. If keepKeys is set, the items are stored at the
+// keys they have in src, with PutAt: dst must then have the same slot sizes,
+// and the slots must be free. Otherwise they are stored with Put, which places
+// them by size, and the optional onCopy callback is invoked with the old and
+// new key of every item. Items copied before an error stay in dst.
+func Copy(dst, src Database, filter CopyFilterFn, keepKeys bool, onCopy OnImportFn) error {
+	return streamItems(src, func(key uint64, data []byte) error {
+		if filter != nil && !filter(key, data) {
+			return nil
+		}
+		newKey := key
+		if keepKeys {
+			if err := dst.PutAt(key, data); err != nil {
+				return fmt.Errorf("key %#x: %w", key, err)
+			}
+		} else {
+			var err error
+			if newKey, err = dst.Put(data); err != nil {
+				return fmt.Errorf("key %#x: %w", key, err)
+			}
+		}
+		if onCopy != nil {
+			onCopy(key, newKey)
+		}
+		return nil
+	})
+}
+
+// streamBatchSize is the amount of data streamItems reads from the source at
+// a time.
+const streamBatchSize = 4 * 1024 * 1024
+
+// errBatchFull ends an iteration of streamItems once its batch is full.
+var errBatchFull = errors.New("batch full")
+
+// streamItems invokes onItem for the items of src in key order. The items are
+// read in batches, and onItem is invoked between the iterations rather than
+// from their callbacks: src is not locked while onItem runs, so it may write to
+// another database, or to src itself.
+func streamItems(src Database, onItem func(key uint64, data []byte) error) error {
+	type item struct {
+		key  uint64
+		data []byte
+	}
+	var start uint64
+	for {
+		var (
+			batch []item
+			bytes int
+		)
+		err := src.IterateErr(func(key uint64, size uint32, data []byte) error {
+			if bytes >= streamBatchSize {
+				return errBatchFull
+			}
+			batch = append(batch, item{key, append([]byte(nil), data...)})
+			bytes += len(data)
+			return nil
+		}, WithStartKey(start))
+		if err != nil && !errors.Is(err, errBatchFull) {
+			return err
+		}
+		for _, it := range batch {
+			if err := onItem(it.key, it.data); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		start = batch[len(batch)-1].key + 1
+	}
+}
+
+// shelfFileNames returns the names of the files of the shelf with the given
+// slot size: its data, metadata and gap index files.
+func shelfFileNames(slotSize uint32) []string {
+	return []string{fmt.Sprintf("bkt_%08d.bag", slotSize), metaName(slotSize), gapIndexName(slotSize)}
+}
+
+// MergeAction tells Merge what to do with an item whose key is taken.
+type MergeAction int
+
+const (
+	MergeKeep     MergeAction = iota // MergeKeep keeps the item stored at the key, dropping the incoming one
+	MergeReplace                     // MergeReplace replaces the stored item with the incoming one
+	MergeRelocate                    // MergeRelocate stores the incoming item under a new key
+)
+
+// MergeResolveFn resolves a collision in Merge, between the item stored at key
+// and an incoming item with the same key. The data is only valid until the
+// method returns.
+type MergeResolveFn func(key uint64, stored, incoming []byte) MergeAction
+
+// Merge folds the databases in the source directories into the database in
+// dir, which is created if needed. All of them must have the slot sizes given
+// by slots, as the items keep their keys. The sources are opened read-only and
+// merged in order. If a key is taken, resolve decides which item to keep. Items
+// it relocates get new keys, which are passed to the optional onRelocate
+// callback along with the old ones, after the other items of their source have
+// been merged. Without resolve, a taken key fails the
+// merge with ErrSlotInUse. The options apply to all databases.
+func Merge(dir string, sources []string, slots SlotSizeFn, resolve MergeResolveFn, onRelocate OnImportFn, options ...Option) error {
+	sizes, err := SlotSizes(slots)
+	if err != nil {
+		return err
+	}
+	dst, err := Open(dir, SlotSizeList(sizes...), nil, options...)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if err := mergeFrom(dst, source, sizes, resolve, onRelocate, options); err != nil {
+			dst.Close()
+			return fmt.Errorf("source %v: %w", source, err)
+		}
+	}
+	return dst.Close()
+}
+
+// mergeFrom merges the database in the source directory into dst, see Merge.
+func mergeFrom(dst Database, source string, sizes []uint32, resolve MergeResolveFn, onRelocate OnImportFn, options []Option) error {
+	src, err := Open(source, SlotSizeList(sizes...), nil, append(options[:len(options):len(options)], WithReadonly())...)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Relocated items are stored once the others have claimed their keys
+	var relocate []uint64
+	err = streamItems(src, func(key uint64, data []byte) error {
+		taken, err := dst.Has(key)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			return dst.PutAt(key, data)
+		}
+		if resolve == nil {
+			return fmt.Errorf("%w: key %#x", ErrSlotInUse, key)
+		}
+		stored, err := dst.Get(key)
+		if err != nil {
+			return err
+		}
+		switch resolve(key, stored, data) {
+		case MergeReplace:
+			if err := dst.Delete(key); err != nil {
+				return err
+			}
+			return dst.PutAt(key, data)
+		case MergeRelocate:
+			relocate = append(relocate, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range relocate {
+		data, err := src.Get(key)
+		if err != nil {
+			return err
+		}
+		newKey, err := dst.Put(data)
+		if err != nil {
+			return err
+		}
+		if onRelocate != nil {
+			onRelocate(key, newKey)
+		}
+	}
+	return nil
+}
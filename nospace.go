@@ -0,0 +1,41 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoSpace is returned by writes which fail because the disk is full. The
+// slot allocated for a failed Put is released again, so nothing is stored.
+var ErrNoSpace = errors.New("no space left on device")
+
+// OnNoSpaceFn is invoked when a Put fails because the disk is full, with the
+// number of the attempt, starting at 1. Returning true retries the Put, after
+// the callback has freed up space, e.g. by deleting items or files. Returning
+// false fails the Put with ErrNoSpace.
+type OnNoSpaceFn func(attempt int, err error) bool
+
+// noSpace marks errors caused by a full disk with ErrNoSpace.
+func noSpace(err error) error {
+	if err == nil || errors.Is(err, ErrNoSpace) || !isNoSpace(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrNoSpace, err)
+}
+
+// retryNoSpace reports whether a write which failed with the given error is
+// to be retried, as decided by the OnNoSpace callback, if any.
+func (db *database) retryNoSpace(attempt int, err error) (bool, error) {
+	if db.opts.OnNoSpace == nil || !errors.Is(err, ErrNoSpace) {
+		return false, err
+	}
+	var retry bool
+	if e := guard(func() error { retry = db.opts.OnNoSpace(attempt, err); return nil }); e != nil {
+		return false, db.repanic(e)
+	}
+	return retry, err
+}
@@ -0,0 +1,13 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package billy
+
+// isNoSpace reports no error as caused by a full disk, on platforms where
+// this can't be told.
+func isNoSpace(err error) bool {
+	return false
+}
@@ -0,0 +1,163 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"io"
+)
+
+// Shelf is a store of items in slots of one fixed size, backed by a single
+// file. It is the building block of a Database, for users who manage the slot
+// sizes themselves: items are addressed by their slot, without the shelf id
+// and generation making up the keys of a Database.
+type Shelf interface {
+	io.Closer
+
+	// Put stores the data in a free slot, and returns the slot.
+	Put(data []byte) (uint64, error)
+
+	// PutAt stores the data in the given slot, which must be free. It grows
+	// the shelf if the slot is beyond its end.
+	PutAt(slot uint64, data []byte) error
+
+	// Update overwrites the item in the given slot, which must be live.
+	Update(slot uint64, data []byte) error
+
+	// UpdateRange overwrites the bytes of the item in the given slot,
+	// starting at offset off. The range must lie within the item.
+	UpdateRange(slot, off uint64, data []byte) error
+
+	// Get retrieves the item in the given slot.
+	Get(slot uint64) ([]byte, error)
+
+	// GetInto reads the item in the given slot into buf, and returns its
+	// length. If buf is too small, it fails with ErrShortBuffer.
+	GetInto(slot uint64, buf []byte) (int, error)
+
+	// GetSample retrieves length bytes of the item in the given slot, starting
+	// at offset off.
+	GetSample(slot, off, length uint64) ([]byte, error)
+
+	// GetReader returns a reader over the item in the given slot.
+	GetReader(slot uint64) (*io.SectionReader, error)
+
+	// Has reports whether the given slot holds an item.
+	Has(slot uint64) (bool, error)
+
+	// Delete frees the given slot.
+	Delete(slot uint64) error
+
+	// Iterate invokes onData for every item in the shelf.
+	Iterate(onData OnSlotFn) error
+
+	// IterateErr invokes onData for every item in the shelf. If onData returns
+	// an error, the iteration is aborted. Returning ErrStopIteration stops the
+	// iteration without error.
+	IterateErr(onData OnSlotErrFn) error
+
+	// Compact moves items into the gaps and truncates the file. The optional
+	// onMove method is invoked for every item which changes slot, without
+	// locks held, so it may access the shelf.
+	Compact(onMove OnSlotMoveFn) error
+
+	// Checkpoint syncs the data to disk and persists the gap list, see
+	// Database.Checkpoint.
+	Checkpoint() error
+
+	// Sync fsyncs the shelf file, if it has been written to since the last
+	// sync.
+	Sync() error
+
+	// SlotSize returns the slot size of the shelf.
+	SlotSize() uint32
+
+	// Infos retrieves statistics about the shelf.
+	Infos() *ShelfInfos
+}
+
+// OnSlotFn is used to iterate the items of a Shelf.
+type OnSlotFn func(slot uint64, data []byte)
+
+// OnSlotErrFn is like OnSlotFn, but can abort the iteration by returning an
+// error.
+type OnSlotErrFn func(slot uint64, data []byte) error
+
+// OnSlotMoveFn is invoked for every item moved by the compaction of a Shelf.
+type OnSlotMoveFn func(oldSlot, newSlot uint64, data []byte)
+
+// OpenShelf opens a (new or existing) shelf with the given slot size, in the
+// directory path. An empty path opens an ephemeral in-memory shelf. The file
+// is the same as the one of a Database with this slot size, so the shelves of
+// a database can be opened individually while the database is closed.
+//
+// The shelf is compacted while opening, and the optional onData callback is
+// invoked for every item, in the same way as for Open.
+//
+// The options concerning the shelf files apply: e.g. WithReadonly, WithSync,
+// WithRepair, WithCrashSafeWrites or WithRecoverPanics. Those implemented by
+// the Database layer are ignored: encryption, generations, key secrets, size
+// limits, remapping, group commit, the lock file and the key-based callbacks.
+func OpenShelf(path string, slotSize uint32, onData OnSlotFn, options ...Option) (Shelf, error) {
+	opts := &Options{Path: path}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.DirectIO && opts.IOUring {
+		return nil, errors.New("direct I/O and io_uring can't be combined")
+	}
+	opts.limiter = newIOLimiter(opts.MaintenanceBytesPerSec, opts.MaintenanceIOPS)
+	if opts.Upgrade && !opts.Readonly && path != "" {
+		if err := upgradeShelf(path, slotSize, opts); err != nil {
+			return nil, err
+		}
+	}
+	s, err := openShelf(path, slotSize, onShelfDataFn(onData), opts)
+	if err != nil {
+		return nil, opts.repanic(err)
+	}
+	if opts.ShareGaps {
+		if err := s.shareGaps(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return &publicShelf{shelf: s, opts: opts}, nil
+}
+
+// publicShelf implements Shelf on top of a shelf, resuming the panics of
+// callbacks once the shelf is in a defined state.
+type publicShelf struct {
+	*shelf
+	opts *Options
+}
+
+func (s *publicShelf) Update(slot uint64, data []byte) error {
+	return s.shelf.Update(data, slot)
+}
+
+func (s *publicShelf) Iterate(onData OnSlotFn) error {
+	return s.opts.repanic(s.shelf.Iterate(onShelfDataFn(onData)))
+}
+
+func (s *publicShelf) IterateErr(onData OnSlotErrFn) error {
+	err := s.shelf.IterateErr(onShelfDataErrFn(onData), nil)
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return s.opts.repanic(err)
+}
+
+func (s *publicShelf) Compact(onMove OnSlotMoveFn) error {
+	return s.opts.repanic(s.shelf.Compact(onShelfMoveFn(onMove)))
+}
+
+func (s *publicShelf) SlotSize() uint32 {
+	return s.slotSize
+}
+
+func (s *publicShelf) Infos() *ShelfInfos {
+	return s.infos()
+}
@@ -0,0 +1,513 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "time"
+
+// Options contains the configuration of a database. It is populated by the
+// Option functions passed to Open.
+type Options struct {
+	Path     string
+	Readonly bool
+	Repair   bool
+	Snappy   bool // unused for now
+
+	// ShareGaps makes the shelves share their gap lists through gap index
+	// files in the database directory. A read-write database publishes the
+	// gaps after mutations, batching those within 50ms, and right away on
+	// Sync. A read-only database reloads them before iterating, so that it
+	// only visits items which are live in the writer.
+	ShareGaps bool
+
+	// Sync makes every write be followed by an fsync of the shelf file.
+	Sync bool
+
+	// OnNoSpace is invoked when Put, PutWithTTL, PutAt or PutReader fail
+	// because the disk is full, so that the application can free up space and
+	// have the write retried, see OnNoSpaceFn. Put, PutWithTTL and PutAt
+	// release the slot taken for the failed write either way. As the reader
+	// can't be rewound, PutReader retries the failed write in place, and
+	// only releases the slot if it is not retried.
+	OnNoSpace OnNoSpaceFn
+
+	// SyncInterval and SyncWrites make a background goroutine fsync the
+	// shelf files which have been written to, every SyncInterval, and after
+	// every SyncWrites writes. The writes in between share one fsync per
+	// shelf, which bounds the data lost on a crash at a fraction of the cost
+	// of Sync. Flush forces a sync right away. Zero disables either trigger.
+	SyncInterval time.Duration
+	SyncWrites   int
+
+	// CrashSafeWrites orders the writes of Put and the other writes of whole
+	// items, so that a crash can't leave the header of an item on disk
+	// without its data: the slot is written with a pending marker in place
+	// of the header, the file is synced, and then the header is written.
+	// Slots left pending by a crash read as empty, and are dropped, with a
+	// log message, when opening. This costs an extra fsync per write. It
+	// does not cover UpdateRange, which patches items in place, nor the moves
+	// of compaction.
+	CrashSafeWrites bool
+
+	// NoCompaction disables moving data into gaps while opening. The gaps are
+	// still reconstructed from the slot headers, and can be filled later on
+	// by calling Compact. Without onData callback, the scan is skipped for
+	// shelves with a clean gap index (see Checkpoint), and only the item
+	// headers are read for shelves with large slots, so that large
+	// databases open quickly.
+	NoCompaction bool
+
+	// OnCompactionProgress receives reports on the progress of the compaction
+	// of every shelf, both when opening and in Compact: at most one per
+	// second, and a final one. Shelves opened concurrently, see OpenWorkers,
+	// report concurrently.
+	OnCompactionProgress OnCompactionProgressFn
+
+	// OnMove is invoked for every item moved by the compaction while opening,
+	// before the onData callback passed to Open is invoked for it with its
+	// new key, so that external indices of keys can be updated. It is also
+	// used by Compact, if no callback is passed to it.
+	OnMove OnMoveFn
+
+	// Remap keeps the keys of items moved by compaction valid: the moves are
+	// recorded in a table, persisted in the database directory, and the old
+	// keys resolve to the items at their new slots. An entry is dropped once
+	// its old slot, or the new one, is reused by another item, after which the
+	// old key refers to the slot again. Remapped keys carry the generation of
+	// the new slot, so stale old keys are not detected; neither are reads
+	// racing with the move of their item in Compact.
+	Remap bool
+
+	// CompactionPolicy decides how the shelves are compacted while opening
+	// and in Compact. If nil, items are always moved into the gaps, unless
+	// NoCompaction is set, which rules out moves while opening.
+	CompactionPolicy CompactionPolicy
+
+	// MaintenanceBytesPerSec and MaintenanceIOPS limit the rate at which
+	// maintenance reads the shelf files, so that it does not starve the
+	// foreground reads and writes of disk bandwidth. They apply to the
+	// compaction when opening and in Compact, to SnapshotTo and
+	// BackupIncremental, and to iterations with WithThrottle. The limits are
+	// shared by all shelves. Zero means unlimited.
+	MaintenanceBytesPerSec int64
+	MaintenanceIOPS        int64
+
+	// limiter enforces the maintenance rates, set by Open
+	limiter *ioLimiter
+
+	// PunchHoles makes Delete deallocate the disk space of deleted slots right
+	// away, by punching holes into the shelf file, instead of only reclaiming
+	// space when the end of the file is truncated. This is only supported on
+	// Linux, for file systems which support it, and is disabled for a shelf
+	// (with a log message) if punching fails.
+	PunchHoles bool
+
+	// Preallocate is the size in bytes of the extents in which disk space is
+	// reserved past the end of the shelf files, as the tail of a shelf grows.
+	// This reduces fragmentation under sustained writes. The file size is not
+	// changed, and the space past the end is released again when a file is
+	// truncated. This is only supported on Linux, and is disabled for a
+	// shelf (with a log message) if allocation fails. Zero disables it.
+	Preallocate int64
+
+	// DropScanCache makes scans through whole shelf files, i.e. iterations,
+	// compactions, snapshots and backups, advise the kernel to drop the files
+	// from the page cache afterwards. This keeps a maintenance scan from
+	// evicting the working set of the node, at the cost of a cold cache for
+	// the items of the database. Only Linux supports it, elsewhere it is
+	// ignored.
+	DropScanCache bool
+
+	// SecureDelete makes Delete overwrite the deleted slot with zeros on disk
+	// before it is released, so that deleted data is not readable from the
+	// shelf file until the slot is reused or compacted away. This costs a
+	// write of the full slot per Delete.
+	SecureDelete bool
+
+	// PersistDeletes makes Delete blank the header of the deleted slot on disk
+	// right away, instead of when the database is closed, so that a deleted
+	// item does not come back after a crash. This costs a small write per
+	// Delete. With SyncDeletes, or Sync, the blanked header is also fsynced
+	// before Delete returns, as is the slot overwritten by SecureDelete.
+	PersistDeletes bool
+	SyncDeletes    bool
+
+	// DirectIO opens the shelf files for direct I/O (O_DIRECT), bypassing the
+	// page cache, so that large scans and bulk ingests don't evict the rest of
+	// the page cache. Reads and writes are widened to whole 4KB blocks, and
+	// writes are serialized per shelf. This is only supported on Linux, for
+	// file systems which support it: Open fails otherwise.
+	DirectIO bool
+
+	// IOUring makes the shelves read and write their files through io_uring,
+	// batching the operations of concurrent goroutines into shared syscalls.
+	// This is experimental, only supported on Linux 5.6 or later, and can't
+	// be combined with DirectIO. Open fails if io_uring is not available.
+	IOUring bool
+
+	// ReuseDelay is the time a deleted slot is held back from reuse by Put,
+	// which bounds the window in which a stale key reads unrelated new data.
+	// Deleted slots at the end of a file are truncated only once their delay
+	// has passed, by a later Delete or Compact, which doesn't fill them
+	// either. PutAt ignores the delay, and it is not retained across
+	// restarts.
+	ReuseDelay time.Duration
+
+	// MaxSize limits the total size in bytes of the slots of all shelves,
+	// i.e. of the shelf files without their headers. Writes which would grow
+	// the database beyond it fail with ErrFull, while slots freed by Delete
+	// can still be reused. Data stored before is kept even if it exceeds the
+	// limit. Zero means no limit.
+	MaxSize uint64
+
+	// OnWatermark is invoked when the size counted against MaxSize grows to
+	// HighWatermark or above, and again once it shrinks to LowWatermark or
+	// below, both given as fractions of MaxSize. This lets the application
+	// prune data before writes start failing. The size only shrinks when
+	// shelf files are truncated, i.e. when the last items of a shelf are
+	// deleted or moved by compaction. The callback runs on a goroutine of
+	// its own, and may be invoked while opening the database.
+	OnWatermark   OnWatermarkFn
+	HighWatermark float64
+	LowWatermark  float64
+
+	// Generations makes the database track a generation for every slot,
+	// bumped whenever the slot is reused for new data, and embed it in bits
+	// 40-63 of the keys it returns. Reads, updates and deletes with a key
+	// whose slot has been reused since fail with ErrStaleKey, instead of
+	// operating on unrelated data. Keys without generation, such as those
+	// built by Key, are not checked. The generations are saved with the
+	// shelves on Close and Checkpoint, but lost in a crash: keys of items
+	// stored before it are not checked until their slots are reused.
+	Generations bool
+
+	// KeySecret is a secret which authenticates the keys returned by the
+	// database, so that only keys issued by it resolve. Bits 40-63 of the
+	// keys hold a 24 bit HMAC-SHA256 code of the shelf id and slot, and of
+	// the generation of the slot if tracked, instead of the generation
+	// itself. Operations with other keys fail with ErrInvalidKey; this
+	// includes stale keys if generations are tracked. As generations are
+	// lost in a crash, keys authenticated with them would no longer resolve
+	// after one, so Open rejects the combination for databases on disk.
+	// PutAt takes keys authenticated without generation.
+	KeySecret []byte
+
+	// Standby makes the database reject writes with ErrStandby, except for
+	// the changes applied with ApplyChange, until Promote is called. This is
+	// meant for replicas following a primary database, ready to take over.
+	Standby bool
+
+	// EncryptionKey is an AES key (16, 24 or 32 bytes long). If set, every
+	// item is encrypted with AES-GCM before being written. Each item grows by
+	// 28 bytes, which reduces the maximum item size of the shelves.
+	EncryptionKey []byte
+
+	// CheckInvariants makes the database verify the bookkeeping of a shelf
+	// after every mutation, and panic if it is inconsistent. This is meant for
+	// tests and soak runs, as it adds a stat syscall to every operation.
+	CheckInvariants bool
+
+	// Upgrade makes Open convert shelf files written in an older format
+	// version to the current one. Otherwise, such files are rejected with a
+	// VersionError. Files written in a newer version are always rejected.
+	Upgrade bool
+
+	// UpgradeBackup makes Open copy each shelf file before upgrading it.
+	UpgradeBackup bool
+
+	// RecoverPanics makes the database recover from panics in the callbacks
+	// passed to Open, Iterate, IterateErr and Compact, and return them as a
+	// CallbackPanicError. Otherwise, the panic is resumed once the operation
+	// has been aborted. Either way, an aborted Open leaves the files as a crash
+	// during Open would, and an aborted Compact leaves a consistent database.
+	RecoverPanics bool
+
+	// CoalesceReads makes concurrent Gets of the same key share a single
+	// read from disk, instead of each issuing their own. This protects the
+	// disk when a popular item is requested by many readers at once, at the
+	// cost of some bookkeeping on every Get.
+	CoalesceReads bool
+
+	// ShelfOnData holds callbacks for the shelves of given slot sizes, which
+	// Open invokes for their items instead of the onData callback passed to
+	// it. This allows decoding items differently depending on their size
+	// class.
+	ShelfOnData map[uint32]OnDataFn
+
+	// OpenWorkers is the number of shelves opened concurrently by Open. If
+	// larger than one, the onData callback passed to Open may be invoked
+	// concurrently for items of different shelves, and must be safe for that.
+	// Items of a single shelf are still passed in order.
+	OpenWorkers int
+
+	// Logger receives reports about noteworthy events, such as repairs. If
+	// nil, nothing is logged.
+	Logger Logger
+
+	// Metrics receives events about the operations performed. If nil, no
+	// metrics are collected.
+	Metrics Metrics
+}
+
+// Option configures a database opened by Open.
+type Option func(*Options)
+
+// Logger is the interface used to report noteworthy events. It is satisfied
+// by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// nopLogger is a Logger which discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...any) {}
+
+// WithReadonly opens the database in read-only mode. A read-only database takes
+// no lock, so it can be opened while a writer is live, in another process or
+// through another handle in the same one. It is not a snapshot: it visits the
+// slots which were in use when it was opened, with their content at the time
+// they are read. Items deleted, moved or replaced by the writer since may be
+// visited with their old or new content, items the writer truncated away are
+// skipped, and items stored since are not visited, but can be read by key.
+// With WithShareGaps, iterations follow the live items of the writer instead.
+// Use SnapshotTo on the writer for a consistent copy.
+func WithReadonly() Option {
+	return func(o *Options) { o.Readonly = true }
+}
+
+// WithRepair makes Open repair corrupt shelves, by truncating partial slots
+// and dropping items with corrupt headers.
+func WithRepair() Option {
+	return func(o *Options) { o.Repair = true }
+}
+
+// WithShareGaps makes the database share its gap lists with other processes
+// through gap index files, see Options.ShareGaps.
+func WithShareGaps() Option {
+	return func(o *Options) { o.ShareGaps = true }
+}
+
+// WithSync makes the database fsync the shelf file after every write.
+func WithSync() Option {
+	return func(o *Options) { o.Sync = true }
+}
+
+// WithNoSpaceHandler sets the callback invoked when a write fails because the
+// disk is full, see Options.OnNoSpace.
+func WithNoSpaceHandler(fn OnNoSpaceFn) Option {
+	return func(o *Options) { o.OnNoSpace = fn }
+}
+
+// WithGroupCommit makes a background goroutine fsync the written shelf files
+// every interval, and after every writes writes, see Options.SyncInterval.
+func WithGroupCommit(interval time.Duration, writes int) Option {
+	return func(o *Options) {
+		o.SyncInterval = interval
+		o.SyncWrites = writes
+	}
+}
+
+// WithCrashSafeWrites orders the writes of items, so that a crash can't leave
+// partially written items behind, see Options.CrashSafeWrites.
+func WithCrashSafeWrites() Option {
+	return func(o *Options) { o.CrashSafeWrites = true }
+}
+
+// WithoutCompaction disables the compaction performed when opening.
+func WithoutCompaction() Option {
+	return func(o *Options) { o.NoCompaction = true }
+}
+
+// WithCompactionProgress sets the receiver of progress reports of compactions,
+// see Options.OnCompactionProgress.
+func WithCompactionProgress(fn OnCompactionProgressFn) Option {
+	return func(o *Options) { o.OnCompactionProgress = fn }
+}
+
+// WithOnMove sets the callback notified of the items moved by compaction, see
+// Options.OnMove.
+func WithOnMove(onMove OnMoveFn) Option {
+	return func(o *Options) { o.OnMove = onMove }
+}
+
+// WithRemap keeps the keys of items moved by compaction valid, see
+// Options.Remap.
+func WithRemap() Option {
+	return func(o *Options) { o.Remap = true }
+}
+
+// WithCompactionPolicy sets the policy deciding how the shelves are compacted,
+// see CompactionPolicy.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *Options) { o.CompactionPolicy = policy }
+}
+
+// WithMaintenanceRate limits the rate of the reads of maintenance work, in
+// bytes and in reads per second, see Options.MaintenanceBytesPerSec. Zero
+// leaves a rate unlimited.
+func WithMaintenanceRate(bytesPerSec, iops int64) Option {
+	return func(o *Options) {
+		o.MaintenanceBytesPerSec = bytesPerSec
+		o.MaintenanceIOPS = iops
+	}
+}
+
+// WithHolePunching makes Delete deallocate the disk space of deleted slots, see
+// Options.PunchHoles.
+func WithHolePunching() Option {
+	return func(o *Options) { o.PunchHoles = true }
+}
+
+// WithPreallocation reserves disk space for the shelf files in extents of the
+// given size, see Options.Preallocate.
+func WithPreallocation(size int64) Option {
+	return func(o *Options) { o.Preallocate = size }
+}
+
+// WithDropScanCache drops the shelf files from the page cache after scans, see
+// Options.DropScanCache.
+func WithDropScanCache() Option {
+	return func(o *Options) { o.DropScanCache = true }
+}
+
+// WithPersistentDeletes makes Delete blank the headers of deleted slots on disk
+// right away, and also fsync them if sync is set, see Options.PersistDeletes.
+func WithPersistentDeletes(sync bool) Option {
+	return func(o *Options) {
+		o.PersistDeletes = true
+		o.SyncDeletes = sync
+	}
+}
+
+// WithSecureDelete makes Delete overwrite deleted slots with zeros, see
+// Options.SecureDelete.
+func WithSecureDelete() Option {
+	return func(o *Options) { o.SecureDelete = true }
+}
+
+// WithDirectIO opens the shelf files for direct I/O, see Options.DirectIO.
+func WithDirectIO() Option {
+	return func(o *Options) { o.DirectIO = true }
+}
+
+// WithIOUring makes the shelves perform their I/O through io_uring, see
+// Options.IOUring.
+func WithIOUring() Option {
+	return func(o *Options) { o.IOUring = true }
+}
+
+// WithReuseDelay holds deleted slots back from reuse for the given time, see
+// Options.ReuseDelay.
+func WithReuseDelay(delay time.Duration) Option {
+	return func(o *Options) { o.ReuseDelay = delay }
+}
+
+// WithMaxSize limits the total size of the shelves, see Options.MaxSize.
+func WithMaxSize(size uint64) Option {
+	return func(o *Options) { o.MaxSize = size }
+}
+
+// WithWatermarks makes the database invoke fn when its size crosses the given
+// fractions of the size limit, see Options.OnWatermark.
+func WithWatermarks(high, low float64, fn OnWatermarkFn) Option {
+	return func(o *Options) {
+		o.HighWatermark, o.LowWatermark = high, low
+		o.OnWatermark = fn
+	}
+}
+
+// WithGenerations embeds slot generations in the keys, to detect stale keys,
+// see Options.Generations.
+func WithGenerations() Option {
+	return func(o *Options) { o.Generations = true }
+}
+
+// WithKeySecret makes the database authenticate its keys with the given
+// secret, see Options.KeySecret.
+func WithKeySecret(secret []byte) Option {
+	return func(o *Options) { o.KeySecret = secret }
+}
+
+// WithStandby opens the database as a standby, see Options.Standby.
+func WithStandby() Option {
+	return func(o *Options) { o.Standby = true }
+}
+
+// WithEncryptionKey makes the database encrypt its items with the given AES
+// key, see Options.EncryptionKey.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *Options) { o.EncryptionKey = key }
+}
+
+// WithInvariantChecks enables verifying the bookkeeping after every
+// mutation, see Options.CheckInvariants.
+func WithInvariantChecks() Option {
+	return func(o *Options) { o.CheckInvariants = true }
+}
+
+// WithUpgrade makes Open upgrade shelf files written in an older format
+// version, optionally backing them up first. Progress is reported through
+// the logger.
+func WithUpgrade(backup bool) Option {
+	return func(o *Options) {
+		o.Upgrade = true
+		o.UpgradeBackup = backup
+	}
+}
+
+// WithRecoverPanics makes panics in callbacks be returned as errors, see
+// Options.RecoverPanics.
+func WithRecoverPanics() Option {
+	return func(o *Options) { o.RecoverPanics = true }
+}
+
+// WithCoalescedReads makes concurrent Gets of the same key share a single
+// read, see Options.CoalesceReads.
+func WithCoalescedReads() Option {
+	return func(o *Options) { o.CoalesceReads = true }
+}
+
+// WithShelfOnData makes Open invoke fn for the items of the shelf with the given
+// slot size, instead of the onData callback passed to it.
+func WithShelfOnData(slotSize uint32, fn OnDataFn) Option {
+	return func(o *Options) {
+		if o.ShelfOnData == nil {
+			o.ShelfOnData = make(map[uint32]OnDataFn)
+		}
+		o.ShelfOnData[slotSize] = fn
+	}
+}
+
+// WithOpenWorkers makes Open open up to n shelves concurrently, see
+// Options.OpenWorkers.
+func WithOpenWorkers(n int) Option {
+	return func(o *Options) { o.OpenWorkers = n }
+}
+
+// WithLogger sets the logger used to report noteworthy events.
+func WithLogger(l Logger) Option {
+	return func(o *Options) { o.Logger = l }
+}
+
+// WithMetrics sets the receiver of events about the operations performed.
+func WithMetrics(m Metrics) Option {
+	return func(o *Options) { o.Metrics = m }
+}
+
+// logger returns the configured logger, or one which discards everything.
+func (o *Options) logger() Logger {
+	if o.Logger == nil {
+		return nopLogger{}
+	}
+	return o.Logger
+}
+
+// metrics returns the configured metrics, or one which discards everything.
+func (o *Options) metrics() Metrics {
+	if o.Metrics == nil {
+		return NopMetrics{}
+	}
+	return o.Metrics
+}
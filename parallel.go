@@ -0,0 +1,79 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// IterateParallel iterates through all the data in the database like
+// IterateErr, but splits the slots of every shelf into n contiguous ranges,
+// which are read by n goroutines. The onData method, and the onCorrupt method
+// of WithSkipCorrupt, are invoked concurrently and must be safe for that; the
+// items are visited in ascending key order within each range only.
+//
+// If onData returns an error, the other goroutines stop after their current
+// item, and the first error is returned. ErrStopIteration stops the iteration
+// without error.
+func (db *database) IterateParallel(n int, onData OnDataErrFn, opts ...IterateOption) error {
+	if n < 1 {
+		n = 1
+	}
+	return db.iterate(n, onDataItem(onData), opts)
+}
+
+// iterateParallel is the shelf level of IterateParallel, using n workers.
+func (s *shelf) iterateParallel(n int, onData onShelfDataErrFn, cfg *iterateConfig) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.reloadGaps(); err != nil {
+		return err
+	}
+	if err := s.clampTail(); err != nil {
+		return err
+	}
+	defer s.dropCache()
+
+	var start uint64
+	if cfg != nil {
+		start = cfg.startSlot
+	}
+	if start >= s.count {
+		return nil
+	}
+	var (
+		total = s.count - start
+		chunk = (total + uint64(n) - 1) / uint64(n)
+
+		wg      sync.WaitGroup
+		stop    uint32
+		errOnce sync.Once
+		failure error
+	)
+	for from := start; from < s.count; from += chunk {
+		to := from + chunk
+		if to > s.count {
+			to = s.count
+		}
+		wg.Add(1)
+		go func(from, to uint64) {
+			defer wg.Done()
+			err := s.iterateRange(from, to, onData, cfg, &stop)
+			if err != nil {
+				errOnce.Do(func() { failure = err })
+				atomic.StoreUint32(&stop, 1)
+			}
+		}(from, to)
+	}
+	wg.Wait()
+	return failure
+}
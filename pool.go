@@ -0,0 +1,38 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "sync"
+
+// scanBufs holds the buffers of scanBatchSize bytes used by slotScanners, so
+// that iterations don't allocate a batch buffer each.
+var scanBufs = sync.Pool{
+	New: func() any {
+		buf := make([]byte, scanBatchSize)
+		return &buf
+	},
+}
+
+// slotPool holds scratch buffers of the slot size of a shelf, for the writes of
+// Put. Buffers handed out to callers, such as the results of Get, are never
+// taken from the pool.
+type slotPool struct {
+	size uint32
+	pool sync.Pool
+}
+
+// get returns a buffer of the slot size. Its content is undefined.
+func (p *slotPool) get() *[]byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, p.size)
+	return &buf
+}
+
+// put returns a buffer obtained from get to the pool.
+func (p *slotPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
@@ -0,0 +1,95 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "time"
+
+// progressInterval is the minimum time between two progress reports of a
+// compaction, apart from the final one.
+const progressInterval = time.Second
+
+// CompactionProgress describes how far the compaction of a shelf has come.
+// When opening, the work is scanning the slots of the shelf. For Compact, it
+// is filling or dropping the gaps of the shelf.
+type CompactionProgress struct {
+	SlotSize  uint32        // SlotSize is the slot size of the shelf
+	Done      uint64        // Done is the number of slots scanned, or gaps handled
+	Total     uint64        // Total is the number of slots, or gaps, to handle
+	Moved     uint64        // Moved is the number of items moved into gaps
+	Reclaimed uint64        // Reclaimed is the number of bytes cut off the end of the file
+	Elapsed   time.Duration // Elapsed is the time since the compaction started
+	ETA       time.Duration // ETA is the estimated time left, zero if unknown
+	Finished  bool          // Finished is set in the last report of the compaction
+}
+
+// OnCompactionProgressFn receives progress reports of compactions, see
+// WithCompactionProgress.
+type OnCompactionProgressFn func(progress CompactionProgress)
+
+// compactionProgress tracks the progress of the compaction of a shelf, and
+// reports it at most every progressInterval. A nil compactionProgress reports
+// nothing.
+type compactionProgress struct {
+	fn      OnCompactionProgressFn
+	state   CompactionProgress
+	started time.Time
+	last    time.Time
+}
+
+// newCompactionProgress starts tracking a compaction of the given amount of
+// work, if there is a callback.
+func newCompactionProgress(fn OnCompactionProgressFn, slotSize uint32, total uint64) *compactionProgress {
+	if fn == nil {
+		return nil
+	}
+	now := time.Now()
+	return &compactionProgress{
+		fn:      fn,
+		state:   CompactionProgress{SlotSize: slotSize, Total: total},
+		started: now,
+		last:    now,
+	}
+}
+
+// update records the work done so far and the slots cut off the file, and
+// reports the progress if it is due. It returns the error of a panicking
+// callback.
+func (p *compactionProgress) update(done, moved, reclaimed uint64) error {
+	if p == nil {
+		return nil
+	}
+	p.state.Done, p.state.Moved = done, moved
+	p.state.Reclaimed = reclaimed * uint64(p.state.SlotSize)
+	// Spare reading the clock for every slot
+	if done%256 != 0 {
+		return nil
+	}
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		return p.report(now)
+	}
+	return nil
+}
+
+// finish reports the final progress, with the given work done.
+func (p *compactionProgress) finish(done, moved, reclaimed uint64) error {
+	if p == nil {
+		return nil
+	}
+	p.state.Done, p.state.Moved = done, moved
+	p.state.Reclaimed = reclaimed * uint64(p.state.SlotSize)
+	p.state.Finished = true
+	return p.report(time.Now())
+}
+
+// report invokes the callback with the current progress.
+func (p *compactionProgress) report(now time.Time) error {
+	state := p.state
+	state.Elapsed = now.Sub(p.started)
+	if state.Done > 0 && state.Done < state.Total && !state.Finished {
+		state.ETA = time.Duration(float64(state.Elapsed) * float64(state.Total-state.Done) / float64(state.Done))
+	}
+	return guard(func() error { p.fn(state); return nil })
+}
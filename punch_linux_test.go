@@ -0,0 +1,60 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPunchHole(t *testing.T) {
+	var (
+		p        = t.TempDir()
+		slotSize = uint32(1 << 16)
+	)
+	a, err := openShelf(p, slotSize, nil, &Options{PunchHoles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	blocks := func() int64 {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(p, "bkt_00065536.bag"), &stat); err != nil {
+			t.Fatal(err)
+		}
+		return stat.Blocks
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i+1), int(slotSize)-itemHeaderSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := blocks()
+	if err := a.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if !a.punch {
+		t.Skip("hole punching not supported by the file system")
+	}
+	if after := blocks(); after >= before {
+		t.Fatalf("have %d blocks after deletion, %d before", after, before)
+	}
+	// The hole reads as a blank slot, and the neighbours are intact
+	buf := make([]byte, slotSize)
+	if data, err := a.readSlot(buf, 1); err != nil || len(data) != 0 {
+		t.Fatalf("have %d bytes, err %v", len(data), err)
+	}
+	for _, slot := range []uint64{0, 2} {
+		data, err := a.Get(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, getBlob(byte(slot+1), int(slotSize)-itemHeaderSize)) {
+			t.Fatalf("slot %d corrupted", slot)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFull is returned by writes which would grow the database beyond
+// Options.MaxSize.
+var ErrFull = errors.New("database full")
+
+// quota limits the total size of the slots of all shelves of a database. The
+// shelves charge it when their tails grow, and are refunded when their files
+// are truncated.
+type quota struct {
+	used  uint64      // used is the number of bytes charged, accessed atomically
+	max   uint64      // max is the limit of used
+	marks *watermarks // marks reports the crossings of watermarks, nil if none
+}
+
+// OnWatermarkFn is invoked when the size of the database crosses a watermark,
+// with high set when it grew to the high watermark, and unset when it shrank
+// back to the low one. See Options.OnWatermark.
+type OnWatermarkFn func(high bool)
+
+// watermarks tracks whether the used size of a quota is above the high
+// watermark, until it drops to the low one, and reports the changes.
+type watermarks struct {
+	high, low uint64 // high and low are the watermarks, in bytes
+	fn        OnWatermarkFn
+	above     uint32 // above is set (atomically) between crossing high and low
+
+	mu       sync.Mutex // mu serializes the invocations of fn
+	reported bool       // reported is the state last reported, guarded by mu
+}
+
+// newQuota creates a quota of max bytes, which reports crossings of the given
+// watermarks (fractions of max) to fn, if set.
+func newQuota(max uint64, high, low float64, fn OnWatermarkFn) (*quota, error) {
+	q := &quota{max: max}
+	if fn != nil {
+		if low < 0 || low >= high || high > 1 {
+			return nil, fmt.Errorf("invalid watermarks: high %v, low %v", high, low)
+		}
+		q.marks = &watermarks{
+			high: uint64(high * float64(max)),
+			low:  uint64(low * float64(max)),
+			fn:   fn,
+		}
+	}
+	return q, nil
+}
+
+// charge adds size bytes to the quota, unless that exceeds the limit.
+func (q *quota) charge(size uint64) error {
+	for {
+		used := atomic.LoadUint64(&q.used)
+		if used+size > q.max {
+			return fmt.Errorf("%w: %d of %d bytes used, %d more needed", ErrFull, used, q.max, size)
+		}
+		if atomic.CompareAndSwapUint64(&q.used, used, used+size) {
+			q.check(used + size)
+			return nil
+		}
+	}
+}
+
+// force adds size bytes to the quota, even if that exceeds the limit. This is
+// used for the data already stored when a shelf is opened.
+func (q *quota) force(size uint64) {
+	q.check(atomic.AddUint64(&q.used, size))
+}
+
+// refund removes size bytes from the quota.
+func (q *quota) refund(size uint64) {
+	q.check(atomic.AddUint64(&q.used, ^(size - 1)))
+}
+
+// check reports a crossing of the watermarks by the given used size. As it is
+// called with the locks of a shelf held, the callback is invoked on its own
+// goroutine, which reports the state current by then. Crossings back and forth
+// in quick succession may thus be reported once, or not at all.
+func (q *quota) check(used uint64) {
+	w := q.marks
+	if w == nil {
+		return
+	}
+	switch {
+	case used >= w.high && atomic.CompareAndSwapUint32(&w.above, 0, 1):
+	case used <= w.low && atomic.CompareAndSwapUint32(&w.above, 1, 0):
+	default:
+		return
+	}
+	go w.report()
+}
+
+// report invokes the callback if the state differs from the one last reported.
+func (w *watermarks) report() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if above := atomic.LoadUint32(&w.above) == 1; above != w.reported {
+		w.reported = above
+		w.fn(above)
+	}
+}
+
+// setQuota makes the shelf charge the given quota for its slots, starting with
+// the ones in use.
+func (s *shelf) setQuota(q *quota) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+
+	s.quota, s.charged = q, s.count
+	q.force(s.count * uint64(s.slotSize))
+}
+
+// growTail charges the quota for growing the tail of the shelf to the given
+// number of slots. This method assumes that the gapsMu is held.
+func (s *shelf) growTail(count uint64) error {
+	if s.quota == nil || count <= s.charged {
+		return nil
+	}
+	if err := s.quota.charge((count - s.charged) * uint64(s.slotSize)); err != nil {
+		return err
+	}
+	s.charged = count
+	return nil
+}
+
+// settleTail refunds the quota for the slots the tail has shrunk by. This
+// method assumes that the gapsMu is held.
+func (s *shelf) settleTail() {
+	if s.quota != nil && s.count < s.charged {
+		s.quota.refund((s.charged - s.count) * uint64(s.slotSize))
+		s.charged = s.count
+	}
+}
@@ -0,0 +1,58 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"sync"
+	"time"
+)
+
+// ioLimiter paces reads to a rate in bytes per second and in operations per
+// second, whichever is more restrictive. It is shared by the shelves of a
+// database. A nil ioLimiter does not limit anything.
+type ioLimiter struct {
+	bytes int64 // bytes is the number of bytes per second, zero if unlimited
+	iops  int64 // iops is the number of reads per second, zero if unlimited
+
+	mu   sync.Mutex
+	next time.Time // next is the time at which the reads admitted so far are paid for
+}
+
+// newIOLimiter creates a limiter for the given rates, or nil if both are zero.
+func newIOLimiter(bytes, iops int64) *ioLimiter {
+	if bytes <= 0 && iops <= 0 {
+		return nil
+	}
+	return &ioLimiter{bytes: bytes, iops: iops}
+}
+
+// wait blocks until a read of n bytes fits into the rates. Time not used by
+// reads is not saved up, so there are no bursts after idle periods.
+func (l *ioLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	var cost time.Duration
+	if l.bytes > 0 {
+		cost = time.Duration(int64(n) * int64(time.Second) / l.bytes)
+	}
+	if l.iops > 0 {
+		if op := time.Second / time.Duration(l.iops); op > cost {
+			cost = op
+		}
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(cost)
+	delay := l.next.Sub(now) - cost
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
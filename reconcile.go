@@ -0,0 +1,135 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Commitment is an entry of an external list of the items expected in the
+// database: the key of an item and the hash of its data.
+type Commitment struct {
+	Key  uint64
+	Hash []byte
+}
+
+// CommitmentIterator yields commitments in ascending key order.
+type CommitmentIterator interface {
+	// Next returns the next commitment, or false once there are no more, or
+	// the iteration failed.
+	Next() (Commitment, bool)
+
+	// Err returns the error which ended the iteration, if any.
+	Err() error
+}
+
+// CommitmentSlice is a CommitmentIterator over a slice of commitments, sorted
+// by key.
+type CommitmentSlice []Commitment
+
+// Next returns the first commitment, and removes it from the slice.
+func (s *CommitmentSlice) Next() (Commitment, bool) {
+	if len(*s) == 0 {
+		return Commitment{}, false
+	}
+	c := (*s)[0]
+	*s = (*s)[1:]
+	return c, true
+}
+
+// Err always returns nil.
+func (s *CommitmentSlice) Err() error {
+	return nil
+}
+
+// HashFn computes the hash of the data of an item, as used by commitments.
+type HashFn func(data []byte) []byte
+
+// MismatchKind describes how an item and its commitment disagree.
+type MismatchKind uint8
+
+const (
+	MismatchMissing MismatchKind = iota // Committed, but not stored
+	MismatchExtra                       // Stored, but not committed
+	MismatchHash                        // Stored with a different hash than committed
+)
+
+func (k MismatchKind) String() string {
+	switch k {
+	case MismatchMissing:
+		return "missing"
+	case MismatchExtra:
+		return "extra"
+	case MismatchHash:
+		return "hash mismatch"
+	}
+	return fmt.Sprintf("mismatch(%d)", uint8(k))
+}
+
+// Mismatch is a disagreement between the database and the commitments found
+// by Reconcile.
+type Mismatch struct {
+	Kind MismatchKind
+	Key  uint64
+	Want []byte // Want is the committed hash, nil for extra items
+	Have []byte // Have is the hash of the stored data, nil for missing items
+}
+
+// Reconcile walks the commitments and the items of the database side by side,
+// and invokes report for every item which is missing, not committed, or
+// stored with a different hash. Items are hashed with the given function, or
+// SHA-256 if nil. The commitments must be sorted by key.
+func (db *database) Reconcile(commitments CommitmentIterator, hash HashFn, report func(Mismatch)) error {
+	if hash == nil {
+		hash = func(data []byte) []byte {
+			h := sha256.Sum256(data)
+			return h[:]
+		}
+	}
+	var (
+		next, ok = commitments.Next()
+		prev     = next.Key
+	)
+	advance := func() error {
+		next, ok = commitments.Next()
+		if ok && next.Key <= prev {
+			return fmt.Errorf("commitments out of order: %#x after %#x", next.Key, prev)
+		}
+		prev = next.Key
+		return nil
+	}
+	err := db.IterateErr(func(key uint64, size uint32, data []byte) error {
+		for ok && next.Key < key {
+			report(Mismatch{Kind: MismatchMissing, Key: next.Key, Want: next.Hash})
+			if err := advance(); err != nil {
+				return err
+			}
+		}
+		have := hash(data)
+		if !ok || next.Key != key {
+			report(Mismatch{Kind: MismatchExtra, Key: key, Have: have})
+			return nil
+		}
+		if !bytes.Equal(have, next.Hash) {
+			report(Mismatch{Kind: MismatchHash, Key: key, Want: next.Hash, Have: have})
+		}
+		return advance()
+	})
+	if err != nil {
+		return err
+	}
+	for ok {
+		c := next
+		if err := guard(func() error { report(Mismatch{Kind: MismatchMissing, Key: c.Key, Want: c.Hash}); return nil }); err != nil {
+			return db.repanic(err)
+		}
+		if err := advance(); err != nil {
+			return err
+		}
+	}
+	return commitments.Err()
+}
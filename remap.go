@@ -0,0 +1,210 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// remapName is the file logging the changes of the remap table.
+const remapName = "REMAP"
+
+// remapDropped marks a log record dropping the entries of a key.
+const remapDropped = ^uint64(0)
+
+// remapTable maps the keys of items moved by compaction to their current keys,
+// see Options.Remap. The keys in the table are plain, without generation.
+//
+// The changes are appended to a log file as pairs of old and new key, or of a
+// key and remapDropped, which is rewritten without the superseded records on
+// close. A nil remapTable maps nothing.
+type remapTable struct {
+	mu  sync.RWMutex
+	fwd map[uint64]uint64   // fwd maps old keys to current ones
+	rev map[uint64][]uint64 // rev maps current keys to the old ones mapped to them
+
+	path string   // path is the log file, empty for in-memory databases
+	log  *os.File // log is open for appending, nil if read-only or in-memory
+	err  error    // err is the first failure to append to the log
+}
+
+// openRemap loads the remap table of the database in dir. Writable tables
+// keep the log open for appending.
+func openRemap(dir string, readonly bool) (*remapTable, error) {
+	r := &remapTable{
+		fwd: make(map[uint64]uint64),
+		rev: make(map[uint64][]uint64),
+	}
+	if dir == "" {
+		return r, nil
+	}
+	r.path = filepath.Join(dir, remapName)
+	blob, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// A crash may have cut the last record short, drop it
+	for ; len(blob) >= 16; blob = blob[16:] {
+		from, to := binary.BigEndian.Uint64(blob), binary.BigEndian.Uint64(blob[8:])
+		if to == remapDropped {
+			r.drop(from)
+		} else {
+			r.remap(from, to)
+		}
+	}
+	if readonly {
+		return r, nil
+	}
+	// Start from a compact log
+	if err := r.rewrite(); err != nil {
+		return nil, err
+	}
+	if r.log, err = os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND, 0666); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resolve returns the current key of an item moved from the given key.
+func (r *remapTable) resolve(key uint64) (uint64, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	to, ok := r.fwd[key]
+	return to, ok
+}
+
+// move records that the item at key from has been moved to key to. The keys
+// mapped to from are mapped to to as well, so that lookups take one step.
+func (r *remapTable) move(from, to uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remap(from, to)
+	r.append(from, to)
+}
+
+// forget drops the entries of the given key, whose slot is being reused for
+// another item: both the mapping from it and those to it.
+func (r *remapTable) forget(key uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.fwd[key]; !ok && len(r.rev[key]) == 0 {
+		return
+	}
+	r.drop(key)
+	r.append(key, remapDropped)
+}
+
+// remap updates the table for a move. This method assumes that mu is held.
+func (r *remapTable) remap(from, to uint64) {
+	r.drop(to)
+	olds := append(r.rev[from], from)
+	delete(r.rev, from)
+	for _, old := range olds {
+		r.fwd[old] = to
+	}
+	r.rev[to] = append(r.rev[to], olds...)
+}
+
+// drop removes the entries from and to the key. This method assumes that mu
+// is held.
+func (r *remapTable) drop(key uint64) {
+	if to, ok := r.fwd[key]; ok {
+		delete(r.fwd, key)
+		olds := r.rev[to]
+		for i, old := range olds {
+			if old == key {
+				olds = append(olds[:i], olds[i+1:]...)
+				break
+			}
+		}
+		if len(olds) == 0 {
+			delete(r.rev, to)
+		} else {
+			r.rev[to] = olds
+		}
+	}
+	for _, old := range r.rev[key] {
+		delete(r.fwd, old)
+	}
+	delete(r.rev, key)
+}
+
+// append logs a change. Failures are kept, and reported by failed. This
+// method assumes that mu is held.
+func (r *remapTable) append(from, to uint64) {
+	if r.log == nil || r.err != nil {
+		return
+	}
+	var rec [16]byte
+	binary.BigEndian.PutUint64(rec[:], from)
+	binary.BigEndian.PutUint64(rec[8:], to)
+	if _, err := r.log.Write(rec[:]); err != nil {
+		r.err = fmt.Errorf("remap table: %w", err)
+	}
+}
+
+// failed returns the first failure to log a change.
+func (r *remapTable) failed() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// rewrite replaces the log with one record per entry. This method assumes
+// that mu is held, or that the table is not shared yet.
+func (r *remapTable) rewrite() error {
+	buf := new(bytes.Buffer)
+	for from, to := range r.fwd {
+		var rec [16]byte
+		binary.BigEndian.PutUint64(rec[:], from)
+		binary.BigEndian.PutUint64(rec[8:], to)
+		buf.Write(rec[:])
+	}
+	return writeFileAtomic(r.path, buf.Bytes())
+}
+
+// sync flushes the log to disk.
+func (r *remapTable) sync() error {
+	if r == nil || r.log == nil {
+		return nil
+	}
+	return r.log.Sync()
+}
+
+// close compacts and closes the log.
+func (r *remapTable) close() error {
+	if r == nil || r.log == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.log.Close()
+	r.log = nil
+	if err == nil {
+		err = r.err
+	}
+	if err == nil {
+		err = r.rewrite()
+	}
+	return err
+}
@@ -0,0 +1,500 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethstorage/billy"
+	"github.com/ethstorage/billy/remote/remotepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// ErrUnsupported is returned by the methods of Client which can't be performed
+// over the connection: those accessing the file system of the server, or
+// taking callbacks or iteration options which can't be sent to it.
+var ErrUnsupported = errors.New("unsupported by remote database")
+
+// Client accesses a database served by Serve. It implements billy.Database,
+// and the errors of the server match the errors of the billy package with
+// errors.Is. The methods which can't be performed remotely fail with
+// ErrUnsupported, see their docs.
+type Client struct {
+	rpc  remotepb.BillyClient
+	conn grpc.ClientConnInterface
+
+	mu       sync.Mutex // mu protects the limits, which are fetched once
+	min, max uint32
+}
+
+var _ billy.Database = (*Client)(nil)
+
+// Dial connects to the database served at the given address, without
+// transport security. Further options, e.g. credentials, can be given.
+func Dial(network, address string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(maxMessageSize),
+			grpc.MaxCallSendMsgSize(maxMessageSize),
+		),
+	}, opts...)
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient creates a client over the given connection.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{rpc: remotepb.NewBillyClient(conn), conn: conn}
+}
+
+// Put stores the data, and returns its key.
+func (c *Client) Put(data []byte) (uint64, error) {
+	reply, err := c.rpc.Put(context.Background(), &remotepb.Data{Data: data})
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	return reply.Key, nil
+}
+
+// PutReader stores length bytes read from r. Unlike with a local database,
+// the data is read into memory before being sent.
+func (c *Client) PutReader(r io.Reader, length int) (uint64, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, err
+	}
+	return c.Put(data)
+}
+
+// Get retrieves the data stored at the given key.
+func (c *Client) Get(key uint64) ([]byte, error) {
+	reply, err := c.rpc.Get(context.Background(), &remotepb.Key{Key: key})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return reply.Data, nil
+}
+
+// GetReader returns a reader over the data stored at the given key. Unlike
+// with a local database, the data is fetched at once.
+func (c *Client) GetReader(key uint64) (*io.SectionReader, error) {
+	data, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+}
+
+// GetInto retrieves the data stored at the given key into buf, and returns
+// its size. If buf is too small, the size is returned with io.ErrShortBuffer.
+func (c *Client) GetInto(key uint64, buf []byte) (int, error) {
+	data, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(buf) {
+		return len(data), io.ErrShortBuffer
+	}
+	return copy(buf, data), nil
+}
+
+// GetSample retrieves a portion of the data stored at the given key.
+func (c *Client) GetSample(key, off, length uint64) ([]byte, error) {
+	reply, err := c.rpc.GetSample(context.Background(), &remotepb.SampleRequest{Key: key, Offset: off, Length: length})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return reply.Data, nil
+}
+
+// Has returns whether an item is stored at the given key.
+func (c *Client) Has(key uint64) (bool, error) {
+	reply, err := c.rpc.Has(context.Background(), &remotepb.Key{Key: key})
+	if err != nil {
+		return false, decodeError(err)
+	}
+	return reply.Has, nil
+}
+
+// Delete deletes the data stored at the given key.
+func (c *Client) Delete(key uint64) error {
+	_, err := c.rpc.Delete(context.Background(), &remotepb.Key{Key: key})
+	return decodeError(err)
+}
+
+// PutAt stores the data at the given key.
+func (c *Client) PutAt(key uint64, data []byte) error {
+	_, err := c.rpc.PutAt(context.Background(), &remotepb.Item{Key: key, Data: data})
+	return decodeError(err)
+}
+
+// UpdateRange overwrites part of the data stored at the given key.
+func (c *Client) UpdateRange(key, off uint64, data []byte) error {
+	_, err := c.rpc.UpdateRange(context.Background(), &remotepb.UpdateRequest{Key: key, Offset: off, Data: data})
+	return decodeError(err)
+}
+
+// Size returns the storage size of the value belonging to the given key, or 0
+// if it can't be retrieved.
+func (c *Client) Size(key uint64) uint32 {
+	reply, err := c.rpc.Size(context.Background(), &remotepb.Key{Key: key})
+	if err != nil {
+		return 0
+	}
+	return reply.Size
+}
+
+// Limits returns the smallest and largest slot sizes of the database. They
+// are fetched from the server on the first call, and are zero if that fails.
+func (c *Client) Limits() (uint32, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.max == 0 {
+		reply, err := c.rpc.Limits(context.Background(), new(emptypb.Empty))
+		if err != nil {
+			return 0, 0
+		}
+		c.min, c.max = reply.Min, reply.Max
+	}
+	return c.min, c.max
+}
+
+// SlotSizeFor returns the slot size of the shelf which Put would store data of
+// the given size in.
+func (c *Client) SlotSizeFor(size int) (uint32, error) {
+	reply, err := c.rpc.SlotSizeFor(context.Background(), &remotepb.SizeRequest{Size: int64(size)})
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	return reply.Size, nil
+}
+
+// Infos retrieves the statistics of the database, which are empty if they
+// can't be retrieved.
+func (c *Client) Infos() *billy.Infos {
+	infos := new(billy.Infos)
+	reply, err := c.rpc.Infos(context.Background(), new(emptypb.Empty))
+	if err != nil {
+		return infos
+	}
+	infos.OversizedPuts = reply.OversizedPuts
+	infos.FileSize = reply.FileSize
+	infos.WastedBytes = reply.WastedBytes
+	for _, shelf := range reply.Shelves {
+		infos.Shelves = append(infos.Shelves, &billy.ShelfInfos{
+			SlotSize:       shelf.SlotSize,
+			FilledSlots:    shelf.FilledSlots,
+			GappedSlots:    shelf.GappedSlots,
+			RemainingSlots: shelf.RemainingSlots,
+			FileSize:       shelf.FileSize,
+			WastedBytes:    shelf.WastedBytes,
+			Created:        fromUnixNano(shelf.Created),
+			Modified:       fromUnixNano(shelf.Modified),
+		})
+	}
+	return infos
+}
+
+// Iterate invokes onData for every item of the database, see IterateErr.
+func (c *Client) Iterate(onData billy.OnDataFn, opts ...billy.IterateOption) error {
+	return c.IterateErr(func(key uint64, size uint32, data []byte) error {
+		if onData != nil {
+			onData(key, size, data)
+		}
+		return nil
+	}, opts...)
+}
+
+// IterateErr invokes onData for every item of the database, fetching them in
+// pages. Unlike with a local database, the items are not visited atomically:
+// changes made meanwhile may or may not be seen. Iteration options are not
+// supported.
+func (c *Client) IterateErr(onData billy.OnDataErrFn, opts ...billy.IterateOption) error {
+	return c.IterateItems(func(item billy.ItemInfo, data []byte) error {
+		return onData(item.Key, item.SlotSize, data)
+	}, opts...)
+}
+
+// IterateParallel is the same as IterateErr: the items are fetched by a single
+// goroutine, so onData is not invoked concurrently.
+func (c *Client) IterateParallel(n int, onData billy.OnDataErrFn, opts ...billy.IterateOption) error {
+	return c.IterateErr(onData, opts...)
+}
+
+// IterateItems is like IterateErr, but describes every item with an ItemInfo.
+func (c *Client) IterateItems(onItem billy.OnItemFn, opts ...billy.IterateOption) error {
+	if len(opts) > 0 {
+		return fmt.Errorf("%w: iteration options", ErrUnsupported)
+	}
+	req := &remotepb.PageRequest{Limit: 1024}
+	for {
+		page, err := c.rpc.Iterate(context.Background(), req)
+		if err != nil {
+			return decodeError(err)
+		}
+		for _, item := range page.Items {
+			shelf, slot := billy.SplitKey(item.Key)
+			info := billy.ItemInfo{
+				Key:      item.Key,
+				Shelf:    shelf,
+				Slot:     slot,
+				SlotSize: item.SlotSize,
+				Stored:   item.Stored,
+			}
+			if err := onItem(info, item.Data); err != nil {
+				if errors.Is(err, billy.ErrStopIteration) {
+					return nil
+				}
+				return err
+			}
+		}
+		if page.Done {
+			return nil
+		}
+		req.Start = page.Next
+	}
+}
+
+// All returns an iterator over the items in the database, see IterateErr.
+func (c *Client) All(opts ...billy.IterateOption) func(yield func(uint64, []byte) bool) {
+	return func(yield func(uint64, []byte) bool) {
+		_ = c.IterateErr(func(key uint64, size uint32, data []byte) error {
+			if !yield(key, data) {
+				return billy.ErrStopIteration
+			}
+			return nil
+		}, opts...)
+	}
+}
+
+// Compact compacts the database on the server. As the moves can't be reported
+// to the client, it fails with ErrUnsupported if onMove is set.
+func (c *Client) Compact(onMove billy.OnMoveFn) error {
+	if onMove != nil {
+		return fmt.Errorf("%w: compaction callback", ErrUnsupported)
+	}
+	_, err := c.rpc.Compact(context.Background(), new(emptypb.Empty))
+	return decodeError(err)
+}
+
+// Checkpoint checkpoints the database on the server.
+func (c *Client) Checkpoint() error {
+	_, err := c.rpc.Checkpoint(context.Background(), new(emptypb.Empty))
+	return decodeError(err)
+}
+
+// Sync syncs the database on the server.
+func (c *Client) Sync() error {
+	_, err := c.rpc.Sync(context.Background(), new(emptypb.Empty))
+	return decodeError(err)
+}
+
+// Flush returns once the writes made before it are synced on the server.
+func (c *Client) Flush() error {
+	_, err := c.rpc.Flush(context.Background(), new(emptypb.Empty))
+	return decodeError(err)
+}
+
+// SnapshotTo fails with ErrUnsupported, as the directory would be on the
+// server.
+func (c *Client) SnapshotTo(dir string) error {
+	return fmt.Errorf("%w: snapshots", ErrUnsupported)
+}
+
+// Export fails with ErrUnsupported.
+func (c *Client) Export(w io.Writer) error {
+	return fmt.Errorf("%w: export", ErrUnsupported)
+}
+
+// Import fails with ErrUnsupported.
+func (c *Client) Import(r io.Reader, onImport billy.OnImportFn) error {
+	return fmt.Errorf("%w: import", ErrUnsupported)
+}
+
+// BackupIncremental fails with ErrUnsupported, as the directory would be on
+// the server.
+func (c *Client) BackupIncremental(since billy.BackupID, dir string) (billy.BackupID, error) {
+	return 0, fmt.Errorf("%w: backups", ErrUnsupported)
+}
+
+// PutWithTTL stores the data along with an expiry time ttl from now.
+func (c *Client) PutWithTTL(data []byte, ttl time.Duration) (uint64, error) {
+	reply, err := c.rpc.PutWithTTL(context.Background(), &remotepb.TTLRequest{Data: data, Ttl: int64(ttl)})
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	return reply.Key, nil
+}
+
+// Expire deletes the items expired at now on the server, and then invokes
+// the optional onExpire callback with their keys.
+func (c *Client) Expire(now time.Time, onExpire billy.OnExpireFn) error {
+	var keys []uint64
+	reply, err := c.rpc.Expire(context.Background(), &remotepb.ExpireRequest{Now: now.UnixNano()})
+	if err != nil {
+		keys = errorKeys(err)
+	} else {
+		keys = reply.Keys
+	}
+	if onExpire != nil {
+		for _, key := range keys {
+			onExpire(key)
+		}
+	}
+	return decodeError(err)
+}
+
+// Verify verifies the database on the server.
+func (c *Client) Verify() error {
+	_, err := c.rpc.Verify(context.Background(), new(emptypb.Empty))
+	return decodeError(err)
+}
+
+// PauseBackground pauses the maintenance operations on the server. Errors of
+// the connection are ignored.
+func (c *Client) PauseBackground() {
+	_, _ = c.rpc.PauseBackground(context.Background(), new(emptypb.Empty))
+}
+
+// ResumeBackground resumes the maintenance operations on the server. Errors of
+// the connection are ignored.
+func (c *Client) ResumeBackground() {
+	_, _ = c.rpc.ResumeBackground(context.Background(), new(emptypb.Empty))
+}
+
+// Reconcile fails with ErrUnsupported.
+func (c *Client) Reconcile(commitments billy.CommitmentIterator, hash billy.HashFn, report func(billy.Mismatch)) error {
+	return fmt.Errorf("%w: reconciliation", ErrUnsupported)
+}
+
+// ApplyChange stores data at key, or deletes the item at key if data is nil.
+func (c *Client) ApplyChange(key uint64, data []byte) error {
+	_, err := c.rpc.ApplyChange(context.Background(), &remotepb.Change{Key: key, Data: data, Delete: data == nil})
+	return decodeError(err)
+}
+
+// Promote makes the database on the server accept writes. Errors of the
+// connection are ignored.
+func (c *Client) Promote() {
+	_, _ = c.rpc.Promote(context.Background(), new(emptypb.Empty))
+}
+
+// DumpJSON writes the live items as newline-delimited JSON, see
+// billy.Database.
+func (c *Client) DumpJSON(w io.Writer, withData bool) error {
+	reply, err := c.rpc.DumpJSON(context.Background(), &remotepb.DumpRequest{WithData: withData})
+	if err != nil {
+		return decodeError(err)
+	}
+	_, err = w.Write(reply.Data)
+	return err
+}
+
+// DebugState writes a JSON dump of the internal state of the database.
+func (c *Client) DebugState(w io.Writer) error {
+	reply, err := c.rpc.DebugState(context.Background(), new(emptypb.Empty))
+	if err != nil {
+		return decodeError(err)
+	}
+	_, err = w.Write(reply.Data)
+	return err
+}
+
+// Lease is a write lease held on a server created by NewLeasedServer, see
+// billy.Lease.
+type Lease struct {
+	Holder string
+	First  int
+	Last   int
+
+	client *Client
+	id     uint64
+}
+
+// Acquire acquires a lease over the shelves with id first to last (inclusive),
+// valid for the given duration.
+func (c *Client) Acquire(holder string, first, last int, ttl time.Duration) (*Lease, error) {
+	req := &remotepb.LeaseRequest{Holder: holder, First: int32(first), Last: int32(last), Ttl: int64(ttl)}
+	reply, err := c.rpc.Acquire(context.Background(), req)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return &Lease{Holder: holder, First: first, Last: last, client: c, id: reply.Id}, nil
+}
+
+// Renew extends the lease to expire ttl from now.
+func (l *Lease) Renew(ttl time.Duration) error {
+	_, err := l.client.rpc.Renew(context.Background(), &remotepb.RenewRequest{Lease: l.id, Ttl: int64(ttl)})
+	return decodeError(err)
+}
+
+// Release gives up the lease.
+func (l *Lease) Release() error {
+	_, err := l.client.rpc.Release(context.Background(), &remotepb.LeaseID{Id: l.id})
+	return decodeError(err)
+}
+
+// Put stores the data under the lease, and returns its key.
+func (l *Lease) Put(data []byte) (uint64, error) {
+	reply, err := l.client.rpc.LeasedPut(context.Background(), &remotepb.LeasedRequest{Lease: l.id, Data: data})
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	return reply.Key, nil
+}
+
+// PutAt stores the data at the given key under the lease.
+func (l *Lease) PutAt(key uint64, data []byte) error {
+	_, err := l.client.rpc.LeasedPutAt(context.Background(), &remotepb.LeasedRequest{Lease: l.id, Key: key, Data: data})
+	return decodeError(err)
+}
+
+// UpdateRange overwrites part of the data at the given key under the lease.
+func (l *Lease) UpdateRange(key, off uint64, data []byte) error {
+	req := &remotepb.LeasedRequest{Lease: l.id, Key: key, Offset: off, Data: data}
+	_, err := l.client.rpc.LeasedUpdateRange(context.Background(), req)
+	return decodeError(err)
+}
+
+// Delete deletes the data at the given key under the lease.
+func (l *Lease) Delete(key uint64) error {
+	_, err := l.client.rpc.LeasedDelete(context.Background(), &remotepb.LeasedRequest{Lease: l.id, Key: key})
+	return decodeError(err)
+}
+
+// Close closes the connection, if it is one that can be closed.
+func (c *Client) Close() error {
+	if closer, ok := c.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// fromUnixNano returns the time of the unix nanoseconds, or the zero time for
+// zero.
+func fromUnixNano(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,287 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethstorage/billy"
+	"github.com/ethstorage/billy/remote/remotepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func newTestClient(t *testing.T) (billy.Database, *Client) {
+	t.Helper()
+	db, err := billy.Open(t.TempDir(), billy.SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db)
+	go server.Serve(l)
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		server.Stop()
+		db.Close()
+	})
+	return db, c
+}
+
+func TestRemote(t *testing.T) {
+	_, c := newTestClient(t)
+
+	var keys []uint64
+	for i := 0; i < 5; i++ {
+		key, err := c.Put(bytes.Repeat([]byte{byte(i)}, 50*(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	data, err := c.Get(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := data, bytes.Repeat([]byte{2}, 150); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	if err := c.UpdateRange(keys[2], 10, []byte{9, 9}); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := c.GetSample(keys[2], 9, 4); err != nil || !bytes.Equal(have, []byte{2, 9, 9, 2}) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	if err := c.Delete(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := c.Has(keys[0]); err != nil || has {
+		t.Fatalf("have %v want false, err %v", has, err)
+	}
+	// Errors of the database are matched by errors.Is
+	if _, err := c.Get(keys[0]); !errors.Is(err, billy.ErrDeleted) {
+		t.Fatalf("have %v want %v", err, billy.ErrDeleted)
+	}
+	// Clients without the ErrorInfo get the closest status code
+	if _, err := c.rpc.Get(context.Background(), &remotepb.Key{Key: keys[0]}); status.Code(err) != codes.NotFound {
+		t.Fatalf("have %v want %v", status.Code(err), codes.NotFound)
+	}
+	if err := c.Delete(billy.Key(7, 0)); !errors.Is(err, billy.ErrBadIndex) {
+		t.Fatalf("have %v want %v", err, billy.ErrBadIndex)
+	}
+	if _, err := c.Put(make([]byte, 1000)); !errors.Is(err, billy.ErrOversized) {
+		t.Fatalf("have %v want %v", err, billy.ErrOversized)
+	}
+	if min, max := c.Limits(); min != 100 || max != 300 {
+		t.Fatalf("have %d-%d want 100-300", min, max)
+	}
+	var seen []uint64
+	err = c.Iterate(func(key uint64, size uint32, data []byte) {
+		seen = append(seen, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(seen), 4; have != want {
+		t.Fatalf("have %d items want %d", have, want)
+	}
+}
+
+func TestRemoteIteratePages(t *testing.T) {
+	db, c := newTestClient(t)
+
+	for i := 0; i < 10; i++ {
+		if _, err := db.Put(bytes.Repeat([]byte{byte(i)}, 10*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		req  = &remotepb.PageRequest{Limit: 3}
+		seen []uint64
+	)
+	for pages := 1; ; pages++ {
+		page, err := c.rpc.Iterate(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range page.Items {
+			seen = append(seen, item.Key)
+		}
+		if page.Done {
+			if pages != 4 {
+				t.Fatalf("have %d pages want 4", pages)
+			}
+			break
+		}
+		req.Start = page.Next
+	}
+	if len(seen) != 10 {
+		t.Fatalf("have %d items want 10", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i] <= seen[i-1] {
+			t.Fatalf("keys out of order: %v", seen)
+		}
+	}
+}
+
+func TestRemoteLeases(t *testing.T) {
+	db, err := billy.Open(t.TempDir(), billy.SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	leases, err := billy.NewLeases(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewLeasedServer(db, leases)
+	defer server.Stop()
+	go server.Serve(l)
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Put([]byte{1}); !errors.Is(err, billy.ErrNotLeased) {
+		t.Fatalf("have %v want %v", err, billy.ErrNotLeased)
+	}
+	if err := c.Compact(nil); !errors.Is(err, billy.ErrNotLeased) {
+		t.Fatalf("have %v want %v", err, billy.ErrNotLeased)
+	}
+	if err := c.Checkpoint(); !errors.Is(err, billy.ErrNotLeased) {
+		t.Fatalf("have %v want %v", err, billy.ErrNotLeased)
+	}
+	if _, err := c.rpc.Promote(context.Background(), new(emptypb.Empty)); !errors.Is(decodeError(err), billy.ErrNotLeased) {
+		t.Fatalf("have %v want %v", err, billy.ErrNotLeased)
+	}
+	a, err := c.Acquire("a", 0, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Acquire("b", 0, 1, time.Minute); !errors.Is(err, billy.ErrLeaseHeld) {
+		t.Fatalf("have %v want %v", err, billy.ErrLeaseHeld)
+	}
+	key, err := a.Put([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UpdateRange(key, 1, []byte{9}); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := c.Get(key); err != nil || !bytes.Equal(have, []byte{1, 9, 3}) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	if _, err := a.Put(make([]byte, 150)); !errors.Is(err, billy.ErrNotLeased) {
+		t.Fatalf("have %v want %v", err, billy.ErrNotLeased)
+	}
+	if err := a.Renew(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete(key); !errors.Is(err, billy.ErrLeaseExpired) {
+		t.Fatalf("have %v want %v", err, billy.ErrLeaseExpired)
+	}
+	b, err := c.Acquire("b", 0, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteDatabase(t *testing.T) {
+	db, c := newTestClient(t)
+
+	key, err := c.PutReader(bytes.NewReader(bytes.Repeat([]byte{1}, 120)), 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := c.Size(key), db.Size(key); have != want {
+		t.Fatalf("have %d want %d", have, want)
+	}
+	buf := make([]byte, 100)
+	if n, err := c.GetInto(key, buf); !errors.Is(err, io.ErrShortBuffer) || n != 120 {
+		t.Fatalf("have %d, %v want 120, %v", n, err, io.ErrShortBuffer)
+	}
+	r, err := c.GetReader(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := io.ReadAll(r); err != nil || !bytes.Equal(have, bytes.Repeat([]byte{1}, 120)) {
+		t.Fatalf("have %x, err %v", have, err)
+	}
+	if have, err := c.SlotSizeFor(120); err != nil || have != 200 {
+		t.Fatalf("have %d, err %v want 200", have, err)
+	}
+	if have := c.Infos(); len(have.Shelves) != 3 || have.Shelves[1].FilledSlots != 1 {
+		t.Fatalf("have %+v", have)
+	}
+	err = c.IterateItems(func(item billy.ItemInfo, data []byte) error {
+		if item.Key != key || item.Shelf != 1 || item.SlotSize != 200 || item.Stored != 120 {
+			t.Fatalf("have %+v", item)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Iterate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Iterate(nil, billy.WithStartKey(key)); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("have %v want %v", err, ErrUnsupported)
+	}
+	// Expired items are deleted on the server, and reported to the client
+	if _, err := c.PutWithTTL([]byte{2}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	var expired int
+	if err := c.Expire(time.Now().Add(time.Second), func(uint64) { expired++ }); err != nil || expired != 1 {
+		t.Fatalf("have %d expired, err %v", expired, err)
+	}
+	if err := c.ApplyChange(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Compact(func(uint64, uint64, []byte) {}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("have %v want %v", err, ErrUnsupported)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SnapshotTo(t.TempDir()); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("have %v want %v", err, ErrUnsupported)
+	}
+	var dump bytes.Buffer
+	if err := c.DebugState(&dump); err != nil || dump.Len() == 0 {
+		t.Fatalf("have %d bytes, err %v", dump.Len(), err)
+	}
+}
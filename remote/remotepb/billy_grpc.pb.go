@@ -0,0 +1,1275 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: billy.proto
+
+package remotepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Billy_Put_FullMethodName               = "/billy.remote.Billy/Put"
+	Billy_Get_FullMethodName               = "/billy.remote.Billy/Get"
+	Billy_GetSample_FullMethodName         = "/billy.remote.Billy/GetSample"
+	Billy_Has_FullMethodName               = "/billy.remote.Billy/Has"
+	Billy_Delete_FullMethodName            = "/billy.remote.Billy/Delete"
+	Billy_PutAt_FullMethodName             = "/billy.remote.Billy/PutAt"
+	Billy_UpdateRange_FullMethodName       = "/billy.remote.Billy/UpdateRange"
+	Billy_Size_FullMethodName              = "/billy.remote.Billy/Size"
+	Billy_Limits_FullMethodName            = "/billy.remote.Billy/Limits"
+	Billy_SlotSizeFor_FullMethodName       = "/billy.remote.Billy/SlotSizeFor"
+	Billy_Infos_FullMethodName             = "/billy.remote.Billy/Infos"
+	Billy_Iterate_FullMethodName           = "/billy.remote.Billy/Iterate"
+	Billy_PutWithTTL_FullMethodName        = "/billy.remote.Billy/PutWithTTL"
+	Billy_Expire_FullMethodName            = "/billy.remote.Billy/Expire"
+	Billy_ApplyChange_FullMethodName       = "/billy.remote.Billy/ApplyChange"
+	Billy_Compact_FullMethodName           = "/billy.remote.Billy/Compact"
+	Billy_Checkpoint_FullMethodName        = "/billy.remote.Billy/Checkpoint"
+	Billy_Sync_FullMethodName              = "/billy.remote.Billy/Sync"
+	Billy_Flush_FullMethodName             = "/billy.remote.Billy/Flush"
+	Billy_Verify_FullMethodName            = "/billy.remote.Billy/Verify"
+	Billy_PauseBackground_FullMethodName   = "/billy.remote.Billy/PauseBackground"
+	Billy_ResumeBackground_FullMethodName  = "/billy.remote.Billy/ResumeBackground"
+	Billy_Promote_FullMethodName           = "/billy.remote.Billy/Promote"
+	Billy_DumpJSON_FullMethodName          = "/billy.remote.Billy/DumpJSON"
+	Billy_DebugState_FullMethodName        = "/billy.remote.Billy/DebugState"
+	Billy_Acquire_FullMethodName           = "/billy.remote.Billy/Acquire"
+	Billy_Renew_FullMethodName             = "/billy.remote.Billy/Renew"
+	Billy_Release_FullMethodName           = "/billy.remote.Billy/Release"
+	Billy_LeasedPut_FullMethodName         = "/billy.remote.Billy/LeasedPut"
+	Billy_LeasedPutAt_FullMethodName       = "/billy.remote.Billy/LeasedPutAt"
+	Billy_LeasedUpdateRange_FullMethodName = "/billy.remote.Billy/LeasedUpdateRange"
+	Billy_LeasedDelete_FullMethodName      = "/billy.remote.Billy/LeasedDelete"
+)
+
+// BillyClient is the client API for Billy service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BillyClient interface {
+	Put(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Key, error)
+	Get(ctx context.Context, in *Key, opts ...grpc.CallOption) (*Data, error)
+	GetSample(ctx context.Context, in *SampleRequest, opts ...grpc.CallOption) (*Data, error)
+	Has(ctx context.Context, in *Key, opts ...grpc.CallOption) (*HasReply, error)
+	Delete(ctx context.Context, in *Key, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	PutAt(ctx context.Context, in *Item, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	UpdateRange(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Size(ctx context.Context, in *Key, opts ...grpc.CallOption) (*SizeReply, error)
+	Limits(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*LimitsReply, error)
+	SlotSizeFor(ctx context.Context, in *SizeRequest, opts ...grpc.CallOption) (*SizeReply, error)
+	Infos(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*InfosReply, error)
+	// Iterate returns a page of the items in ascending key order.
+	Iterate(ctx context.Context, in *PageRequest, opts ...grpc.CallOption) (*Page, error)
+	PutWithTTL(ctx context.Context, in *TTLRequest, opts ...grpc.CallOption) (*Key, error)
+	// Expire expires the items, and returns their keys.
+	Expire(ctx context.Context, in *ExpireRequest, opts ...grpc.CallOption) (*Keys, error)
+	ApplyChange(ctx context.Context, in *Change, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Compact compacts the database. The moves are not reported.
+	Compact(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Checkpoint(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Sync(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Flush(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Verify(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	PauseBackground(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ResumeBackground(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Promote(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	DumpJSON(ctx context.Context, in *DumpRequest, opts ...grpc.CallOption) (*Data, error)
+	DebugState(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Data, error)
+	// Acquire grants a write lease, and returns its id.
+	Acquire(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseID, error)
+	Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Release(ctx context.Context, in *LeaseID, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// The leased writes are performed under the lease with the given id. The
+	// key is ignored by LeasedPut, and the offset only used by
+	// LeasedUpdateRange.
+	LeasedPut(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*Key, error)
+	LeasedPutAt(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	LeasedUpdateRange(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	LeasedDelete(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+type billyClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBillyClient(cc grpc.ClientConnInterface) BillyClient {
+	return &billyClient{cc}
+}
+
+func (c *billyClient) Put(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, Billy_Put_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Get(ctx context.Context, in *Key, opts ...grpc.CallOption) (*Data, error) {
+	out := new(Data)
+	err := c.cc.Invoke(ctx, Billy_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) GetSample(ctx context.Context, in *SampleRequest, opts ...grpc.CallOption) (*Data, error) {
+	out := new(Data)
+	err := c.cc.Invoke(ctx, Billy_GetSample_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Has(ctx context.Context, in *Key, opts ...grpc.CallOption) (*HasReply, error) {
+	out := new(HasReply)
+	err := c.cc.Invoke(ctx, Billy_Has_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Delete(ctx context.Context, in *Key, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Delete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) PutAt(ctx context.Context, in *Item, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_PutAt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) UpdateRange(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_UpdateRange_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Size(ctx context.Context, in *Key, opts ...grpc.CallOption) (*SizeReply, error) {
+	out := new(SizeReply)
+	err := c.cc.Invoke(ctx, Billy_Size_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Limits(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*LimitsReply, error) {
+	out := new(LimitsReply)
+	err := c.cc.Invoke(ctx, Billy_Limits_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) SlotSizeFor(ctx context.Context, in *SizeRequest, opts ...grpc.CallOption) (*SizeReply, error) {
+	out := new(SizeReply)
+	err := c.cc.Invoke(ctx, Billy_SlotSizeFor_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Infos(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*InfosReply, error) {
+	out := new(InfosReply)
+	err := c.cc.Invoke(ctx, Billy_Infos_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Iterate(ctx context.Context, in *PageRequest, opts ...grpc.CallOption) (*Page, error) {
+	out := new(Page)
+	err := c.cc.Invoke(ctx, Billy_Iterate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) PutWithTTL(ctx context.Context, in *TTLRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, Billy_PutWithTTL_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Expire(ctx context.Context, in *ExpireRequest, opts ...grpc.CallOption) (*Keys, error) {
+	out := new(Keys)
+	err := c.cc.Invoke(ctx, Billy_Expire_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) ApplyChange(ctx context.Context, in *Change, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_ApplyChange_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Compact(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Compact_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Checkpoint(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Checkpoint_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Sync(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Sync_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Flush(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Flush_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Verify(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Verify_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) PauseBackground(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_PauseBackground_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) ResumeBackground(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_ResumeBackground_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Promote(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Promote_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) DumpJSON(ctx context.Context, in *DumpRequest, opts ...grpc.CallOption) (*Data, error) {
+	out := new(Data)
+	err := c.cc.Invoke(ctx, Billy_DumpJSON_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) DebugState(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Data, error) {
+	out := new(Data)
+	err := c.cc.Invoke(ctx, Billy_DebugState_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Acquire(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*LeaseID, error) {
+	out := new(LeaseID)
+	err := c.cc.Invoke(ctx, Billy_Acquire_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Renew_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) Release(ctx context.Context, in *LeaseID, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_Release_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) LeasedPut(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*Key, error) {
+	out := new(Key)
+	err := c.cc.Invoke(ctx, Billy_LeasedPut_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) LeasedPutAt(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_LeasedPutAt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) LeasedUpdateRange(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_LeasedUpdateRange_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *billyClient) LeasedDelete(ctx context.Context, in *LeasedRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Billy_LeasedDelete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BillyServer is the server API for Billy service.
+// All implementations must embed UnimplementedBillyServer
+// for forward compatibility
+type BillyServer interface {
+	Put(context.Context, *Data) (*Key, error)
+	Get(context.Context, *Key) (*Data, error)
+	GetSample(context.Context, *SampleRequest) (*Data, error)
+	Has(context.Context, *Key) (*HasReply, error)
+	Delete(context.Context, *Key) (*emptypb.Empty, error)
+	PutAt(context.Context, *Item) (*emptypb.Empty, error)
+	UpdateRange(context.Context, *UpdateRequest) (*emptypb.Empty, error)
+	Size(context.Context, *Key) (*SizeReply, error)
+	Limits(context.Context, *emptypb.Empty) (*LimitsReply, error)
+	SlotSizeFor(context.Context, *SizeRequest) (*SizeReply, error)
+	Infos(context.Context, *emptypb.Empty) (*InfosReply, error)
+	// Iterate returns a page of the items in ascending key order.
+	Iterate(context.Context, *PageRequest) (*Page, error)
+	PutWithTTL(context.Context, *TTLRequest) (*Key, error)
+	// Expire expires the items, and returns their keys.
+	Expire(context.Context, *ExpireRequest) (*Keys, error)
+	ApplyChange(context.Context, *Change) (*emptypb.Empty, error)
+	// Compact compacts the database. The moves are not reported.
+	Compact(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Checkpoint(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Sync(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Flush(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Verify(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	PauseBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	ResumeBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Promote(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	DumpJSON(context.Context, *DumpRequest) (*Data, error)
+	DebugState(context.Context, *emptypb.Empty) (*Data, error)
+	// Acquire grants a write lease, and returns its id.
+	Acquire(context.Context, *LeaseRequest) (*LeaseID, error)
+	Renew(context.Context, *RenewRequest) (*emptypb.Empty, error)
+	Release(context.Context, *LeaseID) (*emptypb.Empty, error)
+	// The leased writes are performed under the lease with the given id. The
+	// key is ignored by LeasedPut, and the offset only used by
+	// LeasedUpdateRange.
+	LeasedPut(context.Context, *LeasedRequest) (*Key, error)
+	LeasedPutAt(context.Context, *LeasedRequest) (*emptypb.Empty, error)
+	LeasedUpdateRange(context.Context, *LeasedRequest) (*emptypb.Empty, error)
+	LeasedDelete(context.Context, *LeasedRequest) (*emptypb.Empty, error)
+	mustEmbedUnimplementedBillyServer()
+}
+
+// UnimplementedBillyServer must be embedded to have forward compatible implementations.
+type UnimplementedBillyServer struct {
+}
+
+func (UnimplementedBillyServer) Put(context.Context, *Data) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedBillyServer) Get(context.Context, *Key) (*Data, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedBillyServer) GetSample(context.Context, *SampleRequest) (*Data, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSample not implemented")
+}
+func (UnimplementedBillyServer) Has(context.Context, *Key) (*HasReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Has not implemented")
+}
+func (UnimplementedBillyServer) Delete(context.Context, *Key) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedBillyServer) PutAt(context.Context, *Item) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutAt not implemented")
+}
+func (UnimplementedBillyServer) UpdateRange(context.Context, *UpdateRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateRange not implemented")
+}
+func (UnimplementedBillyServer) Size(context.Context, *Key) (*SizeReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Size not implemented")
+}
+func (UnimplementedBillyServer) Limits(context.Context, *emptypb.Empty) (*LimitsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Limits not implemented")
+}
+func (UnimplementedBillyServer) SlotSizeFor(context.Context, *SizeRequest) (*SizeReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SlotSizeFor not implemented")
+}
+func (UnimplementedBillyServer) Infos(context.Context, *emptypb.Empty) (*InfosReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Infos not implemented")
+}
+func (UnimplementedBillyServer) Iterate(context.Context, *PageRequest) (*Page, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Iterate not implemented")
+}
+func (UnimplementedBillyServer) PutWithTTL(context.Context, *TTLRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutWithTTL not implemented")
+}
+func (UnimplementedBillyServer) Expire(context.Context, *ExpireRequest) (*Keys, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Expire not implemented")
+}
+func (UnimplementedBillyServer) ApplyChange(context.Context, *Change) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApplyChange not implemented")
+}
+func (UnimplementedBillyServer) Compact(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Compact not implemented")
+}
+func (UnimplementedBillyServer) Checkpoint(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Checkpoint not implemented")
+}
+func (UnimplementedBillyServer) Sync(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sync not implemented")
+}
+func (UnimplementedBillyServer) Flush(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Flush not implemented")
+}
+func (UnimplementedBillyServer) Verify(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedBillyServer) PauseBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseBackground not implemented")
+}
+func (UnimplementedBillyServer) ResumeBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeBackground not implemented")
+}
+func (UnimplementedBillyServer) Promote(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Promote not implemented")
+}
+func (UnimplementedBillyServer) DumpJSON(context.Context, *DumpRequest) (*Data, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DumpJSON not implemented")
+}
+func (UnimplementedBillyServer) DebugState(context.Context, *emptypb.Empty) (*Data, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DebugState not implemented")
+}
+func (UnimplementedBillyServer) Acquire(context.Context, *LeaseRequest) (*LeaseID, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Acquire not implemented")
+}
+func (UnimplementedBillyServer) Renew(context.Context, *RenewRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Renew not implemented")
+}
+func (UnimplementedBillyServer) Release(context.Context, *LeaseID) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
+func (UnimplementedBillyServer) LeasedPut(context.Context, *LeasedRequest) (*Key, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeasedPut not implemented")
+}
+func (UnimplementedBillyServer) LeasedPutAt(context.Context, *LeasedRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeasedPutAt not implemented")
+}
+func (UnimplementedBillyServer) LeasedUpdateRange(context.Context, *LeasedRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeasedUpdateRange not implemented")
+}
+func (UnimplementedBillyServer) LeasedDelete(context.Context, *LeasedRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeasedDelete not implemented")
+}
+func (UnimplementedBillyServer) mustEmbedUnimplementedBillyServer() {}
+
+// UnsafeBillyServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BillyServer will
+// result in compilation errors.
+type UnsafeBillyServer interface {
+	mustEmbedUnimplementedBillyServer()
+}
+
+func RegisterBillyServer(s grpc.ServiceRegistrar, srv BillyServer) {
+	s.RegisterService(&Billy_ServiceDesc, srv)
+}
+
+func _Billy_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Data)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Put(ctx, req.(*Data))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Key)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Get(ctx, req.(*Key))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_GetSample_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SampleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).GetSample(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_GetSample_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).GetSample(ctx, req.(*SampleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Has_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Key)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Has(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Has_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Has(ctx, req.(*Key))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Key)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Delete(ctx, req.(*Key))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_PutAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Item)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).PutAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_PutAt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).PutAt(ctx, req.(*Item))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_UpdateRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).UpdateRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_UpdateRange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).UpdateRange(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Size_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Key)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Size(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Size_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Size(ctx, req.(*Key))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Limits_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Limits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Limits_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Limits(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_SlotSizeFor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).SlotSizeFor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_SlotSizeFor_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).SlotSizeFor(ctx, req.(*SizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Infos_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Infos(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Infos_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Infos(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Iterate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Iterate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Iterate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Iterate(ctx, req.(*PageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_PutWithTTL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TTLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).PutWithTTL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_PutWithTTL_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).PutWithTTL(ctx, req.(*TTLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Expire_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExpireRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Expire(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Expire_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Expire(ctx, req.(*ExpireRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_ApplyChange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Change)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).ApplyChange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_ApplyChange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).ApplyChange(ctx, req.(*Change))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Compact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Compact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Compact_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Compact(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Checkpoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Checkpoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Checkpoint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Checkpoint(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Sync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Sync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Sync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Sync(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Flush_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Flush(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Flush_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Flush(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Verify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Verify(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_PauseBackground_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).PauseBackground(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_PauseBackground_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).PauseBackground(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_ResumeBackground_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).ResumeBackground(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_ResumeBackground_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).ResumeBackground(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Promote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Promote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Promote_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Promote(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_DumpJSON_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).DumpJSON(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_DumpJSON_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).DumpJSON(ctx, req.(*DumpRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_DebugState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).DebugState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_DebugState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).DebugState(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Acquire_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Acquire(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Acquire_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Acquire(ctx, req.(*LeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Renew_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Renew(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Renew_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Renew(ctx, req.(*RenewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).Release(ctx, req.(*LeaseID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_LeasedPut_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeasedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).LeasedPut(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_LeasedPut_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).LeasedPut(ctx, req.(*LeasedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_LeasedPutAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeasedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).LeasedPutAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_LeasedPutAt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).LeasedPutAt(ctx, req.(*LeasedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_LeasedUpdateRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeasedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).LeasedUpdateRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_LeasedUpdateRange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).LeasedUpdateRange(ctx, req.(*LeasedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Billy_LeasedDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeasedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BillyServer).LeasedDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Billy_LeasedDelete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BillyServer).LeasedDelete(ctx, req.(*LeasedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Billy_ServiceDesc is the grpc.ServiceDesc for Billy service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Billy_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "billy.remote.Billy",
+	HandlerType: (*BillyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Put",
+			Handler:    _Billy_Put_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Billy_Get_Handler,
+		},
+		{
+			MethodName: "GetSample",
+			Handler:    _Billy_GetSample_Handler,
+		},
+		{
+			MethodName: "Has",
+			Handler:    _Billy_Has_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Billy_Delete_Handler,
+		},
+		{
+			MethodName: "PutAt",
+			Handler:    _Billy_PutAt_Handler,
+		},
+		{
+			MethodName: "UpdateRange",
+			Handler:    _Billy_UpdateRange_Handler,
+		},
+		{
+			MethodName: "Size",
+			Handler:    _Billy_Size_Handler,
+		},
+		{
+			MethodName: "Limits",
+			Handler:    _Billy_Limits_Handler,
+		},
+		{
+			MethodName: "SlotSizeFor",
+			Handler:    _Billy_SlotSizeFor_Handler,
+		},
+		{
+			MethodName: "Infos",
+			Handler:    _Billy_Infos_Handler,
+		},
+		{
+			MethodName: "Iterate",
+			Handler:    _Billy_Iterate_Handler,
+		},
+		{
+			MethodName: "PutWithTTL",
+			Handler:    _Billy_PutWithTTL_Handler,
+		},
+		{
+			MethodName: "Expire",
+			Handler:    _Billy_Expire_Handler,
+		},
+		{
+			MethodName: "ApplyChange",
+			Handler:    _Billy_ApplyChange_Handler,
+		},
+		{
+			MethodName: "Compact",
+			Handler:    _Billy_Compact_Handler,
+		},
+		{
+			MethodName: "Checkpoint",
+			Handler:    _Billy_Checkpoint_Handler,
+		},
+		{
+			MethodName: "Sync",
+			Handler:    _Billy_Sync_Handler,
+		},
+		{
+			MethodName: "Flush",
+			Handler:    _Billy_Flush_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _Billy_Verify_Handler,
+		},
+		{
+			MethodName: "PauseBackground",
+			Handler:    _Billy_PauseBackground_Handler,
+		},
+		{
+			MethodName: "ResumeBackground",
+			Handler:    _Billy_ResumeBackground_Handler,
+		},
+		{
+			MethodName: "Promote",
+			Handler:    _Billy_Promote_Handler,
+		},
+		{
+			MethodName: "DumpJSON",
+			Handler:    _Billy_DumpJSON_Handler,
+		},
+		{
+			MethodName: "DebugState",
+			Handler:    _Billy_DebugState_Handler,
+		},
+		{
+			MethodName: "Acquire",
+			Handler:    _Billy_Acquire_Handler,
+		},
+		{
+			MethodName: "Renew",
+			Handler:    _Billy_Renew_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _Billy_Release_Handler,
+		},
+		{
+			MethodName: "LeasedPut",
+			Handler:    _Billy_LeasedPut_Handler,
+		},
+		{
+			MethodName: "LeasedPutAt",
+			Handler:    _Billy_LeasedPutAt_Handler,
+		},
+		{
+			MethodName: "LeasedUpdateRange",
+			Handler:    _Billy_LeasedUpdateRange_Handler,
+		},
+		{
+			MethodName: "LeasedDelete",
+			Handler:    _Billy_LeasedDelete_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "billy.proto",
+}
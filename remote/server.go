@@ -0,0 +1,558 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package remote serves a billy database over gRPC, and provides a client to
+// access it. The service is defined in remotepb/billy.proto, from which
+// clients in other languages can be generated.
+//
+// A server created by NewLeasedServer only accepts writes under the write
+// leases of billy.Leases, and refuses the calls which affect all shelves.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethstorage/billy"
+	"github.com/ethstorage/billy/remote/remotepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// maxPageSize is the number of bytes of data after which a page of items
+// returned by Iterate is closed.
+const maxPageSize = 4 * 1024 * 1024
+
+// maxMessageSize is the largest message accepted by the server and client,
+// which must hold an item of the largest slot size, or a page of items.
+const maxMessageSize = 64 * 1024 * 1024
+
+// Service implements the gRPC service for a database. Errors carry their
+// billy.Code, so that clients can decode them.
+type Service struct {
+	remotepb.UnimplementedBillyServer
+
+	db      billy.Database
+	shelves int // shelves is the number of shelves, to validate keys
+
+	leases  *billy.Leases           // leases is set if writes require a lease
+	mu      sync.Mutex              // mu protects granted and lastID
+	granted map[uint64]*billy.Lease // granted maps the ids of the leases to them
+	lastID  uint64
+}
+
+// NewServer returns a gRPC server for the given database.
+func NewServer(db billy.Database, opts ...grpc.ServerOption) *grpc.Server {
+	return newServer(&Service{db: db, shelves: len(db.Infos().Shelves)}, opts)
+}
+
+// NewLeasedServer returns a gRPC server for the given database, on which
+// writes are only accepted under a lease of the given lease manager: clients
+// acquire one with Client.Acquire, and write through it. The plain writes of
+// the Client fail with billy.ErrNotLeased.
+func NewLeasedServer(db billy.Database, leases *billy.Leases, opts ...grpc.ServerOption) *grpc.Server {
+	return newServer(&Service{
+		db:      db,
+		shelves: len(db.Infos().Shelves),
+		leases:  leases,
+		granted: make(map[uint64]*billy.Lease),
+	}, opts)
+}
+
+func newServer(service *Service, opts []grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.MaxSendMsgSize(maxMessageSize),
+	}, opts...)
+	server := grpc.NewServer(opts...)
+	remotepb.RegisterBillyServer(server, service)
+	return server
+}
+
+// Serve serves the database on the connections accepted from l, until
+// accepting fails, e.g. because l is closed. It returns the error of Accept.
+func Serve(l net.Listener, db billy.Database) error {
+	return NewServer(db).Serve(l)
+}
+
+// ServeLeased is like Serve, but with the server of NewLeasedServer.
+func ServeLeased(l net.Listener, db billy.Database, leases *billy.Leases) error {
+	return NewLeasedServer(db, leases).Serve(l)
+}
+
+func (s *Service) Put(_ context.Context, req *remotepb.Data) (*remotepb.Key, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	key, err := s.db.Put(req.Data)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Key{Key: key}, nil
+}
+
+func (s *Service) Get(_ context.Context, req *remotepb.Key) (*remotepb.Data, error) {
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	data, err := s.db.Get(req.Key)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Data{Data: data}, nil
+}
+
+func (s *Service) GetSample(_ context.Context, req *remotepb.SampleRequest) (*remotepb.Data, error) {
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	data, err := s.db.GetSample(req.Key, req.Offset, req.Length)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Data{Data: data}, nil
+}
+
+func (s *Service) Has(_ context.Context, req *remotepb.Key) (*remotepb.HasReply, error) {
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	has, err := s.db.Has(req.Key)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.HasReply{Has: has}, nil
+}
+
+func (s *Service) Delete(_ context.Context, req *remotepb.Key) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	return empty(s.db.Delete(req.Key))
+}
+
+func (s *Service) PutAt(_ context.Context, req *remotepb.Item) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	return empty(s.db.PutAt(req.Key, req.Data))
+}
+
+func (s *Service) UpdateRange(_ context.Context, req *remotepb.UpdateRequest) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	return empty(s.db.UpdateRange(req.Key, req.Offset, req.Data))
+}
+
+func (s *Service) Size(_ context.Context, req *remotepb.Key) (*remotepb.SizeReply, error) {
+	return &remotepb.SizeReply{Size: s.db.Size(req.Key)}, nil
+}
+
+func (s *Service) Limits(context.Context, *emptypb.Empty) (*remotepb.LimitsReply, error) {
+	min, max := s.db.Limits()
+	return &remotepb.LimitsReply{Min: min, Max: max}, nil
+}
+
+func (s *Service) SlotSizeFor(_ context.Context, req *remotepb.SizeRequest) (*remotepb.SizeReply, error) {
+	slotSize, err := s.db.SlotSizeFor(int(req.Size))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.SizeReply{Size: slotSize}, nil
+}
+
+func (s *Service) Infos(context.Context, *emptypb.Empty) (*remotepb.InfosReply, error) {
+	infos := s.db.Infos()
+	reply := &remotepb.InfosReply{
+		OversizedPuts: infos.OversizedPuts,
+		FileSize:      infos.FileSize,
+		WastedBytes:   infos.WastedBytes,
+	}
+	for _, shelf := range infos.Shelves {
+		reply.Shelves = append(reply.Shelves, &remotepb.ShelfInfos{
+			SlotSize:       shelf.SlotSize,
+			FilledSlots:    shelf.FilledSlots,
+			GappedSlots:    shelf.GappedSlots,
+			RemainingSlots: shelf.RemainingSlots,
+			FileSize:       shelf.FileSize,
+			WastedBytes:    shelf.WastedBytes,
+			Created:        unixNano(shelf.Created),
+			Modified:       unixNano(shelf.Modified),
+		})
+	}
+	return reply, nil
+}
+
+// Iterate returns a page of the items from req.Start on, of at most req.Limit
+// items if positive, and about maxPageSize bytes.
+func (s *Service) Iterate(_ context.Context, req *remotepb.PageRequest) (*remotepb.Page, error) {
+	page := &remotepb.Page{Done: true}
+	size := 0
+	err := s.db.IterateItems(func(item billy.ItemInfo, data []byte) error {
+		if (req.Limit > 0 && len(page.Items) == int(req.Limit)) || size >= maxPageSize {
+			page.Next, page.Done = item.Key, false
+			return billy.ErrStopIteration
+		}
+		page.Items = append(page.Items, &remotepb.Item{
+			Key:      item.Key,
+			Data:     append([]byte{}, data...),
+			SlotSize: item.SlotSize,
+			Stored:   item.Stored,
+		})
+		size += len(data)
+		return nil
+	}, billy.WithStartKey(req.Start))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return page, nil
+}
+
+func (s *Service) PutWithTTL(_ context.Context, req *remotepb.TTLRequest) (*remotepb.Key, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	key, err := s.db.PutWithTTL(req.Data, time.Duration(req.Ttl))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Key{Key: key}, nil
+}
+
+// Expire expires the items, and returns their keys. The keys expired before a
+// failure are returned along with the error, in its details.
+func (s *Service) Expire(_ context.Context, req *remotepb.ExpireRequest) (*remotepb.Keys, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	keys := new(remotepb.Keys)
+	err := s.db.Expire(time.Unix(0, req.Now), func(key uint64) {
+		keys.Keys = append(keys.Keys, key)
+	})
+	if err != nil {
+		st := status.Convert(encodeError(err))
+		if withKeys, derr := st.WithDetails(keys); derr == nil {
+			st = withKeys
+		}
+		return nil, st.Err()
+	}
+	return keys, nil
+}
+
+func (s *Service) ApplyChange(_ context.Context, req *remotepb.Change) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	data := req.Data
+	if req.Delete {
+		data = nil
+	} else if data == nil {
+		data = []byte{}
+	}
+	return empty(s.db.ApplyChange(req.Key, data))
+}
+
+func (s *Service) Compact(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	return empty(s.db.Compact(nil))
+}
+
+func (s *Service) Checkpoint(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	return empty(s.db.Checkpoint())
+}
+
+func (s *Service) Sync(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return empty(s.db.Sync())
+}
+
+func (s *Service) Flush(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return empty(s.db.Flush())
+}
+
+func (s *Service) Verify(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return empty(s.db.Verify())
+}
+
+func (s *Service) PauseBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	s.db.PauseBackground()
+	return new(emptypb.Empty), nil
+}
+
+func (s *Service) ResumeBackground(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	s.db.ResumeBackground()
+	return new(emptypb.Empty), nil
+}
+
+func (s *Service) Promote(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := s.checkUnleased(); err != nil {
+		return nil, err
+	}
+	s.db.Promote()
+	return new(emptypb.Empty), nil
+}
+
+func (s *Service) DumpJSON(_ context.Context, req *remotepb.DumpRequest) (*remotepb.Data, error) {
+	var buf bytes.Buffer
+	if err := s.db.DumpJSON(&buf, req.WithData); err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Data{Data: buf.Bytes()}, nil
+}
+
+func (s *Service) DebugState(context.Context, *emptypb.Empty) (*remotepb.Data, error) {
+	var buf bytes.Buffer
+	if err := s.db.DebugState(&buf); err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Data{Data: buf.Bytes()}, nil
+}
+
+// Acquire grants a lease, and returns its id.
+func (s *Service) Acquire(_ context.Context, req *remotepb.LeaseRequest) (*remotepb.LeaseID, error) {
+	if s.leases == nil {
+		return nil, status.Error(codes.Unimplemented, "server without leases")
+	}
+	lease, err := s.leases.Acquire(req.Holder, int(req.First), int(req.Last), time.Duration(req.Ttl))
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop the leases which have expired without being released
+	now := time.Now()
+	for id, lease := range s.granted {
+		if !now.Before(lease.Expires()) {
+			delete(s.granted, id)
+		}
+	}
+	s.lastID++
+	s.granted[s.lastID] = lease
+	return &remotepb.LeaseID{Id: s.lastID}, nil
+}
+
+func (s *Service) Renew(_ context.Context, req *remotepb.RenewRequest) (*emptypb.Empty, error) {
+	lease, err := s.lease(req.Lease)
+	if err != nil {
+		return nil, err
+	}
+	return empty(lease.Renew(time.Duration(req.Ttl)))
+}
+
+func (s *Service) Release(_ context.Context, req *remotepb.LeaseID) (*emptypb.Empty, error) {
+	lease, err := s.lease(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	delete(s.granted, req.Id)
+	s.mu.Unlock()
+
+	lease.Release()
+	return new(emptypb.Empty), nil
+}
+
+func (s *Service) LeasedPut(_ context.Context, req *remotepb.LeasedRequest) (*remotepb.Key, error) {
+	lease, err := s.lease(req.Lease)
+	if err != nil {
+		return nil, err
+	}
+	key, err := lease.Put(req.Data)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return &remotepb.Key{Key: key}, nil
+}
+
+func (s *Service) LeasedPutAt(_ context.Context, req *remotepb.LeasedRequest) (*emptypb.Empty, error) {
+	lease, err := s.leasedKey(req)
+	if err != nil {
+		return nil, err
+	}
+	return empty(lease.PutAt(req.Key, req.Data))
+}
+
+func (s *Service) LeasedUpdateRange(_ context.Context, req *remotepb.LeasedRequest) (*emptypb.Empty, error) {
+	lease, err := s.leasedKey(req)
+	if err != nil {
+		return nil, err
+	}
+	return empty(lease.UpdateRange(req.Key, req.Offset, req.Data))
+}
+
+func (s *Service) LeasedDelete(_ context.Context, req *remotepb.LeasedRequest) (*emptypb.Empty, error) {
+	lease, err := s.leasedKey(req)
+	if err != nil {
+		return nil, err
+	}
+	return empty(lease.Delete(req.Key))
+}
+
+// lease returns the lease with the given id. Unknown ids, e.g. of released
+// leases, fail with billy.ErrLeaseExpired.
+func (s *Service) lease(id uint64) (*billy.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, ok := s.granted[id]
+	if !ok {
+		return nil, encodeError(fmt.Errorf("%w: lease %d", billy.ErrLeaseExpired, id))
+	}
+	return lease, nil
+}
+
+// leasedKey returns the lease of a write to the key of req, checking the key.
+func (s *Service) leasedKey(req *remotepb.LeasedRequest) (*billy.Lease, error) {
+	if err := s.checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	return s.lease(req.Lease)
+}
+
+// checkUnleased rejects the plain writes if the server requires leases. So
+// are Compact, Checkpoint and Promote, which no lease over a part of the
+// shelves covers.
+func (s *Service) checkUnleased() error {
+	if s.leases != nil {
+		return encodeError(fmt.Errorf("%w: server requires a lease", billy.ErrNotLeased))
+	}
+	return nil
+}
+
+// checkKey rejects keys outside of the shelves of the database before they
+// reach it, so that clients can't crash the server with a Database which does
+// not check them. The bits above the shelf id may hold the generation of the
+// slot.
+func (s *Service) checkKey(key uint64) error {
+	if id, _ := billy.SplitKey(key); id >= s.shelves {
+		return encodeError(fmt.Errorf("%w: key %#x", billy.ErrBadIndex, key))
+	}
+	return nil
+}
+
+// empty returns the reply of the calls without result.
+func empty(err error) (*emptypb.Empty, error) {
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return new(emptypb.Empty), nil
+}
+
+// unixNano returns the time in unix nanoseconds, or zero for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// grpcCodes maps the billy codes to the closest gRPC status codes, for
+// clients which don't decode the ErrorInfo.
+var grpcCodes = map[billy.Code]codes.Code{
+	billy.CodeClosed:       codes.Unavailable,
+	billy.CodeOversized:    codes.InvalidArgument,
+	billy.CodeBadIndex:     codes.InvalidArgument,
+	billy.CodeEmptyData:    codes.InvalidArgument,
+	billy.CodeInvalidKey:   codes.InvalidArgument,
+	billy.CodeDeleted:      codes.NotFound,
+	billy.CodeStaleKey:     codes.NotFound,
+	billy.CodeSlotInUse:    codes.AlreadyExists,
+	billy.CodeReadonly:     codes.FailedPrecondition,
+	billy.CodeStandby:      codes.FailedPrecondition,
+	billy.CodePaused:       codes.FailedPrecondition,
+	billy.CodeLeaseHeld:    codes.FailedPrecondition,
+	billy.CodeLeaseExpired: codes.FailedPrecondition,
+	billy.CodeNotLeased:    codes.PermissionDenied,
+	billy.CodeFull:         codes.ResourceExhausted,
+	billy.CodeDatabaseFull: codes.ResourceExhausted,
+	billy.CodeNoSpace:      codes.ResourceExhausted,
+	billy.CodeCorrupt:      codes.DataLoss,
+	billy.CodeTimeout:      codes.DeadlineExceeded,
+}
+
+// encodeError converts the error into a gRPC status carrying its billy.Code.
+func encodeError(err error) error {
+	code := billy.ErrorCode(err)
+	grpcCode, ok := grpcCodes[code]
+	if !ok {
+		grpcCode = codes.Unknown
+	}
+	st := status.New(grpcCode, err.Error())
+	if withInfo, err := st.WithDetails(&remotepb.ErrorInfo{Code: uint32(code)}); err == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+// Error is an error returned by the server. It matches the error of the billy
+// package identified by its code when used with errors.Is.
+type Error struct {
+	Code billy.Code
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Code.Err()
+}
+
+// decodeError converts an error returned by the server into an Error, if it
+// carries a code. Other errors, e.g. of the connection, are returned as is.
+func decodeError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*remotepb.ErrorInfo); ok {
+			return &Error{Code: billy.Code(info.Code), Msg: st.Message()}
+		}
+	}
+	if st.Code() == codes.Unimplemented {
+		return fmt.Errorf("%w: %s", ErrUnsupported, st.Message())
+	}
+	return err
+}
+
+// errorKeys returns the keys carried in the details of an error returned by
+// the server, see Service.Expire.
+func errorKeys(err error) []uint64 {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	for _, detail := range st.Details() {
+		if keys, ok := detail.(*remotepb.Keys); ok {
+			return keys.Keys
+		}
+	}
+	return nil
+}
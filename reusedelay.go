@@ -0,0 +1,84 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "time"
+
+// coolingGaps tracks the recently deleted slots of a shelf, which are gaps,
+// but are not handed out by Put until the reuse delay has passed. It is
+// guarded by the gapsMu of the shelf.
+type coolingGaps struct {
+	delay time.Duration
+	until map[uint64]int64 // Slots and the time they become reusable, in unix nanoseconds
+	queue []coolingGap     // Slots in order of deletion, possibly stale
+}
+
+type coolingGap struct {
+	slot  uint64
+	until int64
+}
+
+// add starts the reuse delay of a deleted slot, if enabled.
+func (c *coolingGaps) add(slot uint64) {
+	if c.delay <= 0 {
+		return
+	}
+	if c.until == nil {
+		c.until = make(map[uint64]int64)
+	}
+	until := time.Now().Add(c.delay).UnixNano()
+	c.until[slot] = until
+	c.queue = append(c.queue, coolingGap{slot, until})
+}
+
+// remove ends the reuse delay of a slot, because it has been filled.
+func (c *coolingGaps) remove(slot uint64) {
+	delete(c.until, slot)
+}
+
+// has returns whether the slot may not be reused yet.
+func (c *coolingGaps) has(slot uint64) bool {
+	_, ok := c.until[slot]
+	return ok
+}
+
+// release ends the reuse delay of the slots deleted long enough ago.
+func (c *coolingGaps) release(now int64) {
+	for len(c.queue) > 0 && c.queue[0].until <= now {
+		// A slot filled and deleted again has a later entry
+		if gap := c.queue[0]; c.until[gap.slot] == gap.until {
+			delete(c.until, gap.slot)
+		}
+		c.queue = c.queue[1:]
+	}
+	if len(c.queue) == 0 {
+		c.queue = nil // Release the backing array
+	}
+}
+
+// firstGap returns the lowest gap which may be reused. This method assumes
+// that the gapsMu is held.
+func (s *shelf) firstGap() (uint64, bool) {
+	s.cooling.release(time.Now().UnixNano())
+	gap, ok := s.gaps.first()
+	for ok && s.cooling.has(gap) {
+		gap, ok = s.gaps.next(gap + 1)
+	}
+	return gap, ok
+}
+
+// trimTail drops the gaps directly below the tail, except for those within
+// their reuse delay, which would otherwise be handed out again when the tail
+// is extended. This method assumes that the gapsMu is held.
+func (s *shelf) trimTail() {
+	for {
+		last, ok := s.gaps.last()
+		if !ok || last+1 != s.count || s.cooling.has(last) {
+			return
+		}
+		s.gaps.remove(last)
+		s.count--
+	}
+}
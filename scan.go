@@ -0,0 +1,139 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// scanBatchSize is the number of bytes read at once when scanning through the
+// slots of a shelf. Slots larger than this are read one at a time.
+const scanBatchSize = 1 << 20
+
+// slotScanner reads consecutive slots of a shelf in batches, so that scanning a
+// shelf takes one syscall per batch rather than one per slot. It expects the
+// fileMu of the shelf to be R-locked while it is used.
+type slotScanner struct {
+	s      *shelf
+	lo, hi uint64  // lo and hi bound the slots [lo, hi) which are read ahead
+	buf    []byte  // buf holds the slots read, or the single slot read on errors
+	pooled *[]byte // pooled is the buffer from scanBufs backing buf, if any
+	first  uint64  // first is the first slot held in buf
+	n      uint64  // n is the number of slots held in buf
+
+	limit *ioLimiter // limit paces the reads, if set
+}
+
+// newSlotScanner creates a scanner which reads ahead within the slots [lo, hi).
+func newSlotScanner(s *shelf, lo, hi uint64) *slotScanner {
+	slots := uint64(scanBatchSize / s.slotSize)
+	if slots == 0 {
+		slots = 1
+	}
+	if hi > lo && slots > hi-lo {
+		slots = hi - lo
+	}
+	sc := &slotScanner{s: s, lo: lo, hi: hi}
+	if size := slots * uint64(s.slotSize); size <= scanBatchSize {
+		sc.pooled = scanBufs.Get().(*[]byte)
+		sc.buf = (*sc.pooled)[:size]
+	} else {
+		sc.buf = make([]byte, size)
+	}
+	return sc
+}
+
+// release returns the buffer of the scanner to the pool. The scanner, and the
+// data it returned, must not be used afterwards.
+func (sc *slotScanner) release() {
+	if sc.pooled != nil {
+		scanBufs.Put(sc.pooled)
+		sc.pooled, sc.buf = nil, nil
+	}
+}
+
+// raw returns the content of the given slot, header included. On a miss, the
+// batch read is the one starting at the slot if forward is set, or the one
+// ending at it otherwise. The returned slice is valid until the next call.
+func (sc *slotScanner) raw(slot uint64, forward bool) ([]byte, error) {
+	size := uint64(sc.s.slotSize)
+	if slot < sc.first || slot >= sc.first+sc.n {
+		if err := sc.fill(slot, forward); err != nil {
+			return nil, err
+		}
+	}
+	off := (slot - sc.first) * size
+	return sc.buf[off : off+size], nil
+}
+
+// fill reads the batch of slots around the given slot. If the batch read fails,
+// e.g. because of a bad sector, only the slot itself is read, so that errors
+// are reported for the slots which can't be read.
+func (sc *slotScanner) fill(slot uint64, forward bool) error {
+	var (
+		size  = uint64(sc.s.slotSize)
+		slots = uint64(len(sc.buf)) / size
+		first = slot
+	)
+	if slot >= sc.lo && slot < sc.hi {
+		if forward {
+			if slots > sc.hi-slot {
+				slots = sc.hi - slot
+			}
+		} else {
+			if slots > slot-sc.lo+1 {
+				slots = slot - sc.lo + 1
+			}
+			first = slot + 1 - slots
+		}
+	} else {
+		slots = 1
+	}
+	sc.n = 0
+	buf := sc.buf[:slots*size]
+	sc.limit.wait(len(buf))
+	if _, err := sc.s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(first)*int64(size)); err != nil {
+		if slots == 1 {
+			return err
+		}
+		first, buf = slot, sc.buf[:size]
+		sc.limit.wait(len(buf))
+		if _, err := sc.s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(first)*int64(size)); err != nil {
+			return err
+		}
+	}
+	sc.s.metrics.Read(sc.s.slotSize, len(buf))
+	sc.first, sc.n = first, uint64(len(buf))/size
+	return nil
+}
+
+// read returns the data stored in the given slot, like readSlot.
+func (sc *slotScanner) read(slot uint64, forward bool) ([]byte, error) {
+	buf, err := sc.raw(slot, forward)
+	if err != nil {
+		return nil, err
+	}
+	start, size, err := sc.s.parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[start : start+size], nil
+}
+
+// readSize returns the size of the item stored in the given slot, like
+// readSize.
+func (sc *slotScanner) readSize(slot uint64, forward bool) (uint32, error) {
+	buf, err := sc.raw(slot, forward)
+	if err != nil {
+		return 0, err
+	}
+	_, size, err := sc.s.parseHeader(buf)
+	return uint32(size), err
+}
+
+// update replaces the content of the given slot, if it has been read ahead,
+// so that writes to the slot are seen by the scanner.
+func (sc *slotScanner) update(slot uint64, raw []byte) {
+	if slot >= sc.first && slot < sc.first+sc.n {
+		off := (slot - sc.first) * uint64(sc.s.slotSize)
+		copy(sc.buf[off:off+uint64(sc.s.slotSize)], raw)
+	}
+}
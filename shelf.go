@@ -9,16 +9,33 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	curVersion     = uint16(0)
 	itemHeaderSize = 4 // size of the per-item header
-	maxSlotSize    = uint64(0xffffffff)
+	// itemExpiryFlag is set in the item header if the item has an expiry
+	// time, stored as a big-endian unix nanosecond timestamp in front of the
+	// payload. The size in the header includes the timestamp.
+	itemExpiryFlag = uint32(1) << 31
+	itemExpirySize = 8
+	// itemPendingHeader is the header of a slot being written with ordered
+	// writes, until the data is on disk. It reads as an empty slot, so that a
+	// write torn by a crash leaves a gap. No item has this header, as it would
+	// be an expiring item larger than any slot can hold.
+	itemPendingHeader = ^uint32(0)
+	// sampleReadAhead is the largest read performed by GetSample to fetch the
+	// item header and the sample at once.
+	sampleReadAhead = 4096
+	maxSlotSize     = uint64(0xffffffff)
+	// maxSlots is the maximum number of slots in a shelf, limited by the
+	// 28 bits of the key used for the slot.
+	maxSlots = uint64(1) << 28
 	// minSlotSize is the minimum size of a slot. It needs to fit the header,
 	// and then some actual data too.
 	minSlotSize = itemHeaderSize * 2
@@ -31,24 +48,88 @@ var (
 	ErrEmptyData   = errors.New("empty data")
 	ErrReadonly    = errors.New("read-only mode")
 	ErrCorruptData = errors.New("corrupt data")
+	ErrLocked      = errors.New("shelf locked by another process")
+	ErrShelfFull   = errors.New("shelf full")
+	ErrSlotInUse   = errors.New("slot in use")
+	ErrDeleted     = errors.New("item deleted")
+	ErrBadHeader   = errors.New("bad shelf header")
 )
 
 // shelf represents a collection of similarly-sized items. The shelf uses
 // a number of slots, where each slot is of the exact same size.
 type shelf struct {
+	// modified is the time of the last modification in unix nanoseconds,
+	// accessed atomically. It is the first field to be 64-bit aligned on
+	// 32-bit platforms.
+	modified int64
+	created  int64 // created is the creation time in unix nanoseconds
+
 	slotSize uint32 // Size of the slots, up to 4GB
 
-	// gaps is a slice of indices to slots that are free to use. The
-	// gaps are always sorted lowest numbers first.
-	gaps   sortedUniqueInts
-	gapsMu sync.Mutex // Mutex for operating on 'gaps' and 'count'.
-	count  uint64     // count holds the number of items on the shelf.
+	// gaps holds the indices of slots that are free to use.
+	gaps   gapSet
+	gapsMu gapsMutex // Mutex for operating on 'gaps' and 'count'.
+	count  uint64    // count holds the number of items on the shelf.
 
-	f      store        // f is the file where data is persisted.
-	fileMu sync.RWMutex // Mutex for file operations on 'f' (rw versus Close) and closed.
+	f      store     // f is the file where data is persisted.
+	fileMu fileMutex // Mutex for file operations on 'f' (rw versus Close) and closed.
 
+	maxSlots uint64 // maxSlots is the maximum tail of the shelf
+	// pending holds the slots handed out to Put but not yet written, to
+	// protect them from being moved or expired while the slot still
+	// holds stale data. Guarded by gapsMu.
+	pending map[uint64]struct{}
+	// busy holds the live slots being overwritten in place, to protect them
+	// from being deleted or moved before the write is done. The channels are
+	// closed once the writes are done. Guarded by gapsMu.
+	busy     map[uint64]chan struct{}
 	closed   bool
 	readonly bool
+	sync     bool        // sync makes every write be followed by an fsync
+	ordered  bool        // ordered makes the data of a write reach the disk before its header
+	dirty    uint32      // dirty is set (atomically) if there are writes not yet synced
+	punch    bool        // punch makes Delete punch holes over the slots, guarded by gapsMu
+	wipe     bool        // wipe makes Delete overwrite the slots with zeros
+	tombs    bool        // tombs makes Delete blank the headers of the slots on disk
+	syncTomb bool        // syncTomb makes Delete fsync the blanked header or slot
+	nocache  bool        // nocache drops the file from the page cache after scans
+	prealloc int64       // prealloc is the size of the extents to preallocate, guarded by gapsMu
+	reserved int64       // reserved is the end of the preallocated space, guarded by gapsMu
+	quota    *quota      // quota limits the size of the database, if set
+	charged  uint64      // charged is the tail the quota is charged for, guarded by gapsMu
+	cooling  coolingGaps // cooling holds the deleted slots within their reuse delay
+	log      Logger      // log receives reports about noteworthy events
+	metrics  Metrics     // metrics receives events about the operations
+
+	// reads coalesces concurrent Gets of the same slot, if enabled
+	reads *readGroup
+	// onProgress receives the progress of compactions, if set
+	onProgress OnCompactionProgressFn
+	// throttle paces the reads of maintenance work, if set
+	throttle *ioLimiter
+	// policy decides how the shelf is compacted, moving everything if nil
+	policy CompactionPolicy
+	// bufs holds scratch buffers of the slot size
+	bufs slotPool
+
+	// changes tracks the slots changed since the last incremental backup
+	changes changeSet
+	// deleted remembers recent deletions, for reads of them to fail fast
+	deleted deletedCache
+	// gens tracks the generations of the slots, nil if disabled
+	gens *generations
+
+	idxPath  string // idxPath is the gap index file, empty for in-memory shelves
+	metaPath string // metaPath is the metadata file, empty for in-memory shelves
+	idxClean bool   // idxClean is set if a clean gap index has been written
+	shared   bool   // shared is set if the gaps are shared through the gap index
+	// gensSaved is set if the metadata file holds the current generations
+	gensSaved bool
+
+	// published is the time the gaps were last published, and publishTimer
+	// publishes the changes since, if scheduled. Guarded by gapsMu.
+	published    time.Time
+	publishTimer *time.Timer
 }
 
 var (
@@ -67,8 +148,20 @@ type shelfHeader struct {
 // openShelf opens a (new or existing) shelf with the given slot size.
 // If the shelf already exists, it's opened and read, which populates the
 // internal gap-list.
-// The onData callback is optional, and can be nil.
-func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool, repair bool) (*shelf, error) {
+// The onData callback is optional, and can be nil. The path of the options is
+// ignored in favour of the given path.
+func openShelf(path string, slotSize uint32, onData onShelfDataFn, opts *Options) (*shelf, error) {
+	return openShelfMoving(path, slotSize, onData, nil, opts)
+}
+
+// openShelfMoving is like openShelf, and additionally invokes the optional
+// onMove callback for every item moved by the compaction, before onData.
+func openShelfMoving(path string, slotSize uint32, onData onShelfDataFn, onMove onShelfMoveFn, opts *Options) (*shelf, error) {
+	var (
+		readonly = opts.Readonly
+		repair   = opts.Repair
+		log      = opts.logger()
+	)
 	if slotSize < minSlotSize {
 		return nil, fmt.Errorf("slot size %d smaller than minimum (%d)", slotSize, minSlotSize)
 	}
@@ -81,6 +174,7 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 	}
 	var (
 		fileSize int
+		isNew    bool
 		h        = shelfHeader{Magic, curVersion, slotSize}
 		fname    = fmt.Sprintf("bkt_%08d.bag", slotSize)
 		flags    = os.O_RDWR | os.O_CREATE
@@ -95,10 +189,31 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 		fileName = filepath.Join(path, fname)
 	)
 	if path != "" {
-		f, err = os.OpenFile(fileName, flags, 0666)
+		file, err := os.OpenFile(fileName, flags, 0666)
 		if err != nil {
 			return nil, err
 		}
+		// Two writers would silently corrupt each other, make sure we're
+		// the only one. Readers may run alongside a writer.
+		if !readonly {
+			if err := lockFile(file); err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("%w, file %v", err, fileName)
+			}
+		}
+		f = file
+		if opts.DirectIO {
+			if f, err = newDirectStore(file); err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("direct I/O: %w, file %v", err, fileName)
+			}
+		}
+		if opts.IOUring {
+			if f, err = newUringStore(file); err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("io_uring: %w, file %v", err, fileName)
+			}
+		}
 	} else {
 		fileName = "<memmoryfile>"
 		f = new(memoryStore)
@@ -110,6 +225,7 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 		fileSize = int(stat.Size())
 	}
 	if fileSize == 0 {
+		isNew = true
 		a := new(bytes.Buffer)
 		if err = binary.Write(a, binary.BigEndian, &h); err != nil {
 			panic(err) // Cannot fail unless 'a' is changed to reject writes or 'h' is changed to be unmarshallable
@@ -122,6 +238,8 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 		b := make([]byte, binary.Size(h))
 		if n, err = f.ReadAt(b, 0); n == len(b) {
 			err = binary.Read(bytes.NewReader(b), binary.BigEndian, &h)
+		} else if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w: file too short (%d bytes)", ErrBadHeader, fileSize)
 		}
 	}
 	if err != nil {
@@ -130,11 +248,12 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 	}
 	switch {
 	case h.Magic != Magic:
-		err = errors.New("missing magic")
+		err = fmt.Errorf("%w: missing magic", ErrBadHeader)
 	case h.Version != curVersion:
-		err = fmt.Errorf("wrong version: %d", h.Version)
+		_ = f.Close()
+		return nil, &VersionError{File: fileName, Version: h.Version, Current: curVersion}
 	case h.Slotsize != slotSize:
-		err = fmt.Errorf("wrong slotsize, file:%d, need:%d", h.Slotsize, slotSize)
+		err = fmt.Errorf("%w: wrong slotsize, file:%d, need:%d", ErrBadHeader, h.Slotsize, slotSize)
 	}
 	if err != nil {
 		_ = f.Close()
@@ -143,6 +262,7 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 	dataSize := fileSize - ShelfHeaderSize
 	if extra := dataSize % int(slotSize); extra != 0 {
 		if !readonly && repair {
+			log.Printf("billy: truncating %d bytes of partial slot data, file %v", extra, fileName)
 			fileSize -= extra
 			dataSize -= extra
 			err = f.Truncate(int64(fileSize))
@@ -154,24 +274,87 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 		_ = f.Close()
 		return nil, fmt.Errorf("%w, file %v", err, fileName)
 	}
+	if slots := uint64(dataSize / int(slotSize)); slots > maxSlots {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w: %d slots exceed the maximum of %d, file %v", ErrCorruptData, slots, maxSlots, fileName)
+	}
 	sh := &shelf{
 		slotSize: slotSize,
+		maxSlots: maxSlots,
+		pending:  make(map[uint64]struct{}),
+		busy:     make(map[uint64]chan struct{}),
 		count:    uint64(dataSize / int(slotSize)),
-		f:        f,
+		f:        &retryStore{f, slotSize},
 		readonly: readonly,
+		sync:     opts.Sync,
+		ordered:  opts.CrashSafeWrites,
+		punch:    opts.PunchHoles && !readonly,
+		wipe:     opts.SecureDelete && !readonly,
+		tombs:    opts.PersistDeletes && !readonly,
+		syncTomb: opts.Sync || opts.SyncDeletes,
+		nocache:  opts.DropScanCache,
+		prealloc: opts.Preallocate,
+		cooling:  coolingGaps{delay: opts.ReuseDelay},
+		bufs:     slotPool{size: slotSize},
+		log:      log,
+		metrics:  opts.metrics(),
+
+		onProgress: opts.OnCompactionProgress,
+		throttle:   opts.limiter,
+		policy:     opts.CompactionPolicy,
+	}
+	if opts.CoalesceReads {
+		sh.reads = new(readGroup)
+	}
+	if opts.Generations {
+		sh.gens = newGenerations()
+	}
+	if path != "" {
+		sh.idxPath = filepath.Join(path, gapIndexName(slotSize))
+		sh.metaPath = filepath.Join(path, metaName(slotSize))
+	}
+	if err := sh.loadMeta(isNew); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	// If nobody needs to see the data, a clean gap index spares us from
+	// scanning the shelf.
+	if onData == nil && sh.loadGapIndex() {
+		// The gap index spares us the scan, make sure the file agrees
+		err := sh.checkTail()
+		if err == nil {
+			sh.idxClean = !readonly
+			sh.reportGaps()
+			return sh, nil
+		}
+		log.Printf("billy: gap index does not match, rescanning, file %v: %v", fileName, err)
 	}
 	// Compact + iterate
-	if err := sh.compact(onData, repair); err != nil {
+	mode, _, err := sh.compaction(true)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w, file %v", err, fileName)
+	}
+	if err := sh.compact(onData, onMove, repair, mode == CompactMove && !opts.NoCompaction); err != nil {
 		_ = f.Close()
 		return nil, fmt.Errorf("%w, file %v", err, fileName)
 	}
+	// Any existing gap index is stale now
+	if !readonly && sh.idxPath != "" {
+		if err := os.Remove(sh.idxPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	sh.reportGaps()
 	return sh, nil
 }
 
 func (s *shelf) Close() error {
 	// We don't need the gapsMu until later, but order matters: all places
 	// which require both mutexes first obtain gapsMu, and _then_ fileMu.
-	// If one place uses a different order, then a deadlock is possible
+	// If one place uses a different order, then a deadlock is possible.
+	// Building with the billydebug tag verifies the order at runtime.
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
 	s.fileMu.Lock()
@@ -180,6 +363,7 @@ func (s *shelf) Close() error {
 		return nil
 	}
 	s.closed = true
+	s.cancelPublish()
 	if s.readonly {
 		return nil
 	}
@@ -193,18 +377,24 @@ func (s *shelf) Close() error {
 	// blank space in the headers. Later on, when opening, we can reconstruct the
 	// gaps by skimming through the slots and checking the headers.
 	hdr := make([]byte, 4)
-	for _, gap := range s.gaps {
+	s.gaps.each(func(gap uint64) {
 		setErr(s.writeSlot(hdr, gap))
-	}
-	s.gaps = s.gaps[:0]
+	})
 	setErr(s.f.Sync())
+	if err == nil {
+		// Persist the gaps, to speed up the next opening
+		setErr(s.checkpointGaps())
+	}
+	setErr(s.saveMeta())
+	s.gaps.reset()
 	setErr(s.f.Close())
 	return err
 }
 
 // Update overwrites the existing data at the given slot. This operation is more
 // efficient than Delete + Put, since it does not require managing slot availability
-// but instead just overwrites in-place.
+// but instead just overwrites in-place. The slot must hold live data: updating
+// a gap, or a slot beyond the tail, fails with ErrBadIndex.
 func (s *shelf) Update(data []byte, slot uint64) error {
 	if s.readonly {
 		return ErrReadonly
@@ -212,248 +402,1164 @@ func (s *shelf) Update(data []byte, slot uint64) error {
 	if len(data) == 0 {
 		return ErrEmptyData
 	}
-	if have, max := uint32(len(data)+itemHeaderSize), s.slotSize; have > max {
-		return ErrOversized
+	if have, max := len(data)+itemHeaderSize, int(s.slotSize); have > max {
+		return fmt.Errorf("%w: item size %d, slot size %d", ErrOversized, have, max)
+	}
+	// Mark the slot busy while writing, so it can't be deleted and handed
+	// out to a Put, nor moved by a compaction, in the meantime.
+	unlock, err := s.lockLive(slot)
+	if err != nil {
+		return err
 	}
-	return s.update(data, slot)
+	defer unlock()
+	return s.update(data, slot, 0)
 }
 
 // Put writes the given data and returns a slot identifier. The caller may
 // modify the data after this method returns.
 func (s *shelf) Put(data []byte) (uint64, error) {
+	return s.put(data, 0)
+}
+
+// put writes the data, with an expiry time unless it is zero.
+func (s *shelf) put(data []byte, expiry int64) (uint64, error) {
 	if s.readonly {
 		return 0, ErrReadonly
 	}
 	if len(data) == 0 {
 		return 0, ErrEmptyData
 	}
-	if have, max := uint32(len(data)+itemHeaderSize), s.slotSize; have > max {
+	have := uint64(len(data) + itemHeaderSize)
+	if expiry != 0 {
+		have += itemExpirySize
+	}
+	if have > uint64(s.slotSize) || uint64(len(data)) >= uint64(itemExpiryFlag) {
 		return 0, ErrOversized
 	}
-	slot := s.getSlot()
-	return slot, s.update(data, slot)
-}
+	if expiry != 0 && uint64(len(data))+itemExpirySize >= uint64(itemExpiryFlag-1) {
+		return 0, ErrOversized // The header would be itemPendingHeader
+	}
+	slot, err := s.getSlot()
+	if err != nil {
+		return 0, err
+	}
+	err = noSpace(s.update(data, slot, expiry))
 
-// update writes the data to the given slot.
-func (s *shelf) update(data []byte, slot uint64) error {
-	// Read-lock to prevent file from being closed while writing to it
-	s.fileMu.RLock()
-	defer s.fileMu.RUnlock()
-	if s.closed {
-		return ErrClosed
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	delete(s.pending, slot)
+	if err != nil {
+		// Don't leak the slot, nor leave a partially written one at the tail
+		_ = s.release(slot)
+		return 0, err
 	}
-	buf := make([]byte, s.slotSize)
-	binary.BigEndian.PutUint32(buf, uint32(len(data))) // Write header
-	copy(buf[itemHeaderSize:], data)                   // Write data
-	return s.writeSlot(buf, slot)
+	s.metrics.Put(s.slotSize, len(data))
+	s.publishGaps()
+	return slot, nil
 }
 
-// Delete marks the data at the given slot of deletion.
-// Delete does not touch the disk. When the shelf is Close():d, any remaining
-// gaps will be marked as such in the backing file.
-// NOTE: If a Get-operation is performed _after_ Delete, then the results
-// are undefined. It may return the original value or a new value, if a new
-// value has been written into the slot.
-// It will _not_ return any kind of "MissingItem" error in this scenario.
-func (s *shelf) Delete(slot uint64) error {
+// putReader writes length bytes read from r into a free slot, and returns the
+// slot. If reading or writing fails, the slot is released again. Writes failing
+// because the disk is full are repeated in place as long as the optional retry
+// method says so, as the data already read from r can't be read again.
+func (s *shelf) putReader(r io.Reader, length int, retry func(attempt int, err error) (bool, error)) (uint64, error) {
 	if s.readonly {
-		return ErrReadonly
+		return 0, ErrReadonly
 	}
-	// Mark gap
+	if length <= 0 {
+		return 0, ErrEmptyData
+	}
+	if uint64(length)+itemHeaderSize > uint64(s.slotSize) || uint64(length) >= uint64(itemExpiryFlag) {
+		return 0, ErrOversized
+	}
+	slot, err := s.getSlot()
+	if err != nil {
+		return 0, err
+	}
+	err = noSpace(s.stream(r, length, slot, retry))
+
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
-	// Can't delete outside of the file
-	if slot >= s.count {
-		return fmt.Errorf("%w: shelf %d, slot %d, tail %d", ErrBadIndex, s.slotSize, slot, s.count)
+	delete(s.pending, slot)
+	if err != nil {
+		_ = s.release(slot)
+		return 0, err
 	}
-	// We try to keep writes going to the early parts of the file, to have the
-	// possibility of trimming the file when/if the tail becomes unused.
-	s.gaps.Append(slot)
+	s.metrics.Put(s.slotSize, length)
+	s.publishGaps()
+	return slot, nil
+}
 
-	// s.count is the first empty location. If the gaps has reached to one below
-	// the tail, then we can start truncating
-	if lastGap := s.gaps[len(s.gaps)-1]; lastGap+1 == s.count {
-		// we can delete a portion of the file
-		s.fileMu.Lock()
-		defer s.fileMu.Unlock()
-		if s.closed { // Undo (not really important, but correct) and back out again
-			s.gaps = s.gaps[:0]
+// stream copies length bytes from r into the slot. The header is blanked
+// first and written last, so that an interrupted stream leaves a gap. With
+// ordered writes, the header is marked pending instead, and the data is synced
+// before the header is written. The fileMu is only held while writing, not
+// while reading from r or deciding on a retry.
+func (s *shelf) stream(r io.Reader, length int, slot uint64, retry func(attempt int, err error) (bool, error)) error {
+	writeOnce := func(data []byte, off int) error {
+		s.fileMu.RLock()
+		defer s.fileMu.RUnlock()
+		if s.closed {
 			return ErrClosed
 		}
-		for len(s.gaps) > 0 && s.gaps[len(s.gaps)-1]+1 == s.count {
-			s.gaps = s.gaps[:len(s.gaps)-1]
-			s.count--
+		return noSpace(s.writeSlotAt(data, slot, off))
+	}
+	write := func(data []byte, off int) error {
+		err := writeOnce(data, off)
+		for attempt := 1; err != nil && retry != nil; attempt++ {
+			var again bool
+			if again, err = retry(attempt, err); !again {
+				return err
+			}
+			err = writeOnce(data, off)
+		}
+		return err
+	}
+	hdr := make([]byte, itemHeaderSize)
+	if s.ordered {
+		binary.BigEndian.PutUint32(hdr, itemPendingHeader)
+	}
+	if err := write(hdr, 0); err != nil {
+		return err
+	}
+	// The whole slot is written, padded with zeros like with Put, so that the
+	// file covers it even at the tail
+	var (
+		total = int(s.slotSize) - itemHeaderSize
+		buf   = make([]byte, 64*1024)
+	)
+	for off := 0; off < total; {
+		part := buf
+		if total-off < len(part) {
+			part = part[:total-off]
+		}
+		n := 0
+		if off < length {
+			n = len(part)
+			if length-off < n {
+				n = length - off
+			}
+			if _, err := io.ReadFull(r, part[:n]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+		copy(part[n:], make([]byte, len(part)-n))
+		if err := write(part, itemHeaderSize+off); err != nil {
+			return err
 		}
-		if err := s.f.Truncate(int64(ShelfHeaderSize) + int64(s.count*uint64(s.slotSize))); err != nil {
+		off += len(part)
+	}
+	if s.ordered {
+		if err := s.barrier(); err != nil {
 			return err
 		}
 	}
+	binary.BigEndian.PutUint32(hdr, uint32(length))
+	if err := write(hdr, 0); err != nil {
+		return err
+	}
+	if s.sync {
+		s.fileMu.RLock()
+		defer s.fileMu.RUnlock()
+		if s.closed {
+			return ErrClosed
+		}
+		return s.f.Sync()
+	}
 	return nil
 }
 
-// Get returns the data at the given slot. If the slot has been deleted, the returndata
-// this method is undefined: it may return the original data, or some newer data
-// which has been written into the slot after Delete was called.
-func (s *shelf) Get(slot uint64) ([]byte, error) {
-	// Read-lock to prevent file from being closed while reading from it
+// UpdateRange overwrites part of the data at the given slot, starting at
+// offset off, without rewriting the whole slot. The range must be within the
+// stored data. The slot must hold live data, otherwise it fails with
+// ErrBadIndex, and it is neither deleted nor moved by a compaction while
+// being written.
+func (s *shelf) UpdateRange(slot, off uint64, data []byte) error {
+	if s.readonly {
+		return ErrReadonly
+	}
+	unlock, err := s.lockLive(slot)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Read-lock to prevent file from being closed while writing to it
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
 	if s.closed {
-		return nil, ErrClosed
+		return ErrClosed
 	}
-	data, err := s.readSlot(make([]byte, s.slotSize), slot)
+	var (
+		pos = int64(ShelfHeaderSize) + int64(slot)*int64(s.slotSize)
+		hdr = make([]byte, itemHeaderSize)
+	)
+	if _, err := s.f.ReadAt(hdr, pos); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, len(hdr))
+	start, size, err := s.parseHeader(hdr)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+		return err
 	}
-	return data, nil
+	if off > size || uint64(len(data)) > size-off {
+		return fmt.Errorf("%w: update %d+%d, item size %d", ErrBadIndex, off, len(data), size)
+	}
+	n, err := s.f.WriteAt(data, pos+int64(start+off))
+	s.metrics.Write(s.slotSize, n)
+	atomic.StoreUint32(&s.dirty, 1)
+	s.touch()
+	s.changes.mark(slot)
+	if s.reads != nil {
+		s.reads.forget(slot)
+	}
+	if err != nil {
+		return err
+	}
+	if s.sync {
+		return s.f.Sync()
+	}
+	return nil
 }
 
-func (s *shelf) GetSample(slot, off, length uint64) ([]byte, error) {
-	// Read-lock to prevent file from being closed while reading from it
+// rewrite replaces the data at the given slot by the result of modify, which
+// is passed the current data, retaining its expiry time. The slot is kept from
+// being changed otherwise in between.
+func (s *shelf) rewrite(slot uint64, modify func(data []byte) ([]byte, error)) error {
+	if s.readonly {
+		return ErrReadonly
+	}
+	unlock, err := s.lockLive(slot)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := s.get(slot)
+	if err != nil {
+		return err
+	}
+	if data, err = modify(data); err != nil {
+		return err
+	}
 	s.fileMu.RLock()
-	defer s.fileMu.RUnlock()
 	if s.closed {
-		return nil, ErrClosed
+		s.fileMu.RUnlock()
+		return ErrClosed
 	}
-	buf := make([]byte, length)
-	if _, err := s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)+int64(itemHeaderSize)+int64(off)); err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	expiry, err := s.readExpiry(make([]byte, itemHeaderSize+itemExpirySize), slot)
+	s.fileMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadIndex, err)
 	}
-	return buf, nil
-}
-
-// readSlot is a convenience function to the data from a slot.
-// It
-//   - expects the given 'buf' to be correctly sized (len = s.slotSize),
-//   - expects the fileMu to be R-locked, to prevent file from being closed during/before reading.
-//   - returns a subslice of buf containing the live data.
-func (s *shelf) readSlot(buf []byte, slot uint64) ([]byte, error) {
-	// Read the entire slot at once -- this might mean we read a bit more
-	// than strictly necessary, but it saves us one syscall.
-	if _, err := s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)); err != nil {
-		return nil, err
+	size := uint64(len(data) + itemHeaderSize)
+	if expiry != 0 {
+		size += itemExpirySize
 	}
-	size := uint64(binary.BigEndian.Uint32(buf)) + itemHeaderSize
 	if size > uint64(s.slotSize) {
-		return nil, fmt.Errorf("%w: item size %d, slot size %d", ErrCorruptData, size, s.slotSize)
+		return ErrOversized
 	}
-	return buf[itemHeaderSize:size], nil
+	return s.update(data, slot, expiry)
 }
 
-// writeSlot writes the given data to the slot. This method assumes that the
-// fileMu is read-locked.
-func (s *shelf) writeSlot(data []byte, slot uint64) error {
-	_, err := s.f.WriteAt(data, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize))
-	return err
-}
+// PutAt writes the given data into the given slot, which must be a gap or
+// beyond the tail. If it's beyond the tail, the tail is extended, and the
+// slots in between become gaps.
+func (s *shelf) PutAt(slot uint64, data []byte) error {
+	if s.readonly {
+		return ErrReadonly
+	}
+	if len(data) == 0 {
+		return ErrEmptyData
+	}
+	have := uint64(len(data) + itemHeaderSize)
+	if have > uint64(s.slotSize) || uint64(len(data)) >= uint64(itemExpiryFlag) {
+		return ErrOversized
+	}
+	if err := s.reserveSlot(slot); err != nil {
+		return err
+	}
+	err := noSpace(s.update(data, slot, 0))
 
-func (s *shelf) getSlot() uint64 {
-	var slot uint64
-	// Locate the first free slot
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
-	if nGaps := len(s.gaps); nGaps > 0 {
-		slot = s.gaps[0]
-		s.gaps = s.gaps[1:]
-		return slot
+	delete(s.pending, slot)
+	if err != nil {
+		_ = s.release(slot)
+		return err
 	}
-	// No gaps available: Expand the tail
-	slot = s.count
-	s.count++
-	return slot
+	s.metrics.Put(s.slotSize, len(data))
+	s.publishGaps()
+	return nil
 }
 
-// onShelfDataFn is used to iterate the entire dataset in the shelf.
-// After the method returns, the content of 'data' will be modified by
-// the iterator, so it needs to be copied if it is to be used later.
-type onShelfDataFn func(slot uint64, data []byte)
-
-// Iterate iterates through the elements on the shelf, and invokes the onData
-// callback for each item.
-func (s *shelf) Iterate(onData onShelfDataFn) error {
+// reserveSlot takes the given slot out of the gaps, or extends the tail to
+// include it, for a subsequent write.
+func (s *shelf) reserveSlot(slot uint64) error {
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
+	if slot >= s.maxSlots {
+		return fmt.Errorf("%w: slot %d, shelf %d has %d slots", ErrShelfFull, slot, s.slotSize, s.maxSlots)
+	}
+	if _, ok := s.pending[slot]; ok {
+		return fmt.Errorf("%w: slot %d", ErrSlotInUse, slot)
+	}
+	if slot < s.count && !s.gaps.contains(slot) {
+		return fmt.Errorf("%w: slot %d", ErrSlotInUse, slot)
+	}
+	if slot >= s.count {
+		if err := s.growTail(slot + 1); err != nil {
+			return err
+		}
+	}
+	if err := s.invalidateGaps(); err != nil {
+		return err
+	}
+	if err := s.invalidateGens(); err != nil {
+		return err
+	}
+	defer s.reportGaps()
+	if slot < s.count {
+		s.gaps.remove(slot)
+		s.cooling.remove(slot)
+	} else {
+		for ; s.count < slot; s.count++ {
+			s.gaps.add(s.count)
+		}
+		s.count++
+		s.preallocate()
+	}
+	s.pending[slot] = struct{}{}
+	s.deleted.remove(slot)
+	s.gens.bump(slot)
+	return nil
+}
 
+// update writes the data to the given slot, with an expiry time unless it is
+// zero. The header and the data are assembled into one buffer, so that the
+// slot is written by a single syscall and can't be torn between the two. With
+// ordered writes, the slot is written with a pending header, which is only
+// replaced once the data is on disk.
+func (s *shelf) update(data []byte, slot uint64, expiry int64) error {
+	// Read-lock to prevent file from being closed while writing to it
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
 	if s.closed {
 		return ErrClosed
 	}
+	pooled := s.bufs.get()
+	defer s.bufs.put(pooled)
 
 	var (
-		buf     = make([]byte, s.slotSize)
-		nextGap = uint64(0xffffffffffffffff)
-		gapIdx  = 0
+		buf = *pooled
+		end int
 	)
-	if gapIdx < len(s.gaps) {
-		nextGap = s.gaps[gapIdx]
+	if expiry == 0 {
+		binary.BigEndian.PutUint32(buf, uint32(len(data))) // Write header
+		end = itemHeaderSize + copy(buf[itemHeaderSize:], data)
+	} else {
+		binary.BigEndian.PutUint32(buf, uint32(len(data)+itemExpirySize)|itemExpiryFlag)
+		binary.BigEndian.PutUint64(buf[itemHeaderSize:], uint64(expiry))
+		end = itemHeaderSize + itemExpirySize + copy(buf[itemHeaderSize+itemExpirySize:], data)
 	}
-	for slot := uint64(0); slot < s.count; slot++ {
-		if slot == nextGap {
-			// We've reached a gap. Skip it
-			gapIdx++
-			if gapIdx < len(s.gaps) {
-				nextGap = s.gaps[gapIdx]
-			}
-			// implicit else: leave 'nextGap' as is, we're already past it now
-			// and won't hit this clause again
-			continue
-		}
-		data, err := s.readSlot(buf, slot)
-		if err != nil {
-			return err
-		}
-		onData(slot, data)
+	// Zero the padding, which holds whatever the buffer was last used for
+	for i := end; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	if s.ordered {
+		return s.writeOrdered(buf, slot)
+	}
+	if err := s.writeSlot(buf, slot); err != nil {
+		return err
+	}
+	if s.sync {
+		return s.f.Sync()
 	}
 	return nil
 }
 
-// compact moves data 'up' to fill gaps, and truncates the file afterwards.
-// This operation must only be performed during the opening of the shelf.
-func (s *shelf) compact(onData onShelfDataFn, repair bool) error {
-	s.gapsMu.Lock()
-	defer s.gapsMu.Unlock()
+// writeOrdered writes the slot content in buf so that a crash can't leave the
+// header of the item on disk without its data: the slot is written with a
+// pending header first, and the header is written once the rest is synced.
+// This method assumes that the fileMu is read-locked.
+func (s *shelf) writeOrdered(buf []byte, slot uint64) error {
+	hdr := binary.BigEndian.Uint32(buf)
+	binary.BigEndian.PutUint32(buf, itemPendingHeader)
+	err := s.writeSlot(buf, slot)
+	binary.BigEndian.PutUint32(buf, hdr)
+	if err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	if err := s.writeSlotAt(buf[:itemHeaderSize], slot, 0); err != nil {
+		return err
+	}
+	if s.sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// barrier syncs the shelf file, for ordered writes.
+func (s *shelf) barrier() error {
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.f.Sync()
+}
 
-	buf := make([]byte, s.slotSize)
-	// nextGap searches upwards from the given slot (inclusive),
-	// to find the first gap.
-	nextGap := func(slot uint64) (uint64, error) {
-		for ; slot < s.count; slot++ {
-			data, err := s.readSlot(buf, slot)
-			if err != nil {
-				if errors.Is(err, ErrCorruptData) && !s.readonly && repair { // Repair corruption by dropping it
-					break
-				}
-				return 0, err
-			}
-			if len(data) == 0 { // We've found a gap
-				break
-			}
-			if onData != nil {
-				onData(slot, data)
-			}
-		}
-		return slot, nil
+// Delete marks the data at the given slot of deletion.
+// Delete does not touch the disk. When the shelf is Close():d, any remaining
+// gaps will be marked as such in the backing file.
+// NOTE: If a Get-operation is performed _after_ Delete, it fails with
+// ErrDeleted as long as the slot is among the recently deleted ones, and has
+// not been reused. Otherwise the results are undefined. It may return the
+// original value or a new value, if a new value has been written into the slot.
+func (s *shelf) Delete(slot uint64) error {
+	return s.deleteChecked(slot, nil)
+}
+
+// deleteChecked deletes the slot like Delete, unless the optional check fails.
+// The check is done with the gapsMu held, so the slot can't be reused in
+// between, e.g. to verify the generation of the slot.
+func (s *shelf) deleteChecked(slot uint64, check func() error) error {
+	if s.readonly {
+		return ErrReadonly
 	}
-	// prevData searches downwards from the given slot (inclusive), to find
-	// the next data-filled slot.
-	prevData := func(slot, gap uint64) (uint64, error) {
-		for ; slot > gap && slot > 0; slot-- {
-			data, err := s.readSlot(buf, slot)
+	// Mark gap
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.waitIdle(slot)
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return s.delete(slot)
+}
+
+// delete marks the slot as a gap, and truncates the file if the gaps reach
+// the tail. This method assumes that the gapsMu is held.
+func (s *shelf) delete(slot uint64) error {
+	// Can't delete outside of the file
+	if slot >= s.count {
+		return fmt.Errorf("%w: shelf %d, slot %d, tail %d", ErrBadIndex, s.slotSize, slot, s.count)
+	}
+	if s.wipe {
+		if err := s.wipeSlot(slot, int(s.slotSize)); err != nil {
+			return err
+		}
+	} else if s.tombs {
+		if err := s.wipeSlot(slot, itemHeaderSize); err != nil {
+			return err
+		}
+	}
+	if err := s.invalidateGaps(); err != nil {
+		return err
+	}
+	// We try to keep writes going to the early parts of the file, to have the
+	// possibility of trimming the file when/if the tail becomes unused.
+	s.gaps.add(slot)
+	s.deleted.add(slot)
+	s.cooling.add(slot)
+	s.cooling.release(time.Now().UnixNano())
+	s.changes.mark(slot)
+	s.touch()
+	s.metrics.Delete(s.slotSize)
+	defer s.reportGaps()
+
+	trimmed, err := s.trimGaps()
+	if err != nil {
+		return err
+	}
+	if !trimmed {
+		s.punchHole(slot)
+	}
+	s.publishGaps()
+	return nil
+}
+
+// release returns a slot taken for a write which failed to the gaps, and
+// truncates the file if the slot is at the tail. This method assumes that the
+// gapsMu is held.
+func (s *shelf) release(slot uint64) error {
+	if err := s.invalidateGaps(); err != nil {
+		return err
+	}
+	s.gaps.add(slot)
+	defer s.reportGaps()
+	if _, err := s.trimGaps(); err != nil {
+		return err
+	}
+	s.publishGaps()
+	return nil
+}
+
+// trimGaps truncates the gaps at the end of the file, if any, and reports
+// whether it did. This method assumes that the gapsMu is held.
+func (s *shelf) trimGaps() (bool, error) {
+	// s.count is the first empty location. If the gaps has reached to one below
+	// the tail, then we can start truncating
+	if lastGap, _ := s.gaps.last(); lastGap+1 != s.count || s.cooling.has(lastGap) {
+		return false, nil
+	}
+	// we can delete a portion of the file
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.closed { // Undo (not really important, but correct) and back out again
+		s.gaps.reset()
+		return true, ErrClosed
+	}
+	s.trimTail()
+	return true, s.truncate()
+}
+
+// wipeSlot overwrites the first size bytes of the slot with zeros, which also
+// marks it as a gap in the file: the whole slot for secure deletes, or just the
+// header for persistent ones. This method assumes that the gapsMu is held.
+func (s *shelf) wipeSlot(slot uint64, size int) error {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	n, err := s.f.WriteAt(make([]byte, size), int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize))
+	s.metrics.Write(s.slotSize, n)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&s.dirty, 1)
+	if s.reads != nil {
+		s.reads.forget(slot)
+	}
+	if s.syncTomb {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// punchHole deallocates the disk space of the deleted slot, if enabled. If the
+// file does not support it, hole punching is disabled for the shelf. This
+// method assumes that the gapsMu is held.
+func (s *shelf) punchHole(slot uint64) {
+	if !s.punch {
+		return
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	f, ok := osFile(s.f)
+	if !ok || s.closed {
+		return // Nothing to reclaim in memory
+	}
+	if err := punchHole(f, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize), int64(s.slotSize)); err != nil {
+		s.log.Printf("billy: disabling hole punching, shelf %d: %v", s.slotSize, err)
+		s.punch = false
+		return
+	}
+	atomic.StoreUint32(&s.dirty, 1)
+}
+
+// dropCache drops the shelf file from the page cache after a scan, if enabled.
+// This method assumes that the fileMu is held, at least for reading.
+func (s *shelf) dropCache() {
+	if !s.nocache || s.closed {
+		return
+	}
+	if f, ok := osFile(s.f); ok {
+		if err := dropFileCache(f); err != nil {
+			s.log.Printf("billy: dropping page cache failed, shelf %d: %v", s.slotSize, err)
+		}
+	}
+}
+
+// Get returns the data at the given slot. If the slot has been deleted, the returndata
+// this method is undefined: it may return the original data, or some newer data
+// which has been written into the slot after Delete was called.
+func (s *shelf) Get(slot uint64) ([]byte, error) {
+	if s.reads != nil {
+		return s.reads.do(slot, func() ([]byte, error) { return s.get(slot) })
+	}
+	return s.get(slot)
+}
+
+// get reads the data at the given slot.
+func (s *shelf) get(slot uint64) ([]byte, error) {
+	// Read-lock to prevent file from being closed while reading from it
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.deleted.has(slot) {
+		return nil, fmt.Errorf("%w: slot %d", ErrDeleted, slot)
+	}
+	data, err := s.readSlot(make([]byte, s.slotSize), slot)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Get(s.slotSize, len(data))
+	return data, nil
+}
+
+// GetInto reads the data at the given slot into buf, and returns its size. If
+// buf is too small, the size is returned along with io.ErrShortBuffer. A buf
+// of at least the slot size is filled with a single read, otherwise the item
+// header is read first.
+func (s *shelf) GetInto(slot uint64, buf []byte) (int, error) {
+	// Read-lock to prevent file from being closed while reading from it
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	if s.deleted.has(slot) {
+		return 0, fmt.Errorf("%w: slot %d", ErrDeleted, slot)
+	}
+	if len(buf) >= int(s.slotSize) {
+		data, err := s.readSlot(buf[:s.slotSize], slot)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+		}
+		s.metrics.Get(s.slotSize, len(data))
+		return copy(buf, data), nil
+	}
+	var (
+		pos  = int64(ShelfHeaderSize) + int64(slot)*int64(s.slotSize)
+		head [itemHeaderSize + itemExpirySize]byte
+		hdr  = head[:]
+	)
+	if len(hdr) > int(s.slotSize) {
+		hdr = hdr[:s.slotSize]
+	}
+	if _, err := s.f.ReadAt(hdr, pos); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, len(hdr))
+	start, size, err := s.parseHeader(hdr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	if size > uint64(len(buf)) {
+		return int(size), io.ErrShortBuffer
+	}
+	if _, err := s.f.ReadAt(buf[:size], pos+int64(start)); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, int(size))
+	s.metrics.Get(s.slotSize, int(size))
+	return int(size), nil
+}
+
+// GetSample returns length bytes of the data at the given slot, starting at
+// offset off. Only the requested range and the item header are read from disk.
+// The range must be within the stored data.
+func (s *shelf) GetSample(slot, off, length uint64) ([]byte, error) {
+	// Read-lock to prevent file from being closed while reading from it
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.deleted.has(slot) {
+		return nil, fmt.Errorf("%w: slot %d", ErrDeleted, slot)
+	}
+	var (
+		pos  = int64(ShelfHeaderSize) + int64(slot)*int64(s.slotSize)
+		head = uint64(itemHeaderSize + itemExpirySize)
+		end  = head + off + length
+	)
+	if head > uint64(s.slotSize) {
+		head = uint64(s.slotSize)
+	}
+	if off > uint64(s.slotSize) || length > uint64(s.slotSize) {
+		return nil, fmt.Errorf("%w: sample %d+%d, slot size %d", ErrBadIndex, off, length, s.slotSize)
+	}
+	// Samples close to the start of the slot are read along with the header,
+	// otherwise the header is read separately.
+	var buf []byte
+	if end <= sampleReadAhead && end <= uint64(s.slotSize) {
+		buf = make([]byte, end)
+	} else {
+		buf = make([]byte, head)
+	}
+	if _, err := s.f.ReadAt(buf, pos); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, len(buf))
+	start, size, err := s.parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if off+length > size {
+		return nil, fmt.Errorf("%w: sample %d+%d, item size %d", ErrBadIndex, off, length, size)
+	}
+	if uint64(len(buf)) >= start+off+length {
+		return buf[start+off : start+off+length], nil
+	}
+	sample := make([]byte, length)
+	if _, err := s.f.ReadAt(sample, pos+int64(start+off)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, len(sample))
+	return sample, nil
+}
+
+// GetReader returns a reader over the data at the given slot, which reads from
+// the shelf file on demand. Like with Get, the data read is undefined if the
+// slot is deleted and reused meanwhile.
+func (s *shelf) GetReader(slot uint64) (*io.SectionReader, error) {
+	// Read-lock to prevent file from being closed while reading from it
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.deleted.has(slot) {
+		return nil, fmt.Errorf("%w: slot %d", ErrDeleted, slot)
+	}
+	var (
+		pos = int64(ShelfHeaderSize) + int64(slot)*int64(s.slotSize)
+		hdr = make([]byte, itemHeaderSize)
+	)
+	if _, err := s.f.ReadAt(hdr, pos); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	s.metrics.Read(s.slotSize, len(hdr))
+	start, size, err := s.parseHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.Get(s.slotSize, int(size))
+	return io.NewSectionReader(&slotReader{s}, pos+int64(start), int64(size)), nil
+}
+
+// slotReader reads from the shelf file, for the readers of GetReader, which
+// fail with ErrClosed once the shelf is closed.
+type slotReader struct {
+	s *shelf
+}
+
+func (r *slotReader) ReadAt(p []byte, off int64) (int, error) {
+	r.s.fileMu.RLock()
+	defer r.s.fileMu.RUnlock()
+	if r.s.closed {
+		return 0, ErrClosed
+	}
+	n, err := r.s.f.ReadAt(p, off)
+	r.s.metrics.Read(r.s.slotSize, n)
+	return n, err
+}
+
+// parseHeader decodes the item header at the start of buf, which must hold
+// the expiry time too, if present. It returns the offset of the data within
+// the slot and its size. Slots with a pending header read as empty.
+func (s *shelf) parseHeader(buf []byte) (uint64, uint64, error) {
+	var (
+		hdr   = binary.BigEndian.Uint32(buf)
+		start = uint64(itemHeaderSize)
+		size  = uint64(hdr &^ itemExpiryFlag)
+	)
+	if hdr == itemPendingHeader {
+		return start, 0, nil
+	}
+	if start+size > uint64(s.slotSize) {
+		return 0, 0, fmt.Errorf("%w: item size %d, slot size %d", ErrCorruptData, start+size, s.slotSize)
+	}
+	if hdr&itemExpiryFlag != 0 {
+		if size < itemExpirySize {
+			return 0, 0, fmt.Errorf("%w: item size %d too small for expiry", ErrCorruptData, size)
+		}
+		start += itemExpirySize
+		size -= itemExpirySize
+	}
+	return start, size, nil
+}
+
+// readSlot is a convenience function to the data from a slot.
+// It
+//   - expects the given 'buf' to be correctly sized (len = s.slotSize),
+//   - expects the fileMu to be R-locked, to prevent file from being closed during/before reading.
+//   - returns a subslice of buf containing the live data.
+func (s *shelf) readSlot(buf []byte, slot uint64) ([]byte, error) {
+	// Read the entire slot at once -- this might mean we read a bit more
+	// than strictly necessary, but it saves us one syscall.
+	if _, err := s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)); err != nil {
+		return nil, err
+	}
+	s.metrics.Read(s.slotSize, len(buf))
+	start, size, err := s.parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[start : start+size], nil
+}
+
+// readSize reads the size of the item stored in the slot, without reading the
+// data itself. It expects the fileMu to be R-locked.
+func (s *shelf) readSize(buf []byte, slot uint64) (uint32, error) {
+	if _, err := s.f.ReadAt(buf[:itemHeaderSize], int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)); err != nil {
+		return 0, err
+	}
+	s.metrics.Read(s.slotSize, itemHeaderSize)
+	_, size, err := s.parseHeader(buf)
+	return uint32(size), err
+}
+
+// readExpiry reads the expiry time of the item stored in the slot, which is
+// zero if the item does not expire. It expects the fileMu to be R-locked.
+func (s *shelf) readExpiry(buf []byte, slot uint64) (int64, error) {
+	buf = buf[:itemHeaderSize+itemExpirySize]
+	if _, err := s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)); err != nil {
+		return 0, err
+	}
+	s.metrics.Read(s.slotSize, len(buf))
+	if hdr := binary.BigEndian.Uint32(buf); hdr == itemPendingHeader || hdr&itemExpiryFlag == 0 || hdr&^itemExpiryFlag < itemExpirySize {
+		return 0, nil
+	}
+	return int64(binary.BigEndian.Uint64(buf[itemHeaderSize:])), nil
+}
+
+// writeSlot writes the given data to the slot. This method assumes that the
+// fileMu is read-locked.
+func (s *shelf) writeSlot(data []byte, slot uint64) error {
+	return s.writeSlotAt(data, slot, 0)
+}
+
+// writeSlotAt writes the data into the given slot, at offset off within it.
+// This method assumes that the fileMu is held.
+func (s *shelf) writeSlotAt(data []byte, slot uint64, off int) error {
+	n, err := s.f.WriteAt(data, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize)+int64(off))
+	s.metrics.Write(s.slotSize, n)
+	atomic.StoreUint32(&s.dirty, 1)
+	s.touch()
+	s.changes.mark(slot)
+	if s.reads != nil {
+		s.reads.forget(slot)
+	}
+	return noSpace(err)
+}
+
+// truncate truncates the file to the tail. This method assumes that the fileMu
+// is held.
+func (s *shelf) truncate() error {
+	atomic.StoreUint32(&s.dirty, 1)
+	s.touch()
+	s.reserved = 0 // Truncation releases the space past the end
+	s.settleTail()
+	return s.f.Truncate(int64(ShelfHeaderSize) + int64(s.count*uint64(s.slotSize)))
+}
+
+// Sync fsyncs the shelf file, if it has been written to since the last sync,
+// and publishes the gaps if a publication is scheduled.
+func (s *shelf) Sync() error {
+	s.gapsMu.Lock()
+	s.publishPending()
+	s.gapsMu.Unlock()
+
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if atomic.SwapUint32(&s.dirty, 0) == 0 {
+		return nil
+	}
+	if err := s.f.Sync(); err != nil {
+		atomic.StoreUint32(&s.dirty, 1)
+		return err
+	}
+	return nil
+}
+
+func (s *shelf) getSlot() (uint64, error) {
+	var slot uint64
+	// Locate the first free slot
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	if err := s.invalidateGaps(); err != nil {
+		return 0, err
+	}
+	if err := s.invalidateGens(); err != nil {
+		return 0, err
+	}
+	defer s.reportGaps()
+	if gap, ok := s.firstGap(); ok {
+		slot = gap
+		s.gaps.remove(slot)
+		s.pending[slot] = struct{}{}
+		s.deleted.remove(slot)
+		s.gens.bump(slot)
+		return slot, nil
+	}
+	// No gaps available: Expand the tail
+	if s.count >= s.maxSlots {
+		return 0, fmt.Errorf("%w: shelf %d has %d slots", ErrShelfFull, s.slotSize, s.maxSlots)
+	}
+	if err := s.growTail(s.count + 1); err != nil {
+		return 0, err
+	}
+	slot = s.count
+	s.count++
+	s.preallocate()
+	s.pending[slot] = struct{}{}
+	s.deleted.remove(slot)
+	s.gens.bump(slot)
+	return slot, nil
+}
+
+// preallocate reserves disk space for the next Options.Preallocate bytes from
+// the last slot on, once the tail has grown past the space reserved before.
+// This method assumes that the gapsMu is held.
+func (s *shelf) preallocate() {
+	if s.prealloc <= 0 || s.readonly {
+		return
+	}
+	off := int64(ShelfHeaderSize) + int64(s.count-1)*int64(s.slotSize)
+	if off+int64(s.slotSize) <= s.reserved {
+		return
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	f, ok := osFile(s.f)
+	if !ok || s.closed {
+		return // Nothing to reserve in memory
+	}
+	size := s.prealloc
+	if size < int64(s.slotSize) {
+		size = int64(s.slotSize)
+	}
+	if err := preallocate(f, off, size); err != nil {
+		s.log.Printf("billy: disabling preallocation, shelf %d: %v", s.slotSize, err)
+		s.prealloc = 0
+		return
+	}
+	s.reserved = off + size
+}
+
+// onShelfDataFn is used to iterate the entire dataset in the shelf.
+// After the method returns, the content of 'data' will be modified by
+// the iterator, so it needs to be copied if it is to be used later.
+type onShelfDataFn func(slot uint64, data []byte)
+
+// onShelfDataErrFn is used to iterate the dataset in the shelf, with the
+// possibility to abort the iteration by returning an error.
+type onShelfDataErrFn func(slot uint64, data []byte) error
+
+// Iterate iterates through the elements on the shelf, and invokes the onData
+// callback for each item.
+func (s *shelf) Iterate(onData onShelfDataFn) error {
+	if onData == nil {
+		return s.IterateErr(nil, nil)
+	}
+	return s.IterateErr(func(slot uint64, data []byte) error {
+		onData(slot, data)
+		return nil
+	}, nil)
+}
+
+// IterateErr iterates through the elements on the shelf, and invokes the onData
+// callback for each item. If the callback returns an error, the iteration is
+// aborted and the error is returned. The optional cfg can be used to filter the
+// items visited.
+func (s *shelf) IterateErr(onData onShelfDataErrFn, cfg *iterateConfig) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.reloadGaps(); err != nil {
+		return err
+	}
+	if err := s.clampTail(); err != nil {
+		return err
+	}
+	defer s.dropCache()
+
+	var start uint64
+	if cfg != nil {
+		start = cfg.startSlot
+	}
+	return s.iterateRange(start, s.count, onData, cfg, nil)
+}
+
+// clampTail lowers the tail of a read-only shelf to the slots in the file, as
+// a writer running alongside may have truncated it since. This method assumes
+// that the gapsMu is held.
+func (s *shelf) clampTail() error {
+	if !s.readonly {
+		return nil
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	var slots uint64
+	if size := stat.Size(); size > int64(ShelfHeaderSize) {
+		slots = uint64(size-int64(ShelfHeaderSize)) / uint64(s.slotSize)
+	}
+	if slots < s.count {
+		s.count = slots
+	}
+	return nil
+}
+
+// iterateRange invokes onData for the items in the slots [from, to), which are
+// read in batches. If stop is non-nil, the iteration ends early without error
+// once it is set. This method assumes that the gapsMu is held and the fileMu
+// is read-locked.
+func (s *shelf) iterateRange(from, to uint64, onData onShelfDataErrFn, cfg *iterateConfig, stop *uint32) error {
+	sc := newSlotScanner(s, from, to)
+	if cfg != nil && cfg.throttle {
+		sc.limit = s.throttle
+	}
+	defer sc.release()
+	for slot := from; slot < to; slot++ {
+		if stop != nil && atomic.LoadUint32(stop) != 0 {
+			return nil
+		}
+		if s.gaps.contains(slot) {
+			// We've reached a gap. Skip it
+			continue
+		}
+		if cfg != nil && cfg.filterSize {
+			// Check the size before reading the item itself
+			size, err := sc.readSize(slot, true)
+			if err != nil {
+				if err := cfg.corrupt(slot, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if cfg.skipSize(size) {
+				continue
+			}
+		}
+		data, err := sc.read(slot, true)
+		if err != nil {
+			if err := cfg.corrupt(slot, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(data) == 0 || onData == nil {
+			// Gap which is not tracked, e.g. in read-only mode
+			continue
+		}
+		if err := guard(func() error { return onData(slot, data) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact moves data 'up' to fill gaps, and truncates the file afterwards.
+// This operation must only be performed during the opening of the shelf.
+// The optional onMove callback is invoked for every item moved.
+// If move is false, no data is moved: the gaps are only collected, and the
+// gaps at the end of the file are truncated away.
+func (s *shelf) compact(onData onShelfDataFn, onMove onShelfMoveFn, repair bool, move bool) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	defer s.dropCache()
+
+	// The slots are read in batches, in each direction
+	var (
+		fwd = newSlotScanner(s, 0, s.count)
+		bwd = newSlotScanner(s, 0, s.count)
+
+		total    = s.count
+		progress = newCompactionProgress(s.onProgress, s.slotSize, total)
+		scanned  uint64 // scanned is the number of slots visited in either direction
+		moved    uint64
+	)
+	fwd.limit, bwd.limit = s.throttle, s.throttle
+	defer fwd.release()
+	defer bwd.release()
+	// nextGap searches upwards from the given slot (inclusive),
+	// to find the first gap.
+	nextGap := func(slot uint64) (uint64, error) {
+		for ; slot < s.count; slot++ {
+			scanned++
+			if err := progress.update(scanned, moved, 0); err != nil {
+				return 0, err
+			}
+			data, err := fwd.read(slot, true)
 			if err != nil {
-				if !errors.Is(err, ErrCorruptData) || s.readonly || !repair { // Only error if it's not a corruption being repaired
+				if errors.Is(err, ErrCorruptData) && !s.readonly && repair { // Repair corruption by dropping it
+					s.log.Printf("billy: dropping corrupt item, shelf %d, slot %d: %v", s.slotSize, slot, err)
+					break
+				}
+				return 0, err
+			}
+			if len(data) == 0 { // We've found a gap
+				if buf, err := fwd.raw(slot, true); err == nil {
+					s.checkTorn(buf, slot)
+				}
+				break
+			}
+			if onData != nil {
+				if err := guard(func() error { onData(slot, data); return nil }); err != nil {
 					return 0, err
 				}
 			}
+		}
+		return slot, nil
+	}
+	// prevData searches downwards from the given slot (inclusive), to find
+	// the next data-filled slot.
+	prevData := func(slot, gap uint64) (uint64, error) {
+		for ; slot > gap && slot > 0; slot-- {
+			scanned++
+			if err := progress.update(scanned, moved, 0); err != nil {
+				return 0, err
+			}
+			buf, err := bwd.raw(slot, false)
+			if err != nil {
+				return 0, err
+			}
+			var data []byte
+			if start, size, err := s.parseHeader(buf); err == nil {
+				data = buf[start : start+size]
+			} else if !errors.Is(err, ErrCorruptData) || s.readonly || !repair { // Only error if it's not a corruption being repaired
+				return 0, err
+			}
+			if len(data) == 0 {
+				s.checkTorn(buf, slot)
+			}
 			if len(data) != 0 {
 				// We've found a slot of data. Copy it to the gap
+				if err := s.invalidateGens(); err != nil {
+					return 0, err
+				}
 				if err := s.writeSlot(buf, gap); err != nil {
 					return 0, err
 				}
+				s.gens.set(gap, s.gens.get(slot))
+				fwd.update(gap, buf)
+				bwd.update(gap, buf)
+				s.metrics.Move(s.slotSize)
+				moved++
+				if onMove != nil {
+					if err := guard(func() error { onMove(slot, gap, data); return nil }); err != nil {
+						return 0, err
+					}
+				}
 				if onData != nil {
-					onData(gap, data)
+					if err := guard(func() error { onData(gap, data); return nil }); err != nil {
+						return 0, err
+					}
 				}
 				break
 			}
@@ -474,21 +1580,50 @@ func (s *shelf) compact(onData onShelfDataFn, repair bool) error {
 	// the algorithm is finished.
 	// This algorithm reads minimal number of items and performs minimal
 	// number of writes.
-	s.gaps = make([]uint64, 0)
+	s.gaps.reset()
 	if empty {
 		return nil
 	}
-	if s.readonly {
+	// Both searches may visit the slot where they meet
+	finish := func() error {
+		if scanned > total {
+			scanned = total
+		}
+		return progress.finish(scanned, moved, total-s.count)
+	}
+	if s.readonly || !move {
 		// Don't (try to) mutate the file in readonly mode, but still
 		// iterate for the ondata callbacks.
-		for gapped <= s.count {
-			gapped, err = nextGap(gapped)
-			if err != nil {
+		if onData == nil && s.slotSize >= headerScanSlotSize {
+			// Only the headers are needed, spare reading the data
+			if err := s.collectGaps(repair, progress); err != nil {
 				return err
 			}
-			gapped++
+			scanned = total
+		} else {
+			for gapped <= s.count {
+				gapped, err = nextGap(gapped)
+				if err != nil {
+					return err
+				}
+				if gapped < s.count && !s.readonly {
+					s.gaps.add(gapped)
+				}
+				gapped++
+			}
 		}
-		return nil
+		if s.readonly {
+			return finish()
+		}
+		// Trim the gaps at the end of the file
+		firstTail := s.count
+		s.count = s.gaps.trimTail(s.count)
+		if firstTail != s.count {
+			if err := s.truncate(); err != nil {
+				return fmt.Errorf("truncation failed: %v", err)
+			}
+		}
+		return finish()
 	}
 	filled--
 	firstTail := s.count
@@ -511,34 +1646,320 @@ func (s *shelf) compact(onData onShelfDataFn, repair bool) error {
 	}
 	if firstTail != s.count {
 		// Some gc was performed. gapSlot is the first empty slot now
-		if err := s.f.Truncate(int64(ShelfHeaderSize) + int64(s.count*uint64(s.slotSize))); err != nil {
+		if err := s.truncate(); err != nil {
 			return fmt.Errorf("truncation failed: %v", err)
 		}
 	}
+	return finish()
+}
+
+// headerScanSlotSize is the slot size from which opening without compaction
+// nor onData callback reads the item headers one by one, rather than reading
+// the whole file in batches.
+const headerScanSlotSize = 64 * 1024
+
+// collectGaps collects the gaps of the shelf from the item headers, reading
+// nothing else. Items with corrupt headers are dropped if repair is set.
+// This method assumes that the gapsMu is held and the fileMu is read-locked.
+func (s *shelf) collectGaps(repair bool, progress *compactionProgress) error {
+	hdr := make([]byte, itemHeaderSize)
+	for slot := uint64(0); slot < s.count; slot++ {
+		if err := progress.update(slot+1, 0, 0); err != nil {
+			return err
+		}
+		s.throttle.wait(itemHeaderSize)
+		size, err := s.readSize(hdr, slot)
+		if err != nil {
+			if !errors.Is(err, ErrCorruptData) || s.readonly || !repair {
+				return err
+			}
+			s.log.Printf("billy: dropping corrupt item, shelf %d, slot %d: %v", s.slotSize, slot, err)
+		}
+		if size == 0 {
+			s.checkTorn(hdr, slot)
+			if !s.readonly {
+				s.gaps.add(slot)
+			}
+		}
+	}
 	return nil
 }
 
+// checkTorn reports the slot if its raw content has a pending header, left
+// behind by an ordered write interrupted by a crash. Such slots read as empty,
+// so they are treated as gaps.
+func (s *shelf) checkTorn(buf []byte, slot uint64) {
+	if binary.BigEndian.Uint32(buf) == itemPendingHeader {
+		s.log.Printf("billy: dropping torn item, shelf %d, slot %d", s.slotSize, slot)
+	}
+}
+
+// onShelfMoveFn is invoked when an item is moved from one slot to another.
+type onShelfMoveFn func(oldSlot, newSlot uint64, data []byte)
+
+// compactBatchSize is the amount of data Compact moves at a time, before
+// releasing the locks of the shelf.
+const compactBatchSize = 4 * 1024 * 1024
+
+// movedItem is an item moved by Compact, to be reported to the callback.
+type movedItem struct {
+	from, to uint64
+	data     []byte
+}
+
+// Compact moves data from the end of the shelf into gaps, and truncates the
+// file afterwards. Unlike the compaction performed during opening, this can be
+// done on a live shelf. The optional onMove callback is invoked for every item
+// which is relocated, so that external references can be updated.
+//
+// The items are moved in batches of about compactBatchSize, and the locks of
+// the shelf are released between them: onMove is invoked, and the reads are
+// throttled, without locks held, so onMove may access the shelf. A failing
+// callback aborts the compaction after the batch, whose moves are all
+// reported.
+func (s *shelf) Compact(onMove onShelfMoveFn) error {
+	return s.compactLive(onMove, nil)
+}
+
+// compactLive compacts the shelf like Compact, and additionally invokes the
+// optional record callback for every move while the locks are still held,
+// before the old slot can be reused.
+func (s *shelf) compactLive(onMove onShelfMoveFn, record func(oldSlot, newSlot uint64)) error {
+	if s.readonly {
+		return ErrReadonly
+	}
+	s.gapsMu.Lock()
+	if s.closed {
+		s.gapsMu.Unlock()
+		return ErrClosed
+	}
+	mode, maxMoves, err := s.compaction(false)
+	gaps := uint64(s.gaps.len())
+	s.gapsMu.Unlock()
+	if err != nil || mode == CompactSkip {
+		return err
+	}
+	var (
+		progress = newCompactionProgress(s.onProgress, s.slotSize, gaps)
+		perBatch = compactBatchSize / int(s.slotSize)
+		handled  uint64 // handled is the number of gaps filled or dropped
+		moved    uint64
+		cbErr    error
+	)
+	if perBatch == 0 || s.throttle != nil {
+		perBatch = 1 // Pace every read
+	}
+	for {
+		var (
+			limit = perBatch
+			final bool // final is set if the policy allows no more moves than limit
+		)
+		if mode == CompactTrim {
+			limit, final = 0, true
+		} else if maxMoves > 0 && uint64(maxMoves)-moved <= uint64(limit) {
+			limit, final = int(uint64(maxMoves)-moved), true
+		}
+		batch, dropped, done, err := s.compactBatch(limit, final, onMove != nil, record)
+		if err != nil {
+			return err
+		}
+		for _, item := range batch {
+			s.throttle.wait(int(s.slotSize))
+			handled++
+			moved++
+			if onMove != nil {
+				if err := guard(func() error { onMove(item.from, item.to, item.data); return nil }); err != nil && cbErr == nil {
+					cbErr = err
+				}
+			}
+			if err := progress.update(handled, moved, handled); err != nil && cbErr == nil {
+				cbErr = err
+			}
+		}
+		handled += dropped
+		if cbErr != nil {
+			return cbErr
+		}
+		if done {
+			break
+		}
+	}
+	return progress.finish(handled, moved, handled)
+}
+
+// compactBatch moves up to limit items from the end of the shelf into gaps,
+// dropping the gaps at the end of the shelf, and truncates the file. Gaps
+// within their reuse delay are neither filled nor dropped. It returns the
+// items moved, the number of gaps dropped, and whether the compaction is done:
+// no reusable gaps are left, the last item can't be moved yet, or the limit is
+// final and reached. The data of the items is only kept if keep
+// is set.
+func (s *shelf) compactBatch(limit int, final, keep bool, record func(oldSlot, newSlot uint64)) ([]movedItem, uint64, bool, error) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return nil, 0, true, ErrClosed
+	}
+	if err := s.invalidateGaps(); err != nil {
+		return nil, 0, true, err
+	}
+	if err := s.invalidateGens(); err != nil {
+		return nil, 0, true, err
+	}
+	defer s.reportGaps()
+
+	var (
+		buf       = make([]byte, s.slotSize)
+		firstTail = s.count
+		batch     []movedItem
+		dropped   uint64
+		done      = true
+	)
+	s.cooling.release(time.Now().UnixNano())
+	for s.gaps.len() > 0 {
+		last := s.count - 1
+		if lastGap, _ := s.gaps.last(); lastGap == last {
+			if s.cooling.has(last) {
+				// The tail is a gap within its reuse delay, which must not be
+				// handed out again by extending the tail, stop here
+				break
+			}
+			// The tail is a gap, just drop it
+			s.gaps.remove(last)
+			s.count--
+			dropped++
+			continue
+		}
+		gap, ok := s.firstGap()
+		if !ok {
+			// Only gaps within their reuse delay are left
+			break
+		}
+		if len(batch) == limit {
+			// The batch is full, or the policy rules out (further) moves
+			done = final
+			break
+		}
+		if _, ok := s.pending[last]; ok {
+			// The last item is still being written, stop here
+			break
+		}
+		if _, ok := s.busy[last]; ok {
+			// The last item is being overwritten in place, stop here
+			break
+		}
+		// Move the last item into the first gap
+		data, err := s.readSlot(buf, last)
+		if err != nil {
+			return batch, dropped, true, err
+		}
+		if err := s.writeSlot(buf, gap); err != nil {
+			return batch, dropped, true, err
+		}
+		s.gaps.remove(gap)
+		s.deleted.remove(gap)
+		s.gens.set(gap, s.gens.get(last))
+		s.count--
+		s.metrics.Move(s.slotSize)
+		if record != nil {
+			record(last, gap)
+		}
+		item := movedItem{from: last, to: gap}
+		if keep {
+			item.data = append([]byte(nil), data...)
+		}
+		batch = append(batch, item)
+	}
+	if firstTail != s.count {
+		if err := s.truncate(); err != nil {
+			return batch, dropped, true, fmt.Errorf("truncation failed: %v", err)
+		}
+	}
+	s.publishGaps()
+	if done {
+		s.dropCache()
+	}
+	return batch, dropped, done, nil
+}
+
+// Has returns whether the given slot holds live data, according to the
+// in-memory tail and gaps. Slots which are being written by an in-flight Put
+// are not live yet.
+func (s *shelf) Has(slot uint64) (bool, error) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	if s.closed {
+		return false, ErrClosed
+	}
+	return s.isLive(slot), nil
+}
+
+// isLive returns whether the given slot holds live data. Slots which are being
+// written by an in-flight Put are not live yet. This method assumes that the
+// gapsMu is held.
+func (s *shelf) isLive(slot uint64) bool {
+	if _, ok := s.pending[slot]; ok {
+		return false
+	}
+	return slot < s.count && !s.gaps.contains(slot)
+}
+
+// lockLive marks the slot busy for an in-place write, after waiting for the
+// in-place write in flight, if any. It fails if the slot does not hold live
+// data. The returned function clears the mark once the write is done.
+func (s *shelf) lockLive(slot uint64) (func(), error) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.waitIdle(slot)
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if !s.isLive(slot) {
+		return nil, fmt.Errorf("%w: shelf %d, slot %d is not live, tail %d", ErrBadIndex, s.slotSize, slot, s.count)
+	}
+	done := make(chan struct{})
+	s.busy[slot] = done
+	return func() {
+		s.gapsMu.Lock()
+		delete(s.busy, slot)
+		s.gapsMu.Unlock()
+		close(done)
+	}, nil
+}
+
+// waitIdle waits until the slot is not being overwritten in place. The gapsMu
+// is released while waiting. This method assumes that the gapsMu is held.
+func (s *shelf) waitIdle(slot uint64) {
+	for {
+		done, ok := s.busy[slot]
+		if !ok {
+			return
+		}
+		s.gapsMu.Unlock()
+		<-done
+		s.gapsMu.Lock()
+	}
+}
+
 // stats returns the total number of slots in the shelf and the gaps within.
 func (s *shelf) stats() (uint64, uint64) {
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
 
-	return s.count, uint64(len(s.gaps))
+	return s.count, uint64(s.gaps.len())
 }
 
-// sortedUniqueInts is a helper structure to maintain an ordered slice
-// of gaps. We keep them ordered to make writes prefer early slots, to increase
-// the chance of trimming the end of files upon deletion.
-type sortedUniqueInts []uint64
-
-func (u *sortedUniqueInts) Append(elem uint64) {
-	s := *u
-	size := len(s)
-	idx := sort.Search(size, func(i int) bool {
-		return elem <= s[i]
-	})
-	if idx < size && s[idx] == elem {
-		return // Elem already there
+// fileSize returns the size of the shelf file. If the file can't be stat:ed,
+// e.g. because the shelf is closed, the size implied by the tail is returned.
+func (s *shelf) fileSize(tail uint64) uint64 {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if !s.closed {
+		if stat, err := s.f.Stat(); err == nil {
+			return uint64(stat.Size())
+		}
 	}
-	*u = append(s[:idx], append([]uint64{elem}, s[idx:]...)...)
+	return uint64(ShelfHeaderSize) + tail*uint64(s.slotSize)
 }
@@ -12,7 +12,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // getBlob returns a byte-slice filled with the given fill-byte
@@ -42,11 +45,11 @@ func TestBasicsOnDisk(t *testing.T)   { testBasics(t, t.TempDir()) }
 func testBasics(t *testing.T, path string) {
 	{ // Pre-instance failures
 		// can't open non-existing directory
-		if _, err := openShelf("/baz/bonk/foobar/gazonk", 10, nil, false, false); err == nil {
+		if _, err := openShelf("/baz/bonk/foobar/gazonk", 10, nil, &Options{}); err == nil {
 			t.Fatal("expected error")
 		}
 		// Can't point path to a file
-		if _, err := openShelf("./README.md", 10, nil, false, false); err == nil {
+		if _, err := openShelf("./README.md", 10, nil, &Options{}); err == nil {
 			t.Fatal("expected error")
 		}
 	}
@@ -80,6 +83,10 @@ func testBasics(t *testing.T, path string) {
 		if err := b.Update(make([]byte, 201), aa); !errors.Is(err, ErrOversized) {
 			t.Fatal("expected error")
 		}
+		// Should reject slots beyond the tail
+		if err := b.Update(getBlob(0x0a, 10), aa+1); !errors.Is(err, ErrBadIndex) {
+			t.Fatal("expected error")
+		}
 	}
 
 	bb, _ := b.Put(getBlob(0x0b, 151))
@@ -226,7 +233,7 @@ func checkIdentical(fileA, fileB string) error {
 
 func setup(t *testing.T, path string) (*shelf, func()) {
 	t.Helper()
-	a, err := openShelf(path, 200, nil, false, false)
+	a, err := openShelf(path, 200, nil, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -379,12 +386,12 @@ func TestCompaction(t *testing.T) {
 		haveOnData = append(haveOnData, data[0])
 	}
 	/// Now open them as shelves
-	a, err = openShelf(pA, 10, onData, false, false)
+	a, err = openShelf(pA, 10, onData, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	a.Close()
-	b, err = openShelf(pB, 10, nil, false, false)
+	b, err = openShelf(pB, 10, nil, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -401,36 +408,113 @@ func TestCompaction(t *testing.T) {
 }
 
 func TestGapHeap(t *testing.T) {
-	fill := func(gaps *sortedUniqueInts) {
-		gaps.Append(uint64(1))
-		gaps.Append(uint64(10))
-		gaps.Append(uint64(2))
-		gaps.Append(uint64(9))
-		gaps.Append(uint64(3))
-		gaps.Append(uint64(8))
-		gaps.Append(uint64(4))
-		gaps.Append(uint64(7))
-		gaps.Append(uint64(5))
-		gaps.Append(uint64(6))
-
-	}
-	gaps := make(sortedUniqueInts, 0)
+	fill := func(gaps *gapSet) {
+		gaps.add(uint64(1))
+		gaps.add(uint64(10))
+		gaps.add(uint64(2))
+		gaps.add(uint64(9))
+		gaps.add(uint64(3))
+		gaps.add(uint64(8))
+		gaps.add(uint64(4))
+		gaps.add(uint64(7))
+		gaps.add(uint64(5))
+		gaps.add(uint64(6))
+
+	}
+	var gaps gapSet
 	fill(&gaps)
-	for i := uint64(10); len(gaps) > 0; i-- {
-		if have, want := gaps[len(gaps)-1], i; have != want {
-			t.Fatalf("have %d want %d", have, want)
+	for i := uint64(10); gaps.len() > 0; i-- {
+		if have, _ := gaps.last(); have != i {
+			t.Fatalf("have %d want %d", have, i)
 		}
-		gaps = gaps[:len(gaps)-1]
+		gaps.remove(i)
 	}
 	// Check uniqueness filter
 	fill(&gaps)
 	fill(&gaps)
 	fill(&gaps)
-	for i := uint64(10); len(gaps) > 0; i-- {
-		if have, want := gaps[len(gaps)-1], i; have != want {
-			t.Fatalf("have %d want %d", have, want)
+	for i := uint64(1); gaps.len() > 0; i++ {
+		if have, _ := gaps.first(); have != i {
+			t.Fatalf("have %d want %d", have, i)
+		}
+		gaps.remove(i)
+	}
+}
+
+func TestGapSet(t *testing.T) {
+	var (
+		gaps gapSet
+		want = make(map[uint64]bool)
+	)
+	// Spread the gaps over several pages, with empty pages in between
+	for _, slot := range []uint64{0, 63, 64, 4095, 4096, 3 * 4096, 3*4096 + 17, 1<<28 - 1} {
+		gaps.add(slot)
+		want[slot] = true
+	}
+	check := func() {
+		t.Helper()
+		if have := gaps.len(); have != len(want) {
+			t.Fatalf("have %d gaps, want %d", have, len(want))
+		}
+		var prev uint64
+		gaps.each(func(slot uint64) {
+			if !want[slot] || (slot < prev) {
+				t.Fatalf("unexpected gap %d after %d", slot, prev)
+			}
+			prev = slot
+		})
+		var lo, hi uint64 = 1 << 63, 0
+		for slot := range want {
+			if !gaps.contains(slot) {
+				t.Fatalf("missing gap %d", slot)
+			}
+			if slot < lo {
+				lo = slot
+			}
+			if slot > hi {
+				hi = slot
+			}
+		}
+		if len(want) == 0 {
+			return
+		}
+		if have, _ := gaps.first(); have != lo {
+			t.Fatalf("have first %d want %d", have, lo)
+		}
+		if have, _ := gaps.last(); have != hi {
+			t.Fatalf("have last %d want %d", have, hi)
+		}
+	}
+	check()
+	for _, slot := range []uint64{0, 1<<28 - 1, 4096, 12345} {
+		gaps.remove(slot)
+		delete(want, slot)
+		check()
+	}
+	if have := len(gaps.pages); have != 4 {
+		t.Fatalf("have %d pages, want 4", have)
+	}
+	// Trimming the tail drops consecutive gaps below it
+	gaps.add(3*4096 + 16)
+	want[3*4096+16] = true
+	if have, want := gaps.trimTail(3*4096+18), uint64(3*4096+16); have != want {
+		t.Fatalf("have tail %d want %d", have, want)
+	}
+	if have, want := gaps.String(), "[63 64 4095 12288]"; have != want {
+		t.Fatalf("have %v want %v", have, want)
+	}
+	// Searching upwards, across pages
+	for _, tt := range []struct {
+		from, want uint64
+		ok         bool
+	}{{0, 63, true}, {64, 64, true}, {65, 4095, true}, {4096, 12288, true}, {12289, 0, false}} {
+		if have, ok := gaps.next(tt.from); have != tt.want || ok != tt.ok {
+			t.Fatalf("next %d: have %d %v want %d %v", tt.from, have, ok, tt.want, tt.ok)
 		}
-		gaps = gaps[:len(gaps)-1]
+	}
+	gaps.reset()
+	if _, ok := gaps.first(); ok || gaps.len() != 0 {
+		t.Fatal("gaps left after reset")
 	}
 }
 
@@ -438,7 +522,7 @@ func TestCompaction2(t *testing.T) {
 	p := t.TempDir()
 	/// Now open them as shelves
 	openAndStore := func(data string) {
-		a, err := openShelf(p, 10, nil, false, false)
+		a, err := openShelf(p, 10, nil, &Options{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -451,16 +535,17 @@ func TestCompaction2(t *testing.T) {
 	}
 	openAndIterate := func() string {
 		var data []byte
-		_, err := openShelf(p, 10, func(slot uint64, x []byte) {
+		a, err := openShelf(p, 10, func(slot uint64, x []byte) {
 			data = append(data, x...)
-		}, false, false)
+		}, &Options{})
 		if err != nil {
 			t.Fatal(err)
 		}
+		a.Close()
 		return string(data)
 	}
 	openAndDel := func(deletes ...int) {
-		a, err := openShelf(p, 10, nil, false, false)
+		a, err := openShelf(p, 10, nil, &Options{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -496,7 +581,7 @@ func TestCompaction2(t *testing.T) {
 func TestShelfRO(t *testing.T) {
 	p := t.TempDir()
 
-	a, err := openShelf(p, 20, nil, false, false)
+	a, err := openShelf(p, 20, nil, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -526,7 +611,7 @@ func TestShelfRO(t *testing.T) {
 	out := new(strings.Builder)
 	a, err = openShelf(p, 20, func(slot uint64, data []byte) {
 		fmt.Fprintf(out, "%d:%d, ", slot, len(data))
-	}, true, false)
+	}, &Options{Readonly: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -554,7 +639,7 @@ func TestShelfRO(t *testing.T) {
 	out = new(strings.Builder)
 	a, err = openShelf(p, 20, func(slot uint64, data []byte) {
 		fmt.Fprintf(out, "%d:%d, ", slot, len(data))
-	}, false, false)
+	}, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -570,7 +655,7 @@ func TestShelfRO(t *testing.T) {
 
 func TestDelete(t *testing.T) {
 	p := t.TempDir()
-	a, err := openShelf(p, 20, nil, false, false)
+	a, err := openShelf(p, 20, nil, &Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -624,19 +709,19 @@ func TestVersion(t *testing.T) {
 	}{
 		{ // Wrong magic
 			hdr:  []byte{'b', 'o', 'l', 'l', 'y', 0x00, 0x00, 0x00, 0x00, 0x00, 100},
-			want: "missing magic",
+			want: "bad shelf header: missing magic",
 		},
 		{ // Wrong size
 			hdr:  []byte{'b', 'i', 'l', 'l', 'y', 0x00, 0x00, 0x00, 0x00, 0x00, 0xff},
-			want: "wrong slotsize, file:255, need:100",
+			want: "bad shelf header: wrong slotsize, file:255, need:100",
 		},
 		{ // Future version
 			hdr:  []byte{'b', 'i', 'l', 'l', 'y', 0x05, 0x39, 0x00, 0x00, 0x00, 100},
-			want: "wrong version: 1337",
+			want: "unsupported format version: file",
 		},
 		{ // Too short
 			hdr:  []byte{'b'},
-			want: "EOF",
+			want: "bad shelf header: file too short (1 bytes)",
 		},
 		{ // Correct magic, empty shelf
 			hdr:  []byte{'b', 'i', 'l', 'l', 'y', 0x00, 0x00, 0x00, 0x00, 0x00, 100},
@@ -646,7 +731,7 @@ func TestVersion(t *testing.T) {
 		if err := os.WriteFile(filepath.Join(p, fname), tc.hdr, 0o777); err != nil {
 			t.Fatal(err)
 		}
-		_, err := openShelf(p, size, nil, false, false)
+		_, err := openShelf(p, size, nil, &Options{})
 		if err == nil {
 			if tc.want != "" {
 				t.Fatal("expected error")
@@ -669,12 +754,12 @@ func fuzzShelf(t *testing.T, content []byte) {
 		t.Fatal(err)
 	}
 	// Try to open the shelf and verify the errors
-	shelf, err := openShelf(path, 100, nil, false, false)
+	shelf, err := openShelf(path, 100, nil, &Options{})
 	if err == nil {
 		shelf.Close()
 		return
 	}
-	shelf, err = openShelf(path, 100, nil, false, true)
+	shelf, err = openShelf(path, 100, nil, &Options{Repair: true})
 	if err != nil {
 		t.Fatalf("failed to recover shelf: %v", err)
 	}
@@ -691,3 +776,664 @@ func TestShelfContents(t *testing.T) {
 func FuzzShelfContents(f *testing.F) {
 	f.Fuzz(fuzzShelf)
 }
+
+func TestCompactLiveInMemory(t *testing.T) { testCompactLive(t, "") }
+func TestCompactLiveOnDisk(t *testing.T)   { testCompactLive(t, t.TempDir()) }
+
+func testCompactLive(t *testing.T, path string) {
+	a, cleanup := setup(t, path)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		if _, err := a.Put(getBlob(byte(i), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, slot := range []uint64{1, 3, 9} {
+		if err := a.Delete(slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var moves string
+	if err := a.Compact(func(oldSlot, newSlot uint64, data []byte) {
+		moves += fmt.Sprintf("%d->%d:%d, ", oldSlot, newSlot, data[0])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := moves, "8->1:8, 7->3:7, "; have != want {
+		t.Fatalf("have %v\nwant %v", have, want)
+	}
+	if slots, gaps := a.stats(); slots != 7 || gaps != 0 {
+		t.Fatalf("wrong stats, slots %d gaps %d", slots, gaps)
+	}
+	finfo, _ := a.f.Stat()
+	if have, want := finfo.Size(), int64(ShelfHeaderSize+7*200); have != want {
+		t.Fatalf("have size %d want %d", have, want)
+	}
+	var have []byte
+	if err := a.Iterate(func(slot uint64, data []byte) {
+		have = append(have, data[0])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 8, 2, 7, 4, 5, 6}; !bytes.Equal(have, want) {
+		t.Fatalf("have %v\nwant %v", have, want)
+	}
+}
+
+func TestOpenWithoutCompaction(t *testing.T) {
+	p := t.TempDir()
+	if err := writeShelfFile(filepath.Join(p, "bkt_00000010.bag"),
+		10, []byte{1, 0, 3, 0, 5, 0, 6, 0, 4, 0, 2, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var haveOnData []byte
+	a, err := openShelf(p, 10, func(slot uint64, data []byte) {
+		haveOnData = append(haveOnData, data[0])
+	}, &Options{NoCompaction: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if want := []byte{1, 3, 5, 6, 4, 2}; !bytes.Equal(haveOnData, want) {
+		t.Fatalf("onData wrong, expected \n%x\ngot\n%x\n", want, haveOnData)
+	}
+	// The trailing gaps are trimmed, the others retained
+	if have, want := fmt.Sprint(a.gaps), "[1 3 5 7 9]"; have != want {
+		t.Fatalf("have gaps %v, want %v", have, want)
+	}
+	if have, want := a.count, uint64(11); have != want {
+		t.Fatalf("have tail %d, want %d", have, want)
+	}
+	// New data goes into the first gap
+	if slot, err := a.Put([]byte{7}); err != nil || slot != 1 {
+		t.Fatalf("have slot %d (err %v), want 1", slot, err)
+	}
+}
+
+func TestGapIndex(t *testing.T) {
+	p := t.TempDir()
+	a, err := openShelf(p, 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _ = a.Put(getBlob(byte(i), 10))
+	}
+	_ = a.Delete(2)
+	_ = a.Delete(5)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idx := filepath.Join(p, gapIndexName(20))
+	if _, err := os.Stat(idx); err != nil {
+		t.Fatalf("gap index missing: %v", err)
+	}
+	// Corrupt the header of a live slot. A full scan would fail on it, so
+	// this verifies that the gap index is used instead.
+	f, _ := os.OpenFile(filepath.Join(p, "bkt_00000020.bag"), os.O_RDWR, 0666)
+	_, _ = f.WriteAt([]byte{0x7f, 0xff, 0xff, 0xff}, int64(ShelfHeaderSize)+7*20)
+	f.Close()
+
+	if a, err = openShelf(p, 20, nil, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(a.gaps), "[2 5]"; have != want {
+		t.Fatalf("have gaps %v, want %v", have, want)
+	}
+	// A mutation invalidates the gap index
+	if _, err := a.Put(getBlob(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(idx); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("gap index not removed: %v", err)
+	}
+	// Simulate a crash after a checkpoint, by opening a second instance
+	if err := a.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := openShelf(p, 20, nil, &Options{Readonly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(b.gaps), "[5]"; have != want {
+		t.Fatalf("have gaps %v, want %v", have, want)
+	}
+	b.Close()
+	a.Close()
+	// With onData, the full scan is needed (and fails on the corruption)
+	if _, err = openShelf(p, 20, func(uint64, []byte) {}, &Options{}); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("want %v, have %v", ErrCorruptData, err)
+	}
+}
+
+func TestCheckGapIndex(t *testing.T) {
+	p := t.TempDir()
+	a, err := openShelf(p, 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, _ = a.Put(getBlob(byte(i), 10))
+	}
+	_ = a.Delete(1)
+	_ = a.Checkpoint()
+	report, err := CheckGapIndex(p, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || !report.Clean {
+		t.Fatalf("expected consistent report: %+v", report)
+	}
+	// Deletions don't touch the disk. Rewrite the index with the gap
+	// to make it diverge from the file.
+	_ = a.Delete(3)
+	a.gapsMu.Lock()
+	_ = writeGapIndex(a.idxPath, a.slotSize, a.count, []uint64{0, 3}, true)
+	a.gapsMu.Unlock()
+	if report, err = CheckGapIndex(p, 20); err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent() {
+		t.Fatalf("expected inconsistent report: %+v", report)
+	}
+	if have, want := fmt.Sprint(report.LiveGaps, report.DeadSlots), "[0 3] [1]"; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	a.Close()
+}
+
+func TestShelfLocked(t *testing.T) {
+	p := t.TempDir()
+	a, err := openShelf(p, 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openShelf(p, 20, nil, &Options{}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("want %v, have %v", ErrLocked, err)
+	}
+	// Readers don't need the lock
+	b, err := openShelf(p, 20, nil, &Options{Readonly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	a.Close()
+	// Closing releases the lock
+	if a, err = openShelf(p, 20, nil, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+}
+
+func TestShelfFull(t *testing.T) {
+	a, err := openShelf("", 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.maxSlots = 3
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Put(getBlob(3, 10)); !errors.Is(err, ErrShelfFull) {
+		t.Fatalf("want %v, have %v", ErrShelfFull, err)
+	}
+	// Gaps can still be filled
+	_ = a.Delete(1)
+	if _, err := a.Put(getBlob(3, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSample(t *testing.T) {
+	a, err := openShelf("", 10000, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	data := make([]byte, 9000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	slot, _ := a.Put(data)
+	for _, tc := range []struct{ off, length uint64 }{
+		{0, 0}, {0, 10}, {100, 50}, {4000, 200}, {8990, 10}, {0, 9000},
+	} {
+		have, err := a.GetSample(slot, tc.off, tc.length)
+		if err != nil {
+			t.Fatalf("sample %d+%d: %v", tc.off, tc.length, err)
+		}
+		if !bytes.Equal(have, data[tc.off:tc.off+tc.length]) {
+			t.Fatalf("sample %d+%d: wrong data", tc.off, tc.length)
+		}
+	}
+	// Beyond the stored data, but within the slot
+	for _, tc := range []struct{ off, length uint64 }{
+		{8990, 11}, {9000, 1}, {0, 9001}, {1 << 40, 1},
+	} {
+		if _, err := a.GetSample(slot, tc.off, tc.length); !errors.Is(err, ErrBadIndex) {
+			t.Fatalf("sample %d+%d: want %v, have %v", tc.off, tc.length, ErrBadIndex, err)
+		}
+	}
+}
+
+func TestShelfSync(t *testing.T) {
+	a, err := openShelf(t.TempDir(), 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.dirty != 0 {
+		t.Fatal("new shelf is dirty")
+	}
+	slot, _ := a.Put(getBlob(1, 10))
+	if a.dirty != 1 {
+		t.Fatal("shelf not dirty after put")
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if a.dirty != 0 {
+		t.Fatal("shelf dirty after sync")
+	}
+	_ = a.Delete(slot) // truncates the file
+	if a.dirty != 1 {
+		t.Fatal("shelf not dirty after truncation")
+	}
+	if err := a.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if a.dirty != 0 {
+		t.Fatal("shelf dirty after checkpoint")
+	}
+	a.Close()
+	if err := a.Sync(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want %v, have %v", ErrClosed, err)
+	}
+}
+
+func TestUpdateGap(t *testing.T) {
+	a, err := openShelf("", 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	x, _ := a.Put(getBlob(1, 10))
+	y, _ := a.Put(getBlob(2, 10))
+	_ = a.Delete(x)
+	if err := a.Update(getBlob(3, 10), x); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+	if err := a.Update(getBlob(3, 10), y); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := a.Get(y); !bytes.Equal(data, getBlob(3, 10)) {
+		t.Fatalf("have %x", data)
+	}
+	a.Close()
+	if err := a.Update(getBlob(3, 10), y); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want %v, have %v", ErrClosed, err)
+	}
+}
+
+// syncGate is a store whose first Sync blocks until released.
+type syncGate struct {
+	store
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *syncGate) Sync() error {
+	g.once.Do(func() {
+		close(g.entered)
+		<-g.release
+	})
+	return g.store.Sync()
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	a, err := openShelf("", 20, nil, &Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	x, _ := a.Put(getBlob(1, 10))
+	y, _ := a.Put(getBlob(2, 10))
+
+	gate := &syncGate{store: a.f, entered: make(chan struct{}), release: make(chan struct{})}
+	a.f = gate
+	updated := make(chan error)
+	go func() { updated <- a.Update(getBlob(3, 10), y) }()
+	<-gate.entered
+
+	// Other slots can be deleted and written while the update syncs
+	if err := a.Delete(x); err != nil {
+		t.Fatal(err)
+	}
+	if live, _ := a.Has(y); !live {
+		t.Fatal("slot being updated not live")
+	}
+	close(gate.release)
+	if err := <-updated; err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := a.Get(y); !bytes.Equal(data, getBlob(3, 10)) {
+		t.Fatalf("have %x", data)
+	}
+}
+
+func TestUpdateRangeLive(t *testing.T) {
+	a, err := openShelf("", 20, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	x, _ := a.Put(getBlob(1, 10))
+	y, _ := a.Put(getBlob(2, 10))
+	_ = a.Delete(x)
+	if err := a.UpdateRange(x, 0, []byte{9}); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+	if err := a.UpdateRange(5, 0, []byte{9}); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+	// A slot being patched is neither moved nor deleted meanwhile
+	unlock, err := a.lockLive(y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if live, _ := a.Has(y); !live {
+		t.Fatal("busy slot moved by compaction")
+	}
+	deleted := make(chan error)
+	go func() { deleted <- a.Delete(y) }()
+	select {
+	case err := <-deleted:
+		t.Fatalf("delete of busy slot returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UpdateRange(y, 0, []byte{9}); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("want %v, have %v", ErrBadIndex, err)
+	}
+}
+
+func TestPublishGapsFailure(t *testing.T) {
+	var (
+		p   = t.TempDir()
+		log = new(recordLogger)
+	)
+	a, err := openShelf(p, 200, nil, &Options{Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.shareGaps(); err != nil {
+		t.Fatal(err)
+	}
+	// Make the publications fail, the writes still succeed
+	a.gapsMu.Lock()
+	a.idxPath = filepath.Join(p, "missing", gapIndexName(200))
+	a.published = time.Time{}
+	a.gapsMu.Unlock()
+	slot, err := a.Put(getBlob(1, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := a.Get(slot); !bytes.Equal(data, getBlob(1, 100)) {
+		t.Fatalf("have %x", data)
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if len(log.msgs) != 1 || !strings.Contains(log.msgs[0], "publishing gaps failed") {
+		t.Fatalf("have log %q", log.msgs)
+	}
+}
+
+func TestSecureDelete(t *testing.T) {
+	p := t.TempDir()
+	a, err := openShelf(p, 200, nil, &Options{SecureDelete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i+1), 150)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	_ = a.Close()
+
+	raw, err := os.ReadFile(filepath.Join(p, "bkt_00000200.bag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := raw[ShelfHeaderSize+200 : ShelfHeaderSize+400]
+	if !bytes.Equal(slot, make([]byte, 200)) {
+		t.Fatalf("deleted slot not wiped: %x", slot)
+	}
+	// The neighbours are intact
+	if !bytes.Contains(raw, getBlob(1, 150)) || !bytes.Contains(raw, getBlob(3, 150)) {
+		t.Fatal("live slots corrupted")
+	}
+}
+
+func TestPersistentDeletes(t *testing.T) {
+	p := t.TempDir()
+	a, err := openShelf(p, 200, nil, &Options{PersistDeletes: true, SyncDeletes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i+1), 150)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	// The header is blanked before the shelf is closed, the data is left
+	raw, err := os.ReadFile(filepath.Join(p, "bkt_00000200.bag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := raw[ShelfHeaderSize+200 : ShelfHeaderSize+400]
+	if !bytes.Equal(slot[:itemHeaderSize], make([]byte, itemHeaderSize)) {
+		t.Fatalf("deleted slot header not blanked: %x", slot[:itemHeaderSize])
+	}
+	if !bytes.Equal(slot[itemHeaderSize:itemHeaderSize+150], getBlob(2, 150)) {
+		t.Fatal("deleted slot data overwritten")
+	}
+	// A crashed writer's deletion sticks
+	b, err := openShelf(p, 200, nil, &Options{Readonly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var live []uint64
+	if err := b.Iterate(func(slot uint64, data []byte) { live = append(live, slot) }); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(live), "[0 2]"; have != want {
+		t.Fatalf("have live slots %v, want %v", have, want)
+	}
+}
+
+func TestReuseDelay(t *testing.T) {
+	a, err := openShelf(t.TempDir(), 200, nil, &Options{ReuseDelay: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted slots are neither reused nor truncated within the delay
+	_ = a.Delete(0)
+	_ = a.Delete(2)
+	if slot, _ := a.Put(getBlob(3, 10)); slot != 3 {
+		t.Fatalf("have slot %d, want 3", slot)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if slot, _ := a.Put(getBlob(4, 10)); slot != 0 {
+		t.Fatalf("have slot %d, want 0", slot)
+	}
+	// Once released, the tail is trimmed by the next deletion, down to the
+	// slots still held back
+	_ = a.Delete(3)
+	if have, want := a.count, uint64(4); have != want {
+		t.Fatalf("have tail %d want %d", have, want)
+	}
+	time.Sleep(150 * time.Millisecond)
+	_ = a.Delete(1)
+	if have, want := a.count, uint64(2); have != want {
+		t.Fatalf("have tail %d want %d", have, want)
+	}
+}
+
+func TestReuseDelayCompact(t *testing.T) {
+	a, err := openShelf(t.TempDir(), 200, nil, &Options{ReuseDelay: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := a.Put(getBlob(byte(i), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compaction neither fills nor drops slots within their delay
+	_ = a.Delete(0)
+	_ = a.Delete(3)
+	if err := a.Compact(func(from, to uint64, _ []byte) {
+		t.Errorf("slot %d moved to %d", from, to)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := a.count, uint64(4); have != want {
+		t.Fatalf("have tail %d want %d", have, want)
+	}
+	time.Sleep(150 * time.Millisecond)
+	var moves [][2]uint64
+	if err := a.Compact(func(from, to uint64, _ []byte) {
+		moves = append(moves, [2]uint64{from, to})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]uint64{{2, 0}}; fmt.Sprint(moves) != fmt.Sprint(want) {
+		t.Fatalf("have moves %v want %v", moves, want)
+	}
+	if have, want := a.count, uint64(2); have != want {
+		t.Fatalf("have tail %d want %d", have, want)
+	}
+}
+
+// flakyStore is a store which transfers at most 7 bytes per call, interrupts
+// every other call, and fails calls reaching offset failAt, if positive.
+type flakyStore struct {
+	store
+	calls  int
+	failAt int64
+}
+
+func (f *flakyStore) flaky(p []byte, off int64) ([]byte, error) {
+	if f.calls++; f.calls%2 == 0 && isInterrupted(syscall.EINTR) {
+		return nil, syscall.EINTR
+	}
+	if f.failAt > 0 && off+int64(len(p)) > f.failAt {
+		return nil, errors.New("bad sector")
+	}
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return p, nil
+}
+
+func (f *flakyStore) ReadAt(p []byte, off int64) (int, error) {
+	part, err := f.flaky(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return f.store.ReadAt(part, off)
+}
+
+func (f *flakyStore) WriteAt(p []byte, off int64) (int, error) {
+	part, err := f.flaky(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return f.store.WriteAt(part, off)
+}
+
+func TestShortTransfers(t *testing.T) {
+	a, err := openShelf(t.TempDir(), 200, nil, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	flaky := &flakyStore{store: a.f.(*retryStore).store}
+	a.f.(*retryStore).store = flaky
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.Put(getBlob(byte(i), 150)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if have, err := a.Get(uint64(i)); err != nil || !bytes.Equal(have, getBlob(byte(i), 150)) {
+			t.Fatalf("slot %d: have %x, %v", i, have, err)
+		}
+	}
+	// Failures report where they happened
+	flaky.failAt = int64(ShelfHeaderSize) + 450
+	_, err = a.Put(getBlob(3, 150))
+	var ioErr *SlotIOError
+	if !errors.As(err, &ioErr) {
+		t.Fatalf("have %v want a SlotIOError", err)
+	}
+	if ioErr.Op != "write" || ioErr.SlotSize != 200 || ioErr.Slot != 3 {
+		t.Fatalf("have %+v", ioErr)
+	}
+	if _, err := a.Get(2); err == nil || !strings.Contains(err.Error(), "slot 2") {
+		t.Fatalf("have %v, want the slot in the error", err)
+	}
+}
+
+func TestDeletedCache(t *testing.T) {
+	var c deletedCache
+	if c.has(0) {
+		t.Fatal("empty cache has slot")
+	}
+	// A slot deleted again after reuse is remembered as recently deleted
+	c.add(0)
+	c.remove(0)
+	c.add(0)
+	for slot := uint64(1); slot < deletedCacheSize; slot++ {
+		c.add(slot)
+	}
+	if !c.has(0) {
+		t.Fatal("slot evicted early")
+	}
+	c.add(deletedCacheSize)
+	if c.has(0) {
+		t.Fatal("oldest slot not evicted")
+	}
+	if !c.has(1) || !c.has(deletedCacheSize) {
+		t.Fatal("recent slots evicted")
+	}
+}
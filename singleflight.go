@@ -0,0 +1,68 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "sync"
+
+// flight is a read in progress, which concurrent readers of the same slot wait
+// for instead of issuing reads of their own.
+type flight struct {
+	done   chan struct{}
+	data   []byte // data is the result, owned by the reader which issued the read
+	shared []byte // shared is a copy of data for the waiting readers to copy from
+	err    error
+	dups   int // dups is the number of waiting readers, guarded by readGroup.mu
+}
+
+// readGroup coalesces concurrent reads of the same slot into a single read.
+// Every reader gets its own copy of the data, so it is safe to modify.
+type readGroup struct {
+	mu      sync.Mutex
+	flights map[uint64]*flight
+}
+
+// do calls read, unless a read of the same slot is already in progress, in
+// which case its result is waited for and copied.
+func (g *readGroup) do(slot uint64, read func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[slot]; ok {
+		f.dups++
+		g.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		return append([]byte(nil), f.shared...), nil
+	}
+	if g.flights == nil {
+		g.flights = make(map[uint64]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[slot] = f
+	g.mu.Unlock()
+
+	f.data, f.err = read()
+
+	g.mu.Lock()
+	if g.flights[slot] == f {
+		delete(g.flights, slot)
+	}
+	// No more readers can join, so the waiting ones can share one copy
+	// while the issuing reader keeps the original.
+	if f.dups > 0 && f.err == nil {
+		f.shared = append([]byte(nil), f.data...)
+	}
+	g.mu.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+// forget makes subsequent reads of the slot not join a read in progress, which
+// may return the data from before a write to the slot.
+func (g *readGroup) forget(slot uint64) {
+	g.mu.Lock()
+	delete(g.flights, slot)
+	g.mu.Unlock()
+}
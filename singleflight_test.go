@@ -0,0 +1,104 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadGroup(t *testing.T) {
+	var (
+		g       readGroup
+		reads   int32
+		release = make(chan struct{})
+		started = make(chan struct{})
+		results = make([][]byte, 10)
+		wg      sync.WaitGroup
+	)
+	read := func() ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		close(started)
+		<-release
+		return []byte("hello"), nil
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = g.do(1, read)
+	}()
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(1, func() ([]byte, error) {
+				t.Error("read not coalesced")
+				return nil, nil
+			})
+		}(i)
+	}
+	// Wait for all readers to join the flight
+	for {
+		g.mu.Lock()
+		dups := g.flights[1].dups
+		g.mu.Unlock()
+		if dups == len(results)-1 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if reads := atomic.LoadInt32(&reads); reads != 1 {
+		t.Fatalf("have %d reads, want 1", reads)
+	}
+	for i, res := range results {
+		if !bytes.Equal(res, []byte("hello")) {
+			t.Fatalf("reader %d: have %q", i, res)
+		}
+	}
+	// Every reader must own its data
+	results[0][0] = 'j'
+	for i, res := range results[1:] {
+		if res[0] != 'h' {
+			t.Fatalf("reader %d shares data", i+1)
+		}
+		res[0] = 'y'
+	}
+	// Once done, a new read is issued
+	if data, _ := g.do(1, func() ([]byte, error) { return []byte("world"), nil }); string(data) != "world" {
+		t.Fatalf("have %q", data)
+	}
+}
+
+func TestReadGroupForget(t *testing.T) {
+	var (
+		g       readGroup
+		release = make(chan struct{})
+		started = make(chan struct{})
+		done    = make(chan []byte)
+	)
+	go func() {
+		data, _ := g.do(1, func() ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("old"), nil
+		})
+		done <- data
+	}()
+	<-started
+	// A write has happened, so the read in progress must not be joined
+	g.forget(1)
+	if data, _ := g.do(1, func() ([]byte, error) { return []byte("new"), nil }); string(data) != "new" {
+		t.Fatalf("have %q, want %q", data, "new")
+	}
+	close(release)
+	if data := <-done; string(data) != "old" {
+		t.Fatalf("have %q, want %q", data, "old")
+	}
+}
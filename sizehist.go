@@ -0,0 +1,140 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// maxHistogramSizes is the number of distinct sizes SizeHistogram.SlotSizes
+// optimizes over. Larger histograms are coarsened first.
+const maxHistogramSizes = 1024
+
+// SizeHistogram records the sizes of the items stored in a database, to derive
+// slot sizes which fit them with little padding, see SlotSizes. It implements
+// Metrics, recording the stored size of every Put: pass it to WithMetrics, or
+// forward the Put events of another Metrics to it. The items stored already can
+// be recorded with Scan. The sizes are those of the data as stored, so that
+// encryption is accounted for.
+type SizeHistogram struct {
+	NopMetrics
+
+	mu     sync.Mutex
+	counts map[int]uint64 // counts maps the sizes to the number of items
+}
+
+// NewSizeHistogram creates an empty histogram.
+func NewSizeHistogram() *SizeHistogram {
+	return &SizeHistogram{counts: make(map[int]uint64)}
+}
+
+// Add records an item of the given size.
+func (h *SizeHistogram) Add(size int) {
+	h.mu.Lock()
+	h.counts[size]++
+	h.mu.Unlock()
+}
+
+// Put records the size of a stored item, implementing Metrics.
+func (h *SizeHistogram) Put(slotSize uint32, size int) {
+	h.Add(size)
+}
+
+// Scan records the sizes of the items in the database.
+func (h *SizeHistogram) Scan(db Database) error {
+	return db.IterateItems(func(item ItemInfo, data []byte) error {
+		h.Add(int(item.Stored))
+		return nil
+	})
+}
+
+// SlotSizes returns up to n increasing slot sizes which minimize the padding
+// of the recorded items, item headers included, with the largest one fitting
+// the largest item. They can be applied to an existing database with Migrate,
+// using SlotSizeList. Histograms with many distinct sizes are coarsened, so
+// the result is then close to optimal rather than exact.
+func (h *SizeHistogram) SlotSizes(n int) ([]uint32, error) {
+	if n < 1 {
+		return nil, errors.New("no slot sizes requested")
+	}
+	sizes, counts := h.buckets()
+	if len(sizes) == 0 {
+		return nil, errors.New("no sizes recorded")
+	}
+	if n > len(sizes) {
+		n = len(sizes)
+	}
+	// Prefix sums of the counts and sizes, to compute the padding of a shelf
+	// holding the sizes [i, j) as sizes[j-1]*items - payload.
+	var (
+		m      = len(sizes)
+		items  = make([]uint64, m+1)
+		total  = make([]uint64, m+1)
+		waste  = func(i, j int) uint64 { return uint64(sizes[j-1])*(items[j]-items[i]) - (total[j] - total[i]) }
+		best   = make([][]uint64, n+1) // best[k][j] is the padding of sizes [0, j) in k shelves
+		choice = make([][]int, n+1)    // choice[k][j] is the start of the last of those shelves
+	)
+	for i := range sizes {
+		items[i+1] = items[i] + counts[i]
+		total[i+1] = total[i] + counts[i]*uint64(sizes[i])
+	}
+	best[0] = make([]uint64, 1) // No sizes in no shelves
+	for k := 1; k <= n; k++ {
+		best[k], choice[k] = make([]uint64, m+1), make([]int, m+1)
+		for j := k; j <= m; j++ {
+			best[k][j] = ^uint64(0)
+			for i := k - 1; i < j && i < len(best[k-1]); i++ {
+				if cost := best[k-1][i] + waste(i, j); cost < best[k][j] {
+					best[k][j], choice[k][j] = cost, i
+				}
+			}
+		}
+	}
+	// Walk back from the last shelf, which ends with the largest size
+	slotSizes := make([]uint32, n)
+	for k, j := n, m; k > 0; k, j = k-1, choice[k][j] {
+		slotSizes[k-1] = uint32(sizes[j-1] + itemHeaderSize)
+	}
+	// Tiny items may need a larger slot than their size
+	var result []uint32
+	for _, size := range slotSizes {
+		if size < minSlotSize {
+			size = minSlotSize
+		}
+		if len(result) == 0 || size > result[len(result)-1] {
+			result = append(result, size)
+		}
+	}
+	return result, nil
+}
+
+// buckets returns the recorded sizes in increasing order along with their
+// counts, rounding sizes up to a coarser step if there are too many.
+func (h *SizeHistogram) buckets() ([]int, []uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for step := 1; ; step *= 2 {
+		coarse := make(map[int]uint64)
+		for size, count := range h.counts {
+			coarse[(size+step-1)/step*step] += count
+		}
+		if len(coarse) > maxHistogramSizes {
+			continue
+		}
+		sizes := make([]int, 0, len(coarse))
+		for size := range coarse {
+			sizes = append(sizes, size)
+		}
+		sort.Ints(sizes)
+		counts := make([]uint64, len(sizes))
+		for i, size := range sizes {
+			counts[i] = coarse[size]
+		}
+		return sizes, counts
+	}
+}
@@ -0,0 +1,98 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// BlobSize is the size of an EIP-4844 blob, as stored by EthStorage.
+const BlobSize = 4096 * 32
+
+// SlotSizeGeometric is a SlotSizeFn which arranges the slots in shelves which
+// grow by the given ratio for each level, until the max size is reached. A
+// ratio below 2 gives finer size classes than SlotSizePowerOfTwo, at the cost
+// of more shelves. The ratio must be larger than 1.
+func SlotSizeGeometric(min, max uint32, ratio float64) SlotSizeFn {
+	if !(ratio > 1) {
+		panic(fmt.Sprintf("slot size ratio %v not larger than 1", ratio))
+	}
+	v := min
+	return func() (uint32, bool) {
+		ret := v
+		if next := math.Ceil(float64(v) * ratio); next >= math.MaxUint32 {
+			v = math.MaxUint32
+		} else {
+			v = uint32(next)
+		}
+		if v == ret && v < math.MaxUint32 { // Always make progress
+			v++
+		}
+		return ret, ret >= max || ret == math.MaxUint32
+	}
+}
+
+// SlotSizeBlobAligned is a SlotSizeFn which arranges the slots in shelves
+// holding 1 to maxBlobs blobs of the given size, along with extra bytes of
+// metadata per item. Every slot fits its payload exactly, including the item
+// header, so no space is wasted on items of whole blobs.
+func SlotSizeBlobAligned(blobSize, extra uint32, maxBlobs int) SlotSizeFn {
+	i := 0
+	return func() (uint32, bool) {
+		i++
+		return uint32(i)*blobSize + extra + itemHeaderSize, i >= maxBlobs
+	}
+}
+
+// SlotSizeList is a SlotSizeFn which yields the given slot sizes, e.g. as
+// collected by SlotSizes. The sizes must be increasing, and at least one must
+// be given.
+func SlotSizeList(sizes ...uint32) SlotSizeFn {
+	i := 0
+	return func() (uint32, bool) {
+		i++
+		return sizes[i-1], i >= len(sizes)
+	}
+}
+
+// PaddingStats describes how well a set of slot sizes fits a payload
+// distribution, see Padding.
+type PaddingStats struct {
+	Items   int    // Items is the number of payloads which fit into a shelf
+	Payload uint64 // Payload is the total size of the payloads which fit
+	Padding uint64 // Padding is the total slot space not used by payload
+	Unfit   int    // Unfit is the number of payloads too large for any shelf
+}
+
+// Overhead returns the padding as a fraction of the payload.
+func (p *PaddingStats) Overhead() float64 {
+	if p.Payload == 0 {
+		return 0
+	}
+	return float64(p.Padding) / float64(p.Payload)
+}
+
+// Padding computes the space wasted on padding when storing payloads of the
+// given sizes in shelves of the given slot sizes, which must be increasing
+// (see SlotSizes). The item headers are counted as padding. Encryption adds
+// to the payload, and is not accounted for.
+func Padding(slotSizes []uint32, payloads []int) *PaddingStats {
+	stats := new(PaddingStats)
+	for _, size := range payloads {
+		i := sort.Search(len(slotSizes), func(i int) bool {
+			return size+itemHeaderSize <= int(slotSizes[i])
+		})
+		if i == len(slotSizes) {
+			stats.Unfit++
+			continue
+		}
+		stats.Items++
+		stats.Payload += uint64(size)
+		stats.Padding += uint64(slotSizes[i]) - uint64(size)
+	}
+	return stats
+}
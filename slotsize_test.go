@@ -0,0 +1,114 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSlotSizes(t *testing.T) {
+	for i, tt := range []struct {
+		fn   SlotSizeFn
+		want []uint32
+	}{
+		{SlotSizePowerOfTwo(100, 800), []uint32{100, 200, 400, 800}},
+		{SlotSizeLinear(10, 3), []uint32{10, 20, 30}},
+		{SlotSizeGeometric(100, 300, 1.5), []uint32{100, 150, 225, 338}},
+		{SlotSizeGeometric(1, 4, 1.1), []uint32{1, 2, 3, 4}}, // rounds up to make progress
+		{SlotSizeGeometric(1<<31, math.MaxUint32, 4), []uint32{1 << 31, math.MaxUint32}},
+		{SlotSizeBlobAligned(BlobSize, 100, 2), []uint32{BlobSize + 104, 2*BlobSize + 104}},
+		{SlotSizeList(64, 100, 1000), []uint32{64, 100, 1000}},
+	} {
+		have, err := SlotSizes(tt.fn)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: have %v want %v", i, have, tt.want)
+		}
+	}
+	if _, err := SlotSizes(SlotSizeLinear(10, 0x1000)); err == nil {
+		t.Fatal("expected error for too many shelves")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	sizes, _ := SlotSizes(SlotSizeLinear(100, 2))
+	stats := Padding(sizes, []int{96, 50, 97, 196, 300})
+	want := &PaddingStats{
+		Items:   4,
+		Payload: 96 + 50 + 97 + 196,
+		Padding: 4 + 50 + 103 + 4,
+		Unfit:   1,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("have %+v want %+v", stats, want)
+	}
+	if have, want := stats.Overhead(), float64(161)/439; have != want {
+		t.Fatalf("have overhead %v want %v", have, want)
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	h := NewSizeHistogram()
+	if _, err := h.SlotSizes(3); err == nil {
+		t.Fatal("expected error for empty histogram")
+	}
+	var items []int
+	for size, count := range map[int]int{1: 2, 90: 5, 100: 10, 900: 3, 1000: 20, 5000: 1} {
+		for i := 0; i < count; i++ {
+			h.Add(size)
+			items = append(items, size)
+		}
+	}
+	if _, err := h.SlotSizes(0); err == nil {
+		t.Fatal("expected error for no slot sizes")
+	}
+	for i, tt := range []struct {
+		n    int
+		want []uint32
+	}{
+		{1, []uint32{5004}},
+		{3, []uint32{104, 1004, 5004}},
+		{6, []uint32{minSlotSize, 94, 104, 904, 1004, 5004}},
+		{10, []uint32{minSlotSize, 94, 104, 904, 1004, 5004}},
+	} {
+		have, err := h.SlotSizes(tt.n)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: have %v want %v", i, have, tt.want)
+		}
+		if stats := Padding(have, items); stats.Unfit != 0 {
+			t.Errorf("test %d: %d items unfit", i, stats.Unfit)
+		}
+	}
+	// Record through the metrics hook and by scanning, which must agree
+	dir := t.TempDir()
+	live := NewSizeHistogram()
+	db, err := Open(dir, SlotSizeLinear(64, 4), nil, WithMetrics(live))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, size := range []int{10, 10, 100, 200} {
+		if _, err := db.Put(fill(1, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanned := NewSizeHistogram()
+	if err := scanned.Scan(db); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{14, 104, 204}
+	for _, h := range []*SizeHistogram{live, scanned} {
+		if have, err := h.SlotSizes(3); err != nil || !reflect.DeepEqual(have, want) {
+			t.Fatalf("have %v, %v want %v", have, err, want)
+		}
+	}
+}
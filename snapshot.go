@@ -0,0 +1,147 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// SnapshotTo writes a consistent copy of every shelf into dir, which can be
+// opened as a database with the same slot sizes (and encryption key). When
+// opened without onData callback, the items keep their keys. Reads
+// and writes continue meanwhile, except on the shelf being copied, which is
+// latched for the duration of its copy. Shelves are copied one at a time, so
+// the snapshot is consistent per shelf, not across shelves.
+func (db *database) SnapshotTo(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, shelf := range db.shelves {
+		if err := shelf.snapshotTo(dir, false); err != nil {
+			return fmt.Errorf("shelf %d: %w", i, err)
+		}
+	}
+	return db.writeManifest(dir)
+}
+
+// snapshotTo writes a copy of the shelf into dir, along with its metadata and
+// gap index. The shelf file must not exist in dir yet. If track is set, the
+// tracking of changes for incremental backups is (re)started.
+func (s *shelf) snapshotTo(dir string, track bool) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	defer s.dropCache()
+
+	if track {
+		s.changes.restart()
+	}
+	var (
+		name = filepath.Join(dir, fmt.Sprintf("bkt_%08d.bag", s.slotSize))
+		tmp  = name + ".tmp"
+	)
+	if _, err := os.Stat(name); err == nil {
+		return fmt.Errorf("%w: %v", os.ErrExist, name)
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // No-op after the rename
+
+	gaps, tail := s.snapshotGaps()
+	if err := s.writeSnapshot(f, &gaps, tail); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	if err := writeShelfMeta(filepath.Join(dir, metaName(s.slotSize)), s.created, atomic.LoadInt64(&s.modified), nil); err != nil {
+		return err
+	}
+	// A clean gap index lets the copy be opened without compaction, so the
+	// keys remain valid
+	return writeGapIndex(filepath.Join(dir, gapIndexName(s.slotSize)), s.slotSize, tail, gaps.slice(), true)
+}
+
+// snapshotGaps returns the gaps and the tail of the shelf as seen by a snapshot,
+// where the slots of puts in flight are gaps. This method assumes that the
+// gapsMu is held.
+func (s *shelf) snapshotGaps() (gapSet, uint64) {
+	gaps := newGapSet(s.gaps.slice())
+	for slot := range s.pending {
+		gaps.add(slot)
+	}
+	tail := gaps.trimTail(s.count)
+	return gaps, tail
+}
+
+// writeSnapshot writes the header and the slots of the shelf up to tail into f,
+// with the given gaps left blank. This method assumes that the gapsMu and
+// fileMu are held.
+func (s *shelf) writeSnapshot(f *os.File, gaps *gapSet, tail uint64) error {
+	w := bufio.NewWriterSize(f, 1<<20)
+	h := new(bytes.Buffer)
+	if err := binary.Write(h, binary.BigEndian, &shelfHeader{Magic, curVersion, s.slotSize}); err != nil {
+		return err
+	}
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return err
+	}
+	buf := make([]byte, s.slotSize)
+	for slot := uint64(0); slot < tail; slot++ {
+		if err := s.readSnapshotSlot(buf, gaps, slot); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if s.nocache {
+		// The copy is clean after the sync, so it can be dropped too
+		return dropFileCache(f)
+	}
+	return nil
+}
+
+// readSnapshotSlot reads the full content of the slot into buf, which is left
+// blank for gaps. This method assumes that the fileMu is held.
+func (s *shelf) readSnapshotSlot(buf []byte, gaps *gapSet, slot uint64) error {
+	if gaps.contains(slot) {
+		copy(buf, make([]byte, len(buf)))
+		return nil
+	}
+	s.throttle.wait(len(buf))
+	n, err := s.f.ReadAt(buf, int64(ShelfHeaderSize)+int64(slot)*int64(s.slotSize))
+	if errors.Is(err, io.EOF) {
+		// The last slot may end before its full size
+		copy(buf[n:], make([]byte, len(buf)-n))
+	} else if err != nil {
+		return fmt.Errorf("slot %d: %w", slot, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrStandby is returned by the write operations of a database opened
+// WithStandby, until it is promoted.
+var ErrStandby = errors.New("database in standby")
+
+// writable returns ErrStandby if the database is a standby.
+func (db *database) writable() error {
+	if atomic.LoadUint32(&db.standby) != 0 {
+		return ErrStandby
+	}
+	return nil
+}
+
+// ApplyChange applies a change made on a primary database to this one, which
+// is usually a standby: data is stored at key, replacing the item there, or
+// the item at key is deleted if data is nil. Applying a change twice has no
+// further effect, so a feed of changes can be replayed from an earlier point.
+func (db *database) ApplyChange(key uint64, data []byte) error {
+	if !db.validKey(key) {
+		return fmt.Errorf("%w: key %#x", ErrBadIndex, key)
+	}
+	id, slot := SplitKey(key)
+	live, err := db.shelves[id].Has(slot)
+	if err != nil {
+		return err
+	}
+	if live {
+		// The item is replaced whatever its generation
+		if err := db.shelves[id].Delete(slot); err != nil {
+			return err
+		}
+		if db.opts.CheckInvariants {
+			db.shelves[id].checkInvariants("delete")
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	return db.putAt(key, data)
+}
+
+// Promote makes a standby database accept writes. It has no effect on other
+// databases.
+func (db *database) Promote() {
+	atomic.StoreUint32(&db.standby, 0)
+}
@@ -22,6 +22,25 @@ type store interface {
 	Sync() error
 }
 
+// wrappedFile is implemented by the stores performing I/O on a file in a
+// different way than the os.File itself, see osFile.
+type wrappedFile interface {
+	file() *os.File
+}
+
+// osFile returns the file underlying a store, if there is one.
+func osFile(s store) (*os.File, bool) {
+	switch f := s.(type) {
+	case *os.File:
+		return f, true
+	case *retryStore:
+		return osFile(f.store)
+	case wrappedFile:
+		return f.file(), true
+	}
+	return nil, false
+}
+
 // fileinfoMock is a mock implementation for returning non-single-file store
 // sizes.
 type fileinfoMock struct {
@@ -0,0 +1,143 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncer fsyncs the shelves of a database in the background, see
+// Options.SyncInterval. The writes between two syncs share one fsync per
+// shelf, and so do the Flush calls waiting for the same sync. A nil syncer
+// does nothing.
+type syncer struct {
+	writes uint64 // writes is the number of writes since the last sync, accessed atomically
+
+	sync      func() error  // sync fsyncs the dirty shelves
+	interval  time.Duration // interval is the time between two syncs, zero if not periodic
+	threshold uint64        // threshold is the number of writes triggering a sync, zero if none
+
+	kick chan struct{} // kick requests a sync
+	quit chan struct{} // quit stops the loop
+	done chan struct{} // done is closed when the loop has stopped
+
+	mu      sync.Mutex   // mu guards waiters and stopped
+	waiters []chan error // waiters are the Flush calls waiting for the next sync
+	stopped bool         // stopped is set once the loop no longer serves waiters
+}
+
+// newSyncer starts a syncer, if a sync interval or write threshold is set.
+func newSyncer(interval time.Duration, writes int, sync func() error) *syncer {
+	if interval <= 0 && writes <= 0 {
+		return nil
+	}
+	s := &syncer{
+		sync:      sync,
+		interval:  interval,
+		threshold: uint64(writes),
+		kick:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if interval < 0 {
+		s.interval = 0
+	}
+	if writes < 0 {
+		s.threshold = 0
+	}
+	go s.loop()
+	return s
+}
+
+// loop syncs whenever a sync is due, until the syncer is stopped.
+func (s *syncer) loop() {
+	defer close(s.done)
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-s.kick:
+		case <-s.quit:
+			// Serve the Flush calls which are already waiting
+			s.mu.Lock()
+			s.stopped = true
+			waiting := len(s.waiters) > 0
+			s.mu.Unlock()
+			if waiting {
+				s.run()
+			}
+			return
+		}
+		s.run()
+	}
+}
+
+// run performs a sync, and passes its result to the waiting Flush calls.
+func (s *syncer) run() {
+	s.mu.Lock()
+	waiters := s.waiters
+	s.waiters = nil
+	s.mu.Unlock()
+
+	atomic.StoreUint64(&s.writes, 0)
+	err := s.sync()
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// wrote counts a write, and requests a sync once the threshold is reached.
+func (s *syncer) wrote() {
+	if s == nil || s.threshold == 0 {
+		return
+	}
+	if atomic.AddUint64(&s.writes, 1) == s.threshold {
+		s.request()
+	}
+}
+
+// request wakes the loop up for a sync, unless one is requested already.
+func (s *syncer) request() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// flush requests a sync and waits for it. It reports false if the syncer has
+// stopped, and the caller has to sync by itself.
+func (s *syncer) flush() (bool, error) {
+	ch := make(chan error, 1)
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.waiters = append(s.waiters, ch)
+	s.mu.Unlock()
+
+	s.request()
+	return true, <-ch
+}
+
+// stop stops the loop, after a last sync for the waiting Flush calls.
+func (s *syncer) stop() {
+	if s == nil {
+		return
+	}
+	select {
+	case <-s.quit:
+	default:
+		close(s.quit)
+	}
+	<-s.done
+}
@@ -0,0 +1,157 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// VersionError is returned by Open when a shelf file has a format version
+// other than the current one. It matches ErrVersion when used with errors.Is.
+type VersionError struct {
+	File    string
+	Version uint16 // Version is the format version of the file
+	Current uint16 // Current is the format version of this library
+}
+
+var ErrVersion = errors.New("unsupported format version")
+
+func (e *VersionError) Error() string {
+	if e.Version > e.Current {
+		return fmt.Sprintf("%v: file %v has version %d, newer than supported version %d; downgrades are not supported",
+			ErrVersion, e.File, e.Version, e.Current)
+	}
+	return fmt.Sprintf("%v: file %v has version %d, current version is %d; open with WithUpgrade to upgrade it",
+		ErrVersion, e.File, e.Version, e.Current)
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrVersion
+}
+
+// migration converts the slots of a shelf file from one format version to the
+// next, in place. The file header is updated by the caller afterwards. The
+// progress function should be invoked every now and then with the number of
+// slots converted so far.
+type migration func(f *os.File, slotSize uint32, progress func(done, total uint64)) error
+
+// migrations holds the migration from each format version to the next one.
+// Whenever curVersion is increased, a migration from the previous version
+// must be registered here.
+var migrations = map[uint16]migration{}
+
+// readShelfHeader reads the header of the shelf file.
+func readShelfHeader(f io.ReaderAt) (shelfHeader, error) {
+	var (
+		h = shelfHeader{}
+		b = make([]byte, ShelfHeaderSize)
+	)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return h, err
+	}
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h)
+	return h, err
+}
+
+// upgradeShelf upgrades the shelf file with the given slot size in the given
+// directory to the current format version, if it exists and is older. If the
+// backup option is set, a copy of the file is made before converting it.
+func upgradeShelf(path string, slotSize uint32, opts *Options) error {
+	fileName := filepath.Join(path, fmt.Sprintf("bkt_%08d.bag", slotSize))
+	return upgradeFile(fileName, slotSize, curVersion, migrations, opts)
+}
+
+// upgradeFile chains the migrations needed to convert the file to the target
+// version.
+func upgradeFile(fileName string, slotSize uint32, target uint16, migrations map[uint16]migration, opts *Options) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h, err := readShelfHeader(f)
+	if errors.Is(err, io.EOF) { // Empty or truncated, left to openShelf
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w, file %v", err, fileName)
+	}
+	if h.Magic != Magic || h.Version >= target {
+		return nil
+	}
+	for v := h.Version; v < target; v++ {
+		if migrations[v] == nil {
+			return fmt.Errorf("%w: no upgrade from version %d, file %v", ErrVersion, v, fileName)
+		}
+	}
+	log := opts.logger()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("%w, file %v", err, fileName)
+	}
+	if opts.UpgradeBackup {
+		backup := fmt.Sprintf("%v.v%d.bak", fileName, h.Version)
+		log.Printf("billy: backing up %v to %v", fileName, backup)
+		if err := copyFile(f, backup); err != nil {
+			return fmt.Errorf("backup failed: %w", err)
+		}
+	}
+	for v := h.Version; v < target; v++ {
+		log.Printf("billy: upgrading %v from version %d to %d", fileName, v, v+1)
+		var reported uint64
+		progress := func(done, total uint64) {
+			// Report every 10%
+			if total > 0 && done*10/total > reported {
+				reported = done * 10 / total
+				log.Printf("billy: upgrading %v: %d%% (%d/%d slots)", fileName, reported*10, done, total)
+			}
+		}
+		if err := migrations[v](f, slotSize, progress); err != nil {
+			return fmt.Errorf("upgrade to version %d failed: %w, file %v", v+1, err, fileName)
+		}
+		h.Version = v + 1
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.BigEndian, &h); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	// The gap index is bound to the format version, and is stale now
+	idx := filepath.Join(filepath.Dir(fileName), gapIndexName(slotSize))
+	if err := os.Remove(idx); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the contents of the file to a new file at the given path.
+func copyFile(f *os.File, path string) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, 1<<62))
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDowngradeRejected(t *testing.T) {
+	p := t.TempDir()
+	name := filepath.Join(p, "bkt_00000010.bag")
+	if err := writeShelfFile(name, 10, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	// Bump the version in the header
+	f, _ := os.OpenFile(name, os.O_RDWR, 0666)
+	_, _ = f.WriteAt([]byte{0, byte(curVersion + 1)}, 5)
+	f.Close()
+
+	_, err := Open(p, SlotSizeLinear(10, 1), nil, WithUpgrade(false))
+	var verr *VersionError
+	if !errors.As(err, &verr) || verr.Version != curVersion+1 {
+		t.Fatalf("want version error, have %v", err)
+	}
+	if !strings.Contains(err.Error(), "downgrades are not supported") {
+		t.Fatalf("unexpected message: %v", err)
+	}
+}
+
+func TestUpgradeFile(t *testing.T) {
+	p := t.TempDir()
+	name := filepath.Join(p, "bkt_00000010.bag")
+	if err := writeShelfFile(name, 10, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	// Each migration increments the first data byte of every slot
+	migrate := func(step string) migration {
+		return func(f *os.File, slotSize uint32, progress func(done, total uint64)) error {
+			steps = append(steps, step)
+			for slot := uint64(0); slot < 3; slot++ {
+				b := make([]byte, 1)
+				off := int64(ShelfHeaderSize) + int64(slot)*int64(slotSize) + itemHeaderSize
+				if _, err := f.ReadAt(b, off); err != nil {
+					return err
+				}
+				b[0]++
+				if _, err := f.WriteAt(b, off); err != nil {
+					return err
+				}
+				progress(slot+1, 3)
+			}
+			return nil
+		}
+	}
+	// A missing migration must fail before touching the file
+	err := upgradeFile(name, 10, curVersion+2, map[uint16]migration{curVersion: migrate("a")}, &Options{})
+	if !errors.Is(err, ErrVersion) || len(steps) != 0 {
+		t.Fatalf("want %v, have %v (steps %v)", ErrVersion, err, steps)
+	}
+	all := map[uint16]migration{curVersion: migrate("a"), curVersion + 1: migrate("b")}
+	if err := upgradeFile(name, 10, curVersion+2, all, &Options{UpgradeBackup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(steps, ","), "a,b"; have != want {
+		t.Fatalf("have %v want %v", have, want)
+	}
+	f, _ := os.Open(name)
+	defer f.Close()
+	h, err := readShelfHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != curVersion+2 {
+		t.Fatalf("have version %d want %d", h.Version, curVersion+2)
+	}
+	b := make([]byte, 1)
+	_, _ = f.ReadAt(b, int64(ShelfHeaderSize)+10+itemHeaderSize)
+	if have, want := b[0], getBlob(2, 6)[0]+2; have != want {
+		t.Fatalf("have %d want %d", have, want)
+	}
+	backup, err := os.ReadFile(name + ".v0.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := backup[ShelfHeaderSize+10+itemHeaderSize], getBlob(2, 6)[0]; have != want {
+		t.Fatalf("backup: have %d want %d", have, want)
+	}
+	// Already up to date, nothing happens
+	if err := upgradeFile(name, 10, curVersion+2, all, &Options{}); err != nil || len(steps) != 2 {
+		t.Fatalf("unexpected upgrade: %v %v", err, steps)
+	}
+}
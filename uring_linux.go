@@ -0,0 +1,351 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package billy
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants of the io_uring kernel interface.
+const (
+	uringEntries = 256 // uringEntries is the size of the submission queue
+
+	uringOpRead  = 22 // IORING_OP_READ, since Linux 5.6
+	uringOpWrite = 23 // IORING_OP_WRITE, since Linux 5.6
+
+	uringEnterGetEvents = 1 // IORING_ENTER_GETEVENTS
+
+	uringOffSQRing = 0          // IORING_OFF_SQ_RING
+	uringOffCQRing = 0x8000000  // IORING_OFF_CQ_RING
+	uringOffSQEs   = 0x10000000 // IORING_OFF_SQES
+
+	uringMaxLen = 1 << 30 // uringMaxLen caps the length of a single operation
+)
+
+// uringParams mirrors struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// uringSQOffsets mirrors struct io_sqring_offsets.
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringCQOffsets mirrors struct io_cqring_offsets.
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringSQE mirrors struct io_uring_sqe, for the fields used by reads and
+// writes.
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	_        [24]byte
+}
+
+// uringCQE mirrors struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringOp is a read or write waiting for its completion.
+type uringOp struct {
+	opcode uint8
+	buf    []byte // buf is referenced until completion, for the kernel uses it
+	off    int64
+	res    int32
+	done   chan struct{}
+}
+
+// uringStore is a store performing its reads and writes through an io_uring.
+// The operations of all goroutines are collected by a single submitter, which
+// submits them to the kernel in batches, and waits for their completions with
+// the same syscall.
+type uringStore struct {
+	f      *os.File
+	fileFd int32 // fileFd is the file descriptor of f
+	fd     int   // fd is the file descriptor of the ring
+
+	sqRing, cqRing, sqes []byte // the memory shared with the kernel
+
+	sqTail, sqArray *uint32
+	sqMask          uint32
+	cqHead, cqTail  *uint32
+	cqMask          uint32
+	cqes            unsafe.Pointer
+
+	ops  chan *uringOp // ops is unbuffered, so that no operation is left behind on Close
+	quit chan struct{}
+	done chan struct{}
+	err  error // err is the error which broke the ring, set before done is closed
+}
+
+// newUringStore sets up an io_uring for I/O on the given file.
+func newUringStore(f *os.File) (*uringStore, error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	u := &uringStore{
+		f:      f,
+		fileFd: int32(f.Fd()),
+		fd:     int(fd),
+		ops:    make(chan *uringOp),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	var err error
+	mmap := func(off int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var mem []byte
+		if mem, err = unix.Mmap(u.fd, off, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+			err = os.NewSyscallError("mmap", err)
+		}
+		return mem
+	}
+	u.sqRing = mmap(uringOffSQRing, params.sqOff.array+params.sqEntries*4)
+	u.cqRing = mmap(uringOffCQRing, params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	u.sqes = mmap(uringOffSQEs, params.sqEntries*uint32(unsafe.Sizeof(uringSQE{})))
+	if err != nil {
+		u.unmap()
+		return nil, err
+	}
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[params.sqOff.tail]))
+	u.sqArray = (*uint32)(unsafe.Pointer(&u.sqRing[params.sqOff.array]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[params.sqOff.ringMask]))
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[params.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[params.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[params.cqOff.ringMask]))
+	u.cqes = unsafe.Pointer(&u.cqRing[params.cqOff.cqes])
+
+	go u.loop()
+
+	// Kernels before 5.6 reject the read and write opcodes, find out early
+	if _, err := u.do(uringOpRead, nil, 0); err != nil {
+		u.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// unmap releases the memory shared with the kernel, and the ring itself.
+func (u *uringStore) unmap() {
+	for _, mem := range [][]byte{u.sqRing, u.cqRing, u.sqes} {
+		if mem != nil {
+			_ = unix.Munmap(mem)
+		}
+	}
+	_ = unix.Close(u.fd)
+}
+
+// sqe returns the submission queue entry at the given index.
+func (u *uringStore) sqe(idx uint32) *uringSQE {
+	return (*uringSQE)(unsafe.Pointer(&u.sqes[uintptr(idx)*unsafe.Sizeof(uringSQE{})]))
+}
+
+// cqe returns the completion queue entry at the given index.
+func (u *uringStore) cqe(idx uint32) *uringCQE {
+	return (*uringCQE)(unsafe.Add(u.cqes, uintptr(idx)*unsafe.Sizeof(uringCQE{})))
+}
+
+// loop is the submitter, which owns the submission queue and the completion
+// queue head. It runs until the store is closed and no operation is left.
+func (u *uringStore) loop() {
+	var (
+		inflight = make(map[uint64]*uringOp)
+		nextID   uint64
+		queued   uint32 // queued is the number of entries not yet submitted
+		tail     = *u.sqTail
+	)
+	queue := func(op *uringOp) {
+		idx := tail & u.sqMask
+		sqe := u.sqe(idx)
+		*sqe = uringSQE{
+			opcode:   op.opcode,
+			fd:       u.fileFd,
+			off:      uint64(op.off),
+			len:      uint32(len(op.buf)),
+			userData: nextID,
+		}
+		if len(op.buf) > 0 {
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&op.buf[0])))
+		}
+		*(*uint32)(unsafe.Add(unsafe.Pointer(u.sqArray), uintptr(idx)*4)) = idx
+		inflight[nextID] = op
+		nextID++
+		tail++
+		queued++
+	}
+	fail := func(err error) {
+		u.err = err
+		for _, op := range inflight {
+			op.res = -int32(unix.EIO)
+			close(op.done)
+		}
+		close(u.done)
+	}
+	for {
+		// Wait for an operation if there is nothing to complete
+		if len(inflight) == 0 {
+			select {
+			case op := <-u.ops:
+				queue(op)
+			case <-u.quit:
+				close(u.done)
+				return
+			}
+		}
+		// Batch the operations waiting meanwhile, as far as the rings allow
+	batch:
+		for len(inflight) < uringEntries {
+			select {
+			case op := <-u.ops:
+				queue(op)
+			default:
+				break batch
+			}
+		}
+		atomic.StoreUint32(u.sqTail, tail)
+
+		// Submit them, and wait for at least one completion
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(queued), 1, uringEnterGetEvents, 0, 0)
+		switch errno {
+		case 0:
+			queued -= uint32(n)
+		case unix.EINTR, unix.EAGAIN, unix.EBUSY:
+			// Retry, after reaping whatever completed
+		default:
+			fail(os.NewSyscallError("io_uring_enter", errno))
+			return
+		}
+		head := *u.cqHead
+		for ; head != atomic.LoadUint32(u.cqTail); head++ {
+			cqe := u.cqe(head & u.cqMask)
+			if op, ok := inflight[cqe.userData]; ok {
+				delete(inflight, cqe.userData)
+				op.res = cqe.res
+				close(op.done)
+			}
+		}
+		atomic.StoreUint32(u.cqHead, head)
+	}
+}
+
+// do performs a single operation through the ring, and returns its result.
+func (u *uringStore) do(opcode uint8, buf []byte, off int64) (int, error) {
+	op := &uringOp{opcode: opcode, buf: buf, off: off, done: make(chan struct{})}
+	select {
+	case u.ops <- op:
+	case <-u.done:
+		if u.err != nil {
+			return 0, u.err
+		}
+		return 0, ErrClosed
+	}
+	<-op.done
+	runtime.KeepAlive(buf)
+	if op.res < 0 {
+		return 0, unix.Errno(-op.res)
+	}
+	return int(op.res), nil
+}
+
+// ReadAt implements io.ReaderAt of the store interface.
+func (u *uringStore) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		chunk := p[total:]
+		if len(chunk) > uringMaxLen {
+			chunk = chunk[:uringMaxLen]
+		}
+		n, err := u.do(uringOpRead, chunk, off+int64(total))
+		if err != nil {
+			return total, &os.PathError{Op: "read", Path: u.f.Name(), Err: err}
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// WriteAt implements io.WriterAt of the store interface.
+func (u *uringStore) WriteAt(p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		chunk := p[total:]
+		if len(chunk) > uringMaxLen {
+			chunk = chunk[:uringMaxLen]
+		}
+		n, err := u.do(uringOpWrite, chunk, off+int64(total))
+		if err != nil {
+			return total, &os.PathError{Op: "write", Path: u.f.Name(), Err: err}
+		}
+		if n == 0 {
+			return total, &os.PathError{Op: "write", Path: u.f.Name(), Err: io.ErrShortWrite}
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Truncate implements the store interface.
+func (u *uringStore) Truncate(size int64) error { return u.f.Truncate(size) }
+
+// Stat implements the store interface.
+func (u *uringStore) Stat() (os.FileInfo, error) { return u.f.Stat() }
+
+// Sync implements the store interface.
+func (u *uringStore) Sync() error { return u.f.Sync() }
+
+// Close implements io.Closer of the store interface. It waits for the
+// operations in flight before releasing the ring.
+func (u *uringStore) Close() error {
+	select {
+	case <-u.done:
+	default:
+		close(u.quit)
+		<-u.done
+	}
+	u.unmap()
+	return u.f.Close()
+}
+
+// file implements wrappedFile.
+func (u *uringStore) file() *os.File { return u.f }
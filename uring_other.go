@@ -0,0 +1,17 @@
+// bagdb: Simple datastorage
+// Copyright 2023 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package billy
+
+import (
+	"errors"
+	"os"
+)
+
+// newUringStore is not supported on this platform.
+func newUringStore(f *os.File) (store, error) {
+	return nil, errors.New("io_uring not supported")
+}